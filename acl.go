@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// Canned ACLs callers may request when ALLOWED_OBJECT_ACLS is not set.
+// Buckets differ in policy, so public-read is only honoured by buckets that
+// still allow ACLs.
+var defaultObjectACLs = []string{"private", "public-read", "bucket-owner-full-control"}
+
+// Error code S3 returns for ACLs on a bucket with Object Ownership set to
+// "bucket owner enforced"
+const errCodeACLNotSupported = "AccessControlListNotSupported"
+
+// Canned ACLs callers may request, from the comma-separated
+// ALLOWED_OBJECT_ACLS, e.g. "private,bucket-owner-full-control"
+func allowedObjectACLs() []string {
+	value := os.Getenv("ALLOWED_OBJECT_ACLS")
+	if value == "" {
+		return defaultObjectACLs
+	}
+	var acls []string
+	for _, acl := range strings.Split(value, ",") {
+		if acl = strings.TrimSpace(acl); acl != "" {
+			acls = append(acls, acl)
+		}
+	}
+	return acls
+}
+
+func validateObjectACL(acl string) error {
+	if acl == "" || containsString(allowedObjectACLs(), acl) {
+		return nil
+	}
+	return fmt.Errorf("acl must be one of %s, got %q", strings.Join(allowedObjectACLs(), ", "), acl)
+}
+
+// Explain an upload rejected because the bucket has ACLs disabled, which
+// otherwise surfaces as a bare AccessControlListNotSupported
+func explainACLError(err error, acl string) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errCodeACLNotSupported {
+		return fmt.Errorf("bucket has ACLs disabled (Object Ownership is bucket owner enforced), acl %q cannot be applied: %v", acl, err)
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ideogram API versions the generate step can call
+const (
+	ideogramVersionV2 = "v2"
+	ideogramVersionV3 = "v3"
+)
+
+// Generate endpoints per version, unless IDEOGRAM_V2_GENERATE_URL or
+// IDEOGRAM_V3_GENERATE_URL point elsewhere
+var defaultIdeogramGenerateURLs = map[string]string{
+	ideogramVersionV2: "https://api.ideogram.ai/generate",
+	ideogramVersionV3: "https://api.ideogram.ai/v1/ideogram-v3/generate",
+}
+
+// Aspect ratios the v2 endpoint accepts, in v3 notation
+var ideogramV2AspectRatios = []string{
+	"1x1", "10x16", "16x10", "9x16", "16x9", "3x2", "2x3", "4x3", "3x4", "1x3", "3x1",
+}
+
+// Version requested by the caller, else IDEOGRAM_API_VERSION, else v3.
+// Requests using v3-only features stay on v3 whatever the default.
+func (body IdeogramRequestBody) ideogramVersion() string {
+	if body.IdeogramVersion != "" {
+		return body.IdeogramVersion
+	}
+	if body.needsIdeogramV3() {
+		return ideogramVersionV3
+	}
+	if version := strings.ToLower(strings.TrimSpace(os.Getenv("IDEOGRAM_API_VERSION"))); version != "" {
+		return version
+	}
+	return ideogramVersionV3
+}
+
+func ideogramGenerateURL(version string) string {
+	if url := strings.TrimSpace(os.Getenv("IDEOGRAM_" + strings.ToUpper(version) + "_GENERATE_URL")); url != "" {
+		return url
+	}
+	return defaultIdeogramGenerateURLs[version]
+}
+
+// Only generation has a v2 mapping; edits, reframes, remixes and style
+// references are v3 features
+func (body IdeogramRequestBody) needsIdeogramV3() bool {
+	return body.Edit != nil || body.Reframe != nil || body.ImageWeight != nil || len(body.StyleReferenceImages) > 0 || len(body.StyleCodes) > 0
+}
+
+func validateIdeogramVersion(body IdeogramRequestBody) error {
+	version := body.ideogramVersion()
+	if _, ok := defaultIdeogramGenerateURLs[version]; !ok {
+		return fmt.Errorf("ideogram_version must be %s or %s, got %q", ideogramVersionV2, ideogramVersionV3, version)
+	}
+	if version != ideogramVersionV2 {
+		return nil
+	}
+	if body.needsIdeogramV3() {
+		return fmt.Errorf("edit, reframe, image_weight, style_reference_images and style_codes need ideogram_version %s", ideogramVersionV3)
+	}
+	if body.AspectRatio != nil && !containsString(ideogramV2AspectRatios, string(*body.AspectRatio)) {
+		return fmt.Errorf("aspect_ratio %q is not available with ideogram_version %s, expected one of %s", *body.AspectRatio, ideogramVersionV2, strings.Join(ideogramV2AspectRatios, ", "))
+	}
+	return nil
+}
+
+// Body of the v2 generate endpoint, which takes JSON rather than a form
+type ideogramV2Request struct {
+	ImageRequest ideogramV2ImageRequest `json:"image_request"`
+}
+
+type ideogramV2ImageRequest struct {
+	Prompt            string                  `json:"prompt"`
+	NegativePrompt    string                  `json:"negative_prompt,omitempty"`
+	Model             string                  `json:"model"`
+	AspectRatio       string                  `json:"aspect_ratio,omitempty"`
+	Resolution        string                  `json:"resolution,omitempty"`
+	NumImages         *int                    `json:"num_images,omitempty"`
+	StyleType         string                  `json:"style_type,omitempty"`
+	MagicPromptOption string                  `json:"magic_prompt_option,omitempty"`
+	Seed              *int                    `json:"seed,omitempty"`
+	ColorPalette      *ideogramV2ColorPalette `json:"color_palette,omitempty"`
+}
+
+type ideogramV2ColorPalette struct {
+	Name    string                    `json:"name,omitempty"`
+	Members []ideogramV2PaletteMember `json:"members,omitempty"`
+}
+
+type ideogramV2PaletteMember struct {
+	ColorHex    string   `json:"color_hex"`
+	ColorWeight *float64 `json:"color_weight,omitempty"`
+}
+
+// Map a request onto the v2 parameter names: "16x9" becomes "ASPECT_16_9",
+// "1024x1024" becomes "RESOLUTION_1024_1024" and the TURBO rendering speed
+// selects the turbo model
+func mapIdeogramV2Request(body IdeogramRequestBody, negativePrompt string) (ideogramV2Request, error) {
+	imageRequest := ideogramV2ImageRequest{
+		Prompt:         body.Prompt,
+		NegativePrompt: negativePrompt,
+		Model:          "V_2",
+		NumImages:      body.NumImages,
+		Seed:           body.Seed,
+	}
+	if body.RenderingSpeed != nil && *body.RenderingSpeed == "TURBO" {
+		imageRequest.Model = "V_2_TURBO"
+	}
+	if body.Resolution != nil {
+		imageRequest.Resolution = "RESOLUTION_" + strings.ReplaceAll(string(*body.Resolution), "x", "_")
+	} else if body.AspectRatio != nil {
+		imageRequest.AspectRatio = "ASPECT_" + strings.ReplaceAll(string(*body.AspectRatio), "x", "_")
+	}
+	if body.StyleType != nil {
+		imageRequest.StyleType = string(*body.StyleType)
+	}
+	if body.MagicPrompt != nil {
+		imageRequest.MagicPromptOption = *body.MagicPrompt
+	}
+	if body.ColourPalette != nil && body.ColourPalette.Name != "" {
+		imageRequest.ColorPalette = &ideogramV2ColorPalette{Name: body.ColourPalette.Name}
+	} else if body.ColourPalette != nil {
+		palette := &ideogramV2ColorPalette{}
+		for _, member := range body.ColourPalette.Members {
+			mapped := ideogramV2PaletteMember{ColorHex: member.ColorHex}
+			if member.ColorWeight != nil {
+				weight, err := strconv.ParseFloat(string(*member.ColorWeight), 64)
+				if err != nil {
+					return ideogramV2Request{}, fmt.Errorf("invalid color_weight %q: %v", *member.ColorWeight, err)
+				}
+				mapped.ColorWeight = &weight
+			}
+			palette.Members = append(palette.Members, mapped)
+		}
+		imageRequest.ColorPalette = palette
+	}
+	return ideogramV2Request{ImageRequest: imageRequest}, nil
+}
+
+// Generate with the v2 endpoint. Its response has the same shape as v3's, so
+// the rest of the pipeline is unchanged.
+func sendV2RequestToIdeogram(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) (string, error) {
+	api_key := body.providerKeys.ideogramAPIKey()
+
+	if api_key == "" {
+		return "", fmt.Errorf("API_KEY is not set")
+	}
+	if summary.injectFault(faultIdeogram429) {
+		return "", injectedIdeogramThrottle()
+	}
+
+	body, negativePrompt := applyPlainBackground(applyPattern(applyBrandFonts(body)))
+	v2Request, err := mapIdeogramV2Request(body, negativePrompt)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(v2Request)
+	if err != nil {
+		return "", fmt.Errorf("error encoding request: %v", err)
+	}
+
+	req, err := newProviderRequest(ctx, "POST", ideogramGenerateURL(ideogramVersionV2), bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Api-Key", api_key)
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := new(bytes.Buffer)
+	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return "", &ProviderError{Provider: "ideogram", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return respBody.String(), nil
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// States of a draft's approval. A draft starts pending and moves once, to
+// approved or rejected. It is approving while an approval delivers its
+// images, and goes back to pending if that fails.
+const (
+	approvalPending   = "pending"
+	approvalApproving = "approving"
+	approvalApproved  = "approved"
+	approvalRejected  = "rejected"
+)
+
+// Drafts that can be claimed or rejected: pending ones, ones recorded before
+// APPROVALS_TABLE was set, and ones whose approval timed out mid-way
+const approvalClaimable = "attribute_not_exists(draft_id) OR #state = :pending OR (#state = :approving AND claimed_until < :now)"
+
+// Approval records are kept this long after their last change
+const approvalRetention = 90 * 24 * time.Hour
+
+// Longest an approval can hold a draft, Lambda's maximum timeout
+const approvalMaxClaim = 15 * time.Minute
+
+// Returned when a draft was already approved or rejected
+var errApprovalNotPending = errors.New("draft is no longer pending approval")
+
+// Approval state of a draft, stored in APPROVALS_TABLE keyed by draft_id
+type ApprovalState struct {
+	DraftID   string `json:"draft_id" dynamodbav:"draft_id"`
+	State     string `json:"state" dynamodbav:"state"`
+	Tenant    string `json:"tenant,omitempty" dynamodbav:"tenant,omitempty"`
+	UpdatedAt string `json:"updated_at" dynamodbav:"updated_at"`
+	// Fingerprint of the caller key behind the last change
+	UpdatedBy string `json:"updated_by,omitempty" dynamodbav:"updated_by,omitempty"`
+	// Why the draft was rejected
+	Reason string `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+	// Watermarked drafts while pending, the delivered images once approved
+	ImageURLs []string `json:"image_urls,omitempty" dynamodbav:"image_urls,omitempty"`
+}
+
+// Body of POST /reject/{id}
+type RejectRequestBody struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+func approvalsTable() string {
+	return os.Getenv("APPROVALS_TABLE")
+}
+
+// Record a new draft as pending. Without APPROVALS_TABLE drafts can be
+// neither approved nor rejected.
+func createApproval(draft Draft, imageURLs []string) error {
+	table := approvalsTable()
+	if table == "" {
+		return nil
+	}
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return err
+	}
+	state := ApprovalState{
+		DraftID:   draft.DraftID,
+		State:     approvalPending,
+		Tenant:    draft.Tenant,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+		ImageURLs: imageURLs,
+	}
+	item, err := dynamodbattribute.MarshalMap(state)
+	if err != nil {
+		return err
+	}
+	item["expires_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(approvalRetention).Unix(), 10))}
+	_, err = dynamoSvc.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(draft_id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record approval of draft %s: %v", draft.DraftID, err)
+	}
+	notifyApprovalChange(state, "")
+	return nil
+}
+
+// Approval state of a draft; nil when it has none
+func loadApproval(draftID string) (*ApprovalState, error) {
+	table := approvalsTable()
+	if table == "" {
+		return nil, nil
+	}
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return nil, err
+	}
+	output, err := dynamoSvc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"draft_id": {S: aws.String(draftID)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load approval of draft %s: %v", draftID, err)
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+	var state ApprovalState
+	if err := dynamodbattribute.UnmarshalMap(output.Item, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode approval of draft %s: %v", draftID, err)
+	}
+	return &state, nil
+}
+
+// Reject a pending draft. Fails with errApprovalNotPending when another
+// transition got there first.
+func transitionApproval(draft Draft, to string, actor string, reason string, imageURLs []string) (ApprovalState, error) {
+	table := approvalsTable()
+	if table == "" {
+		return ApprovalState{}, nil
+	}
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return ApprovalState{}, err
+	}
+	state := ApprovalState{
+		DraftID:   draft.DraftID,
+		State:     to,
+		Tenant:    draft.Tenant,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+		UpdatedBy: actor,
+		Reason:    reason,
+		ImageURLs: imageURLs,
+	}
+	urls, err := dynamodbattribute.Marshal(imageURLs)
+	if err != nil {
+		return ApprovalState{}, err
+	}
+	_, err = dynamoSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"draft_id": {S: aws.String(draft.DraftID)},
+		},
+		UpdateExpression:    aws.String("SET #state = :to, tenant = :tenant, updated_at = :updated_at, updated_by = :updated_by, reason = :reason, image_urls = :image_urls, expires_at = :expires_at REMOVE claim_id, claimed_until"),
+		ConditionExpression: aws.String(approvalClaimable),
+		ExpressionAttributeNames: map[string]*string{
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":to":         {S: aws.String(to)},
+			":pending":    {S: aws.String(approvalPending)},
+			":approving":  {S: aws.String(approvalApproving)},
+			":now":        {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+			":tenant":     {S: aws.String(draft.Tenant)},
+			":updated_at": {S: aws.String(state.UpdatedAt)},
+			":updated_by": {S: aws.String(actor)},
+			":reason":     {S: aws.String(reason)},
+			":image_urls": urls,
+			":expires_at": {N: aws.String(strconv.FormatInt(time.Now().Add(approvalRetention).Unix(), 10))},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ApprovalState{}, errApprovalNotPending
+	}
+	if err != nil {
+		return ApprovalState{}, fmt.Errorf("failed to update approval of draft %s: %v", draft.DraftID, err)
+	}
+	notifyApprovalChange(state, approvalPending)
+	return state, nil
+}
+
+// Claim a draft for approval before any image is delivered, for as long as
+// the claiming invocation can run. Fails with errApprovalNotPending when the
+// draft was decided or another approval holds it.
+func claimApproval(draft Draft, claimID string, actor string, lease time.Duration) error {
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return err
+	}
+	if lease > approvalMaxClaim {
+		lease = approvalMaxClaim
+	}
+	now := time.Now()
+	_, err = dynamoSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(approvalsTable()),
+		Key: map[string]*dynamodb.AttributeValue{
+			"draft_id": {S: aws.String(draft.DraftID)},
+		},
+		UpdateExpression:    aws.String("SET #state = :approving, tenant = :tenant, updated_at = :updated_at, updated_by = :updated_by, claim_id = :claim_id, claimed_until = :claimed_until, expires_at = :expires_at"),
+		ConditionExpression: aws.String(approvalClaimable),
+		ExpressionAttributeNames: map[string]*string{
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pending":       {S: aws.String(approvalPending)},
+			":approving":     {S: aws.String(approvalApproving)},
+			":now":           {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+			":tenant":        {S: aws.String(draft.Tenant)},
+			":updated_at":    {S: aws.String(now.UTC().Format(time.RFC3339))},
+			":updated_by":    {S: aws.String(actor)},
+			":claim_id":      {S: aws.String(claimID)},
+			":claimed_until": {N: aws.String(strconv.FormatInt(now.Add(lease).Unix(), 10))},
+			":expires_at":    {N: aws.String(strconv.FormatInt(now.Add(approvalRetention).Unix(), 10))},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return errApprovalNotPending
+	}
+	if err != nil {
+		return fmt.Errorf("failed to claim approval of draft %s: %v", draft.DraftID, err)
+	}
+	return nil
+}
+
+// Mark a claimed draft approved once all its images were delivered
+func completeApproval(draft Draft, claimID string, actor string, imageURLs []string) (ApprovalState, error) {
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return ApprovalState{}, err
+	}
+	state := ApprovalState{
+		DraftID:   draft.DraftID,
+		State:     approvalApproved,
+		Tenant:    draft.Tenant,
+		UpdatedAt: time.Now().UTC().Format(time.RFC3339),
+		UpdatedBy: actor,
+		ImageURLs: imageURLs,
+	}
+	urls, err := dynamodbattribute.Marshal(imageURLs)
+	if err != nil {
+		return ApprovalState{}, err
+	}
+	_, err = dynamoSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(approvalsTable()),
+		Key: map[string]*dynamodb.AttributeValue{
+			"draft_id": {S: aws.String(draft.DraftID)},
+		},
+		UpdateExpression:    aws.String("SET #state = :approved, updated_at = :updated_at, updated_by = :updated_by, image_urls = :image_urls REMOVE claim_id, claimed_until"),
+		ConditionExpression: aws.String("#state = :approving AND claim_id = :claim_id"),
+		ExpressionAttributeNames: map[string]*string{
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":approved":   {S: aws.String(approvalApproved)},
+			":approving":  {S: aws.String(approvalApproving)},
+			":claim_id":   {S: aws.String(claimID)},
+			":updated_at": {S: aws.String(state.UpdatedAt)},
+			":updated_by": {S: aws.String(actor)},
+			":image_urls": urls,
+		},
+	})
+	if err != nil {
+		return ApprovalState{}, fmt.Errorf("failed to complete approval of draft %s: %v", draft.DraftID, err)
+	}
+	notifyApprovalChange(state, approvalPending)
+	return state, nil
+}
+
+// Hand a claimed draft back to pending after a failed or partial approval,
+// so it can be approved again or rejected
+func releaseApproval(draft Draft, claimID string) error {
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return err
+	}
+	_, err = dynamoSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(approvalsTable()),
+		Key: map[string]*dynamodb.AttributeValue{
+			"draft_id": {S: aws.String(draft.DraftID)},
+		},
+		UpdateExpression:    aws.String("SET #state = :pending, updated_at = :updated_at REMOVE claim_id, claimed_until"),
+		ConditionExpression: aws.String("#state = :approving AND claim_id = :claim_id"),
+		ExpressionAttributeNames: map[string]*string{
+			"#state": aws.String("state"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pending":    {S: aws.String(approvalPending)},
+			":approving":  {S: aws.String(approvalApproving)},
+			":claim_id":   {S: aws.String(claimID)},
+			":updated_at": {S: aws.String(time.Now().UTC().Format(time.RFC3339))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release approval of draft %s: %v", draft.DraftID, err)
+	}
+	return nil
+}
+
+// Post every state change to APPROVAL_NOTIFICATION_URL. Failures are logged
+// and never affect the transition.
+func notifyApprovalChange(state ApprovalState, previous string) {
+	url := os.Getenv("APPROVAL_NOTIFICATION_URL")
+	if url == "" {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"draft_id":       state.DraftID,
+		"state":          state.State,
+		"previous_state": previous,
+		"tenant":         state.Tenant,
+		"updated_at":     state.UpdatedAt,
+		"updated_by":     state.UpdatedBy,
+		"reason":         state.Reason,
+		"image_urls":     state.ImageURLs,
+	})
+	if err != nil {
+		log.Println("Error marshalling approval notification:", err)
+		return
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Println("Error sending approval notification:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		log.Printf("Approval notification target responded with status %d", resp.StatusCode)
+	}
+}
+
+// Token subject or fingerprint of the caller key, recorded as who changed an
+// approval
+func approvalActor(request events.LambdaFunctionURLRequest, identity *CallerIdentity) string {
+	if identity != nil {
+		return "jwt:" + identity.Subject
+	}
+	if key := headerValue(request.Headers, callerAPIKeyHeader); key != "" {
+		return keyFingerprint(key)
+	}
+	return ""
+}
+
+// Return the approval state of a draft
+func handleApprovalStatusRequest(request events.LambdaFunctionURLRequest, draftID string, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	if !jobIDPattern.MatchString(draftID) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: invalid draft ID",
+		}, nil
+	}
+	if approvalsTable() == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 501,
+			Body:       "Approvals are not enabled: APPROVALS_TABLE is not set",
+		}, nil
+	}
+	state, err := loadApproval(draftID)
+	if err != nil {
+		log.Println("Error loading approval:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	if state == nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Approval not found",
+		}, nil
+	}
+	if rejection := authorizeDraftTenant(request, draftID, state.Tenant, summary); rejection != nil {
+		return *rejection, nil
+	}
+	return approvalResponse(*state), nil
+}
+
+func approvalResponse(state ApprovalState) events.LambdaFunctionURLResponse {
+	responseBody, err := json.Marshal(state)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}
+}
+
+// Reject a pending draft. Its watermarked images are left for the draft
+// prefix's lifecycle rule to expire.
+func handleRejectRequest(request events.LambdaFunctionURLRequest, draftID string, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	if !jobIDPattern.MatchString(draftID) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: invalid draft ID",
+		}, nil
+	}
+	if approvalsTable() == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 501,
+			Body:       "Approvals are not enabled: APPROVALS_TABLE is not set",
+		}, nil
+	}
+
+	var rejectRequest RejectRequestBody
+	body, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &rejectRequest); err != nil {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Body:       "Bad Request",
+			}, nil
+		}
+	}
+
+	draft, err := loadDraft(draftID)
+	if err != nil {
+		log.Println("Error loading draft:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Draft not found",
+		}, nil
+	}
+	if rejection := authorizeDraftChange(request, draft, summary); rejection != nil {
+		return *rejection, nil
+	}
+
+	state, err := transitionApproval(draft, approvalRejected, approvalActor(request, summary.identity), rejectRequest.Reason, nil)
+	if errors.Is(err, errApprovalNotPending) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 409,
+			Body:       "Conflict: the draft was already approved or rejected",
+		}, nil
+	}
+	if err != nil {
+		log.Println("Error rejecting draft:", err)
+		summary.recordError("approval", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	return approvalResponse(state), nil
+}
+
+// A tenant's drafts are seen, approved and rejected by that tenant only.
+// Admins without a tenant reach every draft; routes go through
+// requireTenant first, so nobody else gets here without one.
+func authorizeDraftTenant(request events.LambdaFunctionURLRequest, draftID string, draftTenant string, summary *InvocationSummary) *events.LambdaFunctionURLResponse {
+	if draftTenant == summary.Tenant || (summary.Tenant == "" && isAdminRequest(request, summary.identity)) {
+		return nil
+	}
+	summary.recordError("tenant", fmt.Errorf("draft %s belongs to another tenant", draftID))
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: 403,
+		Body:       "Forbidden: the draft belongs to another tenant",
+	}
+}
+
+// Check the caller's key policy against the drafted request, as for the
+// generation itself. A non-nil response rejects the change.
+func authorizeDraftChange(request events.LambdaFunctionURLRequest, draft Draft, summary *InvocationSummary) *events.LambdaFunctionURLResponse {
+	if rejection := authorizeDraftTenant(request, draft.DraftID, draft.Tenant, summary); rejection != nil {
+		return rejection
+	}
+	err := enforceKeyPolicy(headerValue(request.Headers, callerAPIKeyHeader), draft.Request)
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		log.Println("Draft change denied by key policy:", err)
+		summary.recordError("policy", err)
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: 403,
+			Body:       "Forbidden: " + policyErr.Message,
+		}
+	}
+	if err != nil {
+		log.Println("Error loading key policy:", err)
+		summary.recordError("policy", err)
+		return &events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}
+	}
+	return nil
+}
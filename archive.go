@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Tag on master images that a bucket lifecycle rule filters on to move them
+// to Glacier. The value is the number of days, so several rules can coexist.
+const archiveTagKey = "archive-after-days"
+
+// Restore statuses of a master image
+const (
+	restoreStatusArchived  = "archived"
+	restoreStatusRestoring = "restoring"
+	restoreStatusAvailable = "available"
+)
+
+// Days a restored copy stays readable, unless the request says otherwise
+const defaultRestoreDays = 7
+
+const maxRestoreDays = 30
+
+// How often a caller should check a restore in progress. Standard retrievals
+// take hours, so there is no point polling faster than this.
+const restorePollInterval = 15 * time.Minute
+
+// Request to bring an archived master back
+type RestoreRequestBody struct {
+	// Object key in the image bucket or its S3 URL
+	Source string `json:"source"`
+	// Days the restored copy stays readable
+	Days int `json:"days,omitempty"`
+	// Glacier retrieval tier: Standard (default), Bulk or Expedited
+	Tier string `json:"tier,omitempty"`
+}
+
+type RestoreStatus struct {
+	Key          string `json:"key"`
+	Status       string `json:"status"`
+	StorageClass string `json:"storage_class,omitempty"`
+	// When a restored copy goes back to being archived only
+	AvailableUntil string `json:"available_until,omitempty"`
+}
+
+// Upload tags for master images, none unless ARCHIVE_AFTER_DAYS is set
+func archiveTags() map[string]string {
+	days, err := strconv.Atoi(os.Getenv("ARCHIVE_AFTER_DAYS"))
+	if err != nil || days <= 0 {
+		return nil
+	}
+	return map[string]string{archiveTagKey: strconv.Itoa(days)}
+}
+
+// Tags in the query string form S3 expects on upload
+func encodeTagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return aws.String(values.Encode())
+}
+
+// Start retrieving an archived master. S3 notifies the restore topic once the
+// copy is readable; callers can also poll GET /restore/<key>. Retrievals are
+// billed, so the route only lets through callers with an authenticated tenant,
+// for keys under its prefix, and admins.
+func handleRestoreRequest(request events.LambdaFunctionURLRequest, tenant string) (events.LambdaFunctionURLResponse, error) {
+	body, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	var restoreRequest RestoreRequestBody
+	if err := json.Unmarshal(body, &restoreRequest); err != nil || restoreRequest.Source == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: source is required",
+		}, nil
+	}
+	if err := restoreRequest.validate(); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}, nil
+	}
+	key, err := archiveKey(restoreRequest.Source)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}, nil
+	}
+	if rejection := authorizeTenantKey(tenant, key); rejection != nil {
+		return *rejection, nil
+	}
+
+	settings, err := loadS3Settings()
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+
+	days := restoreRequest.Days
+	if days == 0 {
+		days = defaultRestoreDays
+	}
+	tier := restoreRequest.Tier
+	if tier == "" {
+		tier = s3.TierStandard
+	}
+	_, err = s3Svc.RestoreObject(&s3.RestoreObjectInput{
+		Bucket: aws.String(settings.Bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days:                 aws.Int64(int64(days)),
+			GlacierJobParameters: &s3.GlacierJobParameters{Tier: aws.String(tier)},
+		},
+	})
+	if err != nil {
+		aerr, ok := err.(awserr.Error)
+		switch {
+		case ok && aerr.Code() == s3.ErrCodeObjectAlreadyInActiveTierError:
+			// Never archived, or already transitioned back
+		case ok && aerr.Code() == "RestoreAlreadyInProgress":
+		case ok && aerr.Code() == "NoSuchKey":
+			return events.LambdaFunctionURLResponse{StatusCode: 404, Body: "Image not found"}, nil
+		default:
+			log.Println("Error restoring archived image:", err)
+			return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Error restoring image"}, nil
+		}
+	}
+
+	status, err := loadRestoreStatus(s3Svc, settings.Bucket, key)
+	if err != nil {
+		log.Println("Error loading restore status:", err)
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Error restoring image"}, nil
+	}
+	statusCode := 200
+	if status.Status == restoreStatusRestoring {
+		statusCode = 202
+	}
+	return restoreStatusResponse(statusCode, status)
+}
+
+// Report whether an archived master is readable again
+func handleRestoreStatusRequest(source string, tenant string) (events.LambdaFunctionURLResponse, error) {
+	key, err := archiveKey(source)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}, nil
+	}
+	if rejection := authorizeTenantKey(tenant, key); rejection != nil {
+		return *rejection, nil
+	}
+	settings, err := loadS3Settings()
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	status, err := loadRestoreStatus(s3Svc, settings.Bucket, key)
+	if err != nil {
+		log.Println("Error loading restore status:", err)
+		return events.LambdaFunctionURLResponse{StatusCode: 404, Body: "Image not found"}, nil
+	}
+	return restoreStatusResponse(200, status)
+}
+
+func (request RestoreRequestBody) validate() error {
+	if request.Days < 0 || request.Days > maxRestoreDays {
+		return fmt.Errorf("days must be between 1 and %d", maxRestoreDays)
+	}
+	switch request.Tier {
+	case "", s3.TierStandard, s3.TierBulk, s3.TierExpedited:
+		return nil
+	}
+	return fmt.Errorf("tier must be %s, %s or %s", s3.TierStandard, s3.TierBulk, s3.TierExpedited)
+}
+
+// Object key of a master, given as a key or an S3 URL of the image bucket
+func archiveKey(source string) (string, error) {
+	key := source
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		parsed, err := url.Parse(source)
+		if err != nil {
+			return "", fmt.Errorf("invalid source URL %q", source)
+		}
+		key = parsed.Path
+	}
+	key = strings.Trim(key, "/")
+	// The function's own state lives in the same bucket and is never archived
+	if key == "" || hasAnyPrefix(key, internalKeyPrefixes()) {
+		return "", fmt.Errorf("invalid source %q", source)
+	}
+	return key, nil
+}
+
+// Status of an object from its storage class and x-amz-restore header, e.g.
+// ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+func loadRestoreStatus(s3Svc *s3.S3, bucket string, key string) (RestoreStatus, error) {
+	head, err := s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return RestoreStatus{}, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	status := RestoreStatus{
+		Key:          key,
+		Status:       restoreStatusAvailable,
+		StorageClass: aws.StringValue(head.StorageClass),
+	}
+	restore := aws.StringValue(head.Restore)
+	switch {
+	case strings.Contains(restore, `ongoing-request="true"`):
+		status.Status = restoreStatusRestoring
+	case strings.Contains(restore, `ongoing-request="false"`):
+		if _, expiry, ok := strings.Cut(restore, `expiry-date="`); ok {
+			if expiresAt, err := time.Parse(time.RFC1123, strings.TrimSuffix(expiry, `"`)); err == nil {
+				status.AvailableUntil = expiresAt.UTC().Format(time.RFC3339)
+			}
+		}
+	case status.StorageClass == s3.ObjectStorageClassGlacier || status.StorageClass == "DEEP_ARCHIVE":
+		status.Status = restoreStatusArchived
+	}
+	return status, nil
+}
+
+func restoreStatusResponse(statusCode int, status RestoreStatus) (events.LambdaFunctionURLResponse, error) {
+	responseBody, err := json.Marshal(status)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	if status.Status == restoreStatusRestoring {
+		headers["Location"] = "/restore/" + status.Key
+		headers["Retry-After"] = strconv.Itoa(int(restorePollInterval.Seconds()))
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
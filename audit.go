@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Maximum number of records returned by one history query
+const historyPageSize = 100
+
+// Who did what, when, and to which assets
+type AuditRecord struct {
+	RequestID  string   `json:"request_id"`
+	Timestamp  string   `json:"timestamp"`
+	Tenant     string   `json:"tenant,omitempty"`
+	SourceIP   string   `json:"source_ip,omitempty"`
+	UserAgent  string   `json:"user_agent,omitempty"`
+	Operation  string   `json:"operation"`
+	StatusCode int      `json:"status_code"`
+	Assets     []string `json:"assets,omitempty"`
+	// Prompts sent to Ideogram, image counts and the estimated provider cost
+	Prompts          []string `json:"prompts,omitempty"`
+	ImagesGenerated  int      `json:"images_generated,omitempty"`
+	ImagesDelivered  int      `json:"images_delivered,omitempty"`
+	EstimatedCostUSD float64  `json:"estimated_cost_usd,omitempty"`
+	// Whose provider key was used: service, environment:<name> or
+	// caller:<key fingerprint>
+	KeyOwners map[string]string `json:"key_owners,omitempty"`
+	// Dashboard thumbnails of the stored images, see GET /recent
+	Thumbnails []string `json:"thumbnails,omitempty"`
+}
+
+type HistoryResponse struct {
+	Date      string        `json:"date"`
+	Records   []AuditRecord `json:"records"`
+	Truncated bool          `json:"truncated,omitempty"`
+	// Pass back as next_token for the next page
+	NextToken string `json:"next_token,omitempty"`
+}
+
+// Audit records are stored one object per request under
+// AUDIT_PREFIX/YYYY/MM/DD/ in AUDIT_BUCKET, so the log only ever grows.
+// Records of a tenant are also indexed under auditTenantPrefix. Pair the
+// bucket with Object Lock to make it tamper-proof.
+func auditLocation() (bucket string, prefix string) {
+	prefix = strings.Trim(os.Getenv("AUDIT_PREFIX"), "/")
+	if prefix == "" {
+		prefix = "audit"
+	}
+	return os.Getenv("AUDIT_BUCKET"), prefix
+}
+
+// Where a tenant's copies of its audit records for a day are kept, so its
+// history is listed without reading every other tenant's records
+func auditTenantPrefix(prefix string, tenant string, day time.Time) string {
+	return fmt.Sprintf("%s/tenants/%s/%s/", prefix, url.PathEscape(tenant), day.Format("2006/01/02"))
+}
+
+func newAuditS3Client() (*s3.S3, error) {
+	region := os.Getenv("BUCKET_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	return newS3Client(S3Settings{Region: region})
+}
+
+// Append the audit record for this invocation. Failures are logged rather
+// than returned, the caller already has its response.
+func writeAuditRecord(request events.LambdaFunctionURLRequest, summary *InvocationSummary) {
+	bucket, prefix := auditLocation()
+	if bucket == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+	record := AuditRecord{
+		RequestID:  summary.RequestID,
+		Timestamp:  now.Format(time.RFC3339Nano),
+		Tenant:     summary.Tenant,
+		SourceIP:   request.RequestContext.HTTP.SourceIP,
+		UserAgent:  request.RequestContext.HTTP.UserAgent,
+		Operation:  summary.Method + " " + summary.Path,
+		StatusCode: summary.StatusCode,
+		Assets:     summary.assets,
+		KeyOwners:  summary.keyOwners,
+		Thumbnails: summary.thumbnails,
+
+		Prompts:          summary.prompts,
+		ImagesGenerated:  summary.ImagesGenerated,
+		ImagesDelivered:  summary.ImagesDelivered,
+		EstimatedCostUSD: estimateCost(summary),
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		log.Println("Error marshalling audit record:", err)
+		return
+	}
+
+	s3Svc, err := newAuditS3Client()
+	if err != nil {
+		log.Println("Error writing audit record:", err)
+		return
+	}
+	name := fmt.Sprintf("%s-%s.json", now.Format("20060102T150405.000000000Z"), record.RequestID)
+	keys := []string{prefix + "/" + now.Format("2006/01/02") + "/" + name}
+	if record.Tenant != "" {
+		keys = append(keys, auditTenantPrefix(prefix, record.Tenant, now)+name)
+	}
+	for _, key := range keys {
+		_, err = s3Svc.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(payload),
+			ContentType: aws.String("application/json"),
+			ContentMD5:  contentMD5(payload),
+		})
+		if err != nil {
+			log.Println("Error writing audit record:", err)
+		}
+	}
+}
+
+// Object Lock buckets refuse uploads that carry no checksum
+func contentMD5(payload []byte) *string {
+	sum := md5.Sum(payload)
+	return aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+// GET /history?date=YYYY-MM-DD[&tenant=...][&next_token=...] returns a page of
+// the audit records of a day, defaulting to today. A tenant's records are
+// listed from its index, so every page is full.
+func handleHistoryRequest(request events.LambdaFunctionURLRequest, scopedTenant string) (events.LambdaFunctionURLResponse, error) {
+	bucket, prefix := auditLocation()
+	if bucket == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Audit log is not configured",
+		}, nil
+	}
+
+	date := time.Now().UTC()
+	if value := request.QueryStringParameters["date"]; value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Body:       "Bad Request: date must be formatted as YYYY-MM-DD",
+			}, nil
+		}
+		date = parsed
+	}
+	tenant := request.QueryStringParameters["tenant"]
+	// Tenant callers only ever see their own records
+	if scopedTenant != "" {
+		tenant = scopedTenant
+	}
+
+	s3Svc, err := newAuditS3Client()
+	if err != nil {
+		log.Println("Error reading audit log:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+
+	listPrefix := prefix + "/" + date.Format("2006/01/02") + "/"
+	if tenant != "" {
+		listPrefix = auditTenantPrefix(prefix, tenant, date)
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(listPrefix),
+		MaxKeys: aws.Int64(historyPageSize),
+	}
+	if token := request.QueryStringParameters["next_token"]; token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	listing, err := s3Svc.ListObjectsV2(input)
+	if aerr, ok := err.(awserr.Error); ok && input.ContinuationToken != nil && aerr.Code() == "InvalidArgument" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: invalid next_token",
+		}, nil
+	}
+	if err != nil {
+		log.Println("Error listing audit records:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+
+	history := HistoryResponse{
+		Date:      date.Format("2006-01-02"),
+		Records:   make([]AuditRecord, 0, len(listing.Contents)),
+		Truncated: aws.BoolValue(listing.IsTruncated),
+		NextToken: aws.StringValue(listing.NextContinuationToken),
+	}
+	for _, object := range listing.Contents {
+		record, err := readAuditRecord(s3Svc, bucket, aws.StringValue(object.Key))
+		if err != nil {
+			log.Println("Error reading audit record:", err)
+			continue
+		}
+		// The index only holds the tenant's records; this guards the copies
+		if tenant != "" && record.Tenant != tenant {
+			continue
+		}
+		history.Records = append(history.Records, record)
+	}
+
+	responseBody, err := json.Marshal(history)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+func readAuditRecord(s3Svc *s3.S3, bucket string, key string) (AuditRecord, error) {
+	var record AuditRecord
+	object, err := s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return record, fmt.Errorf("failed to get %s: %v", key, err)
+	}
+	defer object.Body.Close()
+
+	payload, err := io.ReadAll(object.Body)
+	if err != nil {
+		return record, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	err = json.Unmarshal(payload, &record)
+	return record, err
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Callers can authenticate with a bearer JWT from Cognito or any OIDC provider
+// instead of a shared X-Api-Key, e.g. internal portal users with their SSO
+// token. AUTH_JWT_ISSUER is the token issuer, e.g.
+// https://cognito-idp.<region>.amazonaws.com/<user pool id>; its signing keys
+// are found through the issuer's OIDC discovery document.
+
+// Default claim holding the caller's tenant, a Cognito custom attribute
+const defaultTenantClaim = "custom:tenant"
+
+// Signing keys are refetched after an hour, or sooner for an unknown key ID,
+// but not more than once a minute
+const (
+	jwksTTL             = time.Hour
+	jwksRefetchInterval = time.Minute
+)
+
+// Clock skew tolerated on exp and nbf
+const jwtLeeway = time.Minute
+
+// The caller a bearer token identified
+type CallerIdentity struct {
+	Subject string
+	Tenant  string
+	// Member of AUTH_JWT_ADMIN_GROUP, which grants the admin routes for the
+	// tenant like a tenant admin key
+	Admin bool
+}
+
+// A missing, malformed, expired or wrongly signed token, answered with a 401
+type AuthError struct {
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+func jwtIssuer() string {
+	return strings.TrimSuffix(os.Getenv("AUTH_JWT_ISSUER"), "/")
+}
+
+func tenantClaim() string {
+	if claim := os.Getenv("AUTH_JWT_TENANT_CLAIM"); claim != "" {
+		return claim
+	}
+	return defaultTenantClaim
+}
+
+// Authenticate the caller of a request. A bearer token must be valid when
+// sent; without one the caller is anonymous, which AUTH_REQUIRED refuses
+// unless the request carries a configured API key. Async self-invocations
+// were authenticated when they were submitted.
+func authenticateRequest(request events.LambdaFunctionURLRequest) (*CallerIdentity, error) {
+	if request.RequestContext.APIID == "" {
+		return nil, nil
+	}
+	token, ok := strings.CutPrefix(headerValue(request.Headers, "authorization"), "Bearer ")
+	if ok && jwtIssuer() != "" {
+		return verifyJWT(strings.TrimSpace(token))
+	}
+	if envFlag("AUTH_REQUIRED", false) && !knownAPIKey(headerValue(request.Headers, callerAPIKeyHeader)) {
+		return nil, &AuthError{"a bearer token or API key is required"}
+	}
+	return nil, nil
+}
+
+// Keys with their own KEY_POLICIES entry, and ADMIN_API_KEY
+func knownAPIKey(apiKey string) bool {
+	if apiKey == "" {
+		return false
+	}
+	if adminKey := os.Getenv("ADMIN_API_KEY"); adminKey != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(adminKey)) == 1 {
+		return true
+	}
+	policies, err := loadKeyPolicies()
+	if err != nil {
+		log.Println("Error loading key policies:", err)
+		return false
+	}
+	_, ok := policies[apiKey]
+	return ok && apiKey != "*"
+}
+
+func authErrorResponse(err error) events.LambdaFunctionURLResponse {
+	var authErr *AuthError
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return events.LambdaFunctionURLResponse{StatusCode: 403, Body: "Forbidden: " + policyErr.Message}
+	}
+	if errors.As(err, &authErr) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 401,
+			Headers:    map[string]string{"WWW-Authenticate": `Bearer realm="ideogram"`},
+			Body:       "Unauthorized: " + authErr.Message,
+		}
+	}
+	log.Println("Error authenticating request:", err)
+	return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify an RS256 token's signature, issuer, audience and lifetime, and map
+// its claims to the caller's identity
+func verifyJWT(token string) (*CallerIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, &AuthError{"malformed token"}
+	}
+	var header jwtHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, &AuthError{"malformed token header"}
+	}
+	if header.Alg != "RS256" {
+		return nil, &AuthError{fmt.Sprintf("unsupported token algorithm %q", header.Alg)}
+	}
+	key, err := jwtSigningKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, &AuthError{"malformed token signature"}
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, &AuthError{"invalid token signature"}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, &AuthError{"malformed token claims"}
+	}
+	if err := checkJWTClaims(claims); err != nil {
+		return nil, err
+	}
+
+	identity := &CallerIdentity{Subject: claimString(claims, "sub")}
+	identity.Tenant = claimString(claims, tenantClaim())
+	if identity.Tenant == "" {
+		return nil, &PolicyError{fmt.Sprintf("token has no %s claim", tenantClaim())}
+	}
+	if group := os.Getenv("AUTH_JWT_ADMIN_GROUP"); group != "" {
+		identity.Admin = containsString(claimStrings(claims, "cognito:groups"), group) || containsString(claimStrings(claims, "groups"), group)
+	}
+	return identity, nil
+}
+
+func checkJWTClaims(claims map[string]interface{}) error {
+	if claimString(claims, "iss") != jwtIssuer() {
+		return &AuthError{"token is from another issuer"}
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return &AuthError{"token has expired"}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return &AuthError{"token is not valid yet"}
+	}
+	// Cognito ID tokens carry the app client in aud, access tokens in client_id
+	audiences := strings.Split(os.Getenv("AUTH_JWT_AUDIENCE"), ",")
+	tokenAudiences := append(claimStrings(claims, "aud"), claimString(claims, "client_id"))
+	for _, audience := range audiences {
+		if audience = strings.TrimSpace(audience); audience != "" && containsString(tokenAudiences, audience) {
+			return nil
+		}
+	}
+	return &AuthError{"token is for another audience"}
+}
+
+func decodeJWTSegment(segment string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func claimString(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// A claim that may be one string or a list of them, like aud
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var values []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// The issuer's signing keys by key ID, kept for the container's life
+var jwksCache struct {
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+func jwtSigningKey(kid string) (*rsa.PublicKey, error) {
+	jwksCache.mu.Lock()
+	defer jwksCache.mu.Unlock()
+	key, ok := jwksCache.keys[kid]
+	age := time.Since(jwksCache.fetchedAt)
+	if (ok && age < jwksTTL) || (!ok && age < jwksRefetchInterval) {
+		if !ok {
+			return nil, &AuthError{"token signed with an unknown key"}
+		}
+		return key, nil
+	}
+
+	keys, err := fetchJWKS()
+	if err != nil {
+		// Keep using the keys we have while the issuer is unreachable
+		log.Println("Error fetching token signing keys:", err)
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	jwksCache.keys = keys
+	jwksCache.fetchedAt = time.Now()
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, &AuthError{"token signed with an unknown key"}
+}
+
+// Fetch the RSA signing keys from the jwks_uri of the issuer's discovery
+// document
+func fetchJWKS() (map[string]*rsa.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(jwtIssuer()+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("error fetching OIDC discovery document: %v", err)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document has no jwks_uri")
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("error fetching JWKS: %v", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			log.Printf("Skipping malformed signing key %s", jwk.Kid)
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+func getJSON(url string, target interface{}) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.Unmarshal(body, target)
+}
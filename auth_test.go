@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com/pool"
+	testAudience = "portal-client"
+	testKeyID    = "test-key"
+)
+
+// Sign the token with the key, or leave the signature empty without one
+func signTestJWT(t *testing.T, header map[string]interface{}, claims map[string]interface{}, key *rsa.PrivateKey) string {
+	t.Helper()
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signingInput := encode(header) + "." + encode(claims)
+	if key == nil {
+		return signingInput + "."
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Trust the key for the test, as if fetched from the issuer's JWKS just now
+func trustTestKey(t *testing.T, key *rsa.PublicKey) {
+	t.Helper()
+	jwksCache.mu.Lock()
+	previousKeys, previousFetchedAt := jwksCache.keys, jwksCache.fetchedAt
+	jwksCache.keys = map[string]*rsa.PublicKey{testKeyID: key}
+	jwksCache.fetchedAt = time.Now()
+	jwksCache.mu.Unlock()
+	t.Cleanup(func() {
+		jwksCache.mu.Lock()
+		jwksCache.keys, jwksCache.fetchedAt = previousKeys, previousFetchedAt
+		jwksCache.mu.Unlock()
+	})
+}
+
+func TestVerifyJWT(t *testing.T) {
+	t.Setenv("AUTH_JWT_ISSUER", testIssuer)
+	t.Setenv("AUTH_JWT_AUDIENCE", "other-client, "+testAudience)
+	t.Setenv("AUTH_JWT_TENANT_CLAIM", "")
+	t.Setenv("AUTH_JWT_ADMIN_GROUP", "admins")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustTestKey(t, &key.PublicKey)
+
+	now := time.Now()
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": testKeyID}
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		values := map[string]interface{}{
+			"iss":           testIssuer,
+			"aud":           testAudience,
+			"sub":           "user-1",
+			"exp":           now.Add(time.Hour).Unix(),
+			"custom:tenant": "tenantA",
+		}
+		for name, value := range overrides {
+			if value == nil {
+				delete(values, name)
+			} else {
+				values[name] = value
+			}
+		}
+		return values
+	}
+
+	// HS256 signed with the public key as the secret, the classic confusion
+	publicKeyBytes := x509.MarshalPKCS1PublicKey(&key.PublicKey)
+	hsInput := strings.TrimSuffix(signTestJWT(t, map[string]interface{}{"alg": "HS256", "kid": testKeyID}, claims(nil), nil), ".")
+	mac := hmac.New(sha256.New, publicKeyBytes)
+	mac.Write([]byte(hsInput))
+	hs256Token := hsInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	// Claims swapped after signing keep a signature that no longer matches
+	valid := signTestJWT(t, rs256, claims(nil), key)
+	escalated := strings.Split(signTestJWT(t, rs256, claims(map[string]interface{}{"custom:tenant": "tenantB"}), key), ".")
+	validParts := strings.Split(valid, ".")
+	tampered := validParts[0] + "." + escalated[1] + "." + validParts[2]
+
+	// A valid signature does not make an alg:none header acceptable
+	noneToken := signTestJWT(t, map[string]interface{}{"alg": "none", "kid": testKeyID}, claims(nil), nil)
+	noneHeader := strings.Split(noneToken, ".")[0]
+
+	tests := []struct {
+		name       string
+		token      string
+		wantTenant string
+		wantAdmin  bool
+		// "auth" for an AuthError, "policy" for a PolicyError
+		wantErr string
+	}{
+		{name: "valid", token: valid, wantTenant: "tenantA"},
+		{name: "admin group", token: signTestJWT(t, rs256, claims(map[string]interface{}{"cognito:groups": []string{"editors", "admins"}}), key), wantTenant: "tenantA", wantAdmin: true},
+		{name: "other group", token: signTestJWT(t, rs256, claims(map[string]interface{}{"groups": []string{"editors"}}), key), wantTenant: "tenantA"},
+		{name: "audience in client_id", token: signTestJWT(t, rs256, claims(map[string]interface{}{"aud": nil, "client_id": testAudience}), key), wantTenant: "tenantA"},
+		{name: "audience in list", token: signTestJWT(t, rs256, claims(map[string]interface{}{"aud": []string{"x", testAudience}}), key), wantTenant: "tenantA"},
+		{name: "expiry within leeway", token: signTestJWT(t, rs256, claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}), key), wantTenant: "tenantA"},
+		{name: "signed by another key", token: signTestJWT(t, rs256, claims(nil), otherKey), wantErr: "auth"},
+		{name: "claims changed after signing", token: tampered, wantErr: "auth"},
+		{name: "alg none", token: noneToken, wantErr: "auth"},
+		{name: "alg none with RS256 signature", token: noneHeader + "." + validParts[1] + "." + validParts[2], wantErr: "auth"},
+		{name: "HS256 with the public key as secret", token: hs256Token, wantErr: "auth"},
+		{name: "unknown key ID", token: signTestJWT(t, map[string]interface{}{"alg": "RS256", "kid": "rotated-away"}, claims(nil), key), wantErr: "auth"},
+		{name: "expired", token: signTestJWT(t, rs256, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), key), wantErr: "auth"},
+		{name: "no expiry", token: signTestJWT(t, rs256, claims(map[string]interface{}{"exp": nil}), key), wantErr: "auth"},
+		{name: "not valid yet", token: signTestJWT(t, rs256, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), key), wantErr: "auth"},
+		{name: "wrong audience", token: signTestJWT(t, rs256, claims(map[string]interface{}{"aud": "someone-else"}), key), wantErr: "auth"},
+		{name: "no audience", token: signTestJWT(t, rs256, claims(map[string]interface{}{"aud": nil}), key), wantErr: "auth"},
+		{name: "wrong issuer", token: signTestJWT(t, rs256, claims(map[string]interface{}{"iss": "https://evil.example.com"}), key), wantErr: "auth"},
+		{name: "no tenant", token: signTestJWT(t, rs256, claims(map[string]interface{}{"custom:tenant": nil}), key), wantErr: "policy"},
+		{name: "two segments", token: validParts[0] + "." + validParts[1], wantErr: "auth"},
+		{name: "empty", token: "", wantErr: "auth"},
+		{name: "signature not base64", token: validParts[0] + "." + validParts[1] + ".!!!", wantErr: "auth"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := verifyJWT(tt.token)
+			var authErr *AuthError
+			var policyErr *PolicyError
+			switch tt.wantErr {
+			case "":
+				if err != nil {
+					t.Fatalf("verifyJWT() error = %v, want none", err)
+				}
+				if identity.Tenant != tt.wantTenant || identity.Admin != tt.wantAdmin || identity.Subject != "user-1" {
+					t.Errorf("verifyJWT() = %+v, want tenant %q, admin %v", identity, tt.wantTenant, tt.wantAdmin)
+				}
+			case "auth":
+				if !errors.As(err, &authErr) {
+					t.Errorf("verifyJWT() = %+v, %v, want an AuthError", identity, err)
+				}
+			case "policy":
+				if !errors.As(err, &policyErr) {
+					t.Errorf("verifyJWT() = %+v, %v, want a PolicyError", identity, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import "strings"
+
+// Prompt conventions that steer Ideogram towards an isolated subject on a
+// flat backdrop, which gives Freepik much cleaner cutouts
+const (
+	plainBackgroundPromptSuffix    = "isolated subject on a plain solid white background, centered, no shadows"
+	plainBackgroundNegativePrompt  = "busy background, scenery, clutter, gradient, texture, cast shadows"
+	plainBackgroundStyleConvention = "DESIGN"
+)
+
+// Adjust the request for plain_background: append the backdrop instructions to
+// the prompt, and pick the DESIGN style unless the caller chose one. Returns
+// the negative prompt to send, the caller's plus the backdrop's.
+func applyPlainBackground(body IdeogramRequestBody) (IdeogramRequestBody, string) {
+	negativePrompt := strings.TrimRight(strings.TrimSpace(body.NegativePrompt), ".,")
+	if !body.PlainBackground {
+		return body, negativePrompt
+	}
+	body.Prompt = strings.TrimRight(strings.TrimSpace(body.Prompt), ".,") + ", " + plainBackgroundPromptSuffix
+	// Style codes stand in for the style type and cannot be combined with it
+	if len(body.StyleCodes) == 0 && (body.StyleType == nil || *body.StyleType == "AUTO") {
+		style := StyleType(plainBackgroundStyleConvention)
+		body.StyleType = &style
+	}
+	if negativePrompt == "" {
+		return body, plainBackgroundNegativePrompt
+	}
+	return body, negativePrompt + ", " + plainBackgroundNegativePrompt
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/bedrockruntime"
+)
+
+// Bedrock image models, selected with BEDROCK_IMAGE_MODEL. Both take the same
+// request body.
+var bedrockModelIDs = map[string]string{
+	"nova-canvas": "amazon.nova-canvas-v1:0",
+	"titan":       "amazon.titan-image-generator-v2:0",
+}
+
+const defaultBedrockModel = "nova-canvas"
+
+// Sizes both models generate, by the aspect ratio they stand for. Titan only
+// takes a fixed list of sizes; Nova Canvas takes any multiple of 16.
+var bedrockImageSizes = map[string][2]int{
+	"1x1":  {1024, 1024},
+	"16x9": {1408, 768},
+	"9x16": {768, 1408},
+	"3x2":  {1152, 768},
+	"2x3":  {768, 1152},
+}
+
+// Images per invocation, the most either model makes at once
+const maxBedrockImages = 5
+
+func init() {
+	registerGenerator("bedrock", bedrockGenerator{})
+}
+
+// Amazon's own image models through the Bedrock runtime, keeping generation
+// traffic inside AWS
+type bedrockGenerator struct{}
+
+func bedrockModel() string {
+	model := strings.ToLower(strings.TrimSpace(os.Getenv("BEDROCK_IMAGE_MODEL")))
+	if _, ok := bedrockModelIDs[model]; !ok {
+		return defaultBedrockModel
+	}
+	return model
+}
+
+func (bedrockGenerator) Name(body IdeogramRequestBody) string {
+	return "bedrock-" + bedrockModel()
+}
+
+func (bedrockGenerator) Validate(body IdeogramRequestBody) error {
+	if err := rejectIdeogramOnlyFeatures(body); err != nil {
+		return err
+	}
+	if body.AspectRatio != nil {
+		if _, ok := bedrockImageSizes[string(*body.AspectRatio)]; !ok {
+			return fmt.Errorf("aspect_ratio %q is not available with the bedrock provider, expected one of 1x1, 16x9, 9x16, 3x2, 2x3", *body.AspectRatio)
+		}
+	}
+	if body.NumImages != nil && *body.NumImages > maxBedrockImages {
+		return fmt.Errorf("num_images must be at most %d with the bedrock provider", maxBedrockImages)
+	}
+	return nil
+}
+
+// Request body shared by Titan Image Generator and Nova Canvas
+type bedrockImageRequest struct {
+	TaskType              string                       `json:"taskType"`
+	TextToImageParams     bedrockTextToImageParams     `json:"textToImageParams"`
+	ImageGenerationConfig bedrockImageGenerationConfig `json:"imageGenerationConfig"`
+}
+
+type bedrockTextToImageParams struct {
+	Text         string `json:"text"`
+	NegativeText string `json:"negativeText,omitempty"`
+}
+
+type bedrockImageGenerationConfig struct {
+	NumberOfImages int    `json:"numberOfImages"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	Quality        string `json:"quality,omitempty"`
+	Seed           *int   `json:"seed,omitempty"`
+}
+
+type bedrockImageResponse struct {
+	Images []string `json:"images"`
+	Error  string   `json:"error,omitempty"`
+}
+
+func bedrockRegion() string {
+	if region := os.Getenv("BEDROCK_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_REGION")
+}
+
+func (bedrockGenerator) Generate(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) ([]Image, error) {
+	body, negativePrompt := applyPlainBackground(applyPattern(applyBrandFonts(body)))
+
+	size := bedrockImageSizes["1x1"]
+	if body.AspectRatio != nil {
+		size = bedrockImageSizes[string(*body.AspectRatio)]
+	}
+	count := 1
+	if body.NumImages != nil {
+		count = *body.NumImages
+	}
+	imageRequest := bedrockImageRequest{
+		TaskType: "TEXT_IMAGE",
+		TextToImageParams: bedrockTextToImageParams{
+			Text:         body.Prompt,
+			NegativeText: negativePrompt,
+		},
+		ImageGenerationConfig: bedrockImageGenerationConfig{
+			NumberOfImages: count,
+			Width:          size[0],
+			Height:         size[1],
+			Quality:        "standard",
+			Seed:           body.Seed,
+		},
+	}
+	if body.RenderingSpeed != nil && *body.RenderingSpeed == "QUALITY" {
+		imageRequest.ImageGenerationConfig.Quality = "premium"
+	}
+	payload, err := json.Marshal(imageRequest)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling Bedrock request: %v", err)
+	}
+
+	sess, err := session.NewSession(newAWSConfig(bedrockRegion()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	output, err := bedrockruntime.New(sess).InvokeModelWithContext(ctx, &bedrockruntime.InvokeModelInput{
+		ModelId:     aws.String(bedrockModelIDs[bedrockModel()]),
+		ContentType: aws.String("application/json"),
+		Accept:      aws.String("application/json"),
+		Body:        payload,
+	})
+	if err != nil {
+		// Surface throttling and rejected prompts like any provider's HTTP errors
+		if failure, ok := err.(awserr.RequestFailure); ok {
+			return nil, &ProviderError{Provider: "bedrock", StatusCode: failure.StatusCode(), Body: failure.Message()}
+		}
+		return nil, fmt.Errorf("error invoking Bedrock: %v", err)
+	}
+
+	var bedrockResp bedrockImageResponse
+	if err := json.Unmarshal(output.Body, &bedrockResp); err != nil {
+		return nil, fmt.Errorf("error unmarshalling Bedrock response: %v", err)
+	}
+	if bedrockResp.Error != "" {
+		return nil, fmt.Errorf("bedrock returned an error: %s", bedrockResp.Error)
+	}
+	resolution := fmt.Sprintf("%dx%d", size[0], size[1])
+	images := make([]Image, 0, len(bedrockResp.Images))
+	for _, encoded := range bedrockResp.Images {
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding Bedrock image: %v", err)
+		}
+		image := Image{
+			Data:        data,
+			Prompt:      body.Prompt,
+			Resolution:  resolution,
+			IsImageSafe: true,
+		}
+		if body.Seed != nil {
+			image.Seed = *body.Seed
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
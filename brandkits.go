@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// A brand's look, stored in the BRAND_KITS_TABLE DynamoDB table keyed by
+// brand and selected with "brand" in a request. Like tenant defaults, it
+// only fills in what the request left out.
+type BrandKit struct {
+	Brand string `dynamodbav:"brand"`
+	// Tenant allowed to use the kit; empty for kits every caller may use
+	TenantID      string         `dynamodbav:"tenant_id,omitempty"`
+	ColourPalette *ColourPalette `dynamodbav:"colour_palette,omitempty"`
+	StyleType     *StyleType     `dynamodbav:"style_type,omitempty"`
+	StyleCodes    []string       `dynamodbav:"style_codes,omitempty"`
+	// Typefaces asked for in the prompt, for any text in the image
+	Fonts []string `dynamodbav:"fonts,omitempty"`
+	// Logo composited onto every image
+	Logo *BrandLogo `dynamodbav:"logo,omitempty"`
+	// Watermark drawn over every image, after the logo
+	Watermark *BrandWatermark `dynamodbav:"watermark,omitempty"`
+	// Frame template the images are placed in
+	Frame  string `dynamodbav:"frame,omitempty"`
+	Folder string `dynamodbav:"folder,omitempty"`
+	// Filename template, e.g. "acme-{prompt_slug}-{seed}"
+	FileName string `dynamodbav:"filename,omitempty"`
+}
+
+type BrandLogo struct {
+	// PNG in the image bucket
+	Key string `dynamodbav:"key"`
+	// top-left, top-right, bottom-left or bottom-right (default)
+	Position string `dynamodbav:"position,omitempty"`
+	// Width of the logo as a share of the image's width, default 0.15
+	Scale float64 `dynamodbav:"scale,omitempty"`
+}
+
+type BrandWatermark struct {
+	// PNG in the image bucket
+	Key string `dynamodbav:"key"`
+	// From 0 to 1, default 0.2
+	Opacity float64 `dynamodbav:"opacity,omitempty"`
+	// Repeat the watermark across the image instead of centering it once
+	Tile bool `dynamodbav:"tile,omitempty"`
+}
+
+const (
+	defaultBrandLogoPosition     = "bottom-right"
+	defaultBrandLogoScale        = 0.15
+	defaultBrandWatermarkOpacity = 0.2
+)
+
+var brandLogoPositions = []string{"top-left", "top-right", "bottom-left", "bottom-right"}
+
+var errBrandNotFound = errors.New("unknown brand")
+
+// Brand kits read by this container
+var brandKitCache = newWarmCache("BrandKits")
+
+func (kit BrandKit) validate() error {
+	if logo := kit.Logo; logo != nil {
+		if logo.Key == "" {
+			return fmt.Errorf("logo has no key")
+		}
+		if logo.Position != "" && !containsString(brandLogoPositions, logo.Position) {
+			return fmt.Errorf("logo position %q is not one of %s", logo.Position, strings.Join(brandLogoPositions, ", "))
+		}
+		if logo.Scale < 0 || logo.Scale > 1 {
+			return fmt.Errorf("logo scale must be between 0 and 1")
+		}
+	}
+	if watermark := kit.Watermark; watermark != nil {
+		if watermark.Key == "" {
+			return fmt.Errorf("watermark has no key")
+		}
+		if watermark.Opacity < 0 || watermark.Opacity > 1 {
+			return fmt.Errorf("watermark opacity must be between 0 and 1")
+		}
+	}
+	if kit.Frame != "" && !frameNamePattern.MatchString(kit.Frame) {
+		return fmt.Errorf("invalid frame %q", kit.Frame)
+	}
+	return nil
+}
+
+// Load the named brand kit, errBrandNotFound when it does not exist
+func loadBrandKit(brand string) (*BrandKit, error) {
+	tableName := os.Getenv("BRAND_KITS_TABLE")
+	if tableName == "" {
+		return nil, fmt.Errorf("%w %q, brand kits are not configured in this deployment", errBrandNotFound, brand)
+	}
+	kit, err := brandKitCache.get(tableName+"/"+brand, func() (interface{}, error) {
+		return fetchBrandKit(tableName, brand)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if kit.(*BrandKit) == nil {
+		return nil, fmt.Errorf("%w %q", errBrandNotFound, brand)
+	}
+	return kit.(*BrandKit), nil
+}
+
+func fetchBrandKit(tableName string, brand string) (*BrandKit, error) {
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := dynamoSvc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"brand": {S: aws.String(brand)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load brand kit %s: %v", brand, err)
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+
+	var kit BrandKit
+	err = dynamodbattribute.UnmarshalMap(output.Item, &kit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode brand kit %s: %v", brand, err)
+	}
+	if err := kit.validate(); err != nil {
+		return nil, fmt.Errorf("invalid brand kit %s: %v", brand, err)
+	}
+	return &kit, nil
+}
+
+// Apply the request's brand kit to every field the request left unset. It
+// runs before the tenant's defaults, so the brand wins over them. Patterns
+// fill the whole tile, so they get the brand's palette, style and typefaces
+// but no frame, logo or watermark. A brand kept for one tenant is only
+// available to requests authenticated as that tenant.
+func applyBrandKit(tenant string, body *IdeogramRequestBody) error {
+	body.Brand = strings.ToLower(strings.TrimSpace(body.Brand))
+	if body.Brand == "" {
+		return nil
+	}
+	if !frameNamePattern.MatchString(body.Brand) {
+		return fmt.Errorf("%w %q, expected lowercase letters, digits, - and _", errBrandNotFound, body.Brand)
+	}
+	kit, err := loadBrandKit(body.Brand)
+	if err != nil {
+		return err
+	}
+	if kit.TenantID != "" && kit.TenantID != tenant {
+		return &PolicyError{fmt.Sprintf("brand %s is not available to this caller", body.Brand)}
+	}
+
+	if body.ColourPalette == nil {
+		body.ColourPalette = kit.ColourPalette
+	}
+	// Style codes replace the style type, so either fills in for both
+	if body.StyleType == nil && len(body.StyleCodes) == 0 {
+		body.StyleType = kit.StyleType
+		if body.StyleType == nil {
+			body.StyleCodes = append([]string(nil), kit.StyleCodes...)
+		}
+	}
+	if body.Folder == "" {
+		body.Folder = kit.Folder
+	}
+	if body.FileName == "" {
+		body.FileName = kit.FileName
+	}
+	if body.Frame == "" && body.Pattern == nil {
+		body.Frame = kit.Frame
+	}
+	body.brandKit = kit
+	return nil
+}
+
+func brandErrorResponse(err error) *events.LambdaFunctionURLResponse {
+	var policyErr *PolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		return &events.LambdaFunctionURLResponse{StatusCode: 403, Body: "Forbidden: " + policyErr.Message}
+	case errors.Is(err, errBrandNotFound):
+		return &events.LambdaFunctionURLResponse{StatusCode: 400, Body: "Bad Request: " + err.Error()}
+	default:
+		log.Println("Error loading brand kit:", err)
+		return &events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}
+	}
+}
+
+// Ask for the brand's typefaces for any text in the image
+func applyBrandFonts(body IdeogramRequestBody) IdeogramRequestBody {
+	if body.brandKit != nil && len(body.brandKit.Fonts) > 0 {
+		body.Prompt = strings.TrimRight(strings.TrimSpace(body.Prompt), ".,") + ", any text set in " + strings.Join(body.brandKit.Fonts, " or ") + " typeface"
+	}
+	return body
+}
+
+func (body IdeogramRequestBody) brandLogoEnabled() bool {
+	return body.brandKit != nil && body.brandKit.Logo != nil && body.Pattern == nil
+}
+
+func (body IdeogramRequestBody) brandWatermarkEnabled() bool {
+	return body.brandKit != nil && body.brandKit.Watermark != nil && body.Pattern == nil
+}
+
+func brandLogoStep(ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) ([]byte, error) {
+	stageStart := time.Now()
+	branded, err := compositeBrandLogo(imageData, *ideogramRequestBody.brandKit.Logo)
+	summary.recordStage("brand", stageStart)
+	if err != nil {
+		log.Println("Error compositing brand logo:", err)
+		summary.recordError("brand", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error compositing brand logo", Err: err}
+	}
+	return branded, nil
+}
+
+func brandWatermarkStep(ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) ([]byte, error) {
+	stageStart := time.Now()
+	watermarked, err := stampBrandWatermark(imageData, *ideogramRequestBody.brandKit.Watermark)
+	summary.recordStage("brand", stageStart)
+	if err != nil {
+		log.Println("Error stamping brand watermark:", err)
+		summary.recordError("brand", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error stamping brand watermark", Err: err}
+	}
+	return watermarked, nil
+}
+
+// Read a PNG from the image bucket, cached like frame assets
+func readBrandImage(key string) (image.Image, error) {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return nil, err
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return nil, err
+	}
+	return readFrameImage(s3Svc, settings.Bucket, strings.TrimPrefix(key, "/"))
+}
+
+// Draw the logo in a corner, a margin of 3% of the image's width away from
+// the edges. The logo is scaled down to its share of the width but never
+// enlarged.
+func compositeBrandLogo(imageData []byte, logo BrandLogo) ([]byte, error) {
+	canvas, err := decodeNRGBA(imageData)
+	if err != nil {
+		return nil, err
+	}
+	mark, err := readBrandImage(logo.Key)
+	if err != nil {
+		return nil, err
+	}
+	scale := logo.Scale
+	if scale == 0 {
+		scale = defaultBrandLogoScale
+	}
+	position := logo.Position
+	if position == "" {
+		position = defaultBrandLogoPosition
+	}
+
+	width, height := canvas.Rect.Dx(), canvas.Rect.Dy()
+	bounds := mark.Bounds()
+	if maxWidth := int(math.Round(float64(width) * scale)); bounds.Dx() > maxWidth && maxWidth > 0 {
+		mark = downscale(mark, maxWidth, max(bounds.Dy()*maxWidth/bounds.Dx(), 1))
+		bounds = mark.Bounds()
+	}
+	margin := width * 3 / 100
+	x, y := margin, margin
+	if strings.HasSuffix(position, "right") {
+		x = width - margin - bounds.Dx()
+	}
+	if strings.HasPrefix(position, "bottom") {
+		y = height - margin - bounds.Dy()
+	}
+	draw.Draw(canvas, image.Rect(x, y, x+bounds.Dx(), y+bounds.Dy()), mark, bounds.Min, draw.Over)
+	return encodePNG(canvas)
+}
+
+// Draw the watermark at its opacity, centered at up to half the image's
+// width or repeated across the whole image
+func stampBrandWatermark(imageData []byte, watermark BrandWatermark) ([]byte, error) {
+	canvas, err := decodeNRGBA(imageData)
+	if err != nil {
+		return nil, err
+	}
+	mark, err := readBrandImage(watermark.Key)
+	if err != nil {
+		return nil, err
+	}
+	opacity := watermark.Opacity
+	if opacity == 0 {
+		opacity = defaultBrandWatermarkOpacity
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(opacity * 255))})
+
+	width, height := canvas.Rect.Dx(), canvas.Rect.Dy()
+	bounds := mark.Bounds()
+	if watermark.Tile {
+		for y := 0; y < height; y += bounds.Dy() {
+			for x := 0; x < width; x += bounds.Dx() {
+				draw.DrawMask(canvas, image.Rect(x, y, x+bounds.Dx(), y+bounds.Dy()), mark, bounds.Min, mask, image.Point{}, draw.Over)
+			}
+		}
+		return encodePNG(canvas)
+	}
+	if bounds.Dx() > width/2 && width >= 2 {
+		mark = downscale(mark, width/2, max(bounds.Dy()*(width/2)/bounds.Dx(), 1))
+		bounds = mark.Bounds()
+	}
+	x, y := (width-bounds.Dx())/2, (height-bounds.Dy())/2
+	draw.DrawMask(canvas, image.Rect(x, y, x+bounds.Dx(), y+bounds.Dy()), mark, bounds.Min, mask, image.Point{}, draw.Over)
+	return encodePNG(canvas)
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %v", err)
+	}
+	return buf.Bytes(), nil
+}
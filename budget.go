@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Rendering speed used once the daily soft limit is crossed
+const downgradedRenderingSpeed = "TURBO"
+
+// Daily spend in USD above which requests are downgraded instead of rejected,
+// from DAILY_SPEND_SOFT_LIMIT_USD. Zero disables downgrades.
+func dailySpendSoftLimit() float64 {
+	limit, err := strconv.ParseFloat(os.Getenv("DAILY_SPEND_SOFT_LIMIT_USD"), 64)
+	if err != nil || limit <= 0 {
+		return 0
+	}
+	return limit
+}
+
+// Downgrade to TURBO and a single image once today's spend is over the soft
+// limit, keeping workflows running at reduced cost. Spend that cannot be read
+// leaves the request as it is.
+func applyBudgetDowngrade(body *IdeogramRequestBody) {
+	limit := dailySpendSoftLimit()
+	if limit == 0 || os.Getenv("SPEND_TABLE") == "" {
+		return
+	}
+	spend, err := loadDailySpend(time.Now().UTC())
+	if err != nil {
+		log.Println("Error loading daily spend:", err)
+		return
+	}
+	if spend < limit {
+		return
+	}
+
+	if body.RenderingSpeed == nil || *body.RenderingSpeed != downgradedRenderingSpeed {
+		speed := RenderingSpeed(downgradedRenderingSpeed)
+		body.RenderingSpeed = &speed
+		body.downgraded = true
+	}
+	if body.NumImages == nil || *body.NumImages > 1 {
+		one := 1
+		body.NumImages = &one
+		body.downgraded = true
+	}
+	if body.downgraded {
+		log.Printf("Daily spend $%.2f is over the $%.2f soft limit, downgrading the request", spend, limit)
+	}
+}
+
+// Key of a day's item in SPEND_TABLE
+func spendDay(day time.Time) string {
+	return day.Format("2006-01-02")
+}
+
+func loadDailySpend(day time.Time) (float64, error) {
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return 0, err
+	}
+	output, err := dynamoSvc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(os.Getenv("SPEND_TABLE")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"day": {S: aws.String(spendDay(day))},
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to load spend for %s: %v", spendDay(day), err)
+	}
+	if output.Item["spend_usd"] == nil {
+		return 0, nil
+	}
+	return strconv.ParseFloat(aws.StringValue(output.Item["spend_usd"].N), 64)
+}
+
+// Spend entries, and the days they add up to, expire after a week
+const spendRetention = 7 * 24 * time.Hour
+
+// What an invocation's spend is for: the job or shard it ran, else the
+// request. Lambda's retries and duplicate deliveries of a job share it, so
+// their spend counts once.
+func spendEntryID(request events.LambdaFunctionURLRequest, summary *InvocationSummary) string {
+	if jobID := asyncJobID(request); jobID != "" {
+		if shard, ok := jobShardIndex(request); ok {
+			return fmt.Sprintf("job:%s:shard:%d", jobID, shard)
+		}
+		return "job:" + jobID
+	}
+	if summary.RequestID != "" {
+		return "request:" + summary.RequestID
+	}
+	return ""
+}
+
+// Add the invocation's estimated cost to today's spend, once per job, shard
+// or request. An entry keyed by what the spend is for is written with the
+// day's total in one transaction, which fails if the entry already exists.
+func recordSpend(request events.LambdaFunctionURLRequest, summary *InvocationSummary) {
+	if os.Getenv("SPEND_TABLE") == "" {
+		return
+	}
+	cost := estimateCost(summary)
+	if cost <= 0 {
+		return
+	}
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		log.Println("Error recording spend:", err)
+		return
+	}
+	day := time.Now().UTC()
+	costValue := &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(cost, 'f', -1, 64))}
+	expiresAt := &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(day.Add(spendRetention).Unix(), 10))}
+	update := &dynamodb.Update{
+		TableName: aws.String(os.Getenv("SPEND_TABLE")),
+		Key: map[string]*dynamodb.AttributeValue{
+			"day": {S: aws.String(spendDay(day))},
+		},
+		UpdateExpression: aws.String("ADD spend_usd :cost SET expires_at = :expires_at"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cost":       costValue,
+			":expires_at": expiresAt,
+		},
+	}
+
+	entryID := spendEntryID(request, summary)
+	if entryID == "" {
+		_, err = dynamoSvc.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 update.TableName,
+			Key:                       update.Key,
+			UpdateExpression:          update.UpdateExpression,
+			ExpressionAttributeValues: update.ExpressionAttributeValues,
+		})
+	} else {
+		_, err = dynamoSvc.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{Put: &dynamodb.Put{
+					TableName: aws.String(os.Getenv("SPEND_TABLE")),
+					Item: map[string]*dynamodb.AttributeValue{
+						"day":        {S: aws.String("entry#" + entryID)},
+						"spend_usd":  costValue,
+						"expires_at": expiresAt,
+					},
+					ConditionExpression: aws.String("attribute_not_exists(#day)"),
+					ExpressionAttributeNames: map[string]*string{
+						"#day": aws.String("day"),
+					},
+				}},
+				{Update: update},
+			},
+		})
+		// The entry's condition is the first item; other cancellations, such
+		// as a conflicting write, are errors
+		var canceled *dynamodb.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 && aws.StringValue(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			log.Printf("Spend of %s was already recorded", entryID)
+			return
+		}
+	}
+	if err != nil {
+		log.Println("Error recording spend:", err)
+	}
+}
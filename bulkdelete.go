@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Most objects one bulk delete may match; larger cleanups are split by prefix
+const maxBulkDeleteKeys = 10000
+
+// Most objects whose tags are read for one tag filter, as each costs a request
+const maxBulkDeleteScan = 50000
+
+// Keys listed in a dry run, so the operator can sanity-check the filter
+const bulkDeleteSampleSize = 20
+
+// Concurrent tagging reads while filtering by tag
+const bulkDeleteTagWorkers = 16
+
+// DeleteObjects accepts at most this many keys per call
+const deleteObjectsBatchSize = 1000
+
+type BulkDeleteTag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Objects in the image bucket to delete, by prefix, tag or both. Without a
+// confirmation token the request is a dry run.
+type BulkDeleteRequestBody struct {
+	Prefix string         `json:"prefix,omitempty"`
+	Tag    *BulkDeleteTag `json:"tag,omitempty"`
+	// Token from the dry run of the same filter; deletes for real
+	Confirm string `json:"confirm,omitempty"`
+}
+
+type BulkDeleteResponseBody struct {
+	DryRun     bool     `json:"dry_run"`
+	Matched    int      `json:"matched"`
+	SampleKeys []string `json:"sample_keys"`
+	// Send back as confirm to delete exactly the matched objects
+	ConfirmationToken string   `json:"confirmation_token,omitempty"`
+	Deleted           int      `json:"deleted,omitempty"`
+	Failed            []string `json:"failed,omitempty"`
+}
+
+// POST /bulk-delete removes stored assets by prefix or tag, e.g. a campaign
+// whose licensing window expired. The first call is always a dry run that
+// returns the count, sample keys and a token; deleting needs that token, and
+// it no longer matches once the set of objects has changed.
+func handleBulkDeleteRequest(request events.LambdaFunctionURLRequest, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	if !isAdminRequest(request, summary.identity) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 403,
+			Body:       "Forbidden: bulk deletes require the admin API key",
+		}, nil
+	}
+
+	body, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	var deleteRequest BulkDeleteRequestBody
+	if err := json.Unmarshal(body, &deleteRequest); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request",
+		}, nil
+	}
+	deleteRequest.Prefix = strings.TrimPrefix(deleteRequest.Prefix, "/")
+	if deleteRequest.Prefix == "" && deleteRequest.Tag == nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: prefix or tag is required",
+		}, nil
+	}
+	if deleteRequest.Tag != nil && deleteRequest.Tag.Key == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: tag needs a key",
+		}, nil
+	}
+	// A tenant only lists and deletes under its own prefix; a tag alone
+	// matches within it
+	if summary.Tenant != "" {
+		prefix, err := confineListPrefix(summary.Tenant, deleteRequest.Prefix)
+		if err != nil {
+			summary.recordError("tenant", err)
+			return tenantErrorResponse(err), nil
+		}
+		deleteRequest.Prefix = prefix
+	}
+
+	settings, err := loadS3Settings()
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	keys, err := matchBulkDeleteKeys(s3Svc, settings.Bucket, deleteRequest)
+	if err != nil {
+		log.Println("Error matching objects to delete:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}, nil
+	}
+
+	token := bulkDeleteToken(deleteRequest, keys)
+	responseBody := BulkDeleteResponseBody{
+		DryRun:     deleteRequest.Confirm == "",
+		Matched:    len(keys),
+		SampleKeys: keys[:min(len(keys), bulkDeleteSampleSize)],
+	}
+	if responseBody.DryRun {
+		responseBody.ConfirmationToken = token
+		return bulkDeleteResponse(200, responseBody)
+	}
+	if subtle.ConstantTimeCompare([]byte(deleteRequest.Confirm), []byte(token)) != 1 {
+		// Objects were added or removed since the dry run, preview again
+		responseBody.DryRun = true
+		responseBody.ConfirmationToken = token
+		return bulkDeleteResponse(409, responseBody)
+	}
+
+	responseBody.Deleted, responseBody.Failed = deleteKeys(s3Svc, settings.Bucket, keys)
+	log.Printf("Bulk delete by %s removed %d of %d objects", summary.RequestID, responseBody.Deleted, len(keys))
+	statusCode := 200
+	if len(responseBody.Failed) > 0 {
+		statusCode = 207
+	}
+	return bulkDeleteResponse(statusCode, responseBody)
+}
+
+// Prefixes holding the function's own state and configuration, which bulk
+// deletes never match
+func internalKeyPrefixes() []string {
+	_, auditPrefix := auditLocation()
+	prefixes := []string{"jobs/", draftPrefix() + "/", auditPrefix + "/", intermediatePrefix() + "/", frameTemplatePrefix() + "/", exportsPrefix + "/"}
+	if key := strings.Trim(os.Getenv("STYLE_PRESETS_KEY"), "/"); key != "" {
+		prefixes = append(prefixes, key)
+	}
+	return prefixes
+}
+
+// Keys under the prefix carrying the tag, sorted. Internal keys are never
+// matched.
+func matchBulkDeleteKeys(s3Svc *s3.S3, bucket string, deleteRequest BulkDeleteRequestBody) ([]string, error) {
+	internal := internalKeyPrefixes()
+	listed := make([]string, 0)
+	tooMany := false
+	err := s3Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(deleteRequest.Prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if hasAnyPrefix(key, internal) {
+				continue
+			}
+			listed = append(listed, key)
+		}
+		// Tag filters narrow the listing down, so they may scan more
+		limit := maxBulkDeleteKeys
+		if deleteRequest.Tag != nil {
+			limit = maxBulkDeleteScan
+		}
+		if len(listed) > limit {
+			tooMany = true
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q: %v", deleteRequest.Prefix, err)
+	}
+	if tooMany {
+		return nil, fmt.Errorf("too many objects under %q, narrow the prefix", deleteRequest.Prefix)
+	}
+
+	keys := listed
+	if deleteRequest.Tag != nil {
+		keys = filterKeysByTag(s3Svc, bucket, listed, *deleteRequest.Tag)
+		if len(keys) > maxBulkDeleteKeys {
+			return nil, fmt.Errorf("more than %d objects match, narrow the filter", maxBulkDeleteKeys)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// S3 cannot list by tag, so read every object's tags. Objects whose tags
+// cannot be read are left alone.
+func filterKeysByTag(s3Svc *s3.S3, bucket string, keys []string, tag BulkDeleteTag) []string {
+	matches := make([]bool, len(keys))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < bulkDeleteTagWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				tagging, err := s3Svc.GetObjectTagging(&s3.GetObjectTaggingInput{
+					Bucket: aws.String(bucket),
+					Key:    aws.String(keys[i]),
+				})
+				if err != nil {
+					log.Println("Error reading tags of", keys[i], err)
+					continue
+				}
+				for _, objectTag := range tagging.TagSet {
+					if aws.StringValue(objectTag.Key) == tag.Key && aws.StringValue(objectTag.Value) == tag.Value {
+						matches[i] = true
+					}
+				}
+			}
+		}()
+	}
+	for i := range keys {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	matched := make([]string, 0)
+	for i, key := range keys {
+		if matches[i] {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// Token binding a confirmation to the filter and the exact set of keys the
+// dry run matched
+func bulkDeleteToken(deleteRequest BulkDeleteRequestBody, keys []string) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", deleteRequest.Prefix)
+	if deleteRequest.Tag != nil {
+		fmt.Fprintf(hash, "%s=%s\n", deleteRequest.Tag.Key, deleteRequest.Tag.Value)
+	}
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s\n", key)
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+// Delete the keys in batches, returning how many were removed and the keys
+// that could not be
+func deleteKeys(s3Svc *s3.S3, bucket string, keys []string) (int, []string) {
+	deleted := 0
+	var failed []string
+	for start := 0; start < len(keys); start += deleteObjectsBatchSize {
+		batch := keys[start:min(start+deleteObjectsBatchSize, len(keys))]
+		objects := make([]*s3.ObjectIdentifier, 0, len(batch))
+		for _, key := range batch {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		output, err := s3Svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			log.Println("Error deleting objects:", err)
+			failed = append(failed, batch...)
+			continue
+		}
+		// Quiet mode only reports the failures
+		for _, deleteErr := range output.Errors {
+			log.Printf("Error deleting %s: %s", aws.StringValue(deleteErr.Key), aws.StringValue(deleteErr.Message))
+			failed = append(failed, aws.StringValue(deleteErr.Key))
+		}
+		deleted += len(batch) - len(output.Errors)
+	}
+	return deleted, failed
+}
+
+func bulkDeleteResponse(statusCode int, responseBody BulkDeleteResponseBody) (events.LambdaFunctionURLResponse, error) {
+	payload, err := json.Marshal(responseBody)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(payload),
+	}, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Headers carrying caller-provided provider keys, as an alternative to the
+// ideogram_api_key and freepik_api_key body fields
+const (
+	ideogramAPIKeyHeader = "x-ideogram-api-key"
+	freepikAPIKeyHeader  = "x-freepik-api-key"
+)
+
+// Pick the provider keys for this invocation: the caller's own key first, then
+// the environment's, then the function's API_KEY and FREEPIK_API_KEY. Whose
+// key was used is recorded for the audit log.
+func selectProviderKeys(request events.LambdaFunctionURLRequest, environment *EnvironmentConfig, body *IdeogramRequestBody, summary *InvocationSummary) {
+	if body.IdeogramAPIKey == "" {
+		body.IdeogramAPIKey = headerValue(request.Headers, ideogramAPIKeyHeader)
+	}
+	if body.FreepikAPIKey == "" {
+		body.FreepikAPIKey = headerValue(request.Headers, freepikAPIKeyHeader)
+	}
+
+	var environmentKeys EnvironmentConfig
+	if environment != nil {
+		environmentKeys = *environment
+	}
+	ideogramKey, ideogramOwner := chooseProviderKey(body.IdeogramAPIKey, environmentKeys.IdeogramAPIKey, summary.Environment)
+	freepikKey, freepikOwner := chooseProviderKey(body.FreepikAPIKey, environmentKeys.FreepikAPIKey, summary.Environment)
+	body.providerKeys = ProviderKeys{Ideogram: ideogramKey, Freepik: freepikKey}
+	summary.setKeyOwner("ideogram", ideogramOwner)
+	summary.setKeyOwner("freepik", freepikOwner)
+}
+
+// Return the key to use and who owns it. An empty key means the function's
+// own key from the environment variables.
+func chooseProviderKey(callerKey string, environmentKey string, environmentName string) (string, string) {
+	if callerKey != "" {
+		return callerKey, "caller:" + keyFingerprint(callerKey)
+	}
+	if environmentKey != "" {
+		return environmentKey, "environment:" + environmentName
+	}
+	return "", "service"
+}
+
+// Short hash identifying a caller's key in the audit log without storing it
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Provider key headers to forward to an async job, so it runs with the same
+// caller keys as the request that started it
+func (body IdeogramRequestBody) providerKeyHeaders() map[string]string {
+	headers := map[string]string{}
+	if body.IdeogramAPIKey != "" {
+		headers[ideogramAPIKeyHeader] = body.IdeogramAPIKey
+	}
+	if body.FreepikAPIKey != "" {
+		headers[freepikAPIKeyHeader] = body.FreepikAPIKey
+	}
+	return headers
+}
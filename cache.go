@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// How long the static option lists are cached
+const optionsCacheTTL = time.Hour
+
+// Responses one container keeps when RESPONSE_CACHE_MAX_ENTRIES is unset
+const defaultResponseCacheMaxEntries = 500
+
+// A successful read-only response, cached by route and the query parameters
+// the route reads
+type cachedResponse struct {
+	Body        string
+	ContentType string
+	ETag        string
+	ExpiresAt   time.Time
+}
+
+// Responses cached by this container. DynamoDB shares them across containers
+// when RESPONSE_CACHE_TABLE is set.
+var responseCache = struct {
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+}{entries: map[string]cachedResponse{}}
+
+func responseCacheMaxEntries() int {
+	entries, err := strconv.Atoi(os.Getenv("RESPONSE_CACHE_MAX_ENTRIES"))
+	if err != nil || entries <= 0 {
+		return defaultResponseCacheMaxEntries
+	}
+	return entries
+}
+
+// How long polled routes such as /credits and /history are cached
+func responseCacheTTL() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("RESPONSE_CACHE_TTL_SECONDS"))
+	if err != nil || seconds < 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Serve a read-only route from the cache, calling the handler on a miss. Only
+// 200 responses are cached. Callers sending a matching If-None-Match get a 304.
+// params are the query parameters the handler reads; any other parameter is
+// left out of the key, so junk query strings share one entry.
+func serveCached(request events.LambdaFunctionURLRequest, route string, params []string, ttl time.Duration, handler func() (events.LambdaFunctionURLResponse, error)) (events.LambdaFunctionURLResponse, error) {
+	if ttl <= 0 {
+		return handler()
+	}
+	key := route
+	query := url.Values{}
+	for _, param := range params {
+		if value := request.QueryStringParameters[param]; value != "" {
+			query.Set(param, value)
+		}
+	}
+	if len(query) > 0 {
+		key += "?" + query.Encode()
+	}
+
+	entry, ok := lookupCachedResponse(key)
+	if !ok {
+		response, err := handler()
+		if err != nil || response.StatusCode != 200 {
+			return response, err
+		}
+		sum := sha256.Sum256([]byte(response.Body))
+		entry = cachedResponse{
+			Body:        response.Body,
+			ContentType: response.Headers["Content-Type"],
+			ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+			ExpiresAt:   time.Now().Add(ttl),
+		}
+		storeCachedResponse(key, entry)
+	}
+
+	headers := map[string]string{
+		"ETag":          entry.ETag,
+		"Cache-Control": fmt.Sprintf("max-age=%d", int(time.Until(entry.ExpiresAt).Seconds())),
+	}
+	if etagMatches(headerValue(request.Headers, "if-none-match"), entry.ETag) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 304,
+			Headers:    headers,
+		}, nil
+	}
+	if entry.ContentType != "" {
+		headers["Content-Type"] = entry.ContentType
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       entry.Body,
+	}, nil
+}
+
+// Whether an If-None-Match value, possibly a list or weak tags, names the ETag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupCachedResponse(key string) (cachedResponse, bool) {
+	responseCache.mu.Lock()
+	entry, ok := responseCache.entries[key]
+	responseCache.mu.Unlock()
+	if ok && time.Now().Before(entry.ExpiresAt) {
+		return entry, true
+	}
+
+	entry, err := loadCachedResponse(key)
+	if err != nil {
+		return cachedResponse{}, false
+	}
+	rememberCachedResponse(key, entry)
+	return entry, true
+}
+
+func storeCachedResponse(key string, entry cachedResponse) {
+	rememberCachedResponse(key, entry)
+
+	if os.Getenv("RESPONSE_CACHE_TABLE") == "" {
+		return
+	}
+	if err := saveCachedResponse(key, entry); err != nil {
+		log.Println("Error caching response:", err)
+	}
+}
+
+// Keep the response in this container. Once the cache is full, expired
+// responses are dropped first, then those expiring soonest.
+func rememberCachedResponse(key string, entry cachedResponse) {
+	responseCache.mu.Lock()
+	defer responseCache.mu.Unlock()
+	if _, replacing := responseCache.entries[key]; !replacing && len(responseCache.entries) >= responseCacheMaxEntries() {
+		now := time.Now()
+		for cachedKey, cached := range responseCache.entries {
+			if !now.Before(cached.ExpiresAt) {
+				delete(responseCache.entries, cachedKey)
+			}
+		}
+		for len(responseCache.entries) >= responseCacheMaxEntries() {
+			soonest := ""
+			for cachedKey, cached := range responseCache.entries {
+				if soonest == "" || cached.ExpiresAt.Before(responseCache.entries[soonest].ExpiresAt) {
+					soonest = cachedKey
+				}
+			}
+			delete(responseCache.entries, soonest)
+		}
+	}
+	responseCache.entries[key] = entry
+}
+
+// Store the response in RESPONSE_CACHE_TABLE, keyed by cache_key with an
+// expires_at TTL attribute
+func saveCachedResponse(key string, entry cachedResponse) error {
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return err
+	}
+	_, err = dynamoSvc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv("RESPONSE_CACHE_TABLE")),
+		Item: map[string]*dynamodb.AttributeValue{
+			"cache_key":    {S: aws.String(key)},
+			"body":         {S: aws.String(entry.Body)},
+			"content_type": {S: aws.String(entry.ContentType)},
+			"etag":         {S: aws.String(entry.ETag)},
+			"expires_at":   {N: aws.String(strconv.FormatInt(entry.ExpiresAt.Unix(), 10))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store cached response %s: %v", key, err)
+	}
+	return nil
+}
+
+// DynamoDB TTL deletes lazily, so expired items are ignored here
+func loadCachedResponse(key string) (cachedResponse, error) {
+	tableName := os.Getenv("RESPONSE_CACHE_TABLE")
+	if tableName == "" {
+		return cachedResponse{}, fmt.Errorf("RESPONSE_CACHE_TABLE is not set")
+	}
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return cachedResponse{}, err
+	}
+
+	output, err := dynamoSvc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"cache_key": {S: aws.String(key)},
+		},
+	})
+	if err != nil {
+		log.Println("Error loading cached response:", err)
+		return cachedResponse{}, err
+	}
+	if len(output.Item) == 0 || output.Item["body"] == nil || output.Item["etag"] == nil || output.Item["expires_at"] == nil {
+		return cachedResponse{}, fmt.Errorf("no cached response for %s", key)
+	}
+	expiresAt, err := strconv.ParseInt(aws.StringValue(output.Item["expires_at"].N), 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return cachedResponse{}, fmt.Errorf("cached response for %s has expired", key)
+	}
+	entry := cachedResponse{
+		Body:      aws.StringValue(output.Item["body"].S),
+		ETag:      aws.StringValue(output.Item["etag"].S),
+		ExpiresAt: time.Unix(expiresAt, 0),
+	}
+	if output.Item["content_type"] != nil {
+		entry.ContentType = aws.StringValue(output.Item["content_type"].S)
+	}
+	return entry, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Largest image fetched from a URL the caller sent
+const maxCallerImageBytes = 25 << 20
+
+// Caller URLs taking longer than this to download are given up on
+const callerImageTimeout = 30 * time.Second
+
+// Shared address space carriers use for NAT, which net.IP.IsPrivate leaves out
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Client for URLs the caller sent, e.g. source_image_url or an edit mask. It
+// only speaks https and refuses to connect to anything but public addresses,
+// so a caller cannot point the function at the Lambda runtime API, the
+// instance metadata service or anything else inside the VPC. The check runs
+// once DNS has resolved, so a public name resolving to a private address is
+// refused too, and it applies to every redirect as well.
+var callerImageClient = &http.Client{
+	Timeout: callerImageTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: refuseNonPublicAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 20 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("too many redirects")
+		}
+		return checkCallerURL(req.URL)
+	},
+}
+
+// Dialer hook refusing loopback, private, link-local and other non-public
+// addresses
+func refuseNonPublicAddress(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicAddress(ip) {
+		return fmt.Errorf("refusing to fetch from non-public address %s", host)
+	}
+	return nil
+}
+
+func isPublicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip)
+}
+
+func checkCallerURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("only https image URLs are accepted")
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("image URL has no host")
+	}
+	return nil
+}
+
+// Download an image from a URL the caller sent, through callerImageClient and
+// capped at maxCallerImageBytes
+func fetchCallerImage(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image URL: %v", err)
+	}
+	if err := checkCallerURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	resp, err := callerImageClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching image: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, &DownloadStatusError{URL: rawURL, StatusCode: resp.StatusCode}
+	}
+
+	imageData, err := io.ReadAll(io.LimitReader(resp.Body, maxCallerImageBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading image data: %v", err)
+	}
+	if len(imageData) > maxCallerImageBytes {
+		return nil, fmt.Errorf("image is larger than %dMB", maxCallerImageBytes>>20)
+	}
+	return imageData, nil
+}
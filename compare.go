@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Output of one side of a comparison run
+type VariantResult struct {
+	StyleType    StyleType               `json:"style_type,omitempty"`
+	Provider     string                  `json:"provider,omitempty"`
+	FileName     string                  `json:"filename"`
+	ImageURLs    []string                `json:"image_urls"`
+	WebImageURLs []string                `json:"web_image_urls,omitempty"`
+	DurationMs   int64                   `json:"duration_ms"`
+	SafetyRetry  *SafetyRetryReport      `json:"safety_retry,omitempty"`
+	Paraphrase   *PromptParaphraseReport `json:"paraphrase,omitempty"`
+	FailedImages []ImageFailure          `json:"failed_images,omitempty"`
+	Reused       bool                    `json:"reused,omitempty"`
+	Error        string                  `json:"error,omitempty"`
+	// Images as they were before upscaling, when upscale is on
+	OriginalImageURLs []string `json:"original_image_urls,omitempty"`
+	// With score_variants, the rating of each image from 1 to 10 in the
+	// order of image_urls, and the best of them
+	Scores []int `json:"scores,omitempty"`
+	Score  int   `json:"score,omitempty"`
+	// Why the variant could not be scored
+	ScoreError string `json:"score_error,omitempty"`
+}
+
+// Generate the same prompt once per requested style type, or once per
+// provider, concurrently and return every result, so editors can pick the
+// best one from a single Zap run. With score_variants, a vision model rates
+// the images and the best variant is named.
+func handleCompareRequest(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) events.LambdaFunctionURLResponse {
+	scoring := body.scoringEnabled()
+	var variantBodies []IdeogramRequestBody
+	var variants []VariantResult
+	for _, name := range body.CompareStyles {
+		style := StyleType(name).Normalize()
+		if err := style.Validate(); err != nil {
+			err = fmt.Errorf("compare_style_types: %v", err)
+			summary.recordError("validate", err)
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Body:       "Bad Request: " + err.Error(),
+			}
+		}
+		variantBody := body
+		variantBody.CompareStyles = nil
+		variantBody.StyleType = &style
+		// Each variant gets its own key so the runs do not overwrite each other
+		variantBody.FileName = fmt.Sprintf("%s-%s", body.FileName, strings.ToLower(string(style)))
+		variantBodies = append(variantBodies, variantBody)
+		variants = append(variants, VariantResult{StyleType: style, FileName: variantBody.FileName, ImageURLs: make([]string, 0)})
+	}
+	for _, provider := range body.CompareProviders {
+		variantBody := body
+		variantBody.CompareProviders = nil
+		variantBody.Provider = provider
+		variantBody.FileName = fmt.Sprintf("%s-%s", body.FileName, provider)
+		variantBodies = append(variantBodies, variantBody)
+		variants = append(variants, VariantResult{Provider: provider, FileName: variantBody.FileName, ImageURLs: make([]string, 0)})
+	}
+
+	results := make([]GenerationResult, len(variants))
+	errs := make([]error, len(variants))
+	var wg sync.WaitGroup
+	for i, variantBody := range variantBodies {
+		wg.Add(1)
+		go func(i int, variantBody IdeogramRequestBody) {
+			defer wg.Done()
+			// A panic in a goroutine is out of reach of the handler's recovery
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					log.Printf("Recovered from panic in variant %s: %v\n%s", variantBody.FileName, recovered, debug.Stack())
+					emitMetric("Panics", 1, "Count")
+					errs[i] = fmt.Errorf("variant panicked: %v", recovered)
+				}
+			}()
+			start := time.Now()
+			if scoring {
+				// The scores are taken from the stored images' bytes
+				variantBody.ReturnBase64 = true
+			}
+			results[i], errs[i] = runGenerationPipeline(ctx, variantBody, summary)
+			variants[i].DurationMs = time.Since(start).Milliseconds()
+			if scoring && errs[i] == nil {
+				if err := scoreVariant(&variants[i], variantBody.Prompt, results[i].Images, summary); err != nil {
+					log.Printf("Error scoring variant %s: %v", variantBody.FileName, err)
+					summary.recordError("scoring", err)
+					variants[i].ScoreError = err.Error()
+				}
+			}
+		}(i, variantBody)
+	}
+	wg.Wait()
+
+	responseBody := LambdaResponseBody{
+		ImageURLs:         make([]string, 0),
+		Regeneration:      body.regeneration,
+		Sanitization:      body.sanitization,
+		Downgraded:        body.downgraded,
+		PromptTruncations: body.truncations,
+	}
+	var gallery []GalleryImage
+	failed := 0
+	bestScore := 0
+	for i := range variants {
+		if errs[i] != nil {
+			log.Printf("Variant %s failed: %v", variants[i].FileName, errs[i])
+			if isQuotaExceeded(errs[i]) {
+				return handleQuotaExceeded(errs[i], body.Folder, variants[i].FileName)
+			}
+			if throttleErr, ok := throttleFromError(errs[i]); ok {
+				return throttledResponse(throttleErr)
+			}
+			variants[i].Error = errs[i].Error()
+			failed++
+			continue
+		}
+		variants[i].ImageURLs = results[i].ImageURLs
+		variants[i].WebImageURLs = results[i].WebImageURLs
+		variants[i].OriginalImageURLs = results[i].OriginalImageURLs
+		variants[i].SafetyRetry = results[i].SafetyRetry
+		variants[i].Paraphrase = results[i].Paraphrase
+		variants[i].FailedImages = results[i].FailedImages
+		variants[i].Reused = results[i].Reused
+		responseBody.ImageURLs = append(responseBody.ImageURLs, results[i].ImageURLs...)
+		responseBody.Seeds = append(responseBody.Seeds, results[i].Seeds...)
+		responseBody.ImageMetadata = append(responseBody.ImageMetadata, results[i].ImageMetadata...)
+		responseBody.WebImageURLs = append(responseBody.WebImageURLs, results[i].WebImageURLs...)
+		responseBody.OriginalImageURLs = append(responseBody.OriginalImageURLs, results[i].OriginalImageURLs...)
+		responseBody.ReviewRequired = append(responseBody.ReviewRequired, results[i].ReviewRequired...)
+		if body.ReturnBase64 {
+			responseBody.Images = append(responseBody.Images, results[i].Images...)
+		}
+		gallery = append(gallery, results[i].Gallery...)
+		if variants[i].Score > 0 && (responseBody.BestVariant == "" || variants[i].Score > bestScore) {
+			responseBody.BestVariant = variants[i].FileName
+			bestScore = variants[i].Score
+		}
+	}
+	responseBody.Variants = variants
+
+	if failed == len(variants) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "All comparison variants failed",
+		}
+	}
+	if failed > 0 {
+		responseBody.Warnings = append(responseBody.Warnings, fmt.Sprintf("%d of %d variants failed", failed, len(variants)))
+	}
+	attachGallery(body, &responseBody, gallery, summary)
+	summary.reportRetries(&responseBody)
+	return buildSuccessResponse(responseBody)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Environment variables holding each provider's credential, in lookup order.
+// Ideogram's key was API_KEY before other providers were added, which still
+// works. Providers not listed, like bedrock, authenticate with the
+// execution role.
+var providerCredentialEnv = map[string][]string{
+	"ideogram":  {"IDEOGRAM_API_KEY", "API_KEY"},
+	"stability": {"STABILITY_API_KEY"},
+	"openai":    {"OPENAI_API_KEY"},
+	"replicate": {"REPLICATE_API_TOKEN"},
+}
+
+// The deployment's own credential for the provider, empty when it has none
+func providerCredential(provider string) string {
+	for _, name := range providerCredentialEnv[provider] {
+		if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Providers without a credential of their own, found at cold start. The
+// environment does not change during a container's life.
+var unconfiguredProviders = map[string]bool{}
+
+// Check every registered provider has its credential and log the ones that
+// cannot be used, so a missing secret shows up in the first log lines of a
+// deploy rather than in the first failed request for that provider
+func checkProviderCredentials() {
+	for _, name := range generatorNames() {
+		envNames, ok := providerCredentialEnv[name]
+		if !ok || providerCredential(name) != "" {
+			continue
+		}
+		unconfiguredProviders[name] = true
+		if name == defaultImageProvider {
+			log.Printf("No %s key set; only callers bringing their own key can use it", name)
+			continue
+		}
+		log.Printf("Provider %s is disabled, set %s to enable it", name, strings.Join(envNames, " or "))
+	}
+	if (IdeogramRequestBody{}).removeBackgroundEnabled() {
+		if err := validateBackgroundRemover("", ProviderKeys{}); err != nil {
+			log.Printf("Default background remover %s cannot be used, requests must choose another or send remove_background false: %v", backgroundRemoverName(""), err)
+		}
+	}
+	if provider := (IdeogramRequestBody{}).imageProvider(); unconfiguredProviders[provider] && provider != defaultImageProvider {
+		log.Printf("IMAGE_PROVIDER %s has no credential, requests without a provider will be refused", provider)
+	}
+}
+
+// Whether the provider can serve a request with these keys. Ideogram also
+// takes keys brought by the caller or set for the environment.
+func providerConfigured(provider string, keys ProviderKeys) bool {
+	if provider == defaultImageProvider {
+		return keys.ideogramAPIKey() != ""
+	}
+	return !unconfiguredProviders[provider]
+}
+
+// Providers a request may choose, for GET /options
+func availableProviders() []string {
+	var names []string
+	for _, name := range generatorNames() {
+		if name == defaultImageProvider || !unconfiguredProviders[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func missingCredentialError(provider string) error {
+	return fmt.Errorf("provider %s is not configured in this deployment, set %s", provider, strings.Join(providerCredentialEnv[provider], " or "))
+}
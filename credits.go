@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Remaining balance as reported by a single provider
+type ProviderCredits struct {
+	Provider   string          `json:"provider"`
+	Configured bool            `json:"configured"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Usage      json.RawMessage `json:"usage,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+type CreditsResponse struct {
+	CheckedAt string            `json:"checked_at"`
+	Providers []ProviderCredits `json:"providers"`
+}
+
+// Query the Ideogram and Freepik account/usage endpoints and report what they
+// return, so dashboards can alert before credits run out mid-campaign.
+// The usage endpoints are configured through IDEOGRAM_USAGE_URL and
+// FREEPIK_USAGE_URL; providers without a URL are reported as not configured.
+func handleCreditsRequest() (events.LambdaFunctionURLResponse, error) {
+	credits := CreditsResponse{
+		CheckedAt: time.Now().UTC().Format(time.RFC3339),
+		Providers: []ProviderCredits{
+			fetchProviderCredits("ideogram", os.Getenv("IDEOGRAM_USAGE_URL"), "Api-Key", ProviderKeys{}.ideogramAPIKey()),
+			fetchProviderCredits("freepik", os.Getenv("FREEPIK_USAGE_URL"), "x-freepik-api-key", ProviderKeys{}.freepikAPIKey()),
+		},
+	}
+
+	responseBody, err := json.Marshal(credits)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+func fetchProviderCredits(provider, usageURL, authHeader, apiKey string) ProviderCredits {
+	credits := ProviderCredits{Provider: provider}
+	if usageURL == "" {
+		return credits
+	}
+	credits.Configured = true
+
+	req, err := http.NewRequest(http.MethodGet, usageURL, nil)
+	if err != nil {
+		credits.Error = fmt.Sprintf("error creating request: %v", err)
+		return credits
+	}
+	req.Header.Set(authHeader, apiKey)
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error fetching %s credits: %v", provider, err)
+		credits.Error = fmt.Sprintf("error sending request: %v", err)
+		return credits
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		credits.Error = fmt.Sprintf("error reading response: %v", err)
+		return credits
+	}
+	credits.StatusCode = resp.StatusCode
+	if json.Valid(body) {
+		credits.Usage = body
+	} else {
+		credits.Error = fmt.Sprintf("unexpected response: %s", string(body))
+	}
+	return credits
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Error returned when a provider answers with a non-success status
+type ProviderError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+	// Wait the provider asked for in its Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s returned status %d: %s", e.Provider, e.StatusCode, e.Body)
+}
+
+// Degraded behaviors selectable through the DEGRADED_MODE environment variable
+const (
+	degradedModeError       = "error"
+	degradedModePlaceholder = "placeholder"
+	degradedModeCached      = "cached"
+)
+
+// Report whether the error is a provider telling us we are out of credits
+func isQuotaExceeded(err error) bool {
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) {
+		return false
+	}
+	if providerErr.StatusCode == http.StatusPaymentRequired {
+		return true
+	}
+	body := strings.ToLower(providerErr.Body)
+	for _, marker := range []string{"quota", "credit", "insufficient", "balance"} {
+		if strings.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Respond to an exhausted provider according to DEGRADED_MODE instead of a
+// generic 500 that Zapier would keep retrying
+func handleQuotaExceeded(err error, folder string, filename string) events.LambdaFunctionURLResponse {
+	mode := strings.ToLower(os.Getenv("DEGRADED_MODE"))
+	warning := fmt.Sprintf("degraded response: %v", err)
+
+	switch mode {
+	case degradedModePlaceholder:
+		placeholderURL := os.Getenv("PLACEHOLDER_IMAGE_URL")
+		if placeholderURL != "" {
+			log.Println("Credits exhausted, returning placeholder image:", placeholderURL)
+			return buildSuccessResponse(LambdaResponseBody{
+				ImageURLs: []string{placeholderURL},
+				Warnings:  []string{warning},
+				Fallbacks: []string{"placeholder"},
+			})
+		}
+		log.Println("PLACEHOLDER_IMAGE_URL is not set, falling back to 402")
+	case degradedModeCached:
+		cachedURL, lookupErr := findExistingAsset(folder, filename, formatPNG)
+		if lookupErr == nil {
+			log.Println("Credits exhausted, returning previously generated asset:", cachedURL)
+			return buildSuccessResponse(LambdaResponseBody{
+				ImageURLs: []string{cachedURL},
+				Warnings:  []string{warning},
+				Fallbacks: []string{"cached"},
+			})
+		}
+		log.Println("No cached asset available, falling back to 402:", lookupErr)
+	}
+
+	responseBody, _ := json.Marshal(map[string]string{
+		"error":   "quota_exceeded",
+		"message": fmt.Sprintf("Provider credits are exhausted, retrying will not help until they are topped up: %v", err),
+	})
+	return events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusPaymentRequired,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}
+}
+
+// Look up a previously stored asset for the filename in the output bucket
+func findExistingAsset(folder string, filename string, format string) (string, error) {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return "", err
+	}
+	settings = settings.withFolder(folder)
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return "", err
+	}
+
+	key := settings.imageKey(filename, format)
+	_, err = s3Svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(settings.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("no existing asset at %s: %v", key, err)
+	}
+	return settings.objectURL(key), nil
+}
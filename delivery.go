@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Customer-owned bucket a tenant's final assets are delivered to, written
+// with a role in the customer's account. Our credentials never touch their
+// bucket, and their role never sees ours.
+type TenantDelivery struct {
+	// Role we assume for the upload; its trust policy names our function's role
+	RoleARN string `dynamodbav:"role_arn"`
+	// Required by the role's trust policy, when it sets one
+	ExternalID string `dynamodbav:"external_id,omitempty"`
+	Bucket     string `dynamodbav:"bucket"`
+	Region     string `dynamodbav:"region"`
+}
+
+func (delivery TenantDelivery) validate() error {
+	if delivery.RoleARN == "" || delivery.Bucket == "" || delivery.Region == "" {
+		return fmt.Errorf("delivery needs role_arn, bucket and region")
+	}
+	return nil
+}
+
+// S3 clients per delivery role. The assumed-role credentials refresh
+// themselves, so a client is reused for as long as the container lives.
+var deliveryClients = struct {
+	mu      sync.Mutex
+	clients map[string]*s3.S3
+}{clients: map[string]*s3.S3{}}
+
+func newDeliveryS3Client(delivery TenantDelivery) (*s3.S3, error) {
+	key := delivery.RoleARN + "|" + delivery.ExternalID + "|" + delivery.Region
+	deliveryClients.mu.Lock()
+	defer deliveryClients.mu.Unlock()
+	if client, ok := deliveryClients.clients[key]; ok {
+		return client, nil
+	}
+
+	sess, err := session.NewSession(newAWSConfig(delivery.Region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	credentials := stscreds.NewCredentials(sess, delivery.RoleARN, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = "ideogram-delivery"
+		if delivery.ExternalID != "" {
+			provider.ExternalID = aws.String(delivery.ExternalID)
+		}
+	})
+	client := s3.New(sess, &aws.Config{Credentials: credentials})
+	deliveryClients.clients[key] = client
+	return client, nil
+}
+
+// Bucket settings and client for an upload, the tenant's when the asset is
+// delivered to them
+func uploadTarget(settings S3Settings, delivery *TenantDelivery) (S3Settings, *s3.S3, error) {
+	if delivery == nil {
+		s3Svc, err := newS3Client(settings)
+		return settings, s3Svc, err
+	}
+	settings.Bucket = delivery.Bucket
+	settings.Region = delivery.Region
+	s3Svc, err := newDeliveryS3Client(*delivery)
+	return settings, s3Svc, err
+}
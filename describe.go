@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const defaultPromptTemplate = "{description}"
+
+type IdeogramDescribeResponse struct {
+	Descriptions []struct {
+		Text string `json:"text"`
+	} `json:"descriptions"`
+}
+
+// Existing image to caption, by URL or base64 (optionally a data URI)
+type DescribeRequestBody struct {
+	ImageURL    string `json:"image_url,omitempty"`
+	ImageBase64 string `json:"image_base64,omitempty"`
+}
+
+type DescribeResponseBody struct {
+	// The first description, convenient as alt text or a prompt
+	Caption      string   `json:"caption"`
+	Descriptions []string `json:"descriptions"`
+}
+
+// How the prompt was derived from a source image
+type RegenerationReport struct {
+	SourceImageURL string `json:"source_image_url"`
+	Description    string `json:"description"`
+	DerivedPrompt  string `json:"derived_prompt"`
+}
+
+// Ask Ideogram to describe an image, returning the first description
+func describeImage(ctx context.Context, imageData []byte, keys ProviderKeys) (string, error) {
+	descriptions, err := describeImageAll(ctx, imageData, keys)
+	if err != nil {
+		return "", err
+	}
+	return descriptions[0], nil
+}
+
+// Ask Ideogram to describe an image, returning every non-empty description
+func describeImageAll(ctx context.Context, imageData []byte, keys ProviderKeys) ([]string, error) {
+	api_key := keys.ideogramAPIKey()
+
+	if api_key == "" {
+		return nil, fmt.Errorf("API_KEY is not set")
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, err := writer.CreateFormFile("image_file", "image.png")
+	if err != nil {
+		return nil, fmt.Errorf("error creating form file: %v", err)
+	}
+	part.Write(imageData)
+	writer.Close()
+
+	req, err := newProviderRequest(ctx, "POST", "https://api.ideogram.ai/describe", &buf)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Api-Key", api_key)
+
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := new(bytes.Buffer)
+	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return nil, &ProviderError{Provider: "ideogram", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	var describeResponse IdeogramDescribeResponse
+	err = json.Unmarshal(respBody.Bytes(), &describeResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling describe response: %v", err)
+	}
+	var descriptions []string
+	for _, description := range describeResponse.Descriptions {
+		if description.Text != "" {
+			descriptions = append(descriptions, description.Text)
+		}
+	}
+	if len(descriptions) == 0 {
+		return nil, fmt.Errorf("describe returned no description")
+	}
+	return descriptions, nil
+}
+
+// Download the source image, describe it and render the caller's template
+// into the prompt, e.g. "{description}, flat vector style, brand colours"
+func deriveRegenerationPrompt(ctx context.Context, body *IdeogramRequestBody, summary *InvocationSummary) error {
+	stageStart := time.Now()
+	imageData, err := fetchCallerImage(ctx, body.SourceImageURL)
+	summary.recordStage("download", stageStart)
+	if err != nil {
+		summary.recordError("download", err)
+		return &PipelineError{StatusCode: 400, Message: "Error downloading source image", Err: err}
+	}
+	summary.addDownloadedBytes(len(imageData))
+
+	stageStart = time.Now()
+	description, err := describeImage(ctx, imageData, body.providerKeys)
+	summary.recordStage("describe", stageStart)
+	if err != nil {
+		summary.recordError("describe", err)
+		return &PipelineError{StatusCode: 500, Message: "Error describing source image", Err: err}
+	}
+
+	template := body.PromptTemplate
+	if template == "" {
+		template = defaultPromptTemplate
+	}
+	body.Prompt = strings.ReplaceAll(template, "{description}", description)
+	body.regeneration = &RegenerationReport{
+		SourceImageURL: body.SourceImageURL,
+		Description:    description,
+		DerivedPrompt:  body.Prompt,
+	}
+	return nil
+}
+
+// Caption an existing image with Ideogram's Describe API, without generating
+func handleDescribeRequest(ctx context.Context, request events.LambdaFunctionURLRequest, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	body, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	var describeRequest DescribeRequestBody
+	if err := json.Unmarshal(body, &describeRequest); err != nil || (describeRequest.ImageURL == "") == (describeRequest.ImageBase64 == "") {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: exactly one of image_url or image_base64 is required",
+		}, nil
+	}
+	var keysBody IdeogramRequestBody
+	selectProviderKeys(request, nil, &keysBody, summary)
+
+	stageStart := time.Now()
+	imageData, err := loadEditInput(ctx, describeRequest.ImageURL, describeRequest.ImageBase64, summary)
+	summary.recordStage("download", stageStart)
+	if err != nil {
+		summary.recordError("download", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Error loading image",
+		}, nil
+	}
+
+	stageStart = time.Now()
+	descriptions, err := describeImageAll(ctx, imageData, keysBody.providerKeys)
+	summary.recordStage("describe", stageStart)
+	if err != nil {
+		log.Println("Error describing image:", err)
+		summary.recordError("describe", err)
+		if throttleErr, ok := throttleFromError(err); ok {
+			return throttledResponse(throttleErr), nil
+		}
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error describing image",
+		}, nil
+	}
+
+	responseBody, err := json.Marshal(DescribeResponseBody{
+		Caption:      descriptions[0],
+		Descriptions: descriptions,
+	})
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Download failure reported by the server, e.g. an expired CDN link
+type DownloadStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *DownloadStatusError) Error() string {
+	return fmt.Sprintf("error fetching image: status %d", e.StatusCode)
+}
+
+// Report whether the download failed because the link is no longer valid, in
+// which case fetching it again cannot help
+func isExpiredLink(err error) bool {
+	var statusErr *DownloadStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// A generated image fetched from the provider, or why it could not be
+type GeneratedImage struct {
+	Data []byte
+	Err  error
+
+	// Position among the images the provider returned, unsafe ones included
+	Index int
+
+	// What the provider reported for the image
+	Prompt     string
+	Seed       int
+	StyleType  string
+	Resolution string
+}
+
+// Download every safe image concurrently; images returned inline are used as
+// they are. Images whose link already expired are regenerated once with a
+// fresh call to the provider.
+func fetchGeneratedImages(ctx context.Context, ideogramRequestBody IdeogramRequestBody, generated []Image, summary *InvocationSummary) []GeneratedImage {
+	images := downloadSafeImages(ctx, generated, summary)
+
+	expired := make([]int, 0)
+	for i, image := range images {
+		if image.Err != nil && isExpiredLink(image.Err) {
+			expired = append(expired, i)
+		}
+	}
+	if len(expired) == 0 {
+		return images
+	}
+
+	log.Printf("%d image links expired before download, regenerating them", len(expired))
+	summary.recordRetry("expired_links")
+	regenerateBody := ideogramRequestBody
+	count := len(expired)
+	regenerateBody.NumImages = &count
+	regenerated, err := generateImages(ctx, regenerateBody, summary)
+	if err != nil {
+		log.Println("Error regenerating expired images:", err)
+		return images
+	}
+
+	replacements := downloadSafeImages(ctx, regenerated, summary)
+	next := 0
+	for _, replacement := range replacements {
+		if replacement.Err != nil || next == len(expired) {
+			continue
+		}
+		// The replacement stands in for the expired image
+		replacement.Index = images[expired[next]].Index
+		images[expired[next]] = replacement
+		next++
+	}
+	return images
+}
+
+func downloadSafeImages(ctx context.Context, generated []Image, summary *InvocationSummary) []GeneratedImage {
+	images := make([]GeneratedImage, 0, len(generated))
+	urls := make([]string, 0, len(generated))
+	for i, data := range generated {
+		// Unsafe images come back without a usable URL
+		if data.IsImageSafe {
+			images = append(images, GeneratedImage{Index: i, Data: data.Data, Prompt: data.Prompt, Seed: data.Seed, StyleType: data.StyleType, Resolution: data.Resolution})
+			urls = append(urls, data.URL)
+		}
+	}
+
+	stageStart := time.Now()
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		if images[i].Data != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			data, err := downloadImageWithRetries(ctx, url, summary)
+			if err != nil {
+				log.Println("Error downloading image:", err)
+				summary.recordError("download", err)
+			}
+			summary.addDownloadedBytes(len(data))
+			images[i].Data = data
+			images[i].Err = err
+		}(i, url)
+	}
+	wg.Wait()
+	summary.recordStage("download", stageStart)
+	return images
+}
+
+// Download with up to IMAGE_RETRY_ATTEMPTS retries for transient failures,
+// giving up as soon as the context is cancelled
+func downloadImageWithRetries(ctx context.Context, url string, summary *InvocationSummary) ([]byte, error) {
+	return retryDownload(ctx, url, downloadImage, summary)
+}
+
+// Download an image from a URL the caller sent, with the same retries
+func fetchCallerImageWithRetries(ctx context.Context, url string, summary *InvocationSummary) ([]byte, error) {
+	return retryDownload(ctx, url, fetchCallerImage, summary)
+}
+
+func retryDownload(ctx context.Context, url string, download func(context.Context, string) ([]byte, error), summary *InvocationSummary) ([]byte, error) {
+	attempts := imageRetryAttempts() + 1
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			if err := sleepContext(ctx, time.Duration(attempt-1)*500*time.Millisecond); err != nil {
+				return nil, err
+			}
+			summary.recordRetry("download")
+		}
+		var data []byte
+		data, err = download(ctx, url)
+		if err == nil {
+			return data, nil
+		}
+		if isExpiredLink(err) || ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Key suffix of the unwatermarked image a draft is approved from
+const draftSourceSuffix = "-source"
+
+// Days a draft can be approved for, unless DRAFT_TTL_DAYS is set
+const defaultDraftTTLDays = 7
+
+// Time an approval keeps to release or complete its claim before the function
+// times out
+const approvalReserve = 15 * time.Second
+
+// Prefix for drafts and their records, meant to carry an S3 lifecycle rule
+// expiring them some time after DRAFT_TTL_DAYS
+func draftPrefix() string {
+	prefix := strings.Trim(os.Getenv("DRAFT_PREFIX"), "/")
+	if prefix == "" {
+		return "drafts"
+	}
+	return prefix
+}
+
+// A draft generation awaiting approval, stored as JSON under
+// <DRAFT_PREFIX>/<id>.json
+type Draft struct {
+	DraftID   string `json:"draft_id"`
+	CreatedAt string `json:"created_at"`
+	// Tenant whose defaults, including delivery, apply on approval
+	Tenant string `json:"tenant,omitempty"`
+	// The request as generated, processed again without the watermark
+	Request IdeogramRequestBody `json:"request"`
+	Images  []DraftImage        `json:"images"`
+	// Set once approved; the approval response is returned again on repeats
+	ApprovedAt string          `json:"approved_at,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+}
+
+// A drafted image and the unwatermarked source it is approved from
+type DraftImage struct {
+	// Final filename, rendered from the request's template
+	FileName   string `json:"filename"`
+	SourceKey  string `json:"source_key"`
+	Seed       int    `json:"seed"`
+	Resolution string `json:"resolution,omitempty"`
+	StyleType  string `json:"style_type,omitempty"`
+	Prompt     string `json:"prompt"`
+	// Position among the images generated for the draft, reported when its
+	// approval fails
+	Index int `json:"index"`
+}
+
+func draftTTL() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("DRAFT_TTL_DAYS"))
+	if err != nil || days <= 0 {
+		days = defaultDraftTTLDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Whether the draft is past DRAFT_TTL_DAYS and can no longer be approved
+func (draft Draft) expired(now time.Time) bool {
+	createdAt, err := time.Parse(time.RFC3339, draft.CreatedAt)
+	if err != nil {
+		return false
+	}
+	return now.After(createdAt.Add(draftTTL()))
+}
+
+func validateDraft(body IdeogramRequestBody) error {
+	if !body.Draft {
+		return nil
+	}
+	if len(body.Prompts) > 0 || len(body.CompareStyles) > 0 || len(body.CompareProviders) > 0 || body.ReuseIfExists {
+		return fmt.Errorf("draft cannot be combined with line-item prompts, compare_style_types, compare_providers or reuse_if_exists")
+	}
+	return nil
+}
+
+func draftKey(draftID string) string {
+	return draftPrefix() + "/" + draftID + ".json"
+}
+
+// Request for storing a watermarked draft under the draft prefix. Drafts stay
+// in our bucket and keep no pre-upscale original, which would be unmarked.
+func (body IdeogramRequestBody) forDraft() (IdeogramRequestBody, error) {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return body, err
+	}
+	body.Folder = draftPrefix() + "/" + settings.withFolder(body.Folder).Folder
+	body.delivery = nil
+	archiveOriginal := false
+	body.ArchiveOriginal = &archiveOriginal
+	return body, nil
+}
+
+// Store the generated image as it came from Ideogram next to the draft, and
+// return the key approval reads it back from
+func storeDraftSource(draftBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) (string, error) {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return "", err
+	}
+	options := UploadOptions{Folder: draftBody.Folder}
+	_, err = uploadImageToS3(imageData, draftBody.FileName+draftSourceSuffix, options, summary)
+	if err != nil {
+		summary.recordError("s3_upload", err)
+		return "", err
+	}
+	summary.addUploadedBytes(uploadDestination(options), len(imageData))
+	return settings.withFolder(draftBody.Folder).imageKey(draftBody.FileName+draftSourceSuffix, ""), nil
+}
+
+func saveDraft(draft Draft) error {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return err
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return err
+	}
+	// Caller keys are not stored; the approver sends their own
+	draft.Request.IdeogramAPIKey = ""
+	draft.Request.FreepikAPIKey = ""
+	payload, err := json.Marshal(draft)
+	if err != nil {
+		return err
+	}
+	_, err = s3Svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(settings.Bucket),
+		Key:         aws.String(draftKey(draft.DraftID)),
+		Body:        bytes.NewReader(payload),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save draft %s: %v", draft.DraftID, err)
+	}
+	return nil
+}
+
+func loadDraft(draftID string) (Draft, error) {
+	var draft Draft
+	settings, err := loadS3Settings()
+	if err != nil {
+		return draft, err
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return draft, err
+	}
+	payload, err := readS3Object(s3Svc, settings.Bucket, draftKey(draftID))
+	if err != nil {
+		return draft, fmt.Errorf("failed to load draft %s: %v", draftID, err)
+	}
+	err = json.Unmarshal(payload, &draft)
+	return draft, err
+}
+
+// Process the draft's images again without the watermark and store them at
+// their permanent location. The draft is claimed before anything is
+// delivered, so only one approval runs at a time. Approving twice returns the
+// first approval.
+func handleApproveRequest(ctx context.Context, request events.LambdaFunctionURLRequest, draftID string, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	if !jobIDPattern.MatchString(draftID) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: invalid draft ID",
+		}, nil
+	}
+	if approvalsTable() == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 501,
+			Body:       "Approvals are not enabled: APPROVALS_TABLE is not set",
+		}, nil
+	}
+	draft, err := loadDraft(draftID)
+	if err != nil {
+		log.Println("Error loading draft:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Draft not found",
+		}, nil
+	}
+	if rejection := authorizeDraftChange(request, draft, summary); rejection != nil {
+		return *rejection, nil
+	}
+	if draft.ApprovedAt != "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       string(draft.Result),
+		}, nil
+	}
+	if draft.expired(time.Now()) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 410,
+			Body:       "Gone: the draft expired",
+		}, nil
+	}
+
+	body := draft.Request
+	body.Draft = false
+	// The brand kit's logo and watermark are not stored with the draft, so
+	// load it again before the tenant's defaults, as for a new request
+	if err := applyBrandKit(draft.Tenant, &body); err != nil {
+		log.Println("Error applying brand kit:", err)
+		summary.recordError("brand", err)
+		return *brandErrorResponse(err), nil
+	}
+	if draft.Tenant != "" {
+		if err := applyTenantDefaults(draft.Tenant, &body); err != nil {
+			log.Println("Error loading tenant defaults:", err)
+			summary.recordError("tenant_defaults", err)
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Body:       "Internal Server Error",
+			}, nil
+		}
+	}
+	selectProviderKeys(request, nil, &body, summary)
+
+	settings, err := loadS3Settings()
+	var s3Svc *s3.S3
+	if err == nil {
+		s3Svc, err = newS3Client(settings)
+	}
+	if err != nil {
+		log.Println("Error creating S3 client:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+
+	actor := approvalActor(request, summary.identity)
+	claimID := summary.invocationID
+	if claimID == "" {
+		claimID = summary.RequestID
+	}
+	err = claimApproval(draft, claimID, actor, summary.remainingTime())
+	if errors.Is(err, errApprovalNotPending) {
+		return approvalConflictResponse(draftID), nil
+	}
+	if err != nil {
+		log.Println("Error claiming approval:", err)
+		summary.recordError("approval", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+
+	// Images still processing near the timeout fail, and the claim is
+	// released for the approval to be retried
+	if !summary.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, summary.deadline.Add(-approvalReserve))
+		defer cancel()
+	}
+	responseBody := LambdaResponseBody{ImageURLs: make([]string, 0)}
+	var lastErr error
+	for _, drafted := range draft.Images {
+		imageData, err := readS3Object(s3Svc, settings.Bucket, drafted.SourceKey)
+		if err == nil {
+			imageBody := body
+			imageBody.FileName = drafted.FileName
+			var processed ProcessedImage
+			processed, err = processImageWithRetries(ctx, imageBody, imageData, summary)
+			if err == nil {
+				responseBody.ImageURLs = append(responseBody.ImageURLs, processed.URL)
+				responseBody.Seeds = append(responseBody.Seeds, drafted.Seed)
+				responseBody.ImageMetadata = append(responseBody.ImageMetadata, ImageMetadata{
+					URL:         processed.URL,
+					Seed:        drafted.Seed,
+					Resolution:  drafted.Resolution,
+					StyleType:   drafted.StyleType,
+					IsImageSafe: true,
+					Prompt:      drafted.Prompt,
+				})
+				if processed.WebURL != "" {
+					responseBody.WebImageURLs = append(responseBody.WebImageURLs, processed.WebURL)
+				}
+				if processed.OriginalURL != "" {
+					responseBody.OriginalImageURLs = append(responseBody.OriginalImageURLs, processed.OriginalURL)
+				}
+				continue
+			}
+		}
+		log.Println("Error approving draft image:", err)
+		responseBody.FailedImages = append(responseBody.FailedImages, ImageFailure{Index: drafted.Index, Error: err.Error()})
+		lastErr = err
+	}
+	// Partial approvals go back to pending to be retried; only a complete
+	// one is final
+	if len(responseBody.FailedImages) > 0 {
+		if err := releaseApproval(draft, claimID); err != nil {
+			log.Println("Error releasing approval:", err)
+			summary.recordError("approval", err)
+		}
+	}
+	if len(responseBody.ImageURLs) == 0 && lastErr != nil {
+		return pipelineErrorResponse(lastErr, body.Folder, body.FileName), nil
+	}
+	summary.reportRetries(&responseBody)
+	response := buildSuccessResponse(responseBody)
+
+	if len(responseBody.FailedImages) == 0 {
+		if _, err := completeApproval(draft, claimID, actor, responseBody.ImageURLs); err != nil {
+			log.Println("Error recording approval:", err)
+			summary.recordError("approval", err)
+		}
+		draft.ApprovedAt = time.Now().UTC().Format(time.RFC3339)
+		draft.Result = json.RawMessage(response.Body)
+		if err := saveDraft(draft); err != nil {
+			log.Println("Error recording draft approval:", err)
+			summary.recordError("draft", err)
+		}
+	}
+	return response, nil
+}
+
+// Why a draft could not be claimed for approval
+func approvalConflictResponse(draftID string) events.LambdaFunctionURLResponse {
+	message := "Conflict: the draft was already approved or rejected"
+	approval, err := loadApproval(draftID)
+	if err != nil {
+		log.Println("Error loading approval:", err)
+	} else if approval != nil {
+		switch approval.State {
+		case approvalRejected:
+			message = "Conflict: the draft was rejected"
+		case approvalApproving:
+			message = "Conflict: the draft is being approved"
+		}
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 409,
+		Body:       message,
+	}
+}
+
+// 5x7 glyphs of the watermark text
+var draftGlyphs = map[rune][7]string{
+	'D': {"11110", "10001", "10001", "10001", "10001", "10001", "11110"},
+	'R': {"11110", "10001", "10001", "11110", "10100", "10010", "10001"},
+	'A': {"01110", "10001", "10001", "11111", "10001", "10001", "10001"},
+	'F': {"11111", "10000", "10000", "11110", "10000", "10000", "10000"},
+	'T': {"11111", "00100", "00100", "00100", "00100", "00100", "00100"},
+}
+
+// Mid-grey at half opacity stays readable on light and dark images alike
+var draftWatermarkColor = color.NRGBA{R: 128, G: 128, B: 128, A: 128}
+
+func watermarkStep(ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) ([]byte, error) {
+	stageStart := time.Now()
+	watermarked, err := stampDraftWatermark(imageData)
+	summary.recordStage("watermark", stageStart)
+	if err != nil {
+		log.Println("Error stamping draft watermark:", err)
+		summary.recordError("watermark", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error stamping draft watermark", Err: err}
+	}
+	return watermarked, nil
+}
+
+// Stamp "DRAFT" across the image three times, at a quarter, half and three
+// quarters of its height, so cropping cannot remove it
+func stampDraftWatermark(imageData []byte) ([]byte, error) {
+	src, err := png.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	bounds := src.Bounds()
+	canvas := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(canvas, canvas.Rect, src, bounds.Min, draw.Src)
+
+	text := "DRAFT"
+	// Five columns per glyph plus a column between glyphs
+	columns := len(text)*6 - 1
+	cell := canvas.Rect.Dx() * 3 / 5 / columns
+	if cell < 1 {
+		cell = 1
+	}
+	left := (canvas.Rect.Dx() - columns*cell) / 2
+	ink := image.NewUniform(draftWatermarkColor)
+	for _, band := range []int{1, 2, 3} {
+		top := canvas.Rect.Dy()*band/4 - 7*cell/2
+		for i, letter := range text {
+			for row, line := range draftGlyphs[letter] {
+				for column, bit := range line {
+					if bit != '1' {
+						continue
+					}
+					x := left + (i*6+column)*cell
+					y := top + row*cell
+					draw.Draw(canvas, image.Rect(x, y, x+cell, y+cell), ink, image.Point{}, draw.Over)
+				}
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := png.Encode(&out, canvas); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %v", err)
+	}
+	return out.Bytes(), nil
+}
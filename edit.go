@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Source image and mask for Ideogram's edit (inpainting) endpoint, each given
+// as a URL or base64. The mask must match the image's size; black areas are
+// redrawn from the prompt and white areas are kept.
+type EditRequest struct {
+	ImageURL    string `json:"image_url,omitempty"`
+	ImageBase64 string `json:"image_base64,omitempty"`
+	MaskURL     string `json:"mask_url,omitempty"`
+	MaskBase64  string `json:"mask_base64,omitempty"`
+}
+
+func (edit EditRequest) validate() error {
+	if (edit.ImageURL == "") == (edit.ImageBase64 == "") {
+		return fmt.Errorf("edit needs exactly one of image_url and image_base64")
+	}
+	if (edit.MaskURL == "") == (edit.MaskBase64 == "") {
+		return fmt.Errorf("edit needs exactly one of mask_url and mask_base64")
+	}
+	return nil
+}
+
+// Fetch an edit input from its https URL, or decode it from base64. Data URIs
+// such as "data:image/png;base64,..." are accepted too.
+func loadEditInput(ctx context.Context, url string, encoded string, summary *InvocationSummary) ([]byte, error) {
+	if url != "" {
+		data, err := fetchCallerImageWithRetries(ctx, url, summary)
+		summary.addDownloadedBytes(len(data))
+		return data, err
+	}
+	if _, data, ok := strings.Cut(encoded, ";base64,"); ok {
+		encoded = data
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+}
+
+// Edit the source image with Ideogram. The response has the same shape as a
+// generation, so the rest of the pipeline treats edited images like new ones.
+func sendEditRequestToIdeogram(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) (string, error) {
+	api_key := body.providerKeys.ideogramAPIKey()
+
+	if api_key == "" {
+		return "", fmt.Errorf("API_KEY is not set")
+	}
+	if summary.injectFault(faultIdeogram429) {
+		return "", injectedIdeogramThrottle()
+	}
+
+	image, err := loadEditInput(ctx, body.Edit.ImageURL, body.Edit.ImageBase64, summary)
+	if err != nil {
+		return "", fmt.Errorf("error loading edit image: %v", err)
+	}
+	mask, err := loadEditInput(ctx, body.Edit.MaskURL, body.Edit.MaskBase64, summary)
+	if err != nil {
+		return "", fmt.Errorf("error loading edit mask: %v", err)
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for _, file := range []struct {
+		field string
+		data  []byte
+	}{{"image", image}, {"mask", mask}} {
+		part, err := writer.CreateFormFile(file.field, file.field+".png")
+		if err != nil {
+			return "", fmt.Errorf("error creating form file: %v", err)
+		}
+		part.Write(file.data)
+	}
+	writer.WriteField("prompt", body.Prompt)
+	if body.NumImages != nil {
+		writer.WriteField("num_images", fmt.Sprintf("%d", *body.NumImages))
+	}
+	if body.StyleType != nil {
+		writer.WriteField("style_type", string(*body.StyleType))
+	}
+	if body.RenderingSpeed != nil {
+		writer.WriteField("rendering_speed", string(*body.RenderingSpeed))
+	}
+	if body.MagicPrompt != nil {
+		writer.WriteField("magic_prompt", *body.MagicPrompt)
+	}
+	writeSeed(writer, body.Seed)
+	writeStyleCodes(writer, body.StyleCodes)
+	writeColourPalette(writer, body.ColourPalette)
+	writer.Close()
+
+	req, err := newProviderRequest(ctx, "POST", "https://api.ideogram.ai/v1/ideogram-v3/edit", &buf)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Api-Key", api_key)
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := new(bytes.Buffer)
+	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return "", &ProviderError{Provider: "ideogram", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return respBody.String(), nil
+}
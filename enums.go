@@ -0,0 +1,13 @@
+package main
+
+import "github.com/poulav/ideogram-golang-lambda/enums"
+
+// The enum-valued request fields come from the enums package, which the Go
+// client SDK imports too
+type (
+	StyleType      = enums.StyleType
+	Resolution     = enums.Resolution
+	AspectRatio    = enums.AspectRatio
+	RenderingSpeed = enums.RenderingSpeed
+	EnumError      = enums.EnumError
+)
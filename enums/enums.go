@@ -0,0 +1,186 @@
+// Package enums holds the enum-valued fields of a generation request and the
+// values Ideogram accepts for them. The function and the Go client SDK both
+// import it, so they normalize and check the fields the same way.
+package enums
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Enum-valued request fields. They unmarshal leniently, in any case and with
+// "16:9" for "16x9", into the value Ideogram expects. Style types,
+// resolutions and rendering speeds reject anything else with the allowed
+// values, so a typo fails before reaching a provider. Aspect ratios only
+// need to be well formed when decoded, since each provider takes its own.
+type (
+	StyleType      string
+	Resolution     string
+	AspectRatio    string
+	RenderingSpeed string
+)
+
+// Values accepted by the Ideogram v3 generate endpoint
+var (
+	StyleTypes = []string{"AUTO", "GENERAL", "REALISTIC", "DESIGN"}
+
+	RenderingSpeeds = []string{"TURBO", "DEFAULT", "QUALITY"}
+
+	AspectRatios = []string{
+		"1x3", "3x1", "1x2", "2x1", "9x16", "16x9", "10x16", "16x10",
+		"2x3", "3x2", "3x4", "4x3", "4x5", "5x4", "1x1",
+	}
+
+	Resolutions = []string{
+		"512x1536", "576x1408", "576x1472", "576x1536", "640x1344", "640x1408",
+		"640x1472", "640x1536", "704x1152", "704x1216", "704x1280", "704x1344",
+		"704x1408", "704x1472", "736x1312", "768x1088", "768x1216", "768x1280",
+		"768x1344", "800x1280", "832x960", "832x1024", "832x1088", "832x1152",
+		"832x1216", "832x1248", "864x1152", "896x960", "896x1024", "896x1088",
+		"896x1120", "896x1152", "960x832", "960x896", "960x1024", "960x1088",
+		"1024x832", "1024x896", "1024x960", "1024x1024", "1088x768", "1088x832",
+		"1088x896", "1088x960", "1120x896", "1152x704", "1152x832", "1152x864",
+		"1152x896", "1216x704", "1216x768", "1216x832", "1248x832", "1280x704",
+		"1280x768", "1280x800", "1312x736", "1344x640", "1344x704", "1344x768",
+		"1408x576", "1408x640", "1408x704", "1472x576", "1472x640", "1472x704",
+		"1536x512", "1536x576", "1536x640",
+	}
+)
+
+// Width and height in whole numbers, as in "16x9"
+var aspectRatioPattern = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+
+// An enum field set to a value outside its allowed values, or, for aspect
+// ratios, not in the expected format
+type EnumError struct {
+	Field   string
+	Value   string
+	Allowed []string
+	Format  string
+}
+
+func (e *EnumError) Error() string {
+	if e.Format != "" {
+		return fmt.Sprintf("malformed %s %q, expected %s", e.Field, e.Value, e.Format)
+	}
+	return fmt.Sprintf("unsupported %s %q, expected one of %s", e.Field, e.Value, strings.Join(e.Allowed, ", "))
+}
+
+func checkEnum(field string, value string, allowed []string) error {
+	for _, candidate := range allowed {
+		if candidate == value {
+			return nil
+		}
+	}
+	return &EnumError{Field: field, Value: value, Allowed: allowed}
+}
+
+// Decode a JSON string into an enum field, normalized and checked
+func unmarshalEnum(data []byte, field string, normalize func(string) string, check func(string) error) (string, error) {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return "", &EnumError{Field: field, Value: string(data), Format: "a string"}
+	}
+	value = normalize(value)
+	return value, check(value)
+}
+
+func normalizeUpper(value string) string {
+	return strings.ToUpper(strings.TrimSpace(value))
+}
+
+func (s StyleType) Normalize() StyleType {
+	return StyleType(normalizeUpper(string(s)))
+}
+
+func (s StyleType) Validate() error {
+	return checkEnum("style_type", string(s), StyleTypes)
+}
+
+func (s *StyleType) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum(data, "style_type", normalizeUpper, func(value string) error {
+		return StyleType(value).Validate()
+	})
+	if err != nil {
+		return err
+	}
+	*s = StyleType(value)
+	return nil
+}
+
+func (r Resolution) Normalize() Resolution {
+	return Resolution(strings.ToLower(strings.TrimSpace(string(r))))
+}
+
+func (r Resolution) Validate() error {
+	return checkEnum("resolution", string(r), Resolutions)
+}
+
+func (r *Resolution) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum(data, "resolution", func(value string) string {
+		return string(Resolution(value).Normalize())
+	}, func(value string) error {
+		return Resolution(value).Validate()
+	})
+	if err != nil {
+		return err
+	}
+	*r = Resolution(value)
+	return nil
+}
+
+func (a AspectRatio) Normalize() AspectRatio {
+	return AspectRatio(strings.ReplaceAll(strings.TrimSpace(string(a)), ":", "x"))
+}
+
+// Check the ratio is one Ideogram takes. Other providers check their own.
+func (a AspectRatio) Validate() error {
+	return checkEnum("aspect_ratio", string(a), AspectRatios)
+}
+
+// Check the ratio is written as width x height, whichever provider takes it
+func (a AspectRatio) CheckFormat() error {
+	if !aspectRatioPattern.MatchString(string(a)) {
+		return &EnumError{Field: "aspect_ratio", Value: string(a), Format: "width x height, e.g. 16x9"}
+	}
+	return nil
+}
+
+func (a *AspectRatio) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum(data, "aspect_ratio", func(value string) string {
+		return string(AspectRatio(value).Normalize())
+	}, func(value string) error {
+		return AspectRatio(value).CheckFormat()
+	})
+	if err != nil {
+		return err
+	}
+	*a = AspectRatio(value)
+	return nil
+}
+
+// The ratio with a colon, as most other providers write it
+func (a AspectRatio) Colon() string {
+	return strings.ReplaceAll(string(a), "x", ":")
+}
+
+func (r RenderingSpeed) Normalize() RenderingSpeed {
+	return RenderingSpeed(normalizeUpper(string(r)))
+}
+
+func (r RenderingSpeed) Validate() error {
+	return checkEnum("rendering_speed", string(r), RenderingSpeeds)
+}
+
+func (r *RenderingSpeed) UnmarshalJSON(data []byte) error {
+	value, err := unmarshalEnum(data, "rendering_speed", normalizeUpper, func(value string) error {
+		return RenderingSpeed(value).Validate()
+	})
+	if err != nil {
+		return err
+	}
+	*r = RenderingSpeed(value)
+	return nil
+}
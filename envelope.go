@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Header opting a caller into the response envelope
+const responseEnvelopeHeader = "x-response-envelope"
+
+// A response wrapped with links to related resources and metadata, so
+// clients can follow jobs, galleries and retries without building URLs
+type ResponseEnvelope struct {
+	// The unwrapped response body
+	Data json.RawMessage `json:"data,omitempty"`
+	// Plain-text error bodies, e.g. "Bad Request: ..."
+	Error string            `json:"error,omitempty"`
+	Links map[string]string `json:"links"`
+	Meta  EnvelopeMeta      `json:"meta"`
+}
+
+type EnvelopeMeta struct {
+	// Function version that served the request
+	Version    string `json:"version"`
+	RequestID  string `json:"request_id"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Existing clients read the bare body, so the envelope is opt-in per request
+// with X-Response-Envelope, or for every caller with RESPONSE_ENVELOPE=true
+func wantsEnvelope(request events.LambdaFunctionURLRequest) bool {
+	value := headerValue(request.Headers, responseEnvelopeHeader)
+	if value == "" {
+		value = os.Getenv("RESPONSE_ENVELOPE")
+	}
+	return strings.EqualFold(value, "true") || value == "1"
+}
+
+// Wrap a JSON or plain-text error response in the envelope. Redirects, HTML
+// pages, binary and empty bodies (e.g. 304s) are passed through unchanged.
+func wrapInEnvelope(request events.LambdaFunctionURLRequest, response events.LambdaFunctionURLResponse, summary *InvocationSummary) events.LambdaFunctionURLResponse {
+	if !wantsEnvelope(request) || response.Body == "" || response.IsBase64Encoded {
+		return response
+	}
+	envelope := ResponseEnvelope{
+		Links: responseLinks(request, response),
+		Meta: EnvelopeMeta{
+			Version:    os.Getenv("AWS_LAMBDA_FUNCTION_VERSION"),
+			RequestID:  summary.RequestID,
+			DurationMs: summary.elapsedMs(),
+		},
+	}
+	switch {
+	case json.Valid([]byte(response.Body)):
+		envelope.Data = json.RawMessage(response.Body)
+	case response.StatusCode >= 400:
+		envelope.Error = response.Body
+	default:
+		return response
+	}
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return response
+	}
+
+	headers := make(map[string]string, len(response.Headers)+1)
+	for name, value := range response.Headers {
+		headers[name] = value
+	}
+	headers["Content-Type"] = "application/json"
+	response.Headers = headers
+	response.Body = string(body)
+	return response
+}
+
+// Links to what the response refers to, read from its body and headers
+func responseLinks(request events.LambdaFunctionURLRequest, response events.LambdaFunctionURLResponse) map[string]string {
+	self := request.RawPath
+	if request.RawQueryString != "" {
+		self += "?" + request.RawQueryString
+	}
+	links := map[string]string{"self": self}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(response.Body), &fields) == nil {
+		field := func(name string) string {
+			var value string
+			json.Unmarshal(fields[name], &value)
+			return value
+		}
+		if statusURL := field("status_url"); statusURL != "" {
+			links["job"] = statusURL
+		}
+		if galleryURL := field("gallery_url"); galleryURL != "" {
+			links["gallery"] = galleryURL
+		}
+		if approveURL := field("approve_url"); approveURL != "" {
+			links["approve"] = approveURL
+		}
+		if draftID := field("draft_id"); draftID != "" {
+			links["approval"] = "/approvals/" + draftID
+		}
+		// Exports answer with the manifest they wrote
+		if strings.TrimSuffix(request.RawPath, "/") == "/exports" && field("url") != "" {
+			links["manifest"] = field("url")
+		}
+	}
+	if location := headerValue(response.Headers, "Location"); location != "" && links["job"] == "" {
+		links["status"] = location
+	}
+
+	// Throttled and failed calls can be sent again as they were
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		links["retry"] = self
+	}
+	return links
+}
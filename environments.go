@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Settings for one deployment stage (dev, staging, prod), configured as a JSON
+// map in the ENVIRONMENTS variable, e.g.
+// {"dev": {"folder_prefix": "dev", "api_key": "...", "notification_url": "..."}}
+type EnvironmentConfig struct {
+	// Prepended to the folder, keeping each stage's assets apart
+	FolderPrefix string `json:"folder_prefix,omitempty"`
+	// Provider keys replacing API_KEY and FREEPIK_API_KEY
+	IdeogramAPIKey string `json:"api_key,omitempty"`
+	FreepikAPIKey  string `json:"freepik_api_key,omitempty"`
+	// Receives the result of every generation request in this stage
+	NotificationURL string `json:"notification_url,omitempty"`
+}
+
+// Provider keys a request runs with, chosen by selectProviderKeys and carried
+// on the request body. Empty keys fall back to IDEOGRAM_API_KEY (or API_KEY)
+// and FREEPIK_API_KEY.
+type ProviderKeys struct {
+	Ideogram string
+	Freepik  string
+}
+
+// Look up the requested environment, falling back to DEFAULT_ENVIRONMENT.
+// Returns nil when no environment applies.
+func loadEnvironmentConfig(name string) (*EnvironmentConfig, error) {
+	if name == "" {
+		name = os.Getenv("DEFAULT_ENVIRONMENT")
+	}
+	if name == "" {
+		return nil, nil
+	}
+
+	environments, err := loadEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	config, ok := environments[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown environment %q", name)
+	}
+	return &config, nil
+}
+
+func loadEnvironments() (map[string]EnvironmentConfig, error) {
+	var environments map[string]EnvironmentConfig
+	if raw := os.Getenv("ENVIRONMENTS"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &environments); err != nil {
+			return nil, fmt.Errorf("ENVIRONMENTS is not valid JSON: %v", err)
+		}
+	}
+	return environments, nil
+}
+
+// Point the request at the environment's folder
+func applyEnvironment(config *EnvironmentConfig, body *IdeogramRequestBody) error {
+	if config == nil || config.FolderPrefix == "" {
+		return nil
+	}
+	settings, err := loadS3Settings()
+	if err != nil {
+		return err
+	}
+	body.Folder = config.FolderPrefix + "/" + settings.withFolder(body.Folder).Folder
+	return nil
+}
+
+// Ideogram API key to call with
+func (keys ProviderKeys) ideogramAPIKey() string {
+	if keys.Ideogram != "" {
+		return keys.Ideogram
+	}
+	return providerCredential("ideogram")
+}
+
+// Freepik API key to call with
+func (keys ProviderKeys) freepikAPIKey() string {
+	if keys.Freepik != "" {
+		return keys.Freepik
+	}
+	return os.Getenv("FREEPIK_API_KEY")
+}
+
+// Post the outcome of a generation request to the environment's notification
+// target. Failures are logged and never affect the response.
+func notifyEnvironment(config *EnvironmentConfig, summary *InvocationSummary, response events.LambdaFunctionURLResponse) {
+	if config == nil || config.NotificationURL == "" {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"environment": summary.Environment,
+		"request_id":  summary.RequestID,
+		"status_code": response.StatusCode,
+		"body":        json.RawMessage(notificationBody(response.Body)),
+	})
+	if err != nil {
+		log.Println("Error marshalling notification:", err)
+		return
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Post(config.NotificationURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Println("Error sending notification:", err)
+		summary.recordError("notify", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		log.Printf("Notification target responded with status %d", resp.StatusCode)
+	}
+}
+
+// Embed JSON bodies as-is and wrap plain text error bodies in a JSON string
+func notificationBody(body string) []byte {
+	if json.Valid([]byte(body)) {
+		return []byte(body)
+	}
+	quoted, _ := json.Marshal(body)
+	return quoted
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Longest date range one export may cover, so it finishes within the timeout
+const maxExportDays = 92
+
+// Concurrent audit record reads while building an export
+const exportReadWorkers = 16
+
+// Where manifests are written in the image bucket. They are ad hoc copies of
+// the audit log, so they stay out of its Object Lock retention and the
+// bucket's lifecycle rule expires them after a week.
+const exportsPrefix = "exports"
+
+type ExportRequestBody struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Format string `json:"format,omitempty"`
+	Tenant string `json:"tenant,omitempty"`
+}
+
+type ExportResponseBody struct {
+	Key         string `json:"key"`
+	URL         string `json:"url"`
+	Generations int    `json:"generations"`
+}
+
+// Estimated provider cost of a request in USD: the images each provider
+// generated and each background remover cut out, at that service's price per
+// image
+func estimateCost(summary *InvocationSummary) float64 {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	cost := 0.0
+	for provider, count := range summary.generatedBy {
+		cost += float64(count) * costPerImage(provider)
+	}
+	for remover, count := range summary.removedBy {
+		cost += float64(count) * costPerImage(remover)
+	}
+	return cost
+}
+
+// Price per image of a provider or background remover from
+// <NAME>_COST_PER_IMAGE, e.g. STABILITY_COST_PER_IMAGE or
+// REMOVEBG_COST_PER_IMAGE. Services without a price cost nothing.
+func costPerImage(service string) float64 {
+	price, _ := strconv.ParseFloat(os.Getenv(strings.ToUpper(service)+"_COST_PER_IMAGE"), 64)
+	return price
+}
+
+// POST /exports writes a CSV or JSON manifest of every generation in a date
+// range to the image bucket, for chargeback and licensing reviews
+func handleExportRequest(request events.LambdaFunctionURLRequest, tenant string, identity *CallerIdentity) (events.LambdaFunctionURLResponse, error) {
+	if !isAdminRequest(request, identity) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 403,
+			Body:       "Forbidden: exports require the admin API key",
+		}, nil
+	}
+	bucket, prefix := auditLocation()
+	if bucket == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Audit log is not configured",
+		}, nil
+	}
+
+	body, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	var exportRequest ExportRequestBody
+	if err := json.Unmarshal(body, &exportRequest); err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request",
+		}, nil
+	}
+	from, fromErr := time.Parse("2006-01-02", exportRequest.From)
+	to, toErr := time.Parse("2006-01-02", exportRequest.To)
+	if fromErr != nil || toErr != nil || to.Before(from) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: from and to must be dates formatted as YYYY-MM-DD, from not after to",
+		}, nil
+	}
+	if days := int(to.Sub(from).Hours()/24) + 1; days > maxExportDays {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Bad Request: exports cover at most %d days, got %d", maxExportDays, days),
+		}, nil
+	}
+	// Tenant admins export their own tenant's generations only
+	if tenant != "" {
+		if exportRequest.Tenant != "" && exportRequest.Tenant != tenant {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 403,
+				Body:       "Forbidden: exports are limited to the caller's tenant",
+			}, nil
+		}
+		exportRequest.Tenant = tenant
+	}
+	format := strings.ToLower(exportRequest.Format)
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: format must be csv or json",
+		}, nil
+	}
+
+	s3Svc, err := newAuditS3Client()
+	if err != nil {
+		log.Println("Error reading audit log:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	records, err := collectGenerations(s3Svc, bucket, prefix, from, to, exportRequest.Tenant)
+	if err != nil {
+		log.Println("Error collecting audit records:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+
+	var manifest []byte
+	contentType := "text/csv"
+	if format == "json" {
+		contentType = "application/json"
+		manifest, err = json.Marshal(records)
+	} else {
+		manifest, err = exportCSV(records)
+	}
+	if err != nil {
+		log.Println("Error encoding export manifest:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+
+	settings, err := loadS3Settings()
+	if err != nil {
+		log.Println("Error loading S3 settings:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	imageSvc, err := newS3Client(settings)
+	if err != nil {
+		log.Println("Error creating S3 client:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	key := fmt.Sprintf("%s/%s_%s-%d.%s", exportsPrefix, exportRequest.From, exportRequest.To, time.Now().Unix(), format)
+	_, err = imageSvc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(settings.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(manifest),
+		ContentType: aws.String(contentType),
+		ContentMD5:  contentMD5(manifest),
+	})
+	if err != nil {
+		log.Println("Error uploading export manifest:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error uploading export",
+		}, nil
+	}
+	req, _ := imageSvc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(settings.Bucket),
+		Key:    aws.String(key),
+	})
+	url, err := req.Presign(defaultShareLinkExpiry())
+	if err != nil {
+		log.Println("Error presigning export URL:", err)
+	}
+
+	responseBody, err := json.Marshal(ExportResponseBody{Key: key, URL: url, Generations: len(records)})
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Read the audit records of every day in the range and keep the generations,
+// oldest first
+func collectGenerations(s3Svc *s3.S3, bucket string, prefix string, from time.Time, to time.Time, tenant string) ([]AuditRecord, error) {
+	keys := make([]string, 0)
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		err := s3Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix + "/" + day.Format("2006/01/02") + "/"),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list audit records for %s: %v", day.Format("2006-01-02"), err)
+		}
+	}
+
+	records := make([]AuditRecord, len(keys))
+	found := make([]bool, len(keys))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < exportReadWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				record, err := readAuditRecord(s3Svc, bucket, keys[i])
+				if err != nil {
+					log.Println("Error reading audit record:", err)
+					continue
+				}
+				records[i], found[i] = record, true
+			}
+		}()
+	}
+	for i := range keys {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	generations := make([]AuditRecord, 0, len(records))
+	for i, record := range records {
+		if !found[i] || (record.ImagesGenerated == 0 && len(record.Assets) == 0) {
+			continue
+		}
+		if tenant != "" && record.Tenant != tenant {
+			continue
+		}
+		generations = append(generations, record)
+	}
+	// RFC3339Nano drops trailing zeros, so compare parsed times, not strings
+	sort.SliceStable(generations, func(i, j int) bool {
+		ti, _ := time.Parse(time.RFC3339Nano, generations[i].Timestamp)
+		tj, _ := time.Parse(time.RFC3339Nano, generations[j].Timestamp)
+		return ti.Before(tj)
+	})
+	return generations, nil
+}
+
+func exportCSV(records []AuditRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{"request_id", "timestamp", "tenant", "status_code", "prompts", "image_urls", "images_generated", "images_delivered", "estimated_cost_usd"})
+	for _, record := range records {
+		writer.Write([]string{
+			record.RequestID,
+			record.Timestamp,
+			record.Tenant,
+			strconv.Itoa(record.StatusCode),
+			strings.Join(record.Prompts, " | "),
+			strings.Join(record.Assets, " "),
+			strconv.Itoa(record.ImagesGenerated),
+			strconv.Itoa(record.ImagesDelivered),
+			strconv.FormatFloat(record.EstimatedCostUSD, 'f', 4, 64),
+		})
+	}
+	writer.Flush()
+	return buf.Bytes(), writer.Error()
+}
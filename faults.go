@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Header listing faults to inject, honored only when FAULT_INJECTION=on.
+// Never enable it in production.
+const faultInjectionHeader = "x-fault-injection"
+
+// Injectable faults
+const (
+	faultIdeogram429    = "ideogram_429"
+	faultFreepikTimeout = "freepik_timeout"
+	faultS3Failure      = "s3_fail"
+)
+
+// Faults injected into one invocation, kept on its summary. A fault with a
+// target call fires on that call only; without one it fires on every call.
+type faultPlan struct {
+	mu      sync.Mutex
+	targets map[string]int
+	calls   map[string]int
+}
+
+// Parse the fault header, e.g. "ideogram_429,s3_fail@3", where @3 makes the
+// third S3 upload of the invocation fail
+func parseFaults(request events.LambdaFunctionURLRequest) *faultPlan {
+	targets := map[string]int{}
+	if os.Getenv("FAULT_INJECTION") == "on" {
+		for _, entry := range strings.Split(headerValue(request.Headers, faultInjectionHeader), ",") {
+			name, target, _ := strings.Cut(strings.TrimSpace(entry), "@")
+			if name == "" {
+				continue
+			}
+			call, _ := strconv.Atoi(target)
+			targets[name] = call
+		}
+		if len(targets) > 0 {
+			log.Println("Fault injection active:", targets)
+		}
+	}
+
+	return &faultPlan{targets: targets, calls: map[string]int{}}
+}
+
+// Count a call of the invocation that the fault can affect and report whether
+// it should fail
+func (summary *InvocationSummary) injectFault(name string) bool {
+	faults := summary.faults
+	faults.mu.Lock()
+	defer faults.mu.Unlock()
+	target, ok := faults.targets[name]
+	if !ok {
+		return false
+	}
+	faults.calls[name]++
+	if target > 0 && faults.calls[name] != target {
+		return false
+	}
+	log.Printf("Injecting fault %s on call %d", name, faults.calls[name])
+	return true
+}
+
+// Errors shaped like the real failures, so retries and partial-failure
+// handling see what they would see in an outage
+func injectedIdeogramThrottle() error {
+	return &ProviderError{Provider: "ideogram", StatusCode: 429, Body: "injected fault: rate limited", RetryAfter: 5 * time.Second}
+}
+
+func injectedFreepikTimeout() error {
+	return fmt.Errorf("error sending request to Freepik: injected fault: context deadline exceeded (Client.Timeout exceeded while awaiting headers)")
+}
+
+func injectedS3Failure() error {
+	return fmt.Errorf("failed to upload image: injected fault: InternalError: We encountered an internal error. Please try again.")
+}
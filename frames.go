@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Brand frame template, stored as <prefix>/<name>/template.json in the image
+// bucket. Image paths are relative to the template's folder.
+type FrameTemplate struct {
+	// Size of the finished asset
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Canvas color behind the image, e.g. "#ffffff"
+	Background string `json:"background,omitempty"`
+	// Space kept clear around the image on every side
+	SafeMargin int `json:"safe_margin,omitempty"`
+	// Optional full-size PNG drawn over everything, for borders and badges
+	Overlay string `json:"overlay,omitempty"`
+	// Optional strip along the bottom of the canvas with a centered logo
+	LogoStrip *LogoStrip `json:"logo_strip,omitempty"`
+}
+
+type LogoStrip struct {
+	Height     int    `json:"height"`
+	Background string `json:"background,omitempty"`
+	Logo       string `json:"logo,omitempty"`
+	// Space kept clear around the logo inside the strip
+	Padding int `json:"padding,omitempty"`
+}
+
+var frameNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Folder in the image bucket that holds frame templates
+func frameTemplatePrefix() string {
+	prefix := strings.Trim(os.Getenv("FRAME_TEMPLATE_PREFIX"), "/")
+	if prefix == "" {
+		prefix = "frames"
+	}
+	return prefix
+}
+
+func frameStep(ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) ([]byte, error) {
+	stageStart := time.Now()
+	framed, err := applyFrame(imageData, ideogramRequestBody.Frame)
+	summary.recordStage("frame", stageStart)
+	if err != nil {
+		log.Println("Error applying frame:", err)
+		summary.recordError("frame", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error applying frame", Err: err}
+	}
+	return framed, nil
+}
+
+// Place the image on the template's canvas, inside the safe margins and above
+// the logo strip, then draw the strip and overlay on top. The image is scaled
+// down to fit but never enlarged.
+func applyFrame(imageData []byte, name string) ([]byte, error) {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return nil, err
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return nil, err
+	}
+	folder := frameTemplatePrefix() + "/" + name
+	payload, err := readFrameAsset(s3Svc, settings.Bucket, folder+"/template.json")
+	if err != nil {
+		return nil, err
+	}
+	var template FrameTemplate
+	if err := json.Unmarshal(payload, &template); err != nil {
+		return nil, fmt.Errorf("invalid frame template %s: %v", name, err)
+	}
+	if template.Width <= 0 || template.Height <= 0 {
+		return nil, fmt.Errorf("frame template %s has no size", name)
+	}
+
+	src, err := png.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, template.Width, template.Height))
+	background, err := parseHexColor(template.Background)
+	if err != nil {
+		return nil, err
+	}
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	stripHeight := 0
+	if template.LogoStrip != nil {
+		stripHeight = template.LogoStrip.Height
+	}
+	area := image.Rect(template.SafeMargin, template.SafeMargin, template.Width-template.SafeMargin, template.Height-template.SafeMargin-stripHeight)
+	if area.Empty() {
+		return nil, fmt.Errorf("frame template %s leaves no room for the image", name)
+	}
+	drawFitted(canvas, area, src)
+
+	if strip := template.LogoStrip; strip != nil && strip.Height > 0 {
+		stripArea := image.Rect(0, template.Height-strip.Height, template.Width, template.Height)
+		stripColor, err := parseHexColor(strip.Background)
+		if err != nil {
+			return nil, err
+		}
+		if strip.Background != "" {
+			draw.Draw(canvas, stripArea, image.NewUniform(stripColor), image.Point{}, draw.Src)
+		}
+		if strip.Logo != "" {
+			logo, err := readFrameImage(s3Svc, settings.Bucket, folder+"/"+strip.Logo)
+			if err != nil {
+				return nil, err
+			}
+			drawFitted(canvas, stripArea.Inset(strip.Padding), logo)
+		}
+	}
+
+	if template.Overlay != "" {
+		overlay, err := readFrameImage(s3Svc, settings.Bucket, folder+"/"+template.Overlay)
+		if err != nil {
+			return nil, err
+		}
+		if overlay.Bounds().Dx() != template.Width || overlay.Bounds().Dy() != template.Height {
+			overlay = downscale(overlay, template.Width, template.Height)
+		}
+		draw.Draw(canvas, canvas.Bounds(), overlay, overlay.Bounds().Min, draw.Over)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Draw the image centered in the area, scaled down to fit if it is larger
+func drawFitted(dst draw.Image, area image.Rectangle, src image.Image) {
+	if area.Empty() {
+		return
+	}
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	if width > area.Dx() || height > area.Dy() {
+		if width*area.Dy() > height*area.Dx() {
+			width, height = area.Dx(), max(1, height*area.Dx()/width)
+		} else {
+			width, height = max(1, width*area.Dy()/height), area.Dy()
+		}
+		src = downscale(src, width, height)
+	}
+	offset := image.Pt(area.Min.X+(area.Dx()-width)/2, area.Min.Y+(area.Dy()-height)/2)
+	draw.Draw(dst, image.Rect(0, 0, width, height).Add(offset), src, src.Bounds().Min, draw.Over)
+}
+
+// Frame templates, logos and overlays read by this container
+var frameAssetCache = newWarmCache("FrameAssets")
+
+func readFrameAsset(s3Svc *s3.S3, bucket string, key string) ([]byte, error) {
+	payload, err := frameAssetCache.get(bucket+"/"+key, func() (interface{}, error) {
+		return readS3Object(s3Svc, bucket, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payload.([]byte), nil
+}
+
+func readFrameImage(s3Svc *s3.S3, bucket string, key string) (image.Image, error) {
+	payload, err := readFrameAsset(s3Svc, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", key, err)
+	}
+	return img, nil
+}
+
+func readS3Object(s3Svc *s3.S3, bucket string, key string) ([]byte, error) {
+	object, err := s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", key, err)
+	}
+	defer object.Body.Close()
+
+	payload, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	return payload, nil
+}
+
+// Parse "#rrggbb" or "#rrggbbaa". An empty value is transparent.
+func parseHexColor(value string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if hex == "" {
+		return color.RGBA{}, nil
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	parsed, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb", value)
+	}
+	// Premultiply, as color.RGBA expects
+	r, g, b, a := uint32(parsed>>24), uint32(parsed>>16&0xff), uint32(parsed>>8&0xff), uint32(parsed&0xff)
+	return color.RGBA{R: uint8(r * a / 255), G: uint8(g * a / 255), B: uint8(b * a / 255), A: uint8(a)}, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+)
+
+// Beta background removal endpoint, used unless FREEPIK_REMOVE_BACKGROUND_URL
+// points somewhere else, e.g. the GA endpoint once it ships
+const defaultFreepikRemoveBackgroundURL = "https://api.freepik.com/v1/ai/beta/remove-background"
+
+func freepikRemoveBackgroundURL() string {
+	if url := strings.TrimSpace(os.Getenv("FREEPIK_REMOVE_BACKGROUND_URL")); url != "" {
+		return url
+	}
+	return defaultFreepikRemoveBackgroundURL
+}
+
+// GA responses wrap the image URLs in data, as an object or a list
+type freepikEnvelope struct {
+	FreepikResponse
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Find the cutout URL in a Freepik response, accepting both the beta shape
+// with the URLs at the top level and the GA shape with them under data. Any
+// other shape is a schema change, not an empty result.
+func parseFreepikResponse(response string) (string, error) {
+	var envelope freepikEnvelope
+	if err := decodeProviderResponse("freepik", []byte(response), &envelope); err != nil {
+		return "", err
+	}
+	if url := envelope.cutoutURL(); url != "" {
+		return url, nil
+	}
+
+	if len(envelope.Data) > 0 {
+		var data FreepikResponse
+		if err := json.Unmarshal(envelope.Data, &data); err == nil && data.cutoutURL() != "" {
+			log.Println("Freepik answered in the GA response format")
+			return data.cutoutURL(), nil
+		}
+		var list []FreepikResponse
+		if err := json.Unmarshal(envelope.Data, &list); err == nil && len(list) > 0 && list[0].cutoutURL() != "" {
+			log.Println("Freepik answered in the GA response format")
+			return list[0].cutoutURL(), nil
+		}
+	}
+	return "", newSchemaError("freepik", "no cutout url", response)
+}
+
+// The full-size cutout, falling back to the preview. Original is the input
+// image, not a cutout.
+func (response FreepikResponse) cutoutURL() string {
+	for _, url := range []string{response.URL, response.HighResolution, response.Preview} {
+		if url != "" {
+			return url
+		}
+	}
+	return ""
+}
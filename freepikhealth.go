@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Freepik outcomes are counted in windows of this length
+const freepikHealthWindow = 5 * time.Minute
+
+// How long one container reuses its error budget decision
+const freepikBudgetCheckInterval = 30 * time.Second
+
+const (
+	defaultFreepikBudgetMinutes     = 15
+	defaultFreepikBudgetMinRequests = 20
+)
+
+type freepikCounts struct {
+	successes int
+	failures  int
+}
+
+// Outcomes seen by this container, used when DEPENDENCY_HEALTH_TABLE is not
+// set, and the last budget decision
+var freepikHealth = struct {
+	mu        sync.Mutex
+	windows   map[int64]*freepikCounts
+	checkedAt time.Time
+	exhausted bool
+}{windows: map[int64]*freepikCounts{}}
+
+// Response of the synthetic canary
+type FreepikCanaryResponse struct {
+	Healthy         bool   `json:"healthy"`
+	DurationMs      int64  `json:"duration_ms"`
+	Error           string `json:"error,omitempty"`
+	BudgetExhausted bool   `json:"budget_exhausted"`
+}
+
+// Share of Freepik calls allowed to fail, from FREEPIK_ERROR_BUDGET (e.g.
+// 0.2). Unset disables the automatic skip.
+func freepikErrorBudget() (float64, bool) {
+	budget, err := strconv.ParseFloat(os.Getenv("FREEPIK_ERROR_BUDGET"), 64)
+	if err != nil || budget <= 0 || budget >= 1 {
+		return 0, false
+	}
+	return budget, true
+}
+
+func freepikBudgetMinutes() int {
+	minutes, err := strconv.Atoi(os.Getenv("FREEPIK_ERROR_BUDGET_MINUTES"))
+	if err != nil || minutes <= 0 {
+		return defaultFreepikBudgetMinutes
+	}
+	return minutes
+}
+
+// Fewer calls than this say nothing about Freepik's health
+func freepikBudgetMinRequests() int {
+	count, err := strconv.Atoi(os.Getenv("FREEPIK_ERROR_BUDGET_MIN_REQUESTS"))
+	if err != nil || count <= 0 {
+		return defaultFreepikBudgetMinRequests
+	}
+	return count
+}
+
+func freepikWindowStart(t time.Time) int64 {
+	return t.Truncate(freepikHealthWindow).Unix()
+}
+
+func freepikWindowKey(start int64) string {
+	return "freepik#" + time.Unix(start, 0).UTC().Format(time.RFC3339)
+}
+
+// Count a Freepik call towards its success rate metric and error budget
+func recordFreepikOutcome(err error) {
+	successRate, field := 100.0, "successes"
+	if err != nil {
+		successRate, field = 0, "failures"
+	}
+	emitMetric("FreepikSuccessRate", successRate, "Percent")
+
+	start := freepikWindowStart(time.Now())
+	freepikHealth.mu.Lock()
+	counts := freepikHealth.windows[start]
+	if counts == nil {
+		counts = &freepikCounts{}
+		freepikHealth.windows[start] = counts
+	}
+	if err != nil {
+		counts.failures++
+	} else {
+		counts.successes++
+	}
+	// Forget windows the budget no longer looks at
+	for windowStart := range freepikHealth.windows {
+		if windowStart < start-int64(freepikBudgetMinutes()*60) {
+			delete(freepikHealth.windows, windowStart)
+		}
+	}
+	freepikHealth.mu.Unlock()
+
+	table := os.Getenv("DEPENDENCY_HEALTH_TABLE")
+	if table == "" {
+		return
+	}
+	dynamoSvc, dbErr := newDynamoDBClient()
+	if dbErr != nil {
+		log.Println("Error recording Freepik outcome:", dbErr)
+		return
+	}
+	_, dbErr = dynamoSvc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"window": {S: aws.String(freepikWindowKey(start))},
+		},
+		UpdateExpression: aws.String("ADD " + field + " :one SET expires_at = :expires_at"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":        {N: aws.String("1")},
+			":expires_at": {N: aws.String(strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10))},
+		},
+	})
+	if dbErr != nil {
+		log.Println("Error recording Freepik outcome:", dbErr)
+	}
+}
+
+// Report whether Freepik failed more than FREEPIK_ERROR_BUDGET of its calls
+// in the last FREEPIK_ERROR_BUDGET_MINUTES. While it has, background removal
+// is skipped; the budget recovers as the failing windows age out, or sooner
+// when the canary succeeds.
+func freepikBudgetExhausted() bool {
+	budget, enabled := freepikErrorBudget()
+	if !enabled {
+		return false
+	}
+	freepikHealth.mu.Lock()
+	defer freepikHealth.mu.Unlock()
+	if time.Since(freepikHealth.checkedAt) < freepikBudgetCheckInterval {
+		return freepikHealth.exhausted
+	}
+
+	counts, err := loadFreepikCounts()
+	if err != nil {
+		// Keep the last decision rather than flapping on a read error
+		log.Println("Error loading Freepik error budget:", err)
+		return freepikHealth.exhausted
+	}
+	total := counts.successes + counts.failures
+	exhausted := total >= freepikBudgetMinRequests() && float64(counts.failures)/float64(total) > budget
+	if exhausted != freepikHealth.exhausted {
+		log.Printf("Freepik error budget exhausted: %v (%d of %d calls failed)", exhausted, counts.failures, total)
+	}
+	freepikHealth.exhausted = exhausted
+	freepikHealth.checkedAt = time.Now()
+	if exhausted {
+		emitMetric("FreepikBudgetExhausted", 1, "Count")
+	}
+	return exhausted
+}
+
+// Sum the outcomes of the windows the budget covers, from the shared table
+// when there is one. Called with freepikHealth.mu held.
+func loadFreepikCounts() (freepikCounts, error) {
+	var counts freepikCounts
+	now := freepikWindowStart(time.Now())
+	oldest := now - int64(freepikBudgetMinutes()*60) + int64(freepikHealthWindow.Seconds())
+
+	table := os.Getenv("DEPENDENCY_HEALTH_TABLE")
+	if table == "" {
+		for start, windowCounts := range freepikHealth.windows {
+			if start >= oldest {
+				counts.successes += windowCounts.successes
+				counts.failures += windowCounts.failures
+			}
+		}
+		return counts, nil
+	}
+
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return counts, err
+	}
+	for start := oldest; start <= now; start += int64(freepikHealthWindow.Seconds()) {
+		output, err := dynamoSvc.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(table),
+			Key: map[string]*dynamodb.AttributeValue{
+				"window": {S: aws.String(freepikWindowKey(start))},
+			},
+		})
+		if err != nil {
+			return counts, err
+		}
+		if value := output.Item["successes"]; value != nil {
+			successes, _ := strconv.Atoi(aws.StringValue(value.N))
+			counts.successes += successes
+		}
+		if value := output.Item["failures"]; value != nil {
+			failures, _ := strconv.Atoi(aws.StringValue(value.N))
+			counts.failures += failures
+		}
+	}
+	return counts, nil
+}
+
+// POST /canary/freepik removes the background of FREEPIK_CANARY_IMAGE_URL on
+// a schedule, so the success rate keeps moving while real traffic skips
+// Freepik. Only direct invocations, such as the EventBridge schedule, may run
+// it; it spends Freepik credits.
+func handleFreepikCanaryRequest(ctx context.Context, request events.LambdaFunctionURLRequest, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	if request.RequestContext.APIID != "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 403,
+			Body:       "Forbidden: the canary only runs on a schedule",
+		}, nil
+	}
+	imageURL := os.Getenv("FREEPIK_CANARY_IMAGE_URL")
+	if imageURL == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Freepik canary is not configured",
+		}, nil
+	}
+
+	start := time.Now()
+	response, err := removeImageBGviaFreepik(ctx, imageURL, ProviderKeys{}.freepikAPIKey(), summary)
+	if err == nil {
+		summary.addBackgroundRemovals("freepik", 1)
+		_, err = parseFreepikResponse(response)
+	}
+	duration := time.Since(start)
+	recordFreepikOutcome(err)
+
+	canary := FreepikCanaryResponse{Healthy: err == nil, DurationMs: duration.Milliseconds()}
+	canarySuccess := 100.0
+	if err != nil {
+		log.Println("Freepik canary failed:", err)
+		canary.Error = err.Error()
+		canarySuccess = 0
+	}
+	emitMetric("FreepikCanarySuccess", canarySuccess, "Percent")
+	emitMetric("FreepikCanaryLatency", float64(duration.Milliseconds()), "Milliseconds")
+
+	// Decide afresh with the canary's outcome included
+	freepikHealth.mu.Lock()
+	freepikHealth.checkedAt = time.Time{}
+	freepikHealth.mu.Unlock()
+	canary.BudgetExhausted = freepikBudgetExhausted()
+
+	responseBody, err := json.Marshal(canary)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	statusCode := 200
+	if !canary.Healthy {
+		statusCode = 502
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
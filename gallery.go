@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// One stored image on the gallery page
+type GalleryImage struct {
+	URL       string
+	Prompt    string
+	Seed      int
+	StyleType string
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2rem; background: #fafafa; }
+.grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(260px, 1fr)); gap: 1.5rem; }
+figure { margin: 0; padding: 0.75rem; background: #fff; border: 1px solid #ddd; border-radius: 6px; }
+img { width: 100%; height: 240px; object-fit: contain; background: repeating-conic-gradient(#eee 0% 25%, #fff 0% 50%) 50% / 20px 20px; }
+figcaption { font-size: 0.85rem; color: #333; margin-top: 0.5rem; }
+.meta { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">Generated {{.Created}}</p>
+<div class="grid">
+{{- range .Images}}
+<figure>
+<a href="{{.URL}}"><img src="{{.URL}}" loading="lazy" alt="{{.Prompt}}"></a>
+<figcaption>{{.Prompt}}<br><span class="meta">{{if .StyleType}}{{.StyleType}} · {{end}}seed {{.Seed}}</span></figcaption>
+</figure>
+{{- end}}
+</div>
+</body>
+</html>
+`))
+
+// Render and upload the gallery page for the request's images and add its URL
+// to the response. A failed gallery only adds a warning, since the images
+// themselves were delivered.
+func attachGallery(body IdeogramRequestBody, responseBody *LambdaResponseBody, images []GalleryImage, summary *InvocationSummary) {
+	if !body.Gallery || len(images) == 0 {
+		return
+	}
+	galleryURL, err := publishGallery(body.Folder, summary.RequestID, images)
+	if err != nil {
+		log.Println("Error publishing gallery:", err)
+		summary.recordError("gallery", err)
+		responseBody.Warnings = append(responseBody.Warnings, "Gallery page could not be created")
+		return
+	}
+	summary.addAssets(galleryURL)
+	responseBody.GalleryURL = galleryURL
+}
+
+// Store the gallery as <folder>/gallery-<request id>.html
+func publishGallery(folder string, requestID string, images []GalleryImage) (string, error) {
+	// With a private bucket the page can only show images through signed URLs
+	signer, err := newURLSigner()
+	if err != nil {
+		return "", err
+	}
+	images = append([]GalleryImage(nil), images...)
+	for i := range images {
+		if images[i].URL, err = signer.sign(images[i].URL); err != nil {
+			return "", err
+		}
+	}
+
+	var page bytes.Buffer
+	err = galleryTemplate.Execute(&page, map[string]interface{}{
+		"Title":   fmt.Sprintf("Gallery %s", requestID),
+		"Created": time.Now().UTC().Format(time.RFC1123),
+		"Images":  images,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render gallery: %v", err)
+	}
+
+	settings, err := loadS3Settings()
+	if err != nil {
+		return "", err
+	}
+	settings = settings.withFolder(folder)
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("%s/gallery-%s.html", settings.Folder, requestID)
+	_, err = s3Svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(settings.Bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(page.Bytes()),
+		ContentType: aws.String("text/html; charset=utf-8"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload gallery: %v", err)
+	}
+	return settings.objectURL(key), nil
+}
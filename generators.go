@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An image-generation provider
+type Generator interface {
+	// Name recorded as the provenance generator of the request's images,
+	// e.g. "ideogram-v3"
+	Name(body IdeogramRequestBody) string
+	Generate(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) ([]Image, error)
+}
+
+// Implemented by generators that support only some of the request options
+type RequestValidator interface {
+	Validate(body IdeogramRequestBody) error
+}
+
+// An image returned by a generator, either as a link to download it from or
+// as its bytes
+type Image struct {
+	URL  string
+	Data []byte
+
+	// What the provider reported for the image
+	Prompt     string
+	Seed       int
+	StyleType  string
+	Resolution string
+	// Unsafe images are reported but never downloaded or delivered
+	IsImageSafe bool
+}
+
+// Provider used unless IMAGE_PROVIDER names another
+const defaultImageProvider = "ideogram"
+
+// Generators by provider name. Providers register themselves here; the
+// pipeline only ever talks to the Generator interface.
+var generators = map[string]Generator{
+	defaultImageProvider: ideogramGenerator{},
+}
+
+func registerGenerator(name string, generator Generator) {
+	generators[name] = generator
+}
+
+// Name of the provider generating the request's images: the request's
+// provider, else IMAGE_PROVIDER, else Ideogram
+func (body IdeogramRequestBody) imageProvider() string {
+	if body.Provider != "" {
+		return body.Provider
+	}
+	if provider := strings.ToLower(strings.TrimSpace(os.Getenv("IMAGE_PROVIDER"))); provider != "" {
+		return provider
+	}
+	return defaultImageProvider
+}
+
+func lookupGenerator(provider string) (Generator, error) {
+	generator, ok := generators[provider]
+	if !ok {
+		return nil, fmt.Errorf("image provider %q is not registered", provider)
+	}
+	return generator, nil
+}
+
+// Names of the registered providers, for GET /options
+func generatorNames() []string {
+	names := make([]string, 0, len(generators))
+	for name := range generators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Provenance name of the images generated for the request
+func generatorName(body IdeogramRequestBody) string {
+	generator, err := lookupGenerator(body.imageProvider())
+	if err != nil {
+		return body.imageProvider()
+	}
+	return generator.Name(body)
+}
+
+// Refuse the features only Ideogram has. Every other provider's Validate
+// starts with this, so a new Ideogram-only field is refused for all of them.
+func rejectIdeogramOnlyFeatures(body IdeogramRequestBody) error {
+	if body.Edit != nil || body.Reframe != nil || body.isRemix() || len(body.StyleReferenceImages) > 0 || len(body.StyleCodes) > 0 {
+		return fmt.Errorf("edit, reframe, remixes, style_reference_images and style_codes are only available with the ideogram provider")
+	}
+	// Ideogram's resolutions have no counterpart in the other providers'
+	// sizes; they take aspect_ratio instead
+	if body.Resolution != nil {
+		return fmt.Errorf("resolution is only available with the ideogram provider, use aspect_ratio instead")
+	}
+	return nil
+}
+
+// Check the request's provider exists and supports what it asks for
+func validateProvider(body IdeogramRequestBody) error {
+	generator, err := lookupGenerator(body.imageProvider())
+	if err != nil {
+		return fmt.Errorf("unsupported provider %q, expected one of %s", body.imageProvider(), strings.Join(generatorNames(), ", "))
+	}
+	if !providerConfigured(body.imageProvider(), body.providerKeys) {
+		return missingCredentialError(body.imageProvider())
+	}
+	if validator, ok := generator.(RequestValidator); ok {
+		return validator.Validate(body)
+	}
+	return nil
+}
+
+// Generate the request's images with the configured provider
+func generateImages(ctx context.Context, ideogramRequestBody IdeogramRequestBody, summary *InvocationSummary) ([]Image, error) {
+	provider := ideogramRequestBody.imageProvider()
+	generator, err := lookupGenerator(provider)
+	if err != nil {
+		summary.recordError(provider, err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+
+	stageStart := time.Now()
+	images, err := generator.Generate(ctx, ideogramRequestBody, summary)
+	summary.recordStage(provider, stageStart)
+	if err != nil {
+		log.Printf("Error generating images with %s: %v", provider, err)
+		summary.recordError(provider, err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+	summary.addImagesGenerated(provider, len(images))
+	summary.addPrompt(ideogramRequestBody.Prompt)
+	return images, nil
+}
+
+// Ideogram's generate, edit, reframe and remix endpoints
+type ideogramGenerator struct{}
+
+func (ideogramGenerator) Name(body IdeogramRequestBody) string {
+	return "ideogram-" + body.ideogramVersion()
+}
+
+func (ideogramGenerator) Validate(body IdeogramRequestBody) error {
+	if body.AspectRatio != nil {
+		if err := body.AspectRatio.Validate(); err != nil {
+			return err
+		}
+	}
+	return validateIdeogramVersion(body)
+}
+
+func (ideogramGenerator) Generate(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) ([]Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var response string
+	var err error
+	if body.Edit != nil {
+		response, err = sendEditRequestToIdeogram(ctx, body, summary)
+	} else if body.Reframe != nil {
+		response, err = sendReframeRequestToIdeogram(ctx, body, summary)
+	} else if body.isRemix() {
+		response, err = sendRemixRequestToIdeogram(ctx, body, summary)
+	} else if body.ideogramVersion() == ideogramVersionV2 {
+		response, err = sendV2RequestToIdeogram(ctx, body, summary)
+	} else {
+		response, err = sendRequestToIdeogram(ctx, body, summary)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ideogramResponse IdeogramResponse
+	if err := decodeProviderResponse("ideogram", []byte(response), &ideogramResponse); err != nil {
+		return nil, err
+	}
+	if err := checkIdeogramResponse(ideogramResponse, response); err != nil {
+		return nil, err
+	}
+	images := make([]Image, 0, len(ideogramResponse.Data))
+	for _, data := range ideogramResponse.Data {
+		images = append(images, Image{
+			URL:         data.URL,
+			Prompt:      data.Prompt,
+			Seed:        data.Seed,
+			StyleType:   data.StyleType,
+			Resolution:  data.Resolution,
+			IsImageSafe: data.IsImageSafe,
+		})
+	}
+	return images, nil
+}
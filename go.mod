@@ -1,4 +1,4 @@
-module lambdagolang
+module github.com/poulav/ideogram-golang-lambda
 
 go 1.24.2
 
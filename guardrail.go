@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+// Rekognition only accepts inline images up to 5MB
+const rekognitionMaxImageBytes = 5 * 1024 * 1024
+
+// Findings below this confidence are ignored unless REVIEW_MIN_CONFIDENCE is set
+const defaultReviewMinConfidence = 80
+
+// Rekognition labels that indicate a brand mark in the image
+var logoLabels = []string{"Logo", "Trademark", "Brand", "Emblem"}
+
+// An image held back for human review instead of being delivered
+type ReviewFlag struct {
+	URL     string   `json:"url"`
+	Reasons []string `json:"reasons"`
+}
+
+// Prefix for images awaiting review, outside the folders integrations publish from
+func reviewPrefix() string {
+	prefix := strings.Trim(os.Getenv("REVIEW_PREFIX"), "/")
+	if prefix == "" {
+		return "review"
+	}
+	return prefix
+}
+
+func reviewMinConfidence() float64 {
+	confidence, err := strconv.ParseFloat(os.Getenv("REVIEW_MIN_CONFIDENCE"), 64)
+	if err != nil || confidence <= 0 {
+		return defaultReviewMinConfidence
+	}
+	return confidence
+}
+
+// Check the image for recognizable real people and logos. An image that
+// cannot be checked is flagged too, so nothing risky is published unseen.
+func detectReviewRisks(imageData []byte, summary *InvocationSummary) []string {
+	if len(imageData) > rekognitionMaxImageBytes {
+		return []string{"image too large for the face and logo check"}
+	}
+
+	stageStart := time.Now()
+	defer summary.recordStage("guardrail", stageStart)
+
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err != nil {
+		summary.recordError("guardrail", err)
+		return []string{"face and logo check failed"}
+	}
+	rekognitionSvc := rekognition.New(sess)
+	minConfidence := reviewMinConfidence()
+
+	var reasons []string
+	celebrities, err := rekognitionSvc.RecognizeCelebrities(&rekognition.RecognizeCelebritiesInput{
+		Image: &rekognition.Image{Bytes: imageData},
+	})
+	if err != nil {
+		log.Println("Error recognizing celebrities:", err)
+		summary.recordError("guardrail", err)
+		return []string{"face and logo check failed"}
+	}
+	for _, celebrity := range celebrities.CelebrityFaces {
+		if aws.Float64Value(celebrity.MatchConfidence) >= minConfidence {
+			reasons = append(reasons, fmt.Sprintf("real person: %s", aws.StringValue(celebrity.Name)))
+		}
+	}
+
+	labels, err := rekognitionSvc.DetectLabels(&rekognition.DetectLabelsInput{
+		Image:         &rekognition.Image{Bytes: imageData},
+		MinConfidence: aws.Float64(minConfidence),
+	})
+	if err != nil {
+		log.Println("Error detecting labels:", err)
+		summary.recordError("guardrail", err)
+		return append(reasons, "face and logo check failed")
+	}
+	for _, label := range labels.Labels {
+		if containsString(logoLabels, aws.StringValue(label.Name)) {
+			reasons = append(reasons, fmt.Sprintf("logo: %s", aws.StringValue(label.Name)))
+		}
+	}
+	return reasons
+}
+
+// Request for storing a flagged image under the review prefix, with the
+// reasons recorded as object metadata
+func (body IdeogramRequestBody) forReview(reasons []string) (IdeogramRequestBody, error) {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return body, err
+	}
+	body.Folder = reviewPrefix() + "/" + settings.withFolder(body.Folder).Folder
+	// Held-back images stay in our bucket, where the reviewers are
+	body.delivery = nil
+
+	metadata := make(map[string]string, len(body.Metadata)+2)
+	for key, value := range body.Metadata {
+		metadata[key] = value
+	}
+	metadata["review-status"] = "pending"
+	// Metadata must be ASCII, celebrity names may not be
+	metadata["review-reasons"] = strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, strings.Join(reasons, "; "))
+	body.Metadata = metadata
+	return body, nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// SQS takes at most 10 messages and 256KB per batch
+const (
+	sqsBatchEntries = 10
+	sqsBatchBytes   = 256 * 1024
+)
+
+// Limits of one ingest request, overridable with INGEST_MAX_BYTES and
+// INGEST_MAX_LINES. Function URLs cap request bodies at 6MB anyway.
+const (
+	defaultIngestMaxBytes = 5 * 1024 * 1024
+	defaultIngestMaxLines = 500
+)
+
+// Header carrying a queued job's caller provider keys, encrypted with
+// INGEST_KMS_KEY_ID so they never sit on the queue in plaintext
+const sealedProviderKeysHeader = "x-sealed-provider-keys"
+
+// A line queued as an async job
+type IngestedJob struct {
+	Line      int    `json:"line"`
+	JobID     string `json:"job_id"`
+	StatusURL string `json:"status_url"`
+}
+
+// A line that was not queued, with the response a generation request would
+// have got
+type IngestRejection struct {
+	Line       int    `json:"line"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error"`
+}
+
+// Manifest returned by POST /ingest
+type IngestResponseBody struct {
+	BatchID  string            `json:"batch_id"`
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Jobs     []IngestedJob     `json:"jobs"`
+	Failures []IngestRejection `json:"failures,omitempty"`
+}
+
+func ingestQueueURL() string {
+	return os.Getenv("INGEST_QUEUE_URL")
+}
+
+func ingestLimit(name string, fallback int) int {
+	limit, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || limit <= 0 {
+		return fallback
+	}
+	return limit
+}
+
+// POST /ingest takes NDJSON, one generation request per line. Each line is
+// prepared and checked like a generation request; valid lines become async
+// jobs on INGEST_QUEUE_URL and invalid ones are reported by line number.
+func handleIngestRequest(request events.LambdaFunctionURLRequest, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	if ingestQueueURL() == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 501,
+			Body:       "Ingest is not configured",
+		}, nil
+	}
+	// One call queues hundreds of paid generations, so the caller has to be
+	// known even where AUTH_REQUIRED is off
+	if summary.identity == nil && !knownAPIKey(headerValue(request.Headers, callerAPIKeyHeader)) {
+		return authErrorResponse(&AuthError{"ingest needs a bearer token or an API key"}), nil
+	}
+	body, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	if maxBytes := ingestLimit("INGEST_MAX_BYTES", defaultIngestMaxBytes); len(body) > maxBytes {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 413,
+			Body:       fmt.Sprintf("Payload Too Large: ingest bodies are limited to %d bytes, split the file", maxBytes),
+		}, nil
+	}
+
+	// Blank lines are skipped but still counted, so line numbers match the file
+	type ingestLine struct {
+		number int
+		body   []byte
+	}
+	var lines []ingestLine
+	for i, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			lines = append(lines, ingestLine{number: i + 1, body: line})
+		}
+	}
+	if len(lines) == 0 {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: no requests to ingest",
+		}, nil
+	}
+	if maxLines := ingestLimit("INGEST_MAX_LINES", defaultIngestMaxLines); len(lines) > maxLines {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 413,
+			Body:       fmt.Sprintf("Payload Too Large: at most %d requests per ingest, got %d", maxLines, len(lines)),
+		}, nil
+	}
+
+	batchID := newJobID(summary.RequestID)
+	responseBody := IngestResponseBody{BatchID: batchID, Jobs: make([]IngestedJob, 0, len(lines))}
+	var messages []ingestMessage
+	for _, line := range lines {
+		lineRequest := request
+		lineRequest.Body = string(line.body)
+		lineRequest.IsBase64Encoded = false
+		ideogramRequestBody, _, decodedBody, rejection := prepareGenerationRequest(lineRequest, summary)
+		if rejection != nil {
+			responseBody.Failures = append(responseBody.Failures, IngestRejection{Line: line.number, StatusCode: rejection.StatusCode, Error: rejection.Body})
+			continue
+		}
+
+		jobID := fmt.Sprintf("%s-%d", batchID, line.number)
+		headers, jobBody, err := sealProviderKeys(jobID, decodedBody, ideogramRequestBody.providerKeyHeaders())
+		if err != nil {
+			log.Printf("Error sealing provider keys of line %d: %v", line.number, err)
+			summary.recordError("ingest", err)
+			responseBody.Failures = append(responseBody.Failures, IngestRejection{Line: line.number, StatusCode: 500, Error: "Internal Server Error"})
+			continue
+		}
+		if summary.Tenant != "" {
+			headers["x-tenant-id"] = summary.Tenant
+		}
+		summary.addTraceHeaders(headers)
+		payload, err := json.Marshal(asyncJobRequest(jobID, jobBody, headers))
+		if err == nil && len(payload) > sqsBatchBytes {
+			err = fmt.Errorf("request is larger than the %d bytes a queued job may hold", sqsBatchBytes)
+		}
+		if err != nil {
+			responseBody.Failures = append(responseBody.Failures, IngestRejection{Line: line.number, StatusCode: 400, Error: "Bad Request: " + err.Error()})
+			continue
+		}
+		messages = append(messages, ingestMessage{line: line.number, jobID: jobID, payload: payload})
+	}
+
+	// Jobs are recorded before they are queued, so their status can be polled
+	// as soon as the manifest is returned
+	failed := enqueueIngestJobs(messages, summary)
+	for _, message := range messages {
+		if err, ok := failed[message.jobID]; ok {
+			responseBody.Failures = append(responseBody.Failures, IngestRejection{Line: message.line, StatusCode: 500, Error: err.Error()})
+			continue
+		}
+		responseBody.Jobs = append(responseBody.Jobs, IngestedJob{Line: message.line, JobID: message.jobID, StatusURL: "/jobs/" + message.jobID})
+	}
+	responseBody.Accepted = len(responseBody.Jobs)
+	responseBody.Rejected = len(responseBody.Failures)
+
+	statusCode := http.StatusAccepted
+	if responseBody.Accepted == 0 {
+		statusCode = 400
+	} else if responseBody.Rejected > 0 {
+		statusCode = http.StatusMultiStatus
+	}
+	manifest, err := json.Marshal(responseBody)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(manifest),
+	}, nil
+}
+
+// A validated line, as the job invocation queued for it
+type ingestMessage struct {
+	line    int
+	jobID   string
+	payload []byte
+}
+
+// Move the caller's provider keys out of a job run by another invocation,
+// queued or invoked: they are dropped from the body and travel in one header,
+// encrypted with INGEST_KMS_KEY_ID under the job ID. Jobs without caller keys
+// are passed on as they are.
+func sealProviderKeys(jobID string, decodedBody []byte, keyHeaders map[string]string) (map[string]string, []byte, error) {
+	if len(keyHeaders) == 0 {
+		return map[string]string{}, decodedBody, nil
+	}
+	keyID := os.Getenv("INGEST_KMS_KEY_ID")
+	if keyID == "" {
+		return nil, nil, fmt.Errorf("caller provider keys cannot be passed to another invocation without INGEST_KMS_KEY_ID")
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(decodedBody, &fields); err != nil {
+		return nil, nil, err
+	}
+	delete(fields, "ideogram_api_key")
+	delete(fields, "freepik_api_key")
+	jobBody, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, err := json.Marshal(keyHeaders)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	output, err := kms.New(sess).Encrypt(&kms.EncryptInput{
+		KeyId:             aws.String(keyID),
+		Plaintext:         plaintext,
+		EncryptionContext: map[string]*string{"job_id": aws.String(jobID)},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encrypt provider keys: %v", err)
+	}
+	headers := map[string]string{sealedProviderKeysHeader: base64.StdEncoding.EncodeToString(output.CiphertextBlob)}
+	return headers, jobBody, nil
+}
+
+// Decrypt the provider keys sealed into a job back into their headers
+func unsealProviderKeys(request *events.LambdaFunctionURLRequest) error {
+	sealed := headerValue(request.Headers, sealedProviderKeysHeader)
+	if sealed == "" {
+		return nil
+	}
+	delete(request.Headers, sealedProviderKeysHeader)
+	ciphertext, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return err
+	}
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	output, err := kms.New(sess).Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    ciphertext,
+		EncryptionContext: map[string]*string{"job_id": aws.String(asyncJobID(*request))},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to decrypt provider keys: %v", err)
+	}
+	var keyHeaders map[string]string
+	if err := json.Unmarshal(output.Plaintext, &keyHeaders); err != nil {
+		return err
+	}
+	for name, value := range keyHeaders {
+		request.Headers[name] = value
+	}
+	return nil
+}
+
+// Record each job as pending and send it to the queue. Returns the jobs that
+// could not be queued; they are recorded as failed.
+func enqueueIngestJobs(messages []ingestMessage, summary *InvocationSummary) map[string]error {
+	failed := map[string]error{}
+	var mu sync.Mutex
+	fail := func(jobID string, err error) {
+		mu.Lock()
+		failed[jobID] = err
+		mu.Unlock()
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	slots := make(chan struct{}, batchConcurrency())
+	var wg sync.WaitGroup
+	for _, message := range messages {
+		wg.Add(1)
+		go func(jobID string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if err := saveJob(Job{JobID: jobID, Status: jobStatusPending, CreatedAt: now, UpdatedAt: now, Tenant: summary.Tenant}); err != nil {
+				fail(jobID, err)
+			}
+		}(message.jobID)
+	}
+	wg.Wait()
+
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err != nil {
+		err = fmt.Errorf("failed to create session: %v", err)
+		for _, message := range messages {
+			failed[message.jobID] = err
+		}
+		return failed
+	}
+	sqsSvc := sqs.New(sess)
+
+	var batch []*sqs.SendMessageBatchRequestEntry
+	batchBytes := 0
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		output, err := sqsSvc.SendMessageBatch(&sqs.SendMessageBatchInput{
+			QueueUrl: aws.String(ingestQueueURL()),
+			Entries:  batch,
+		})
+		if err != nil {
+			for _, entry := range batch {
+				failed[aws.StringValue(entry.Id)] = fmt.Errorf("failed to queue job: %v", err)
+			}
+		} else {
+			for _, entry := range output.Failed {
+				failed[aws.StringValue(entry.Id)] = fmt.Errorf("failed to queue job: %s", aws.StringValue(entry.Message))
+			}
+		}
+		batch = nil
+		batchBytes = 0
+	}
+	for _, message := range messages {
+		if _, ok := failed[message.jobID]; ok {
+			continue
+		}
+		if len(batch) == sqsBatchEntries || batchBytes+len(message.payload) > sqsBatchBytes {
+			send()
+		}
+		batch = append(batch, &sqs.SendMessageBatchRequestEntry{
+			Id:          aws.String(message.jobID),
+			MessageBody: aws.String(string(message.payload)),
+		})
+		batchBytes += len(message.payload)
+	}
+	send()
+
+	for jobID, err := range failed {
+		log.Printf("Error ingesting job %s: %v", jobID, err)
+		summary.recordError("ingest", err)
+		now := time.Now().UTC().Format(time.RFC3339)
+		if err := saveJob(Job{JobID: jobID, Status: jobStatusFailed, CreatedAt: now, UpdatedAt: now, StatusCode: 500, Error: err.Error(), Tenant: summary.Tenant}); err != nil {
+			log.Println("Error saving job result:", err)
+		}
+	}
+	return failed
+}
+
+// Run the jobs delivered by the ingest queue, one after another. Jobs with
+// more line items than a shard are split like any request. Throttled jobs
+// are handed back to the queue to be retried after the visibility
+// timeout; every other outcome is final and recorded on the job.
+func handleIngestQueue(ctx context.Context, event events.SQSEvent) events.SQSEventResponse {
+	var response events.SQSEventResponse
+	for _, record := range event.Records {
+		var request events.LambdaFunctionURLRequest
+		if err := json.Unmarshal([]byte(record.Body), &request); err != nil || asyncJobID(request) == "" {
+			log.Printf("Dropping malformed ingest message %s: %v", record.MessageId, err)
+			continue
+		}
+		if err := unsealProviderKeys(&request); err != nil {
+			// KMS may be briefly unavailable, so the job is retried
+			log.Printf("Error unsealing ingest message %s: %v", record.MessageId, err)
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+			continue
+		}
+		result, _ := handleRequest(ctx, request)
+		if result.StatusCode == http.StatusTooManyRequests {
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
+		}
+	}
+	return response
+}
+
+// Entry point for every invocation: ingest queue batches from the SQS event
+// source, everything else as a function URL request
+func handleInvocation(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var probe struct {
+		Records []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(payload, &probe); err == nil && len(probe.Records) > 0 && probe.Records[0].EventSource == "aws:sqs" {
+		var event events.SQSEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return handleIngestQueue(ctx, event), nil
+	}
+
+	var request events.LambdaFunctionURLRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, err
+	}
+	// Self-invoked jobs carry the caller's keys sealed. A failure is returned
+	// so Lambda retries the invocation, as KMS may be briefly unavailable.
+	if asyncJobID(request) != "" {
+		if err := unsealProviderKeys(&request); err != nil {
+			log.Printf("Error unsealing job %s: %v", asyncJobID(request), err)
+			return nil, err
+		}
+	}
+	return handleRequest(ctx, request)
+}
@@ -0,0 +1,660 @@
+//go:build integration
+
+// End-to-end tests of the handler against LocalStack (S3, DynamoDB, SQS) and
+// httptest mocks of Ideogram and Freepik. Providers are always mocked, so no
+// credits are spent.
+//
+// Locally:
+//
+//	docker compose -f docker-compose.integration.yml up -d
+//	go test -tags integration -v ./...
+//
+// In staging verification, against the real staging bucket and tables
+// (created by the stack) with the ambient AWS credentials:
+//
+//	INTEGRATION_STAGING=1 BUCKET_NAME=... BUCKET_REGION=... \
+//	JOB_SHARDS_TABLE=... TENANT_DEFAULTS_TABLE=... go test -tags integration -v ./...
+//
+// Every run writes under its own folder and queues ingest jobs on its own
+// queue, never the stack's. The folder, queue, jobs and shard and tenant rows
+// it created are deleted afterwards.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const defaultLocalStackEndpoint = "http://localhost:4566"
+
+// Prompts the provider mocks react to
+const (
+	promptProviderError = "provider-error"
+	promptRateLimited   = "rate-limited"
+	promptFreepikError  = "freepik-error"
+)
+
+// Caller key the suite configures in KEY_POLICIES, for the routes that need
+// a known caller
+const integrationAPIKey = "integration-caller-key"
+
+// ADMIN_API_KEY for the suite; jobs saved without a tenant are read with it
+const integrationAdminKey = "integration-admin-key"
+
+var providers *providerMocks
+
+func TestMain(m *testing.M) {
+	providers = newProviderMocks()
+	defer providers.server.Close()
+
+	runID := fmt.Sprintf("%d", time.Now().UnixNano())
+	if os.Getenv("INTEGRATION_STAGING") == "" {
+		if err := setUpLocalStack(runID); err != nil {
+			fmt.Fprintln(os.Stderr, "LocalStack is not available:", err)
+			fmt.Fprintln(os.Stderr, "Start it with: docker compose -f docker-compose.integration.yml up -d")
+			os.Exit(1)
+		}
+	}
+	queueURL, err := createIngestQueue(runID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Creating the ingest queue failed:", err)
+		os.Exit(1)
+	}
+	os.Setenv("INGEST_QUEUE_URL", queueURL)
+	os.Setenv("FOLDER_NAME", "integration/"+runID)
+	os.Setenv("API_KEY", "mock-ideogram-key")
+	os.Setenv("FREEPIK_API_KEY", "mock-freepik-key")
+	os.Setenv("KEY_POLICIES", fmt.Sprintf(`{%q: {}}`, integrationAPIKey))
+	os.Setenv("ADMIN_API_KEY", integrationAdminKey)
+	os.Setenv("IDEOGRAM_V3_GENERATE_URL", providers.server.URL+"/ideogram/v1/ideogram-v3/generate")
+	os.Setenv("FREEPIK_REMOVE_BACKGROUND_URL", providers.server.URL+"/freepik/v1/ai/beta/remove-background")
+	checkProviderCredentials()
+
+	code := m.Run()
+	cleanUpRun()
+	os.Exit(code)
+}
+
+// Point the SDK at LocalStack and create the bucket and tables the handler
+// uses
+func setUpLocalStack(runID string) error {
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = defaultLocalStackEndpoint
+	}
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", parsed.Host, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+
+	for name, value := range map[string]string{
+		"AWS_ENDPOINT_URL":      endpoint,
+		"AWS_REGION":            "us-east-1",
+		"BUCKET_REGION":         "us-east-1",
+		"AWS_ACCESS_KEY_ID":     "test",
+		"AWS_SECRET_ACCESS_KEY": "test",
+		"BUCKET_NAME":           "integration-" + runID,
+		"JOB_SHARDS_TABLE":      "integration-job-shards-" + runID,
+		"TENANT_DEFAULTS_TABLE": "integration-tenant-defaults-" + runID,
+	} {
+		os.Setenv(name, value)
+	}
+	sess, err := session.NewSession(newAWSConfig("us-east-1"))
+	if err != nil {
+		return err
+	}
+
+	if _, err := s3.New(sess).CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(os.Getenv("BUCKET_NAME"))}); err != nil {
+		return fmt.Errorf("creating bucket: %v", err)
+	}
+	dynamoSvc := dynamodb.New(sess)
+	tables := map[string][]*dynamodb.KeySchemaElement{
+		os.Getenv("JOB_SHARDS_TABLE"): {
+			{AttributeName: aws.String("job_id"), KeyType: aws.String("HASH")},
+			{AttributeName: aws.String("shard"), KeyType: aws.String("RANGE")},
+		},
+		os.Getenv("TENANT_DEFAULTS_TABLE"): {
+			{AttributeName: aws.String("tenant_id"), KeyType: aws.String("HASH")},
+		},
+	}
+	for table, keySchema := range tables {
+		var attributes []*dynamodb.AttributeDefinition
+		for _, key := range keySchema {
+			attributeType := "S"
+			if aws.StringValue(key.AttributeName) == "shard" {
+				attributeType = "N"
+			}
+			attributes = append(attributes, &dynamodb.AttributeDefinition{AttributeName: key.AttributeName, AttributeType: aws.String(attributeType)})
+		}
+		_, err := dynamoSvc.CreateTable(&dynamodb.CreateTableInput{
+			TableName:            aws.String(table),
+			BillingMode:          aws.String("PAY_PER_REQUEST"),
+			AttributeDefinitions: attributes,
+			KeySchema:            keySchema,
+		})
+		if err != nil {
+			return fmt.Errorf("creating table %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// The run's own ingest queue. In staging the stack's queue feeds the deployed
+// function, which would race the test for the messages and run them for real.
+func createIngestQueue(runID string) (string, error) {
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err != nil {
+		return "", err
+	}
+	queue, err := sqs.New(sess).CreateQueue(&sqs.CreateQueueInput{QueueName: aws.String("integration-ingest-" + runID)})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(queue.QueueUrl), nil
+}
+
+// Jobs the run created, whose state lives outside its folder
+var runJobs struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+func trackJob(jobID string) {
+	runJobs.mu.Lock()
+	runJobs.ids = append(runJobs.ids, jobID)
+	runJobs.mu.Unlock()
+}
+
+// Delete everything the run stored: its folder, its jobs and their shard
+// rows, and its ingest queue
+func cleanUpRun() {
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err == nil {
+		sqs.New(sess).DeleteQueue(&sqs.DeleteQueueInput{QueueUrl: aws.String(ingestQueueURL())})
+	}
+	if dynamoSvc, err := newDynamoDBClient(); err == nil {
+		for _, jobID := range runJobs.ids {
+			shards, _ := loadJobShards(jobID)
+			for _, shard := range shards {
+				dynamoSvc.DeleteItem(&dynamodb.DeleteItemInput{
+					TableName: aws.String(jobShardsTable()),
+					Key: map[string]*dynamodb.AttributeValue{
+						"job_id": {S: aws.String(shard.JobID)},
+						"shard":  {N: aws.String(fmt.Sprint(shard.Shard))},
+					},
+				})
+			}
+		}
+	}
+
+	settings, err := loadS3Settings()
+	if err != nil {
+		return
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return
+	}
+	for _, jobID := range runJobs.ids {
+		s3Svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(settings.Bucket), Key: aws.String(jobKey(jobID))})
+	}
+	s3Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(settings.Bucket),
+		Prefix: aws.String(settings.Folder + "/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			s3Svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(settings.Bucket), Key: object.Key})
+		}
+		return true
+	})
+}
+
+// Ideogram and Freepik as the handler sees them, recording what they were
+// asked for
+type providerMocks struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	prompts  []string
+	styles   []string
+	cutouts  int
+	imagePNG []byte
+}
+
+func newProviderMocks() *providerMocks {
+	mocks := &providerMocks{imagePNG: testPNG()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ideogram/v1/ideogram-v3/generate", mocks.generate)
+	mux.HandleFunc("/freepik/v1/ai/beta/remove-background", mocks.removeBackground)
+	mux.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(mocks.imagePNG)
+	})
+	mocks.server = httptest.NewServer(mux)
+	return mocks
+}
+
+func (mocks *providerMocks) generate(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	prompt := r.FormValue("prompt")
+	mocks.mu.Lock()
+	mocks.prompts = append(mocks.prompts, prompt)
+	mocks.styles = append(mocks.styles, r.FormValue("style_type"))
+	mocks.mu.Unlock()
+
+	switch {
+	case strings.Contains(prompt, promptProviderError):
+		http.Error(w, `{"error": "internal error"}`, http.StatusInternalServerError)
+		return
+	case strings.Contains(prompt, promptRateLimited):
+		w.Header().Set("Retry-After", "7")
+		http.Error(w, `{"error": "rate limited"}`, http.StatusTooManyRequests)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"created": time.Now().UTC().Format(time.RFC3339),
+		"data": []map[string]interface{}{{
+			"prompt":        prompt,
+			"resolution":    "1024x1024",
+			"is_image_safe": true,
+			"seed":          12345,
+			"url":           mocks.server.URL + "/images/generated.png",
+			"style_type":    "GENERAL",
+		}},
+	})
+}
+
+func (mocks *providerMocks) removeBackground(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if strings.Contains(r.FormValue("image_url"), promptFreepikError) {
+		http.Error(w, `{"message": "internal error"}`, http.StatusInternalServerError)
+		return
+	}
+	mocks.mu.Lock()
+	mocks.cutouts++
+	mocks.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{"url": mocks.server.URL + "/images/cutout.png"})
+}
+
+func (mocks *providerMocks) reset() {
+	mocks.mu.Lock()
+	defer mocks.mu.Unlock()
+	mocks.prompts = nil
+	mocks.styles = nil
+	mocks.cutouts = 0
+}
+
+func testPNG() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 16), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// Send a request through the entry point, as a function URL would
+func invoke(t *testing.T, method string, path string, body interface{}, headers map[string]string) events.LambdaFunctionURLResponse {
+	t.Helper()
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body == nil {
+		payload = nil
+	}
+	request := events.LambdaFunctionURLRequest{
+		RawPath: path,
+		Headers: headers,
+		Body:    string(payload),
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			APIID:     "integration",
+			RequestID: fmt.Sprintf("it-%d", time.Now().UnixNano()),
+			HTTP:      events.LambdaFunctionURLRequestContextHTTPDescription{Method: method, Path: path},
+		},
+	}
+	return invokeEvent(t, request)
+}
+
+func invokeEvent(t *testing.T, event interface{}) events.LambdaFunctionURLResponse {
+	t.Helper()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := handleInvocation(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("invocation failed: %v", err)
+	}
+	response, ok := result.(events.LambdaFunctionURLResponse)
+	if !ok {
+		t.Fatalf("unexpected result %T", result)
+	}
+	return response
+}
+
+func decodeBody(t *testing.T, response events.LambdaFunctionURLResponse, target interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(response.Body), target); err != nil {
+		t.Fatalf("response is not JSON: %v\n%s", err, response.Body)
+	}
+}
+
+func requireStatus(t *testing.T, response events.LambdaFunctionURLResponse, status int) {
+	t.Helper()
+	if response.StatusCode != status {
+		t.Fatalf("got status %d, want %d: %s", response.StatusCode, status, response.Body)
+	}
+}
+
+func requireObject(t *testing.T, key string) {
+	t.Helper()
+	settings, err := loadS3Settings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s3Svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(settings.Bucket), Key: aws.String(key)}); err != nil {
+		t.Fatalf("object %s was not stored: %v", key, err)
+	}
+}
+
+func TestIntegrationSingleImage(t *testing.T) {
+	providers.reset()
+	response := invoke(t, "POST", "/", map[string]interface{}{
+		"prompt":     "A red bicycle",
+		"filename":   "single",
+		"style_type": "realistic",
+	}, nil)
+	requireStatus(t, response, http.StatusOK)
+
+	var body LambdaResponseBody
+	decodeBody(t, response, &body)
+	if len(body.ImageURLs) != 1 {
+		t.Fatalf("got %d image URLs, want 1", len(body.ImageURLs))
+	}
+	if providers.styles[0] != "REALISTIC" {
+		t.Errorf("Ideogram got style_type %q, want REALISTIC", providers.styles[0])
+	}
+	if providers.cutouts != 1 {
+		t.Errorf("Freepik removed %d backgrounds, want 1", providers.cutouts)
+	}
+	requireObject(t, os.Getenv("FOLDER_NAME")+"/single.png")
+}
+
+func TestIntegrationLineItems(t *testing.T) {
+	providers.reset()
+	response := invoke(t, "POST", "/", map[string]interface{}{
+		"prompts":  []string{"A cat", "A dog", "A fox"},
+		"filename": "batch",
+	}, nil)
+	requireStatus(t, response, http.StatusOK)
+
+	var body LambdaResponseBody
+	decodeBody(t, response, &body)
+	if len(body.LineItems) != 3 {
+		t.Fatalf("got %d line items, want 3", len(body.LineItems))
+	}
+	for i := range body.LineItems {
+		requireObject(t, fmt.Sprintf("%s/batch-%d.png", os.Getenv("FOLDER_NAME"), i+1))
+	}
+}
+
+func TestIntegrationFailures(t *testing.T) {
+	t.Run("provider error", func(t *testing.T) {
+		response := invoke(t, "POST", "/", map[string]interface{}{"prompt": promptProviderError, "filename": "failed"}, nil)
+		requireStatus(t, response, http.StatusInternalServerError)
+	})
+	t.Run("rate limited", func(t *testing.T) {
+		response := invoke(t, "POST", "/", map[string]interface{}{"prompt": promptRateLimited, "filename": "throttled"}, nil)
+		requireStatus(t, response, http.StatusTooManyRequests)
+		if response.Headers["Retry-After"] == "" {
+			t.Error("429 without Retry-After")
+		}
+	})
+	t.Run("background removal error", func(t *testing.T) {
+		// Freepik is sent the stored original, whose key is the filename
+		response := invoke(t, "POST", "/", map[string]interface{}{"prompt": "A lamp", "filename": promptFreepikError}, nil)
+		requireStatus(t, response, http.StatusInternalServerError)
+	})
+	t.Run("invalid request", func(t *testing.T) {
+		response := invoke(t, "POST", "/", map[string]interface{}{"prompt": "A lamp", "aspect_ratio": "7:5"}, nil)
+		requireStatus(t, response, http.StatusBadRequest)
+		if !strings.Contains(response.Body, "expected one of") {
+			t.Errorf("400 does not list the allowed values: %s", response.Body)
+		}
+	})
+	t.Run("some line items fail", func(t *testing.T) {
+		response := invoke(t, "POST", "/", map[string]interface{}{
+			"prompts":  []string{"A tree", promptProviderError},
+			"filename": "partial",
+		}, nil)
+		requireStatus(t, response, http.StatusOK)
+		var body LambdaResponseBody
+		decodeBody(t, response, &body)
+		if len(body.LineItems) != 2 || body.LineItems[1].Error == "" || len(body.Warnings) == 0 {
+			t.Errorf("failed line item not reported: %s", response.Body)
+		}
+	})
+}
+
+// An async job runs in a second invocation of the function; it is delivered
+// here the way Lambda would deliver it
+func TestIntegrationAsyncJob(t *testing.T) {
+	jobID := fmt.Sprintf("it-async-%d", time.Now().UnixNano())
+	trackJob(jobID)
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := saveJob(Job{JobID: jobID, Status: jobStatusPending, CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	status := invoke(t, "GET", "/jobs/"+jobID, nil, map[string]string{callerAPIKeyHeader: integrationAdminKey})
+	requireStatus(t, status, http.StatusOK)
+
+	body, _ := json.Marshal(map[string]interface{}{"prompt": "A castle", "filename": "async"})
+	invokeEvent(t, asyncJobRequest(jobID, body, nil))
+
+	status = invoke(t, "GET", "/jobs/"+jobID, nil, map[string]string{callerAPIKeyHeader: integrationAdminKey})
+	requireStatus(t, status, http.StatusOK)
+	var job Job
+	decodeBody(t, status, &job)
+	if job.Status != jobStatusSucceeded {
+		t.Fatalf("job is %s, want succeeded: %s", job.Status, status.Body)
+	}
+	requireObject(t, os.Getenv("FOLDER_NAME")+"/async.png")
+}
+
+// POST /ingest queues one job per line; the queue's messages are then handed
+// to the function as the SQS event source would
+func TestIntegrationIngest(t *testing.T) {
+	ndjson := `{"prompt": "A boat", "filename": "ingest-1"}
+{"prompt": "A plane", "filename": "ingest-2"}
+{"prompt": ""}
+`
+	request := events.LambdaFunctionURLRequest{
+		RawPath: "/ingest",
+		Headers: map[string]string{callerAPIKeyHeader: integrationAPIKey},
+		Body:    ndjson,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			APIID:     "integration",
+			RequestID: fmt.Sprintf("it-ingest-%d", time.Now().UnixNano()),
+			HTTP:      events.LambdaFunctionURLRequestContextHTTPDescription{Method: "POST", Path: "/ingest"},
+		},
+	}
+	response := invokeEvent(t, request)
+	requireStatus(t, response, http.StatusMultiStatus)
+	var manifest IngestResponseBody
+	decodeBody(t, response, &manifest)
+	for _, queued := range manifest.Jobs {
+		trackJob(queued.JobID)
+	}
+	if manifest.Accepted != 2 || manifest.Rejected != 1 {
+		t.Fatalf("accepted %d and rejected %d, want 2 and 1", manifest.Accepted, manifest.Rejected)
+	}
+
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqsSvc := sqs.New(sess)
+	delivered := 0
+	deadline := time.Now().Add(30 * time.Second)
+	for delivered < manifest.Accepted && time.Now().Before(deadline) {
+		output, err := sqsSvc.ReceiveMessage(&sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(ingestQueueURL()),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(2),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var event events.SQSEvent
+		for _, message := range output.Messages {
+			event.Records = append(event.Records, events.SQSMessage{
+				MessageId:   aws.StringValue(message.MessageId),
+				Body:        aws.StringValue(message.Body),
+				EventSource: "aws:sqs",
+			})
+			sqsSvc.DeleteMessage(&sqs.DeleteMessageInput{QueueUrl: aws.String(ingestQueueURL()), ReceiptHandle: message.ReceiptHandle})
+		}
+		if len(event.Records) == 0 {
+			continue
+		}
+		payload, _ := json.Marshal(event)
+		result, err := handleInvocation(context.Background(), payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failures := result.(events.SQSEventResponse).BatchItemFailures; len(failures) > 0 {
+			t.Fatalf("queue batch reported failures: %v", failures)
+		}
+		delivered += len(event.Records)
+	}
+	if delivered != manifest.Accepted {
+		t.Fatalf("received %d queued jobs, want %d", delivered, manifest.Accepted)
+	}
+
+	for _, queued := range manifest.Jobs {
+		status := invoke(t, "GET", queued.StatusURL, nil, map[string]string{callerAPIKeyHeader: integrationAdminKey})
+		var job Job
+		decodeBody(t, status, &job)
+		if job.Status != jobStatusSucceeded {
+			t.Errorf("job %s is %s, want succeeded: %s", queued.JobID, job.Status, status.Body)
+		}
+	}
+	requireObject(t, os.Getenv("FOLDER_NAME")+"/ingest-1.png")
+	requireObject(t, os.Getenv("FOLDER_NAME")+"/ingest-2.png")
+}
+
+// Shards record their line items in DynamoDB and the job combines them
+func TestIntegrationShardedBatch(t *testing.T) {
+	jobID := fmt.Sprintf("it-shards-%d", time.Now().UnixNano())
+	trackJob(jobID)
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := saveJob(Job{JobID: jobID, Status: jobStatusPending, CreatedAt: now, UpdatedAt: now, Shards: 2}); err != nil {
+		t.Fatal(err)
+	}
+	shards := [][]string{{"A moon", "A star"}, {"A comet", promptProviderError}}
+	for shard, prompts := range shards {
+		fileNames := []string{fmt.Sprintf("sharded-%d-1", shard), fmt.Sprintf("sharded-%d-2", shard)}
+		body, _ := json.Marshal(map[string]interface{}{"prompts": prompts, "filenames": fileNames})
+		invokeEvent(t, asyncJobRequest(jobID, body, map[string]string{jobShardHeader: fmt.Sprint(shard)}))
+	}
+
+	status := invoke(t, "GET", "/jobs/"+jobID, nil, map[string]string{callerAPIKeyHeader: integrationAdminKey})
+	requireStatus(t, status, http.StatusOK)
+	var job Job
+	decodeBody(t, status, &job)
+	if job.Status != jobStatusSucceeded {
+		t.Fatalf("job is %s, want succeeded: %s", job.Status, status.Body)
+	}
+	var result LambdaResponseBody
+	if err := json.Unmarshal(job.Result, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.LineItems) != 4 || result.LineItems[2].Prompt != "A comet" || result.LineItems[3].Error == "" {
+		t.Fatalf("line items not combined in order: %s", job.Result)
+	}
+}
+
+// Tenant defaults come from DynamoDB and fill what the request leaves out
+func TestIntegrationTenantDefaults(t *testing.T) {
+	providers.reset()
+	// A tenant of the run's own, so staging's real tenants are never touched
+	tenant := "it-tenant-" + randomHex(6)
+	folder := os.Getenv("FOLDER_NAME") + "/" + tenant
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dynamoSvc.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(os.Getenv("TENANT_DEFAULTS_TABLE")),
+		Item: map[string]*dynamodb.AttributeValue{
+			"tenant_id":  {S: aws.String(tenant)},
+			"folder":     {S: aws.String(folder)},
+			"style_type": {S: aws.String("DESIGN")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dynamoSvc.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(os.Getenv("TENANT_DEFAULTS_TABLE")),
+			Key:       map[string]*dynamodb.AttributeValue{"tenant_id": {S: aws.String(tenant)}},
+		})
+	})
+
+	// X-Tenant-Id alone is refused, so the request comes with a key bound to
+	// the tenant
+	tenantKey := "integration-key-" + tenant
+	t.Setenv("KEY_POLICIES", fmt.Sprintf(`{%q: {}, %q: {"tenant": %q}}`, integrationAPIKey, tenantKey, tenant))
+	headers := map[string]string{callerAPIKeyHeader: tenantKey, "x-tenant-id": tenant}
+	response := invoke(t, "POST", "/", map[string]interface{}{"prompt": "A logo", "filename": "tenant"}, headers)
+	requireStatus(t, response, http.StatusOK)
+	if providers.styles[0] != "DESIGN" {
+		t.Errorf("Ideogram got style_type %q, want the tenant's DESIGN", providers.styles[0])
+	}
+	requireObject(t, folder+"/tenant.png")
+
+	providers.reset()
+	response = invoke(t, "POST", "/", map[string]interface{}{"prompt": "A logo", "filename": "tenant-own", "style_type": "GENERAL"}, headers)
+	requireStatus(t, response, http.StatusOK)
+	if providers.styles[0] != "GENERAL" {
+		t.Errorf("Ideogram got style_type %q, want the request's GENERAL", providers.styles[0])
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Values of intermediates, controlling what happens to the original image
+// uploaded for Freepik once the cutout is stored
+const (
+	// Store the original at the final key, where the cutout replaces it
+	intermediatesKeep = "keep"
+	// Store the original under the temp prefix and delete it afterwards
+	intermediatesDelete = "delete"
+	// Store the original under the temp prefix and let a lifecycle rule expire it
+	intermediatesTemp = "temp"
+)
+
+// Prefix for intermediate uploads. The stack's expire-intermediates lifecycle
+// rule covers the default; an override needs the rule changed to match.
+func intermediatePrefix() string {
+	prefix := strings.Trim(os.Getenv("INTERMEDIATE_PREFIX"), "/")
+	if prefix == "" {
+		return "tmp"
+	}
+	return prefix
+}
+
+// Upload options for the original image sent to Freepik
+func (body IdeogramRequestBody) intermediateUploadOptions(provenance map[string]string) (UploadOptions, error) {
+	options := body.uploadOptions(provenance)
+	// Freepik fetches intermediates from our bucket, never the tenant's
+	options.Delivery = nil
+	if body.Intermediates != intermediatesDelete && body.Intermediates != intermediatesTemp {
+		return options, nil
+	}
+	settings, err := loadS3Settings()
+	if err != nil {
+		return UploadOptions{}, err
+	}
+	options.Folder = intermediatePrefix() + "/" + settings.withFolder(body.Folder).Folder
+	return options, nil
+}
+
+// Remove the intermediate upload once the final asset is safely stored.
+// Failures are only logged; the temp prefix lifecycle rule is the backstop.
+func (body IdeogramRequestBody) cleanupIntermediate(summary *InvocationSummary) {
+	if body.Intermediates != intermediatesDelete {
+		return
+	}
+	options, err := body.intermediateUploadOptions(nil)
+	if err == nil {
+		err = deleteImageFromS3(body.FileName, options.Folder)
+	}
+	if err != nil {
+		log.Println("Error deleting intermediate image:", err)
+		summary.recordError("cleanup", err)
+	}
+}
+
+func deleteImageFromS3(filename string, folder string) error {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return err
+	}
+	settings = settings.withFolder(folder)
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return err
+	}
+
+	key := settings.imageKey(filename, formatPNG)
+	_, err = s3Svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(settings.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Header carrying the job ID on self-invocations
+const asyncJobHeader = "x-async-job-id"
+
+const (
+	jobStatusPending   = "pending"
+	jobStatusSucceeded = "succeeded"
+	jobStatusFailed    = "failed"
+)
+
+var jobIDPattern = regexp.MustCompile(`^[a-zA-Z0-9-]{1,64}$`)
+
+// Time an async job keeps to record its outcome before the function times out
+const asyncJobReserve = 15 * time.Second
+
+// State of an async job, stored as JSON under jobs/<id>.json in the output bucket
+type Job struct {
+	JobID      string          `json:"job_id"`
+	Status     string          `json:"status"`
+	CreatedAt  string          `json:"created_at"`
+	UpdatedAt  string          `json:"updated_at"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	// Set on batches split across self-invocations, see shards.go
+	Shards     int `json:"shards,omitempty"`
+	ShardsDone int `json:"shards_done,omitempty"`
+	// Only this tenant, or an admin, may read the job
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Return the job ID of a self-invocation. Function URL and API Gateway events
+// always carry an API ID, so a caller cannot pose as an async job by setting
+// the header.
+func asyncJobID(request events.LambdaFunctionURLRequest) string {
+	if request.RequestContext.APIID != "" {
+		return ""
+	}
+	return headerValue(request.Headers, asyncJobHeader)
+}
+
+// Run the generation, and if it cannot finish within max_wait_seconds hand it
+// over to an async self-invocation and answer 202 with the job ID
+func runWithDeadline(parent context.Context, decodedBody []byte, ideogramRequestBody IdeogramRequestBody, summary *InvocationSummary) events.LambdaFunctionURLResponse {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	done := make(chan events.LambdaFunctionURLResponse, 1)
+	go func() {
+		// A panic in a goroutine is out of reach of the handler's recovery
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- recoverPanic(recovered, summary)
+			}
+		}()
+		done <- dispatchGeneration(ctx, ideogramRequestBody, summary)
+	}()
+
+	timer := time.NewTimer(time.Duration(*ideogramRequestBody.MaxWaitSeconds) * time.Second)
+	defer timer.Stop()
+	select {
+	case response := <-done:
+		return response
+	case <-timer.C:
+	}
+
+	// Stop the in-flight run and wait for it to unwind before handing over,
+	// so the job only ever runs once: provider calls in flight are aborted,
+	// nothing more is uploaded, and nothing touches the summary after we
+	// answer. The async job redoes the work from scratch.
+	cancel()
+	<-done
+	log.Printf("Pipeline exceeded max_wait_seconds=%d, converting to async job", *ideogramRequestBody.MaxWaitSeconds)
+	jobID := newJobID(summary.RequestID)
+	now := time.Now().UTC().Format(time.RFC3339)
+	err := saveJob(Job{JobID: jobID, Status: jobStatusPending, CreatedAt: now, UpdatedAt: now, Tenant: summary.Tenant})
+	if err == nil {
+		// Invoke payloads can end up in logs and failure destinations, so
+		// caller keys only travel sealed
+		var headers map[string]string
+		var jobBody []byte
+		headers, jobBody, err = sealProviderKeys(jobID, decodedBody, ideogramRequestBody.providerKeyHeaders())
+		if err == nil {
+			if summary.Tenant != "" {
+				headers["x-tenant-id"] = summary.Tenant
+			}
+			// Keep the caller's trace going in the async invocation
+			summary.addTraceHeaders(headers)
+			err = invokeAsyncJob(jobID, jobBody, headers)
+		}
+	}
+	if err != nil {
+		log.Println("Error starting async job:", err)
+		summary.recordError("async", err)
+		if throttleErr, ok := throttleFromError(err); ok {
+			return throttledResponse(throttleErr)
+		}
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}
+	}
+
+	return jobAcceptedResponse(jobID, 0)
+}
+
+// 202 pointing the caller at the job's status, with how many shards run it
+// when it was split
+func jobAcceptedResponse(jobID string, shards int) events.LambdaFunctionURLResponse {
+	statusURL := "/jobs/" + jobID
+	fields := map[string]interface{}{
+		"job_id":     jobID,
+		"status":     jobStatusPending,
+		"status_url": statusURL,
+	}
+	if shards > 0 {
+		fields["shards"] = shards
+	}
+	responseBody, _ := json.Marshal(fields)
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 202,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"Location":     statusURL,
+			"Retry-After":  strconv.Itoa(jobPollInterval()),
+		},
+		Body: string(responseBody),
+	}
+}
+
+// Seconds clients are asked to wait between polls of a pending job
+func jobPollInterval() int {
+	seconds, err := strconv.Atoi(os.Getenv("JOB_POLL_INTERVAL_SECONDS"))
+	if err != nil || seconds <= 0 {
+		return 5
+	}
+	return seconds
+}
+
+// Run a job received through self-invocation and record its outcome. The
+// generation is stopped short of the function timeout, so the outcome is
+// recorded even when it runs out of time.
+func runAsyncJob(ctx context.Context, jobID string, ideogramRequestBody IdeogramRequestBody, summary *InvocationSummary) events.LambdaFunctionURLResponse {
+	if !summary.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, summary.deadline.Add(-asyncJobReserve))
+		defer cancel()
+	}
+	log.Println("Running async job:", jobID)
+	response := dispatchGeneration(ctx, ideogramRequestBody, summary)
+
+	job, err := loadJob(jobID)
+	if err != nil {
+		log.Println("Error loading job, recreating it:", err)
+		job = Job{JobID: jobID, CreatedAt: time.Now().UTC().Format(time.RFC3339), Tenant: summary.Tenant}
+	}
+	job.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	job.StatusCode = response.StatusCode
+	if response.StatusCode < 300 {
+		job.Status = jobStatusSucceeded
+	} else {
+		job.Status = jobStatusFailed
+	}
+	if ctx.Err() == context.DeadlineExceeded && response.StatusCode >= 300 {
+		job.Error = "job ran out of time"
+	} else if json.Valid([]byte(response.Body)) {
+		job.Result = json.RawMessage(response.Body)
+	} else {
+		job.Error = response.Body
+	}
+	if err := saveJob(job); err != nil {
+		log.Println("Error saving job result:", err)
+		summary.recordError("async", err)
+	}
+	return response
+}
+
+// GET /jobs/<id> reports the job state and, once finished, its result
+func handleJobStatusRequest(request events.LambdaFunctionURLRequest, jobID string, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	if !jobIDPattern.MatchString(jobID) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: invalid job ID",
+		}, nil
+	}
+	job, err := loadJob(jobID)
+	if err != nil {
+		log.Println("Error loading job:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Job not found",
+		}, nil
+	}
+	if job.Tenant != summary.Tenant && !(summary.Tenant == "" && isAdminRequest(request, summary.identity)) {
+		summary.recordError("tenant", fmt.Errorf("job %s belongs to another tenant", jobID))
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 403,
+			Body:       "Forbidden: the job belongs to another tenant",
+		}, nil
+	}
+	if job.Shards > 0 && job.Status == jobStatusPending {
+		job, err = collectJobShards(job)
+		if err != nil {
+			log.Println("Error collecting job shards:", err)
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Body:       "Internal Server Error",
+			}, nil
+		}
+	}
+
+	responseBody, err := json.Marshal(job)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	headers := map[string]string{"Content-Type": "application/json"}
+	if job.Status == jobStatusPending {
+		headers["Retry-After"] = strconv.Itoa(jobPollInterval())
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       string(responseBody),
+	}, nil
+}
+
+func newJobID(requestID string) string {
+	if jobIDPattern.MatchString(requestID) {
+		return requestID
+	}
+	return randomHex(16)
+}
+
+func jobKey(jobID string) string {
+	return "jobs/" + jobID + ".json"
+}
+
+func saveJob(job Job) error {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return err
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	_, err = s3Svc.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(settings.Bucket),
+		Key:         aws.String(jobKey(job.JobID)),
+		Body:        bytes.NewReader(payload),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save job %s: %v", job.JobID, err)
+	}
+	return nil
+}
+
+func loadJob(jobID string) (Job, error) {
+	var job Job
+	settings, err := loadS3Settings()
+	if err != nil {
+		return job, err
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return job, err
+	}
+	object, err := s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(settings.Bucket),
+		Key:    aws.String(jobKey(jobID)),
+	})
+	if err != nil {
+		return job, fmt.Errorf("failed to load job %s: %v", jobID, err)
+	}
+	defer object.Body.Close()
+	payload, err := io.ReadAll(object.Body)
+	if err != nil {
+		return job, fmt.Errorf("failed to read job %s: %v", jobID, err)
+	}
+	err = json.Unmarshal(payload, &job)
+	return job, err
+}
+
+// Invoke this function asynchronously with the original request body and the
+// given extra headers
+func invokeAsyncJob(jobID string, decodedBody []byte, extraHeaders map[string]string) error {
+	payload, err := json.Marshal(asyncJobRequest(jobID, decodedBody, extraHeaders))
+	if err != nil {
+		return err
+	}
+
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err != nil {
+		return fmt.Errorf("failed to create session: %v", err)
+	}
+	_, err = lambda.New(sess).Invoke(&lambda.InvokeInput{
+		FunctionName:   aws.String(os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
+		InvocationType: aws.String(lambda.InvocationTypeEvent),
+		Payload:        payload,
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == lambda.ErrCodeTooManyRequestsException {
+		return &ThrottleError{Scope: throttleScopeService, Err: fmt.Errorf("failed to invoke async job %s: %v", jobID, err)}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to invoke async job %s: %v", jobID, err)
+	}
+	return nil
+}
+
+// The direct invocation that runs a job: the original request body, with the
+// job ID and the given extra headers
+func asyncJobRequest(jobID string, decodedBody []byte, extraHeaders map[string]string) events.LambdaFunctionURLRequest {
+	headers := map[string]string{asyncJobHeader: jobID}
+	for name, value := range extraHeaders {
+		headers[name] = value
+	}
+
+	return events.LambdaFunctionURLRequest{
+		RawPath: "/",
+		Headers: headers,
+		Body:    string(decodedBody),
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			HTTP: events.LambdaFunctionURLRequestContextHTTPDescription{Method: "POST", Path: "/"},
+		},
+	}
+}
@@ -0,0 +1,45 @@
+#!/bin/sh
+# Build the Lambda layer for background_remover "local": a standalone rembg
+# executable under bin/ and the u2netp model under models/, which the layer
+# mounts at /opt/bin/rembg and /opt/models/u2netp.onnx.
+#
+# The executable is frozen with PyInstaller inside the arm64 Lambda build
+# image, so it carries its own Python and onnxruntime and runs on the
+# function's provided.al2023 arm64 runtime, which has no Python. Rebuild it
+# for x86_64 if the function ever moves off arm64.
+#
+# Usage: layers/rembg/build.sh [output.zip]
+# Then upload it next to the function code:
+#   aws s3 cp rembg-layer.zip s3://coachfoundation-lambda-artifacts/lambda/layers/rembg-layer.zip
+set -eu
+
+output=$(realpath "${1:-rembg-layer.zip}")
+rembg_version=2.0.59
+model_url=https://github.com/danielgatis/rembg/releases/download/v0.0.0/u2netp.onnx
+
+work=$(mktemp -d)
+trap 'rm -rf "$work"' EXIT
+mkdir -p "$work/bin" "$work/models"
+
+docker run --rm --platform linux/arm64 \
+  --entrypoint /bin/sh \
+  -v "$work:/out" \
+  public.ecr.aws/lambda/python:3.12-arm64 \
+  -c "pip install --quiet 'rembg[cli]==$rembg_version' onnxruntime pyinstaller \
+    && cd /tmp \
+    && printf 'from rembg.cli import main\\nmain()\\n' > entry.py \
+    && pyinstaller --onefile --name rembg --collect-all rembg --collect-all onnxruntime --collect-all pymatting entry.py \
+    && cp dist/rembg /out/bin/rembg"
+
+curl --fail --location --silent --show-error --output "$work/models/u2netp.onnx" "$model_url"
+
+# Layers are limited to 250MB unpacked, together with the function
+size=$(du -sm "$work" | cut -f1)
+if [ "$size" -gt 200 ]; then
+  echo "layer is ${size}MB unpacked, too close to the 250MB limit" >&2
+  exit 1
+fi
+
+rm -f "$output"
+(cd "$work" && zip -qr "$output" bin models)
+echo "Built $output (${size}MB unpacked)"
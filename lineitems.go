@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// A list field that Zapier may send either as a JSON array or, for line
+// items, as a single comma-separated string
+type StringList []string
+
+func (list *StringList) UnmarshalJSON(data []byte) error {
+	var items []string
+	if err := json.Unmarshal(data, &items); err == nil {
+		*list = items
+		return nil
+	}
+	var joined string
+	if err := json.Unmarshal(data, &joined); err != nil {
+		return fmt.Errorf("expected a string or an array of strings: %v", err)
+	}
+	*list = nil
+	for _, item := range strings.Split(joined, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
+}
+
+// Result of a single line item, shaped so Zapier exposes it as a line item
+type LineItemResult struct {
+	Prompt       string                  `json:"prompt"`
+	FileName     string                  `json:"filename"`
+	ImageURLs    []string                `json:"image_urls"`
+	WebImageURLs []string                `json:"web_image_urls,omitempty"`
+	SafetyRetry  *SafetyRetryReport      `json:"safety_retry,omitempty"`
+	Paraphrase   *PromptParaphraseReport `json:"paraphrase,omitempty"`
+	FailedImages []ImageFailure          `json:"failed_images,omitempty"`
+	Reused       bool                    `json:"reused,omitempty"`
+	Error        string                  `json:"error,omitempty"`
+	// Images as they were before upscaling, when upscale is on
+	OriginalImageURLs []string `json:"original_image_urls,omitempty"`
+}
+
+// Split line-item prompts and filenames into one generation request each.
+// Filenames are zipped with the prompts; a single filename (or none, in which
+// case the top-level filename is used) is suffixed with the item index.
+func expandLineItems(body IdeogramRequestBody) ([]IdeogramRequestBody, error) {
+	fileNames := body.FileNames
+	if len(fileNames) == 0 && body.FileName != "" {
+		fileNames = StringList{body.FileName}
+	}
+	if len(fileNames) > 1 && len(fileNames) != len(body.Prompts) {
+		return nil, fmt.Errorf("got %d prompts but %d filenames", len(body.Prompts), len(fileNames))
+	}
+
+	requests := make([]IdeogramRequestBody, 0, len(body.Prompts))
+	for i, prompt := range body.Prompts {
+		item := body
+		item.Prompt = prompt
+		item.Prompts = nil
+		item.FileNames = nil
+		switch {
+		case len(fileNames) == len(body.Prompts):
+			item.FileName = fileNames[i]
+		case len(fileNames) == 1:
+			item.FileName = fmt.Sprintf("%s-%d", fileNames[0], i+1)
+		default:
+			item.FileName = fmt.Sprintf("line-item-%d", i+1)
+		}
+		requests = append(requests, item)
+	}
+	return requests, nil
+}
+
+// Run the pipeline once per line item. Items fail independently so one bad
+// prompt does not discard the images already generated for the others.
+func handleLineItemsRequest(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) events.LambdaFunctionURLResponse {
+	items, err := expandLineItems(body)
+	if err != nil {
+		log.Println("Error expanding line items:", err)
+		summary.recordError("parse", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}
+	}
+
+	responseBody := LambdaResponseBody{
+		ImageURLs:         make([]string, 0),
+		LineItems:         make([]LineItemResult, 0, len(items)),
+		Sanitization:      body.sanitization,
+		Downgraded:        body.downgraded,
+		PromptTruncations: body.truncations,
+	}
+	var gallery []GalleryImage
+	failed := 0
+	for _, item := range items {
+		lineItem := LineItemResult{
+			Prompt:    item.Prompt,
+			FileName:  item.FileName,
+			ImageURLs: make([]string, 0),
+		}
+		result, err := runGenerationPipeline(ctx, item, summary)
+		if err != nil {
+			if isQuotaExceeded(err) {
+				return handleQuotaExceeded(err, item.Folder, item.FileName)
+			}
+			if throttleErr, ok := throttleFromError(err); ok {
+				return throttledResponse(throttleErr)
+			}
+			lineItem.Error = err.Error()
+			failed++
+		} else {
+			lineItem.ImageURLs = result.ImageURLs
+			lineItem.WebImageURLs = result.WebImageURLs
+			lineItem.OriginalImageURLs = result.OriginalImageURLs
+			lineItem.SafetyRetry = result.SafetyRetry
+			lineItem.Paraphrase = result.Paraphrase
+			lineItem.FailedImages = result.FailedImages
+			lineItem.Reused = result.Reused
+			responseBody.ImageURLs = append(responseBody.ImageURLs, result.ImageURLs...)
+			responseBody.Seeds = append(responseBody.Seeds, result.Seeds...)
+			responseBody.ImageMetadata = append(responseBody.ImageMetadata, result.ImageMetadata...)
+			responseBody.WebImageURLs = append(responseBody.WebImageURLs, result.WebImageURLs...)
+			responseBody.OriginalImageURLs = append(responseBody.OriginalImageURLs, result.OriginalImageURLs...)
+			responseBody.ReviewRequired = append(responseBody.ReviewRequired, result.ReviewRequired...)
+			responseBody.Images = append(responseBody.Images, result.Images...)
+			gallery = append(gallery, result.Gallery...)
+		}
+		responseBody.LineItems = append(responseBody.LineItems, lineItem)
+	}
+
+	if failed == len(items) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "All line items failed",
+		}
+	}
+	if failed > 0 {
+		responseBody.Warnings = append(responseBody.Warnings, fmt.Sprintf("%d of %d line items failed", failed, len(items)))
+	}
+	attachGallery(body, &responseBody, gallery, summary)
+	summary.reportRetries(&responseBody)
+	return buildSuccessResponse(responseBody)
+}
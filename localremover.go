@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// Runs of the bundled model that take longer than this are killed
+const localRemoverTimeout = 2 * time.Minute
+
+// Model used unless LOCAL_REMOVER_MODEL is set. u2netp is the small u2net,
+// fast enough for the function's default memory; u2net itself cuts out
+// finer edges but needs about 2GB.
+const defaultLocalRemoverModel = "/opt/models/u2netp.onnx"
+
+// Time a cutout needs after the model run: uploading it and answering
+const localRemoverReserve = 15 * time.Second
+
+// One model run at a time: it takes most of the function's memory, and a
+// request's images are processed concurrently
+var localRemoverSlots = make(chan struct{}, 1)
+
+func localRemoverModel() string {
+	if model := os.Getenv("LOCAL_REMOVER_MODEL"); model != "" {
+		return model
+	}
+	return defaultLocalRemoverModel
+}
+
+// The rembg executable, overridable with LOCAL_REMOVER_PATH like the AVIF
+// and HEIC encoders. layers/rembg/build.sh freezes it with its own Python, as
+// the Go runtime has none.
+func localRemoverBinary() string {
+	if binary := os.Getenv("LOCAL_REMOVER_PATH"); binary != "" {
+		return binary
+	}
+	return "rembg"
+}
+
+// Cuts the background out inside the function with a u2net ONNX model run by
+// rembg, both bundled in LocalRemoverLayer. It costs no credits and has no rate
+// limit, at the price of slower, rougher cutouts than the hosted services.
+type localRemover struct{}
+
+func init() {
+	registerBackgroundRemover(localRemover{})
+}
+
+func (localRemover) Name() string { return "local" }
+
+func (localRemover) Configured(keys ProviderKeys) error {
+	if _, err := exec.LookPath(localRemoverBinary()); err != nil {
+		return fmt.Errorf("background remover local is not available in this deployment, add the rembg layer or set LOCAL_REMOVER_PATH")
+	}
+	if _, err := os.Stat(localRemoverModel()); err != nil {
+		return fmt.Errorf("background remover local is not available in this deployment, bundle the model at %s or set LOCAL_REMOVER_MODEL", localRemoverModel())
+	}
+	return nil
+}
+
+func (localRemover) RemoveBackground(ctx context.Context, source BackgroundRemovalSource, summary *InvocationSummary) ([]byte, error) {
+	imageData, err := source.bytes(ctx, summary)
+	if err != nil {
+		summary.recordError("download", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error downloading image", Err: err}
+	}
+
+	// Only wait for the slot while a full run still fits in the invocation,
+	// rather than be killed by the function timeout halfway through
+	wait := summary.remainingTime() - localRemoverTimeout - localRemoverReserve
+	if wait <= 0 {
+		err := fmt.Errorf("not enough time left in the invocation to run the local model")
+		summary.recordError("local", err)
+		return nil, &PipelineError{StatusCode: 503, Message: "Error removing image background", Err: err}
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case localRemoverSlots <- struct{}{}:
+	case <-timer.C:
+		err := fmt.Errorf("timed out waiting for the local model")
+		summary.recordError("local", err)
+		return nil, &PipelineError{StatusCode: 503, Message: "Error removing image background", Err: err}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-localRemoverSlots }()
+	stageStart := time.Now()
+	cutout, err := removeBackgroundLocally(ctx, imageData)
+	summary.recordStage("local", stageStart)
+	if err != nil {
+		summary.recordError("local", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error removing image background", Err: err}
+	}
+	return cutout, nil
+}
+
+func removeBackgroundLocally(ctx context.Context, imageData []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "remove-background-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.png")
+	output := filepath.Join(dir, "output.png")
+	if err := os.WriteFile(input, imageData, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write input image: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, localRemoverTimeout)
+	defer cancel()
+	// u2net_custom loads the bundled model instead of downloading one
+	cmd := exec.CommandContext(ctx, localRemoverBinary(), "i", "-m", "u2net_custom", "-x", fmt.Sprintf(`{"model_path": %q}`, localRemoverModel()), input, output)
+	// Only /tmp is writable in Lambda
+	cmd.Env = append(os.Environ(), "HOME="+os.TempDir(), "U2NET_HOME="+filepath.Join(os.TempDir(), ".u2net"), "NUMBA_CACHE_DIR="+os.TempDir())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("local background removal failed: %v: %s", err, out)
+	}
+
+	cutout, err := os.ReadFile(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cutout: %v", err)
+	}
+	if http.DetectContentType(cutout) != "image/png" {
+		return nil, fmt.Errorf("local background removal did not produce a PNG")
+	}
+	return cutout, nil
+}
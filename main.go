@@ -18,19 +18,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -43,23 +48,262 @@ type FreepikResponse struct {
 	URL            string `json:"url,omitempty"`
 }
 
+// Explicit member colours, or the name of one of Ideogram's preset palettes
 type ColourPalette struct {
+	Name    string `json:"name,omitempty"`
 	Members []struct {
-		ColorHex    string  `json:"color_hex"`
-		ColorWeight *string `json:"color_weight,omitempty"`
+		ColorHex    string         `json:"color_hex"`
+		ColorWeight *PaletteWeight `json:"color_weight,omitempty"`
 	} `json:"members,omitempty"`
 }
 
+// A bare string is a preset name, e.g. "colour_palette": "EMBER"
+func (palette *ColourPalette) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*palette = ColourPalette{Name: name}
+		return nil
+	}
+	type plainPalette ColourPalette
+	return json.Unmarshal(data, (*plainPalette)(palette))
+}
+
+// A palette member's weight, sent as a string by Zapier and as a number by
+// callers following Ideogram's API reference
+type PaletteWeight string
+
+func (weight *PaletteWeight) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err == nil {
+		*weight = PaletteWeight(number)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("expected a number or a string: %v", err)
+	}
+	*weight = PaletteWeight(text)
+	return nil
+}
+
 type IdeogramRequestBody struct {
-	Prompt        string         `json:"prompt"`
-	FileName      string         `json:"filename"`
-	Resolution    *string        `json:"resolution,omitempty"`
-	AspectRatio   *string        `json:"aspect_ratio,omitempty"`
-	NumImages     *int           `json:"num_images,omitempty"`
-	StyleType     *string        `json:"style_type,omitempty"`
-	ColourPalette *ColourPalette `json:"colour_palette,omitempty"`
+	Prompt         string          `json:"prompt"`
+	NegativePrompt string          `json:"negative_prompt,omitempty"`
+	PromptOverflow string          `json:"prompt_overflow,omitempty"`
+	FileName       string          `json:"filename"`
+	Resolution     *Resolution     `json:"resolution,omitempty"`
+	AspectRatio    *AspectRatio    `json:"aspect_ratio,omitempty"`
+	NumImages      *int            `json:"num_images,omitempty"`
+	StyleType      *StyleType      `json:"style_type,omitempty"`
+	StyleCodes     StringList      `json:"style_codes,omitempty"`
+	RenderingSpeed *RenderingSpeed `json:"rendering_speed,omitempty"`
+	MagicPrompt    *string         `json:"magic_prompt,omitempty"`
+	Seed           *int            `json:"seed,omitempty"`
+	ColourPalette  *ColourPalette  `json:"colour_palette,omitempty"`
+	ColorPalette   *ColourPalette  `json:"color_palette,omitempty"`
+	ReturnBase64   bool            `json:"return_base64,omitempty"`
+	Folder         string          `json:"folder,omitempty"`
+
+	// Headers and user metadata for the stored objects
+	DownloadFileName string            `json:"download_filename,omitempty"`
+	CacheControl     string            `json:"cache_control,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+	// Canned ACL of the stored objects, from ALLOWED_OBJECT_ACLS
+	ACL string `json:"acl,omitempty"`
+
+	// Zapier line items, one generation per prompt
+	Prompts   StringList `json:"prompts,omitempty"`
+	FileNames StringList `json:"filenames,omitempty"`
+
+	// Generate once per style type for side-by-side comparison
+	CompareStyles StringList `json:"compare_style_types,omitempty"`
+	// Generate once per provider, e.g. ["ideogram", "stability"]
+	CompareProviders StringList `json:"compare_providers,omitempty"`
+	// Rate each variant's images with a vision model, overriding
+	// SCORE_VARIANTS
+	ScoreVariants *bool `json:"score_variants,omitempty"`
+
+	// Regenerate from an existing image: describe it, then generate from the
+	// template with {description} substituted
+	SourceImageURL string `json:"source_image_url,omitempty"`
+	PromptTemplate string `json:"prompt_template,omitempty"`
+
+	// With source_image_url, remix the image instead of describing it. How
+	// strongly the result follows the source, from 1 to 100.
+	ImageWeight *int `json:"image_weight,omitempty"`
+
+	// Edit an existing image with a mask instead of generating a new one
+	Edit *EditRequest `json:"edit,omitempty"`
+
+	// Extend an existing image's canvas to resolution instead of generating
+	Reframe *ReframeRequest `json:"reframe,omitempty"`
+
+	// Images whose style Ideogram should follow, as URLs or base64
+	StyleReferenceImages []string `json:"style_reference_images,omitempty"`
+
+	// v2 or v3 generate endpoint, overriding IDEOGRAM_API_VERSION
+	IdeogramVersion string `json:"ideogram_version,omitempty"`
+
+	// Image provider generating the images, e.g. ideogram or stability;
+	// IMAGE_PROVIDER when empty
+	Provider string `json:"provider,omitempty"`
+
+	// End-user text substituted for {name} placeholders in the prompts after
+	// sanitization
+	PromptVariables map[string]string `json:"prompt_variables,omitempty"`
+
+	// Adjust the prompt and parameters for a plain backdrop to improve cutouts
+	PlainBackground bool `json:"plain_background,omitempty"`
+
+	// Switches for the optional stages, with defaults from the environment
+	StageFlags
+
+	// Whether upscaling runs before or after background removal
+	PostProcessingOrder string `json:"post_processing_order,omitempty"`
+	// Service removing the background, BACKGROUND_REMOVER when empty.
+	// bg_provider is accepted for it too.
+	BackgroundRemover string `json:"background_remover,omitempty"`
+	BGProvider        string `json:"bg_provider,omitempty"`
+	// Output size of remove.bg cutouts, REMOVEBG_SIZE when empty
+	RemoveBGSize string `json:"removebg_size,omitempty"`
+	// How closely the upscaled image follows the original and how much detail
+	// is added, from 1 to 100
+	UpscaleResemblance *int `json:"upscale_resemblance,omitempty"`
+	UpscaleDetail      *int `json:"upscale_detail,omitempty"`
+
+	// Aspect ratio to crop the cutout to around its subject, e.g. "1x1"
+	SmartCrop string `json:"smart_crop,omitempty"`
+
+	// Soft shadow rendered under the cutout
+	DropShadow *DropShadow `json:"drop_shadow,omitempty"`
+
+	// Name of a brand frame template to place the finished image in
+	Frame string `json:"frame,omitempty"`
+	// Generate a seamless, tileable pattern and check that it tiles
+	Pattern *PatternOptions `json:"pattern,omitempty"`
+	// Reword the prompt via Bedrock and retry once when the provider rejects
+	// it, PARAPHRASE_ON_REJECTION when unset
+	ParaphraseOnRejection *bool `json:"paraphrase_on_rejection,omitempty"`
+	// Brand kit from BRAND_KITS_TABLE filling in palette, style, typefaces,
+	// logo, watermark, frame and naming
+	Brand string `json:"brand,omitempty"`
+
+	// External processors from EXTERNAL_PROCESSORS to run, in order
+	Processors []string `json:"processors,omitempty"`
+
+	// Caller-provided provider keys, used instead of ours when set
+	IdeogramAPIKey string `json:"ideogram_api_key,omitempty"`
+	FreepikAPIKey  string `json:"freepik_api_key,omitempty"`
+
+	// Deployment stage (dev, staging, prod) selecting folders, keys and
+	// notification targets from ENVIRONMENTS
+	Environment string `json:"environment,omitempty"`
+
+	// Seconds to wait before handing the work to an async job
+	MaxWaitSeconds *int `json:"max_wait_seconds,omitempty"`
+
+	// keep, delete or temp; what happens to the original uploaded for Freepik
+	Intermediates string `json:"intermediates,omitempty"`
+
+	// png (default), avif or heic, with the encoder quality from 1 to 100
+	OutputFormat  string `json:"output_format,omitempty"`
+	OutputQuality *int   `json:"output_quality,omitempty"`
+
+	// Also store a compressed, scaled-down copy for the web next to the master
+	WebVariant bool `json:"web_variant,omitempty"`
+
+	// Hold back images showing real people or logos for human review
+	ReviewGuardrail bool `json:"review_guardrail,omitempty"`
+
+	// Also publish an HTML gallery page of the images
+	Gallery bool `json:"gallery,omitempty"`
+
+	// Return the stored asset instead of generating when the key already exists
+	ReuseIfExists bool `json:"reuse_if_exists,omitempty"`
+
+	// Store watermarked drafts under DRAFT_PREFIX until POST /approve/{id}
+	Draft bool `json:"draft,omitempty"`
+
+	// Set when the prompt was derived from SourceImageURL
+	regeneration *RegenerationReport
+	// What was stripped from the prompt variables
+	sanitization []SanitizationReport
+	// Set when the daily spend soft limit lowered the quality
+	downgraded bool
+	// Prompts shortened to fit the token limit
+	truncations []PromptTruncation
+	// The tenant's bucket final assets are delivered to
+	delivery *TenantDelivery
+	// The brand kit named by Brand
+	brandKit *BrandKit
+	// Keys the provider calls are made with
+	providerKeys ProviderKeys
+	// Caller key the key policy was checked against; nil for async jobs,
+	// checked when they were submitted
+	policyKey *string
+}
+
+// Body returned to the caller once all images are processed
+type LambdaResponseBody struct {
+	ImageURLs    []string           `json:"image_urls"`
+	WebImageURLs []string           `json:"web_image_urls,omitempty"`
+	Images       []string           `json:"images,omitempty"`
+	Warnings     []string           `json:"warnings,omitempty"`
+	LineItems    []LineItemResult   `json:"line_items,omitempty"`
+	SafetyRetry  *SafetyRetryReport `json:"safety_retry,omitempty"`
+	// Set when a rejected prompt was reworded and retried
+	Paraphrase   *PromptParaphraseReport `json:"paraphrase,omitempty"`
+	Variants     []VariantResult         `json:"variants,omitempty"`
+	Regeneration *RegenerationReport     `json:"regeneration,omitempty"`
+	Sanitization []SanitizationReport    `json:"sanitization,omitempty"`
+	Downgraded   bool                    `json:"downgraded,omitempty"`
+	FailedImages []ImageFailure          `json:"failed_images,omitempty"`
+	Reused       bool                    `json:"reused,omitempty"`
+	GalleryURL   string                  `json:"gallery_url,omitempty"`
+	// Filename of the highest scored variant, with score_variants
+	BestVariant string `json:"best_variant,omitempty"`
+	// Images held back for human review, not part of image_urls
+	ReviewRequired []ReviewFlag `json:"review_required,omitempty"`
+	// Retries per stage and fallbacks used while serving the request
+	Retries   map[string]int `json:"retries,omitempty"`
+	Fallbacks []string       `json:"fallbacks,omitempty"`
+	// Bytes stored per destination bucket while serving the request
+	UploadedBytes map[string]int `json:"uploaded_bytes,omitempty"`
+	// Images as they were before upscaling, when upscale is on
+	OriginalImageURLs []string `json:"original_image_urls,omitempty"`
+	// Prompts cut at a sentence boundary to fit Ideogram's limit
+	PromptTruncations []PromptTruncation `json:"prompt_truncations,omitempty"`
+	// Seed of each image in image_urls, to regenerate it with the same seed
+	Seeds []int `json:"seeds,omitempty"`
+	// What Ideogram reported for every image, including unsafe ones
+	ImageMetadata []ImageMetadata `json:"image_metadata,omitempty"`
+	// Draft to approve with POST approve_url, when draft is set
+	DraftID    string `json:"draft_id,omitempty"`
+	ApproveURL string `json:"approve_url,omitempty"`
 }
 
+// What Ideogram reported for one image, for downstream automation to store
+// or filter on
+type ImageMetadata struct {
+	// Stored image; empty for unsafe images, which are not delivered
+	URL         string `json:"url,omitempty"`
+	Seed        int    `json:"seed"`
+	Resolution  string `json:"resolution,omitempty"`
+	StyleType   string `json:"style_type,omitempty"`
+	IsImageSafe bool   `json:"is_image_safe"`
+	// The prompt Ideogram generated from, rewritten by magic prompt if it ran
+	Prompt string `json:"prompt"`
+	// How the image tiles, in pattern mode
+	Pattern *PatternReport `json:"pattern,omitempty"`
+}
+
+// Lambda rejects synchronous responses above 6MB; keep some headroom for the
+// function URL envelope (status code, headers, base64 flag).
+const (
+	lambdaResponseLimit  = 6 * 1024 * 1024
+	responseSizeHeadroom = 16 * 1024
+)
+
 type IdeogramResponse struct {
 	Created string `json:"created"`
 	Data    []struct {
@@ -72,185 +316,1053 @@ type IdeogramResponse struct {
 	} `json:"data"`
 }
 
-func handleRequest(request events.LambdaFunctionURLRequest) (events.LambdaFunctionURLResponse, error) {
+func handleRequest(ctx context.Context, request events.LambdaFunctionURLRequest) (response events.LambdaFunctionURLResponse, err error) {
+	summary := newInvocationSummary(request)
+	if deadline, ok := ctx.Deadline(); ok {
+		summary.deadline = deadline
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		summary.invocationID = lc.AwsRequestID
+	}
+	trace := extractTraceHeaders(request)
+	summary.Trace = trace
+	summary.tracer = newInvocationTracer(trace["traceparent"])
+	summary.outboundTrace = summary.tracer.outboundHeaders(trace)
+	ctx = withOutboundTrace(ctx, summary.outboundTrace)
+	if requestID := trace["X-Request-Id"]; requestID != "" {
+		log.Printf("Caller request ID: %s", requestID)
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			response, err = recoverPanic(recovered, summary), nil
+		}
+		response = wrapInEnvelope(request, response, summary)
+		response = withTraceHeaders(response, trace)
+		summary.finish(response)
+		summary.tracer.export(summary)
+		writeAuditRecord(request, summary)
+		recordSpend(request, summary)
+	}()
 
-	// Extract the request body
-	body := request.Body
-	var ideogramRequestBody IdeogramRequestBody
-	var decodedBody []byte
-	var err error
+	identity, err := authenticateRequest(request)
+	if err != nil {
+		summary.recordError("auth", err)
+		return authErrorResponse(err), nil
+	}
+	summary.identity = identity
 
-	//For Zapier, the request body is base64 encoded
-	if request.IsBase64Encoded {
-		decodedBody, err = base64.StdEncoding.DecodeString(body)
-		if err != nil {
-			log.Println("Error decoding base64 body:", err)
-			return events.LambdaFunctionURLResponse{
-				StatusCode: 400,
-				Body:       "Bad Request: invalid base64",
-			}, nil
+	// Confine the request to its tenant's prefix from here on. Only the
+	// authenticated tenant is recorded, so the logs, audit records and metric
+	// dimensions never carry a tenant the caller made up.
+	tenant, err := resolveRequestTenant(request, identity)
+	if err != nil {
+		summary.recordError("tenant", err)
+		return tenantErrorResponse(err), nil
+	}
+	summary.Tenant = tenant
+	return routeRequest(ctx, request, summary)
+}
+
+func routeRequest(ctx context.Context, request events.LambdaFunctionURLRequest, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	// Route the read-only endpoints, share links, exports, batch background
+	// removal, validation, archive restores, captioning, variations, bulk
+	// deletes, draft approvals and rejections, bulk ingest and the Freepik
+	// canary, everything else is a generation request
+	if request.RequestContext.HTTP.Method == http.MethodGet {
+		switch strings.TrimSuffix(request.RawPath, "/") {
+		case "/credits":
+			return serveCached(request, "/credits", nil, responseCacheTTL(), handleCreditsRequest)
+		case "/options":
+			return serveCached(request, "/options", nil, optionsCacheTTL, handleOptionsRequest)
+		case "/styles":
+			return serveCached(request, "/styles", nil, responseCacheTTL(), handleStylesRequest)
+		case "/history":
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			// A tenant's history is cached apart from everyone else's
+			route := "/history"
+			if summary.Tenant != "" {
+				route += "@" + summary.Tenant
+			}
+			return serveCached(request, route, []string{"date", "tenant", "next_token"}, responseCacheTTL(), func() (events.LambdaFunctionURLResponse, error) {
+				return handleHistoryRequest(request, summary.Tenant)
+			})
+		case "/recent":
+			return handleRecentRequest(request, summary.Tenant)
+		}
+		if jobID, ok := strings.CutPrefix(request.RawPath, "/jobs/"); ok {
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			return handleJobStatusRequest(request, strings.Trim(jobID, "/"), summary)
+		}
+		if draftID, ok := strings.CutPrefix(request.RawPath, "/approvals/"); ok {
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			return handleApprovalStatusRequest(request, strings.Trim(draftID, "/"), summary)
+		}
+		if key, ok := strings.CutPrefix(request.RawPath, "/restore/"); ok {
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			return handleRestoreStatusRequest(key, summary.Tenant)
+		}
+		if code, ok := strings.CutPrefix(request.RawPath, "/s/"); ok {
+			return handleShortLinkRequest(strings.Trim(code, "/"), request.RequestContext.HTTP.SourceIP)
 		}
-	} else {
-		decodedBody = []byte(body)
 	}
-	log.Println("Decoded body:", string(decodedBody))
-	err = json.Unmarshal(decodedBody, &ideogramRequestBody)
+	if request.RequestContext.HTTP.Method == http.MethodPost {
+		if draftID, ok := strings.CutPrefix(request.RawPath, "/approve/"); ok {
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			return handleApproveRequest(ctx, request, strings.Trim(draftID, "/"), summary)
+		}
+		if draftID, ok := strings.CutPrefix(request.RawPath, "/reject/"); ok {
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			return handleRejectRequest(request, strings.Trim(draftID, "/"), summary)
+		}
+		switch strings.TrimSuffix(request.RawPath, "/") {
+		case "/share":
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			return handleShareRequest(request, summary.Tenant)
+		case "/exports":
+			return handleExportRequest(request, summary.Tenant, summary.identity)
+		case "/remove-background/batch":
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			return handleBatchRemoveBackgroundRequest(ctx, request, summary)
+		case "/validate":
+			return handleValidateRequest(request, summary)
+		case "/restore":
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			return handleRestoreRequest(request, summary.Tenant)
+		case "/describe":
+			return handleDescribeRequest(ctx, request, summary)
+		case "/variations":
+			if rejection := requireTenant(request, summary); rejection != nil {
+				return *rejection, nil
+			}
+			return handleVariationsRequest(ctx, request, summary)
+		case "/bulk-delete":
+			return handleBulkDeleteRequest(request, summary)
+		case "/ingest":
+			return handleIngestRequest(request, summary)
+		case "/canary/freepik":
+			return handleFreepikCanaryRequest(ctx, request, summary)
+		}
+	}
+	return handleGenerateRequest(ctx, request, summary)
+}
+
+// The request body, base64-decoded when the caller sent it encoded, as Zapier
+// does. A non-nil response rejects the body.
+func decodeRequestBody(request events.LambdaFunctionURLRequest) ([]byte, *events.LambdaFunctionURLResponse) {
+	if !request.IsBase64Encoded {
+		return []byte(request.Body), nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(request.Body)
+	if err != nil {
+		log.Println("Error decoding base64 body:", err)
+		return nil, &events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: invalid base64",
+		}
+	}
+	return decoded, nil
+}
+
+// Decode the generation request, apply tenant defaults and the environment,
+// then normalize, validate and authorize it. A non-nil response rejects the
+// request.
+func prepareGenerationRequest(request events.LambdaFunctionURLRequest, summary *InvocationSummary) (IdeogramRequestBody, *EnvironmentConfig, []byte, *events.LambdaFunctionURLResponse) {
+
+	// Extract the request body
+	var ideogramRequestBody IdeogramRequestBody
+	decodedBody, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		summary.recordError("parse", errors.New("invalid base64 body"))
+		return IdeogramRequestBody{}, nil, nil, rejection
+	}
+	err := json.Unmarshal(decodedBody, &ideogramRequestBody)
 	if err != nil {
 		log.Println("Error unmarshalling request body:", err)
-		return events.LambdaFunctionURLResponse{
+		summary.recordError("parse", err)
+		// Enum fields say which values they take
+		var enumErr *EnumError
+		if errors.As(err, &enumErr) {
+			return IdeogramRequestBody{}, nil, nil, &events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Body:       "Bad Request: " + enumErr.Error(),
+			}
+		}
+		return IdeogramRequestBody{}, nil, nil, &events.LambdaFunctionURLResponse{
 			StatusCode: 400,
 			Body:       "Bad Request",
-		}, nil
+		}
+	}
+	if err := ideogramRequestBody.resolvePaletteSpelling(); err != nil {
+		summary.recordError("parse", err)
+		return IdeogramRequestBody{}, nil, nil, &events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}
 	}
 
-	// Send the request to the ideogram endpoint and get the response
-	response, err := sendRequestToIdeogram(ideogramRequestBody)
-	if err != nil {
-		log.Println("Error sending request to ideogram:", err)
-		return events.LambdaFunctionURLResponse{
-			StatusCode: 500,
-			Body:       "Internal Server Error",
-		}, nil
+	// Fill in what the payload left out from its brand kit, which wins over
+	// the tenant's defaults applied next
+	if err := applyBrandKit(summary.Tenant, &ideogramRequestBody); err != nil {
+		log.Println("Error applying brand kit:", err)
+		summary.recordError("brand", err)
+		return IdeogramRequestBody{}, nil, nil, brandErrorResponse(err)
 	}
 
-	// After getting the response, download the image and send it to Freepik API
-	var ideogramResponse IdeogramResponse
-	err = json.Unmarshal([]byte(response), &ideogramResponse)
+	// Fill in whatever the payload left out from the tenant's stored defaults
+	if summary.Tenant != "" {
+		err = applyTenantDefaults(summary.Tenant, &ideogramRequestBody)
+		if err != nil {
+			log.Println("Error loading tenant defaults:", err)
+			summary.recordError("tenant_defaults", err)
+			return IdeogramRequestBody{}, nil, nil, &events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Body:       "Internal Server Error",
+			}
+		}
+		ideogramRequestBody.Folder, err = confineFolder(summary.Tenant, ideogramRequestBody.Folder)
+		if err != nil {
+			log.Println("Request outside the tenant's prefix:", err)
+			summary.recordError("tenant", err)
+			response := tenantErrorResponse(err)
+			return IdeogramRequestBody{}, nil, nil, &response
+		}
+	}
+
+	// Keep each stage's folders, keys and notifications apart
+	environment, err := loadEnvironmentConfig(ideogramRequestBody.Environment)
+	if err == nil {
+		err = applyEnvironment(environment, &ideogramRequestBody)
+	}
 	if err != nil {
-		log.Println("Error unmarshalling ideogram response:", err)
-		return events.LambdaFunctionURLResponse{
-			StatusCode: 500,
-			Body:       "Internal Server Error",
-		}, nil
+		log.Println("Error selecting environment:", err)
+		summary.recordError("environment", err)
+		return IdeogramRequestBody{}, nil, nil, &events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}
 	}
+	summary.Environment = ideogramRequestBody.Environment
+	selectProviderKeys(request, environment, &ideogramRequestBody, summary)
 
-	s3URLs := make([]string, 0)
-	for i := range ideogramResponse.Data {
-		// Assuming there's only one image in the response
-		imageURL := ideogramResponse.Data[i].URL
-		log.Println("Image URL from Ideogram:", imageURL)
+	// Cost and quality are set per deployment unless the request chooses
+	if ideogramRequestBody.RenderingSpeed == nil {
+		if speed := RenderingSpeed(defaultRenderingSpeed()); speed != "" {
+			ideogramRequestBody.RenderingSpeed = &speed
+		}
+	}
 
-		// Download the image
-		imageData, err := downloadImage(imageURL)
+	normalizeIdeogramRequest(&ideogramRequestBody)
+	ideogramRequestBody.sanitization = renderPromptVariables(&ideogramRequestBody)
+	ideogramRequestBody.truncations, err = enforcePromptLimit(&ideogramRequestBody)
+	if err != nil {
+		log.Println("Prompt over the limit:", err)
+		summary.recordError("validate", err)
+		return IdeogramRequestBody{}, nil, nil, &events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}
+	}
+	if err := validateIdeogramRequest(ideogramRequestBody); err != nil {
+		log.Println("Invalid request:", err)
+		summary.recordError("validate", err)
+		return IdeogramRequestBody{}, nil, nil, &events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}
+	}
+
+	// Restrict what each caller key may request. Async jobs were checked when
+	// they were submitted.
+	if asyncJobID(request) == "" {
+		err = enforceKeyPolicy(headerValue(request.Headers, callerAPIKeyHeader), ideogramRequestBody)
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			log.Println("Request denied by key policy:", err)
+			summary.recordError("policy", err)
+			return IdeogramRequestBody{}, nil, nil, &events.LambdaFunctionURLResponse{
+				StatusCode: 403,
+				Body:       "Forbidden: " + policyErr.Message,
+			}
+		}
 		if err != nil {
-			log.Println("Error downloading image:", err)
-			return events.LambdaFunctionURLResponse{
+			log.Println("Error loading key policy:", err)
+			summary.recordError("policy", err)
+			return IdeogramRequestBody{}, nil, nil, &events.LambdaFunctionURLResponse{
 				StatusCode: 500,
-				Body:       "Error downloading image",
-			}, nil
+				Body:       "Internal Server Error",
+			}
 		}
+		policyKey := headerValue(request.Headers, callerAPIKeyHeader)
+		ideogramRequestBody.policyKey = &policyKey
+	}
+
+	// Past the daily soft limit, lower the quality instead of rejecting
+	applyBudgetDowngrade(&ideogramRequestBody)
 
-		// Upload the image to S3
-		s3URL, err := uploadImageToS3(imageData, ideogramRequestBody.FileName)
+	return ideogramRequestBody, environment, decodedBody, nil
+}
+
+func handleGenerateRequest(ctx context.Context, request events.LambdaFunctionURLRequest, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	ideogramRequestBody, environment, decodedBody, rejection := prepareGenerationRequest(request, summary)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	// The environment is only needed for its notifications
+	if !ideogramRequestBody.notifyEnabled() {
+		environment = nil
+	}
+
+	// Jobs handed over by a self-invocation run to completion and store their result
+	if jobID := asyncJobID(request); jobID != "" {
+		var response events.LambdaFunctionURLResponse
+		if shard, ok := jobShardIndex(request); ok {
+			var ran bool
+			response, ran = runJobShard(ctx, jobID, shard, ideogramRequestBody, summary)
+			if !ran {
+				return response, nil
+			}
+		} else if shouldShard(ideogramRequestBody) {
+			// Ingested jobs are split here, their shards notify when they finish
+			return startShardedJob(jobID, decodedBody, ideogramRequestBody, summary), nil
+		} else {
+			response = runAsyncJob(ctx, jobID, ideogramRequestBody, summary)
+		}
+		notifyEnvironment(environment, summary, response)
+		return response, nil
+	}
+
+	// Batches too large for one invocation are split across self-invocations
+	if shouldShard(ideogramRequestBody) {
+		return startShardedJob(newJobID(summary.RequestID), decodedBody, ideogramRequestBody, summary), nil
+	}
+
+	// Callers with a deadline get a job ID instead of a timeout
+	if ideogramRequestBody.MaxWaitSeconds != nil && *ideogramRequestBody.MaxWaitSeconds > 0 {
+		response := runWithDeadline(ctx, decodedBody, ideogramRequestBody, summary)
+		// Handed-over jobs notify from the async invocation
+		if response.StatusCode != http.StatusAccepted {
+			notifyEnvironment(environment, summary, response)
+		}
+		return response, nil
+	}
+
+	response := dispatchGeneration(ctx, ideogramRequestBody, summary)
+	notifyEnvironment(environment, summary, response)
+	return response, nil
+}
+
+// Run the generation mode selected by the request body
+func dispatchGeneration(ctx context.Context, ideogramRequestBody IdeogramRequestBody, summary *InvocationSummary) events.LambdaFunctionURLResponse {
+	// Derive the prompt from the source image before generating, unless the
+	// image is remixed directly with a prompt of its own
+	if ideogramRequestBody.SourceImageURL != "" && (!ideogramRequestBody.isRemix() || strings.TrimSpace(ideogramRequestBody.Prompt) == "") {
+		err := deriveRegenerationPrompt(ctx, &ideogramRequestBody, summary)
 		if err != nil {
-			log.Println("Error uploading image to S3:", err)
-			return events.LambdaFunctionURLResponse{
-				StatusCode: 500,
-				Body:       "Error uploading image to S3",
+			log.Println("Error deriving prompt from source image:", err)
+			return pipelineErrorResponse(err, ideogramRequestBody.Folder, ideogramRequestBody.FileName)
+		}
+	}
+
+	// Comparison mode generates the prompt once per style type or provider
+	// concurrently
+	if len(ideogramRequestBody.CompareStyles) > 0 || len(ideogramRequestBody.CompareProviders) > 0 {
+		return handleCompareRequest(ctx, ideogramRequestBody, summary)
+	}
+
+	// Zapier line items fan out into one generation per prompt
+	if len(ideogramRequestBody.Prompts) > 0 {
+		return handleLineItemsRequest(ctx, ideogramRequestBody, summary)
+	}
+
+	result, err := runGenerationPipeline(ctx, ideogramRequestBody, summary)
+	if err != nil {
+		return pipelineErrorResponse(err, ideogramRequestBody.Folder, ideogramRequestBody.FileName)
+	}
+
+	var warnings []string
+	if len(result.FailedImages) > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d images failed after retries", len(result.FailedImages)))
+	}
+	responseBody := LambdaResponseBody{
+		Warnings:          warnings,
+		ImageURLs:         result.ImageURLs,
+		WebImageURLs:      result.WebImageURLs,
+		Images:            result.Images,
+		SafetyRetry:       result.SafetyRetry,
+		Paraphrase:        result.Paraphrase,
+		Regeneration:      ideogramRequestBody.regeneration,
+		Sanitization:      ideogramRequestBody.sanitization,
+		Downgraded:        ideogramRequestBody.downgraded,
+		PromptTruncations: ideogramRequestBody.truncations,
+		FailedImages:      result.FailedImages,
+		Reused:            result.Reused,
+		ReviewRequired:    result.ReviewRequired,
+		OriginalImageURLs: result.OriginalImageURLs,
+		Seeds:             result.Seeds,
+		ImageMetadata:     result.ImageMetadata,
+	}
+	if result.DraftID != "" {
+		responseBody.DraftID = result.DraftID
+		responseBody.ApproveURL = "/approve/" + result.DraftID
+	}
+	attachGallery(ideogramRequestBody, &responseBody, result.Gallery, summary)
+	summary.reportRetries(&responseBody)
+	return buildSuccessResponse(responseBody)
+}
+
+// Images produced by one run of the generation pipeline
+type GenerationResult struct {
+	ImageURLs    []string
+	WebImageURLs []string
+	Images       []string
+	SafetyRetry  *SafetyRetryReport
+	FailedImages []ImageFailure
+	Reused       bool
+	// Set when a rejected prompt was reworded and retried
+	Paraphrase *PromptParaphraseReport
+	// Stored images with the prompt and seed they came from
+	Gallery []GalleryImage
+	// Images stored under the review prefix instead of being delivered
+	ReviewRequired []ReviewFlag
+	// Images as they were before upscaling, when upscale is on
+	OriginalImageURLs []string
+	// Seed of each image in ImageURLs
+	Seeds []int
+	// Ideogram's details of the delivered and the unsafe images
+	ImageMetadata []ImageMetadata
+	// Draft the images were stored as, when draft is set
+	DraftID string
+}
+
+// An image that could not be delivered after all retries
+type ImageFailure struct {
+	// Position among the images the provider returned, as in num_images
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// Extra attempts per image when IMAGE_RETRY_ATTEMPTS is not set
+const defaultImageRetryAttempts = 2
+
+// Pipeline failure carrying the status and message returned to the caller
+type PipelineError struct {
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+func (e *PipelineError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+// Convert a pipeline failure into the response sent back to the caller
+func pipelineErrorResponse(err error, folder string, filename string) events.LambdaFunctionURLResponse {
+	if isQuotaExceeded(err) {
+		return handleQuotaExceeded(err, folder, filename)
+	}
+	if throttleErr, ok := throttleFromError(err); ok {
+		return throttledResponse(throttleErr)
+	}
+	if isSchemaChanged(err) {
+		return schemaChangedResponse(err)
+	}
+	var pipelineErr *PipelineError
+	if errors.As(err, &pipelineErr) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: pipelineErr.StatusCode,
+			Body:       pipelineErr.Message,
+		}
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 500,
+		Body:       "Internal Server Error",
+	}
+}
+
+// Generate the images with Ideogram, remove their backgrounds via Freepik and
+// store both versions in S3
+func runGenerationPipeline(ctx context.Context, ideogramRequestBody IdeogramRequestBody, summary *InvocationSummary) (GenerationResult, error) {
+	// Idempotent backfills skip generation when the asset is already stored
+	if ideogramRequestBody.ReuseIfExists {
+		existingURL, err := findExistingAsset(ideogramRequestBody.Folder, ideogramRequestBody.FileName, ideogramRequestBody.OutputFormat)
+		if err == nil {
+			log.Println("Reusing existing asset:", existingURL)
+			return GenerationResult{
+				ImageURLs: []string{existingURL},
+				Reused:    true,
+				Gallery:   []GalleryImage{{URL: existingURL, Prompt: ideogramRequestBody.Prompt}},
 			}, nil
 		}
-		log.Println("Ideogram Image uploaded to S3:", s3URL)
+		log.Println("No existing asset to reuse, generating:", err)
+	}
+
+	// Generate the images with the configured provider
+	originalPrompt := ideogramRequestBody.Prompt
+	images, err := generateImages(ctx, ideogramRequestBody, summary)
 
-		// Remove Background via Freepik
-		response, err := removeImageBGviaFreepik(s3URL)
+	result := GenerationResult{
+		ImageURLs: make([]string, 0),
+		Images:    make([]string, 0),
+	}
+
+	// Retry once with a sanitized prompt when every image was flagged unsafe
+	if err == nil && allImagesUnsafe(images) {
+		suffix, enabled := safetyRetrySuffix()
+		if enabled {
+			retryBody := ideogramRequestBody
+			retryBody.Prompt = adjustPromptForSafety(ideogramRequestBody.Prompt, suffix)
+			summary.recordRetry("safety")
+			log.Println("All images flagged unsafe, retrying with adjusted prompt:", retryBody.Prompt)
+
+			images, err = generateImages(ctx, retryBody, summary)
+			if err != nil && !isContentRejection(err) {
+				return GenerationResult{}, err
+			}
+			result.SafetyRetry = &SafetyRetryReport{
+				OriginalPrompt: ideogramRequestBody.Prompt,
+				AdjustedPrompt: retryBody.Prompt,
+				Succeeded:      err == nil && !allImagesUnsafe(images),
+			}
+			ideogramRequestBody = retryBody
+		}
+	}
+
+	// A prompt the provider refused, or whose images stay unsafe after the
+	// safety retry, can be reworded and tried once more
+	if isContentRejection(err) || (err == nil && allImagesUnsafe(images)) {
+		reason := "unsafe"
 		if err != nil {
-			log.Println("Error removing image background:", err)
-			return events.LambdaFunctionURLResponse{
-				StatusCode: 500,
-				Body:       "Error removing image background",
-			}, nil
+			reason = "rejected"
 		}
+		ideogramRequestBody, images, result.Paraphrase, err = retryWithParaphrase(ctx, ideogramRequestBody, originalPrompt, reason, images, err, summary)
+	}
+	if isContentRejection(err) {
+		summary.recordError("safety", err)
+		return result, contentRejectionError(result.Paraphrase, err)
+	}
+	if err != nil {
+		return GenerationResult{}, err
+	}
+	if allImagesUnsafe(images) {
+		err := fmt.Errorf("all %d images were flagged unsafe", len(images))
+		summary.recordError("safety", err)
+		return result, &PipelineError{StatusCode: 422, Message: "All generated images were flagged unsafe", Err: err}
+	}
+
+	// Ideogram's links expire quickly, so fetch every image before doing
+	// anything else with them
+	generatedImages := fetchGeneratedImages(ctx, ideogramRequestBody, images, summary)
+	for _, data := range images {
+		if !data.IsImageSafe {
+			result.ImageMetadata = append(result.ImageMetadata, ImageMetadata{
+				Seed:       data.Seed,
+				Resolution: data.Resolution,
+				StyleType:  data.StyleType,
+				Prompt:     data.Prompt,
+			})
+		}
+	}
+
+	var draft *Draft
+	if ideogramRequestBody.Draft {
+		draft = &Draft{
+			DraftID:   newJobID(summary.RequestID),
+			CreatedAt: time.Now().UTC().Format(time.RFC3339),
+			Tenant:    summary.Tenant,
+			Request:   ideogramRequestBody,
+		}
+	}
+
+	var lastErr error
+	for i, generated := range generatedImages {
+		if generated.Err != nil {
+			result.FailedImages = append(result.FailedImages, ImageFailure{Index: generated.Index, Error: generated.Err.Error()})
+			lastErr = generated.Err
+			continue
+		}
+
+		imageBody := ideogramRequestBody
+		imageBody.FileName = renderFileName(ideogramRequestBody.FileName, FileNameMetadata{
+			Prompt:    ideogramRequestBody.Prompt,
+			Seed:      generated.Seed,
+			StyleType: generated.StyleType,
+			Index:     i + 1,
+		})
 
-		// After getting the response from Freepik, download the image and upload it to S3
-		var freepikResponse FreepikResponse
-		err = json.Unmarshal([]byte(response), &freepikResponse)
+		// Images showing real people or logos are held back for review
+		var reviewReasons []string
+		if ideogramRequestBody.ReviewGuardrail {
+			reviewReasons = detectReviewRisks(generated.Data, summary)
+			if len(reviewReasons) > 0 {
+				imageBody, err = imageBody.forReview(reviewReasons)
+				if err != nil {
+					result.FailedImages = append(result.FailedImages, ImageFailure{Index: generated.Index, Error: err.Error()})
+					lastErr = err
+					continue
+				}
+			}
+		}
+
+		// Drafts are watermarked under the draft prefix, next to the
+		// unwatermarked source approval starts from
+		var draftImage DraftImage
+		if draft != nil && len(reviewReasons) == 0 {
+			finalFileName := imageBody.FileName
+			imageBody, err = imageBody.forDraft()
+			if err == nil {
+				draftImage.SourceKey, err = storeDraftSource(imageBody, generated.Data, summary)
+			}
+			if err != nil {
+				result.FailedImages = append(result.FailedImages, ImageFailure{Index: generated.Index, Error: err.Error()})
+				lastErr = err
+				continue
+			}
+			draftImage.FileName = finalFileName
+		}
+
+		// Each image succeeds or fails on its own, so one failure does not
+		// throw away the rest of the batch
+		processed, err := processImageWithRetries(ctx, imageBody, generated.Data, summary)
 		if err != nil {
-			log.Println("Error unmarshalling ideogram response:", err)
-			return events.LambdaFunctionURLResponse{
-				StatusCode: 500,
-				Body:       "Internal Server Error",
-			}, nil
+			if _, throttled := throttleFromError(err); throttled || isQuotaExceeded(err) {
+				return result, err
+			}
+			result.FailedImages = append(result.FailedImages, ImageFailure{Index: generated.Index, Error: err.Error()})
+			lastErr = err
+			continue
+		}
+		if len(reviewReasons) > 0 {
+			log.Println("Image held for review:", processed.URL, reviewReasons)
+			result.ReviewRequired = append(result.ReviewRequired, ReviewFlag{URL: processed.URL, Reasons: reviewReasons})
+			continue
 		}
 
-		log.Println("Freepik response:", freepikResponse.URL)
+		if draft != nil {
+			draftImage.Index = generated.Index
+			draftImage.Seed = generated.Seed
+			draftImage.Resolution = generated.Resolution
+			draftImage.StyleType = generated.StyleType
+			draftImage.Prompt = generated.Prompt
+			draft.Images = append(draft.Images, draftImage)
+		}
+		result.ImageURLs = append(result.ImageURLs, processed.URL)
+		result.Seeds = append(result.Seeds, generated.Seed)
+		result.ImageMetadata = append(result.ImageMetadata, ImageMetadata{
+			URL:         processed.URL,
+			Seed:        generated.Seed,
+			Resolution:  generated.Resolution,
+			StyleType:   generated.StyleType,
+			IsImageSafe: true,
+			Prompt:      generated.Prompt,
+			Pattern:     processed.Pattern,
+		})
+		if processed.WebURL != "" {
+			result.WebImageURLs = append(result.WebImageURLs, processed.WebURL)
+		}
+		if processed.OriginalURL != "" {
+			result.OriginalImageURLs = append(result.OriginalImageURLs, processed.OriginalURL)
+		}
+		result.Gallery = append(result.Gallery, GalleryImage{URL: processed.URL, Prompt: generated.Prompt, Seed: generated.Seed, StyleType: generated.StyleType})
+		if ideogramRequestBody.ReturnBase64 {
+			result.Images = append(result.Images, base64.StdEncoding.EncodeToString(processed.Data))
+		}
+	}
+	if len(result.ImageURLs) == 0 && len(result.ReviewRequired) == 0 && lastErr != nil {
+		return result, lastErr
+	}
+	if draft != nil && len(draft.Images) > 0 {
+		if err := saveDraft(*draft); err != nil {
+			log.Println("Error saving draft:", err)
+			summary.recordError("draft", err)
+			return result, &PipelineError{StatusCode: 500, Message: "Error saving draft", Err: err}
+		}
+		result.DraftID = draft.DraftID
+		if err := createApproval(*draft, result.ImageURLs); err != nil {
+			log.Println("Error recording pending approval:", err)
+			summary.recordError("approval", err)
+		}
+	}
+
+	return result, nil
+}
 
-		// Download the Freepik image
-		freepikImage, err := downloadImage(freepikResponse.URL)
+// Process one image, retrying up to IMAGE_RETRY_ATTEMPTS more times
+func processImageWithRetries(ctx context.Context, ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) (ProcessedImage, error) {
+	attempts := imageRetryAttempts() + 1
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			if err := sleepContext(ctx, time.Duration(attempt-1)*time.Second); err != nil {
+				return ProcessedImage{}, err
+			}
+			log.Printf("Retrying image processing (attempt %d of %d)", attempt, attempts)
+			summary.recordRetry("image_processing")
+		}
+		var processed ProcessedImage
+		processed, err = processGeneratedImage(ctx, ideogramRequestBody, imageData, summary)
+		if err == nil {
+			return processed, nil
+		}
+		// Retrying straight away won't help an exhausted or throttling
+		// provider, nor a run that was cancelled
+		if ctx.Err() != nil {
+			break
+		}
+		if _, throttled := throttleFromError(err); throttled || isQuotaExceeded(err) {
+			break
+		}
+	}
+	return ProcessedImage{}, err
+}
+
+// Wait between retries, returning early with the context's error once it is
+// cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func imageRetryAttempts() int {
+	attempts, err := strconv.Atoi(os.Getenv("IMAGE_RETRY_ATTEMPTS"))
+	if err != nil || attempts < 0 {
+		return defaultImageRetryAttempts
+	}
+	return attempts
+}
+
+// A processed image as stored in S3
+type ProcessedImage struct {
+	URL string
+	// Compressed web-ready copy, when requested
+	WebURL string
+	// The image before upscaling, when upscale is on
+	OriginalURL string
+	Data        []byte
+	// Seam check and tiled preview, in pattern mode
+	Pattern *PatternReport
+}
+
+// Run the post-processing steps on a generated image and store the result.
+// A cancelled context stops it between steps and before the upload.
+func processGeneratedImage(ctx context.Context, ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) (ProcessedImage, error) {
+	generator := generatorName(ideogramRequestBody)
+	var originalURL string
+	for _, step := range ideogramRequestBody.postProcessingSteps() {
+		if err := ctx.Err(); err != nil {
+			return ProcessedImage{}, err
+		}
+		// While Freepik is over its error budget, cut out with the bundled
+		// model when there is one, else deliver the image with its
+		// background rather than fail
+		if step == stepRemoveBackground && backgroundRemoverName(ideogramRequestBody.BackgroundRemover) == defaultBackgroundRemover && freepikBudgetExhausted() {
+			if (localRemover{}).Configured(ideogramRequestBody.providerKeys) != nil {
+				summary.recordFallback("skip_remove_background", "Background removal was skipped because Freepik is failing; the image keeps its background")
+				continue
+			}
+			summary.recordFallback("local_remove_background", "Background removal ran in the function because Freepik is failing; edges may be rougher")
+			ideogramRequestBody.BackgroundRemover = localRemover{}.Name()
+		}
+		processor, err := lookupPostProcessor(ideogramRequestBody, step)
 		if err != nil {
-			log.Println("Error downloading image:", err)
-			return events.LambdaFunctionURLResponse{
-				StatusCode: 500,
-				Body:       "Error downloading image",
-			}, nil
+			return ProcessedImage{}, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+		}
+		// Keep the image as it was before upscaling, so callers get both
+		if step == stepUpscale && ideogramRequestBody.archiveOriginalEnabled() {
+			originalURL, err = storeOriginalBeforeUpscale(ideogramRequestBody, imageData, generator, summary)
+			if err != nil {
+				return ProcessedImage{}, err
+			}
+		}
+		imageData, err = processor.Process(ctx, ideogramRequestBody, imageData, generator, summary)
+		if err != nil {
+			return ProcessedImage{}, err
 		}
+		generator += "+" + processor.Name()
+	}
 
-		// Upload the image to S3
-		fs3URL, err := uploadImageToS3(freepikImage, ideogramRequestBody.FileName)
+	var pattern *PatternReport
+	if ideogramRequestBody.Pattern != nil {
+		var err error
+		imageData, pattern, err = seamlessPatternStep(ideogramRequestBody, imageData, summary)
 		if err != nil {
-			log.Println("Error uploading image to S3:", err)
-			return events.LambdaFunctionURLResponse{
-				StatusCode: 500,
-				Body:       "Error uploading image to S3",
-			}, nil
+			return ProcessedImage{}, err
+		}
+		if pattern.Fixed {
+			generator += "+seam-blend"
+		}
+	}
+
+	// Encode the image in the requested output format
+	outputData, err := encodeOutputFormat(ideogramRequestBody, imageData, summary)
+	if err != nil {
+		return ProcessedImage{}, err
+	}
+
+	// Sign the provenance of the processed image
+	provenance, err := buildProvenanceMetadata(outputData, ideogramRequestBody.Prompt, generator)
+	if err != nil {
+		log.Println("Error building provenance manifest:", err)
+		return ProcessedImage{}, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+
+	// Upload the image to S3
+	if err := ctx.Err(); err != nil {
+		return ProcessedImage{}, err
+	}
+	options := ideogramRequestBody.uploadOptions(provenance)
+	options.Format = ideogramRequestBody.OutputFormat
+	options.Tags = archiveTags()
+	stageStart := time.Now()
+	fs3URL, err := uploadImageToS3(outputData, ideogramRequestBody.FileName, options, summary)
+	summary.recordStage("s3_upload", stageStart)
+	if err != nil {
+		log.Println("Error uploading image to S3:", err)
+		summary.recordError("s3_upload", err)
+		return ProcessedImage{}, &PipelineError{StatusCode: 500, Message: "Error uploading image to S3", Err: err}
+	}
+	summary.addUploadedBytes(uploadDestination(options), len(outputData))
+	summary.addAssets(fs3URL)
+	summary.addImagesDelivered(1)
+	ideogramRequestBody.cleanupIntermediate(summary)
+
+	// The web variant and thumbnail are always derived from the PNG
+	processed := ProcessedImage{URL: fs3URL, OriginalURL: originalURL, Data: outputData, Pattern: pattern}
+	if ideogramRequestBody.thumbnailsEnabled() {
+		storeThumbnail(ideogramRequestBody, imageData, summary)
+	}
+	if ideogramRequestBody.WebVariant {
+		processed.WebURL, err = storeWebVariant(ideogramRequestBody, imageData, generator, summary)
+		if err != nil {
+			return ProcessedImage{}, err
+		}
+	}
+	if pattern != nil {
+		pattern.PreviewURL, err = storePatternPreview(ideogramRequestBody, imageData, generator, summary)
+		if err != nil {
+			return ProcessedImage{}, err
+		}
+	}
+	return processed, nil
+}
+
+// Store the image so the background remover can fetch it, and cut it out
+func removeBackgroundStep(ctx context.Context, remover BackgroundRemover, ideogramRequestBody IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+	// Sign the provenance of the input image
+	provenance, err := buildProvenanceMetadata(imageData, ideogramRequestBody.Prompt, generator)
+	if err != nil {
+		log.Println("Error building provenance manifest:", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+
+	options, err := ideogramRequestBody.intermediateUploadOptions(provenance)
+	if err != nil {
+		log.Println("Error resolving intermediate location:", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+
+	// Upload the image to S3
+	stageStart := time.Now()
+	s3URL, err := uploadImageToS3(imageData, ideogramRequestBody.FileName, options, summary)
+	summary.recordStage("s3_upload", stageStart)
+	if err != nil {
+		log.Println("Error uploading image to S3:", err)
+		summary.recordError("s3_upload", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error uploading image to S3", Err: err}
+	}
+	summary.addUploadedBytes(uploadDestination(options), len(imageData))
+	if ideogramRequestBody.Intermediates != intermediatesDelete {
+		summary.addAssets(s3URL)
+	}
+
+	sourceURL, err := removerSourceURL(s3URL)
+	if err != nil {
+		log.Println("Error signing the background remover's source:", err)
+		summary.recordError("sign", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+	cutout, err := remover.RemoveBackground(ctx, BackgroundRemovalSource{URL: sourceURL, Data: imageData, Size: ideogramRequestBody.RemoveBGSize, Keys: ideogramRequestBody.providerKeys}, summary)
+	if err != nil {
+		if _, ok := err.(*PipelineError); ok {
+			return nil, err
 		}
-		log.Println("Freepik Image uploaded to S3:", fs3URL)
+		log.Printf("Error removing image background with %s: %v", remover.Name(), err)
+		summary.recordError(remover.Name(), err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error removing image background", Err: err}
+	}
+	summary.addBackgroundRemovals(remover.Name(), 1)
+	return cutout, nil
+}
 
-		s3URLs = append(s3URLs, fs3URL)
+// Marshal the response body, with signed asset URLs when SIGNED_URLS is on,
+// falling back to URL-only output when inline
+// images would push the payload over the Lambda response limit
+func buildSuccessResponse(responseBody LambdaResponseBody) events.LambdaFunctionURLResponse {
+	if err := signResponseURLs(&responseBody); err != nil {
+		log.Println("Error signing asset URLs:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error signing asset URLs",
+		}
 	}
 
-	responseBody, err := json.Marshal(map[string][]string{"image_urls": s3URLs})
+	payload, err := json.Marshal(responseBody)
 	if err != nil {
 		return events.LambdaFunctionURLResponse{
 			StatusCode: 500,
 			Body:       "Error marshaling response",
-		}, nil
+		}
+	}
+
+	if len(payload) > lambdaResponseLimit-responseSizeHeadroom && len(responseBody.Images) > 0 {
+		log.Printf("Response size %d bytes exceeds Lambda limit, falling back to URL-only response", len(payload))
+		responseBody.Images = nil
+		responseBody.Warnings = append(responseBody.Warnings,
+			fmt.Sprintf("inline images omitted: response would be %d bytes, above the %d byte Lambda limit", len(payload), lambdaResponseLimit))
+		payload, err = json.Marshal(responseBody)
+		if err != nil {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Body:       "Error marshaling response",
+			}
+		}
 	}
+
 	return events.LambdaFunctionURLResponse{
 		StatusCode: 200,
-		Body:       string(responseBody),
-	}, nil
+		Body:       string(payload),
+	}
 }
 
-func sendRequestToIdeogram(body IdeogramRequestBody) (string, error) {
+// Add the seed to an Ideogram form, when the caller chose one
+func writeSeed(writer *multipart.Writer, seed *int) {
+	if seed != nil {
+		writer.WriteField("seed", strconv.Itoa(*seed))
+	}
+}
+
+// Add the style codes to an Ideogram form, one field each
+func writeStyleCodes(writer *multipart.Writer, codes []string) {
+	for _, code := range codes {
+		writer.WriteField("style_codes", code)
+	}
+}
+
+// Accept color_palette as well as colour_palette, so payloads copied from
+// Ideogram's API reference keep their palette
+func (body *IdeogramRequestBody) resolvePaletteSpelling() error {
+	if body.ColorPalette == nil {
+		return nil
+	}
+	if body.ColourPalette != nil {
+		return fmt.Errorf("give either colour_palette or color_palette, not both")
+	}
+	body.ColourPalette, body.ColorPalette = body.ColorPalette, nil
+	return nil
+}
+
+// Add the palette members to an Ideogram form
+func writeColourPalette(writer *multipart.Writer, palette *ColourPalette) {
+	if palette == nil {
+		return
+	}
+	if palette.Name != "" {
+		writer.WriteField("colour_palette[name]", palette.Name)
+		return
+	}
+	for i, member := range palette.Members {
+		memberPrefix := fmt.Sprintf("colour_palette[members][%d]", i)
+		writer.WriteField(memberPrefix+"[color_hex]", member.ColorHex)
+		if member.ColorWeight != nil {
+			writer.WriteField(memberPrefix+"[color_weight]", string(*member.ColorWeight))
+		}
+	}
+}
+
+func sendRequestToIdeogram(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) (string, error) {
 	// Load environment variables from .env file
-	api_key := os.Getenv("API_KEY")
+	api_key := body.providerKeys.ideogramAPIKey()
 
 	if api_key == "" {
 		return "", fmt.Errorf("API_KEY is not set")
 	}
+	if summary.injectFault(faultIdeogram429) {
+		return "", injectedIdeogramThrottle()
+	}
+
+	styleReferences, err := loadStyleReferenceImages(ctx, body.StyleReferenceImages, summary)
+	if err != nil {
+		return "", err
+	}
+
+	// Steer towards a flat backdrop before Freepik cuts the subject out
+	body, negativePrompt := applyPlainBackground(applyPattern(applyBrandFonts(body)))
 
 	// Create a buffer and multipart writer
 	var buf bytes.Buffer
 	writer := multipart.NewWriter(&buf)
+	if err := writeStyleReferenceImages(writer, styleReferences); err != nil {
+		return "", err
+	}
 
 	// Add fields as per the API documentation
 	writer.WriteField("prompt", body.Prompt)
+	if negativePrompt != "" {
+		writer.WriteField("negative_prompt", negativePrompt)
+	}
 	if body.Resolution != nil {
-		writer.WriteField("resolution", *body.Resolution)
+		writer.WriteField("resolution", string(*body.Resolution))
 	} else if body.AspectRatio != nil {
-		writer.WriteField("aspect_ratio", *body.AspectRatio)
+		writer.WriteField("aspect_ratio", string(*body.AspectRatio))
 	}
 	if body.NumImages != nil {
 		writer.WriteField("num_images", fmt.Sprintf("%d", *body.NumImages))
 	}
 	if body.StyleType != nil {
-		writer.WriteField("style_type", *body.StyleType)
+		writer.WriteField("style_type", string(*body.StyleType))
 	}
-	if body.ColourPalette != nil {
-		for i, member := range body.ColourPalette.Members {
-			memberPrefix := fmt.Sprintf("colour_palette[members][%d]", i)
-			writer.WriteField(memberPrefix+"[color_hex]", member.ColorHex)
-			if member.ColorWeight != nil {
-				writer.WriteField(memberPrefix+"[color_weight]", *member.ColorWeight)
-			}
-		}
+	if body.RenderingSpeed != nil {
+		writer.WriteField("rendering_speed", string(*body.RenderingSpeed))
+	}
+	if body.MagicPrompt != nil {
+		writer.WriteField("magic_prompt", *body.MagicPrompt)
 	}
+	writeSeed(writer, body.Seed)
+	writeStyleCodes(writer, body.StyleCodes)
+	writeColourPalette(writer, body.ColourPalette)
 
 	writer.Close()
 
 	// Make the request to the ideogram endpoint
-	endpoint := "https://api.ideogram.ai/v1/ideogram-v3/generate"
-	req, err := http.NewRequest("POST", endpoint, &buf)
+	endpoint := ideogramGenerateURL(ideogramVersionV3)
+	req, err := newProviderRequest(ctx, "POST", endpoint, &buf)
 	if err != nil {
 		return "", fmt.Errorf("error creating request: %v", err)
 	}
@@ -267,16 +1379,29 @@ func sendRequestToIdeogram(body IdeogramRequestBody) (string, error) {
 	defer resp.Body.Close()
 	respBody := new(bytes.Buffer)
 	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return "", &ProviderError{Provider: "ideogram", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
 	return respBody.String(), nil
 }
 
 // Download the image from the URL
-func downloadImage(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+func downloadImage(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching image: %v", err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, &DownloadStatusError{URL: url, StatusCode: resp.StatusCode}
+	}
 
 	// Read the image data
 	imageData, err := io.ReadAll(resp.Body)
@@ -287,78 +1412,207 @@ func downloadImage(url string) ([]byte, error) {
 	return imageData, nil
 }
 
-// Upload the image to S3
-func uploadImageToS3(imageData []byte, filename string) (string, error) {
+// Bucket settings read from the Lambda environment
+type S3Settings struct {
+	Bucket string
+	Folder string
+	Region string
+}
+
+func loadS3Settings() (S3Settings, error) {
 	bucket_name := os.Getenv("BUCKET_NAME")
 
 	if bucket_name == "" {
-		return "", fmt.Errorf("BUCKET_NAME is not set")
+		return S3Settings{}, fmt.Errorf("BUCKET_NAME is not set")
 	}
 	folder_name := os.Getenv("FOLDER_NAME")
 
 	if folder_name == "" {
-		return "", fmt.Errorf("FOLDER_NAME is not set")
+		return S3Settings{}, fmt.Errorf("FOLDER_NAME is not set")
 	}
 	bucket_region := os.Getenv("BUCKET_REGION")
 
 	if bucket_region == "" {
-		return "", fmt.Errorf("BUCKET_REGION is not set")
+		return S3Settings{}, fmt.Errorf("BUCKET_REGION is not set")
 	}
 
-	// Create an S3 session
-	sess, err := session.NewSession(&aws.Config{
-		Region: aws.String(bucket_region),
-	})
+	return S3Settings{
+		Bucket: bucket_name,
+		Folder: folder_name,
+		Region: bucket_region,
+	}, nil
+}
+
+// AWS client config for the region. AWS_ENDPOINT_URL sends every client to
+// another endpoint instead, e.g. LocalStack in the integration tests.
+func newAWSConfig(region string) *aws.Config {
+	config := &aws.Config{Region: aws.String(region)}
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+	return config
+}
+
+// Create an S3 service client for the configured region
+func newS3Client(settings S3Settings) (*s3.S3, error) {
+	sess, err := session.NewSession(newAWSConfig(settings.Region))
 	if err != nil {
-		return "", fmt.Errorf("failed to create session: %v", err)
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	return s3.New(sess), nil
+}
+
+// Settings with the folder replaced, unless the override is empty
+func (settings S3Settings) withFolder(folder string) S3Settings {
+	if folder = strings.Trim(folder, "/"); folder != "" {
+		settings.Folder = folder
+	}
+	return settings
+}
+
+// Object key for an image stored under the configured folder. An empty format
+// means PNG.
+func (settings S3Settings) imageKey(filename string, format string) string {
+	return settings.Folder + "/" + filename + formatExtension(format)
+}
+
+// Public URL of an object in the configured bucket
+func (settings S3Settings) objectURL(key string) string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", settings.Bucket, key)
+}
+
+// Per-upload overrides of the bucket defaults
+type UploadOptions struct {
+	// Folder replaces FOLDER_NAME when set
+	Folder string
+	// User metadata stored with the object
+	Metadata map[string]string
+	// Object headers, left unset when empty
+	ContentDisposition string
+	CacheControl       string
+	// Image format, PNG when empty
+	Format string
+	// Object tags, e.g. for lifecycle rules
+	Tags map[string]string
+	// Canned ACL, the bucket default when empty
+	ACL string
+	// Store in the tenant's bucket with their role instead of ours
+	Delivery *TenantDelivery
+}
+
+// Upload options for the request's assets. The provenance metadata is merged
+// over the caller's, so callers cannot forge a manifest.
+func (body IdeogramRequestBody) uploadOptions(provenance map[string]string) UploadOptions {
+	metadata := make(map[string]string, len(body.Metadata)+len(provenance))
+	for key, value := range body.Metadata {
+		metadata[strings.ToLower(key)] = value
+	}
+	for key, value := range provenance {
+		metadata[key] = value
 	}
 
-	// Create an S3 service client
-	s3Svc := s3.New(sess)
+	options := UploadOptions{
+		Folder:       body.Folder,
+		Metadata:     metadata,
+		CacheControl: body.CacheControl,
+		ACL:          body.ACL,
+		Delivery:     body.delivery,
+	}
+	if body.DownloadFileName != "" {
+		options.ContentDisposition = fmt.Sprintf("attachment; filename=%q", body.DownloadFileName)
+	}
+	return options
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+// Bucket an upload with these options is stored in
+func uploadDestination(options UploadOptions) string {
+	if options.Delivery != nil {
+		return options.Delivery.Bucket
+	}
+	return os.Getenv("BUCKET_NAME")
+}
+
+// Upload the image to S3
+func uploadImageToS3(imageData []byte, filename string, options UploadOptions, summary *InvocationSummary) (string, error) {
+	settings, err := loadS3Settings()
+	if err != nil {
+		return "", err
+	}
+	settings, s3Svc, err := uploadTarget(settings.withFolder(options.Folder), options.Delivery)
+	if err != nil {
+		return "", err
+	}
 
 	// Set the bucket and key (file name)
-	key := folder_name + "/" + filename + ".png"
+	key := settings.imageKey(filename, options.Format)
+	if summary.injectFault(faultS3Failure) {
+		return "", injectedS3Failure()
+	}
 
 	// Upload the image
 	_, err = s3Svc.PutObject(&s3.PutObjectInput{
-		Bucket:      aws.String(bucket_name),
-		Key:         aws.String(key),
-		Body:        bytes.NewReader(imageData),
-		ContentType: aws.String("image/png"),
+		Bucket:             aws.String(settings.Bucket),
+		Key:                aws.String(key),
+		Body:               bytes.NewReader(imageData),
+		ContentType:        aws.String(formatContentType(options.Format)),
+		Metadata:           aws.StringMap(options.Metadata),
+		ContentDisposition: optionalString(options.ContentDisposition),
+		CacheControl:       optionalString(options.CacheControl),
+		Tagging:            encodeTagging(options.Tags),
+		ACL:                optionalString(options.ACL),
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to upload image: %v", err)
+		return "", fmt.Errorf("failed to upload image: %v", explainACLError(err, options.ACL))
 	}
 
 	// Return the S3 URL
-	s3URL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s", bucket_name, key)
-	return s3URL, nil
+	return settings.objectURL(key), nil
 }
 
-func removeImageBGviaFreepik(imageUrl string) (string, error) {
+func removeImageBGviaFreepik(ctx context.Context, imageUrl string, apiKey string, summary *InvocationSummary) (string, error) {
 
-	url := "https://api.freepik.com/v1/ai/beta/remove-background"
+	endpoint := freepikRemoveBackgroundURL()
+	if summary.injectFault(faultFreepikTimeout) {
+		return "", injectedFreepikTimeout()
+	}
 
-	payload := strings.NewReader("image_url=" + imageUrl)
+	// Presigned sources carry their own query string, which must stay in the
+	// one form field
+	payload := strings.NewReader(url.Values{"image_url": {imageUrl}}.Encode())
 
-	req, _ := http.NewRequest("POST", url, payload)
+	req, err := newProviderRequest(ctx, "POST", endpoint, payload)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
 
-	req.Header.Add("x-freepik-api-key", os.Getenv("FREEPIK_API_KEY"))
+	req.Header.Add("x-freepik-api-key", apiKey)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	res, err := http.DefaultClient.Do(req)
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	res, err := client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("error sending request to Freepik: %v", err)
 	}
 	defer res.Body.Close()
 	body, _ := io.ReadAll(res.Body)
 
-	// fmt.Println(res)
-	fmt.Println(string(body))
-
+	if res.StatusCode >= 400 {
+		return "", &ProviderError{Provider: "freepik", StatusCode: res.StatusCode, Body: string(body), RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"))}
+	}
 	return string(body), nil
 }
 
 func main() {
-	lambda.Start(handleRequest)
+	checkProviderCredentials()
+	lambda.Start(handleInvocation)
 }
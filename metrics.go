@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const defaultMetricsNamespace = "IdeogramLambda"
+
+// Emit a CloudWatch metric using the Embedded Metric Format: a JSON log line
+// that CloudWatch turns into a metric without any API call from the function
+func emitMetric(name string, value float64, unit string) {
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+	functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+
+	line, err := json.Marshal(map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  namespace,
+				"Dimensions": [][]string{{"FunctionName"}},
+				"Metrics":    []map[string]string{{"Name": name, "Unit": unit}},
+			}},
+		},
+		"FunctionName": functionName,
+		name:           value,
+	})
+	if err != nil {
+		log.Println("Error marshalling metric:", err)
+		return
+	}
+	fmt.Println(string(line))
+}
+
+// Emit a metric split by extra dimensions besides the function name, e.g.
+// bytes uploaded per destination bucket and tenant. Empty dimension values are
+// reported as "none" so the series stay comparable.
+func emitDimensionedMetric(name string, value float64, unit string, dimensions map[string]string) {
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+
+	names := []string{"FunctionName"}
+	fields := map[string]interface{}{
+		"FunctionName": os.Getenv("AWS_LAMBDA_FUNCTION_NAME"),
+		name:           value,
+	}
+	for dimension, dimensionValue := range dimensions {
+		if dimensionValue == "" {
+			dimensionValue = "none"
+		}
+		names = append(names, dimension)
+		fields[dimension] = dimensionValue
+	}
+	sort.Strings(names[1:])
+	fields["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{names},
+			"Metrics":    []map[string]string{{"Name": name, "Unit": unit}},
+		}},
+	}
+
+	line, err := json.Marshal(fields)
+	if err != nil {
+		log.Println("Error marshalling metric:", err)
+		return
+	}
+	fmt.Println(string(line))
+}
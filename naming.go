@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Placeholders a filename may contain, filled in per image once it is
+// generated, e.g. "{prompt_slug}-{seed}-{style}"
+var fileNamePlaceholders = map[string]bool{
+	"prompt_slug": true,
+	"seed":        true,
+	"style":       true,
+	"index":       true,
+	"date":        true,
+}
+
+var fileNamePlaceholderPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// Prompt slugs are cut to this many characters unless FILENAME_SLUG_LENGTH is
+// set
+const defaultFileNameSlugLength = 48
+
+// Longest filename rendered from a template, well within S3's key limit
+const maxRenderedFileNameLength = 200
+
+// What a filename template is rendered from
+type FileNameMetadata struct {
+	Prompt    string
+	Seed      int
+	StyleType string
+	// 1-based position of the image in the response
+	Index int
+}
+
+func isFileNameTemplate(fileName string) bool {
+	return fileNamePlaceholderPattern.MatchString(fileName)
+}
+
+func validateFileNameTemplate(body IdeogramRequestBody) error {
+	for _, fileName := range append([]string{body.FileName}, body.FileNames...) {
+		for _, match := range fileNamePlaceholderPattern.FindAllStringSubmatch(fileName, -1) {
+			if !fileNamePlaceholders[match[1]] {
+				return fmt.Errorf("unknown filename placeholder {%s}, expected {prompt_slug}, {seed}, {style}, {index} or {date}", match[1])
+			}
+		}
+		// The stored key is only known after generating
+		if body.ReuseIfExists && isFileNameTemplate(fileName) {
+			return fmt.Errorf("reuse_if_exists needs a filename without placeholders")
+		}
+	}
+	return nil
+}
+
+func fileNameSlugLength() int {
+	length, err := strconv.Atoi(os.Getenv("FILENAME_SLUG_LENGTH"))
+	if err != nil || length <= 0 {
+		return defaultFileNameSlugLength
+	}
+	return length
+}
+
+// Fill in the placeholders of a filename template. Filenames without
+// placeholders are returned unchanged.
+func renderFileName(template string, metadata FileNameMetadata) string {
+	if !isFileNameTemplate(template) {
+		return template
+	}
+	style := metadata.StyleType
+	if style == "" {
+		style = "auto"
+	}
+	rendered := fileNamePlaceholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		switch strings.Trim(placeholder, "{}") {
+		case "prompt_slug":
+			return slugify(metadata.Prompt, fileNameSlugLength())
+		case "seed":
+			return strconv.Itoa(metadata.Seed)
+		case "style":
+			return slugify(style, fileNameSlugLength())
+		case "index":
+			return strconv.Itoa(metadata.Index)
+		case "date":
+			return time.Now().UTC().Format("20060102")
+		}
+		return placeholder
+	})
+	if len(rendered) > maxRenderedFileNameLength {
+		rendered = strings.TrimRight(rendered[:maxRenderedFileNameLength], "-_.")
+	}
+	return rendered
+}
+
+// Common accented Latin letters and their plain ASCII letters
+var accentFolder = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a",
+	"ç", "c", "è", "e", "é", "e", "ê", "e", "ë", "e",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ñ", "n",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ý", "y", "ÿ", "y", "ß", "ss",
+)
+
+// Lowercase ASCII letters and digits separated by single dashes, at most
+// maxLength long and cut between words where possible. Accents are dropped;
+// any other character separates words.
+func slugify(text string, maxLength int) string {
+	var slug strings.Builder
+	dash := false
+	for _, r := range accentFolder.Replace(strings.ToLower(text)) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			if dash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			slug.WriteRune(r)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	result := slug.String()
+	if len(result) > maxLength {
+		result = result[:maxLength]
+		if cut := strings.LastIndexByte(result, '-'); cut >= maxLength/2 {
+			result = result[:cut]
+		}
+		result = strings.Trim(result, "-")
+	}
+	if result == "" {
+		return "image"
+	}
+	return result
+}
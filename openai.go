@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultOpenAIImagesURL = "https://api.openai.com/v1/images/generations"
+
+// Model selected with OPENAI_IMAGE_MODEL
+const (
+	openAIModelGPTImage = "gpt-image-1"
+	openAIModelDallE3   = "dall-e-3"
+)
+
+// Sizes each model generates, by the aspect ratio they stand for
+var openAIImageSizes = map[string]map[string]string{
+	openAIModelGPTImage: {"1x1": "1024x1024", "3x2": "1536x1024", "2x3": "1024x1536"},
+	openAIModelDallE3:   {"1x1": "1024x1024", "16x9": "1792x1024", "9x16": "1024x1792"},
+}
+
+// Quality for each rendering speed. Unset speeds leave the model's default.
+var openAIImageQualities = map[string]map[string]string{
+	openAIModelGPTImage: {"TURBO": "low", "DEFAULT": "medium", "QUALITY": "high"},
+	openAIModelDallE3:   {"TURBO": "standard", "DEFAULT": "standard", "QUALITY": "hd"},
+}
+
+func init() {
+	registerGenerator("openai", openAIGenerator{})
+}
+
+// OpenAI's Images API. dall-e-3 makes one image per call, so for both models
+// the calls for num_images run concurrently, as with Stability.
+type openAIGenerator struct{}
+
+func openAIImageModel() string {
+	model := strings.ToLower(strings.TrimSpace(os.Getenv("OPENAI_IMAGE_MODEL")))
+	if _, ok := openAIImageSizes[model]; !ok {
+		return openAIModelGPTImage
+	}
+	return model
+}
+
+func openAIImagesURL() string {
+	if url := strings.TrimSpace(os.Getenv("OPENAI_IMAGES_URL")); url != "" {
+		return url
+	}
+	return defaultOpenAIImagesURL
+}
+
+func (openAIGenerator) Name(body IdeogramRequestBody) string {
+	return "openai-" + openAIImageModel()
+}
+
+// Besides Ideogram's own features, OpenAI takes neither seeds nor negative
+// prompts, and each model has three sizes
+func (openAIGenerator) Validate(body IdeogramRequestBody) error {
+	if err := rejectIdeogramOnlyFeatures(body); err != nil {
+		return err
+	}
+	if body.Seed != nil || body.NegativePrompt != "" {
+		return fmt.Errorf("seed and negative_prompt are not available with the openai provider")
+	}
+	sizes := openAIImageSizes[openAIImageModel()]
+	if body.AspectRatio != nil {
+		if _, ok := sizes[string(*body.AspectRatio)]; !ok {
+			supported := make([]string, 0, len(sizes))
+			for ratio := range sizes {
+				supported = append(supported, ratio)
+			}
+			sort.Strings(supported)
+			return fmt.Errorf("aspect_ratio %q is not available with %s, expected one of %s", *body.AspectRatio, openAIImageModel(), strings.Join(supported, ", "))
+		}
+	}
+	return nil
+}
+
+type openAIImageRequest struct {
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n"`
+	Size           string `json:"size,omitempty"`
+	Quality        string `json:"quality,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+}
+
+type openAIImageResponse struct {
+	Data []struct {
+		B64JSON string `json:"b64_json"`
+		// dall-e-3 rewrites prompts and reports what it drew
+		RevisedPrompt string `json:"revised_prompt"`
+	} `json:"data"`
+}
+
+func (openAIGenerator) Generate(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) ([]Image, error) {
+	apiKey := providerCredential("openai")
+	if apiKey == "" {
+		return nil, missingCredentialError("openai")
+	}
+	// OpenAI has no negative prompt; the plain background prompt suffix
+	// carries the convention on its own
+	body, _ = applyPlainBackground(applyPattern(applyBrandFonts(body)))
+
+	model := openAIImageModel()
+	imageRequest := openAIImageRequest{Model: model, Prompt: body.Prompt, N: 1}
+	if body.AspectRatio != nil {
+		imageRequest.Size = openAIImageSizes[model][string(*body.AspectRatio)]
+	}
+	if body.RenderingSpeed != nil {
+		imageRequest.Quality = openAIImageQualities[model][string(*body.RenderingSpeed)]
+	}
+	// gpt-image-1 always returns base64 and rejects response_format
+	if model == openAIModelDallE3 {
+		imageRequest.ResponseFormat = "b64_json"
+	}
+
+	count := 1
+	if body.NumImages != nil {
+		count = *body.NumImages
+	}
+	images := make([]Image, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			images[i], errs[i] = sendRequestToOpenAI(ctx, apiKey, imageRequest)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// Generate one image. Prompts OpenAI's moderation refuses come back as a 400
+// rather than a flagged image, so every image returned is safe.
+func sendRequestToOpenAI(ctx context.Context, apiKey string, imageRequest openAIImageRequest) (Image, error) {
+	payload, err := json.Marshal(imageRequest)
+	if err != nil {
+		return Image{}, fmt.Errorf("error marshalling OpenAI request: %v", err)
+	}
+	req, err := newProviderRequest(ctx, "POST", openAIImagesURL(), bytes.NewReader(payload))
+	if err != nil {
+		return Image{}, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	client := &http.Client{
+		Timeout: 120 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Image{}, fmt.Errorf("error sending request to OpenAI: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := new(bytes.Buffer)
+	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return Image{}, &ProviderError{Provider: "openai", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	var openAIResp openAIImageResponse
+	if err := json.Unmarshal(respBody.Bytes(), &openAIResp); err != nil {
+		return Image{}, fmt.Errorf("error unmarshalling OpenAI response: %v", err)
+	}
+	if len(openAIResp.Data) == 0 {
+		return Image{}, fmt.Errorf("OpenAI returned no images")
+	}
+	data, err := base64.StdEncoding.DecodeString(openAIResp.Data[0].B64JSON)
+	if err != nil {
+		return Image{}, fmt.Errorf("error decoding OpenAI image: %v", err)
+	}
+	prompt := imageRequest.Prompt
+	if openAIResp.Data[0].RevisedPrompt != "" {
+		prompt = openAIResp.Data[0].RevisedPrompt
+	}
+	return Image{
+		Data:        data,
+		Prompt:      prompt,
+		Resolution:  imageRequest.Size,
+		IsImageSafe: true,
+	}, nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/poulav/ideogram-golang-lambda/enums"
+)
+
+// Values accepted by the Ideogram v3 generate endpoint
+var (
+	ideogramStyleTypes = enums.StyleTypes
+
+	ideogramRenderingSpeeds = enums.RenderingSpeeds
+
+	ideogramMagicPromptOptions = []string{"AUTO", "ON", "OFF"}
+
+	ideogramPalettePresets = []string{"EMBER", "FRESH", "JUNGLE", "MAGIC", "MELON", "MOSAIC", "PASTEL", "ULTRAMARINE"}
+
+	// Style codes as Ideogram returns them, e.g. "A1B2C3D4"
+	styleCodePattern = regexp.MustCompile(`^[0-9A-F]{8}$`)
+
+	ideogramAspectRatios = enums.AspectRatios
+
+	ideogramResolutions = enums.Resolutions
+)
+
+// Largest seed Ideogram accepts
+const maxIdeogramSeed = 2147483647
+
+// Supported enums, used to populate Zap dropdowns dynamically
+type OptionsResponse struct {
+	StyleTypes      []string `json:"style_types"`
+	AspectRatios    []string `json:"aspect_ratios"`
+	Resolutions     []string `json:"resolutions"`
+	RenderingSpeeds []string `json:"rendering_speeds"`
+	MagicPrompts    []string `json:"magic_prompts"`
+	PalettePresets  []string `json:"palette_presets"`
+	Providers       []string `json:"providers"`
+	// Services background_remover may name
+	BackgroundRemovers []string `json:"background_removers"`
+	// Used when a request sets no rendering_speed
+	DefaultRenderingSpeed string `json:"default_rendering_speed,omitempty"`
+}
+
+func handleOptionsRequest() (events.LambdaFunctionURLResponse, error) {
+	responseBody, err := json.Marshal(OptionsResponse{
+		StyleTypes:            ideogramStyleTypes,
+		AspectRatios:          ideogramAspectRatios,
+		Resolutions:           ideogramResolutions,
+		RenderingSpeeds:       ideogramRenderingSpeeds,
+		MagicPrompts:          ideogramMagicPromptOptions,
+		PalettePresets:        ideogramPalettePresets,
+		Providers:             availableProviders(),
+		BackgroundRemovers:    backgroundRemoverNames(),
+		DefaultRenderingSpeed: defaultRenderingSpeed(),
+	})
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Rendering speed for requests without one, from DEFAULT_RENDERING_SPEED.
+// Unset or invalid values leave Ideogram's default in place.
+func defaultRenderingSpeed() string {
+	speed := strings.ToUpper(strings.TrimSpace(os.Getenv("DEFAULT_RENDERING_SPEED")))
+	if speed != "" && !containsString(ideogramRenderingSpeeds, speed) {
+		log.Printf("Ignoring DEFAULT_RENDERING_SPEED %q, expected one of %s", speed, strings.Join(ideogramRenderingSpeeds, ", "))
+		return ""
+	}
+	return speed
+}
+
+// Bring the enum fields into the form Ideogram expects: "16:9" becomes "16x9"
+// and style types and rendering speeds are upper-cased
+func normalizeIdeogramRequest(body *IdeogramRequestBody) {
+	if body.AspectRatio != nil {
+		normalized := body.AspectRatio.Normalize()
+		body.AspectRatio = &normalized
+	}
+	if body.Resolution != nil {
+		normalized := body.Resolution.Normalize()
+		body.Resolution = &normalized
+	}
+	if body.StyleType != nil {
+		normalized := body.StyleType.Normalize()
+		body.StyleType = &normalized
+	}
+	if body.RenderingSpeed != nil {
+		normalized := body.RenderingSpeed.Normalize()
+		body.RenderingSpeed = &normalized
+	}
+	if body.MagicPrompt != nil {
+		normalized := strings.ToUpper(strings.TrimSpace(*body.MagicPrompt))
+		body.MagicPrompt = &normalized
+	}
+	body.IdeogramVersion = strings.ToLower(strings.TrimSpace(body.IdeogramVersion))
+	body.Provider = strings.ToLower(strings.TrimSpace(body.Provider))
+	if body.BackgroundRemover == "" {
+		body.BackgroundRemover = body.BGProvider
+	}
+	body.BackgroundRemover = strings.ToLower(strings.TrimSpace(body.BackgroundRemover))
+	body.RemoveBGSize = strings.TrimSpace(body.RemoveBGSize)
+	for i, provider := range body.CompareProviders {
+		body.CompareProviders[i] = strings.ToLower(strings.TrimSpace(provider))
+	}
+	if body.ColourPalette != nil {
+		body.ColourPalette.Name = strings.ToUpper(strings.TrimSpace(body.ColourPalette.Name))
+	}
+	for i, code := range body.StyleCodes {
+		body.StyleCodes[i] = strings.ToUpper(strings.TrimSpace(code))
+	}
+	body.OutputFormat = strings.ToLower(strings.TrimSpace(body.OutputFormat))
+	body.SmartCrop = strings.ReplaceAll(strings.TrimSpace(body.SmartCrop), ":", "x")
+	body.Frame = strings.ToLower(strings.TrimSpace(body.Frame))
+}
+
+// Reject values the Ideogram v3 endpoint would refuse, so Zap authors get a
+// clear 400 instead of an opaque provider error
+func validateIdeogramRequest(body IdeogramRequestBody) error {
+	// Values decoded from a request are checked as they are unmarshalled;
+	// these catch the ones merged in from tenant defaults and policies.
+	// Aspect ratios are checked against the provider's own list later.
+	if body.Resolution != nil {
+		if err := body.Resolution.Validate(); err != nil {
+			return err
+		}
+	}
+	if body.AspectRatio != nil {
+		if err := body.AspectRatio.CheckFormat(); err != nil {
+			return err
+		}
+	}
+	if body.StyleType != nil {
+		if err := body.StyleType.Validate(); err != nil {
+			return err
+		}
+	}
+	if body.RenderingSpeed != nil {
+		if err := body.RenderingSpeed.Validate(); err != nil {
+			return err
+		}
+	}
+	if body.MagicPrompt != nil && !containsString(ideogramMagicPromptOptions, *body.MagicPrompt) {
+		return fmt.Errorf("unsupported magic_prompt %q, expected one of %s", *body.MagicPrompt, strings.Join(ideogramMagicPromptOptions, ", "))
+	}
+	if palette := body.ColourPalette; palette != nil {
+		if palette.Name != "" && len(palette.Members) > 0 {
+			return fmt.Errorf("colour_palette takes a preset name or members, not both")
+		}
+		if palette.Name != "" && !containsString(ideogramPalettePresets, palette.Name) {
+			return fmt.Errorf("unsupported colour_palette preset %q, expected one of %s", palette.Name, strings.Join(ideogramPalettePresets, ", "))
+		}
+	}
+	for _, code := range body.StyleCodes {
+		if !styleCodePattern.MatchString(code) {
+			return fmt.Errorf("invalid style code %q, expected 8 hexadecimal characters", code)
+		}
+	}
+	if len(body.StyleCodes) > 0 && (body.StyleType != nil || len(body.StyleReferenceImages) > 0 || len(body.CompareStyles) > 0) {
+		return fmt.Errorf("style_codes cannot be combined with style_type, style_reference_images or compare_style_types")
+	}
+	if body.SmartCrop != "" {
+		if _, _, err := parseAspectRatio(body.SmartCrop); err != nil {
+			return fmt.Errorf("smart_crop: %v", err)
+		}
+	}
+	if err := validatePattern(body); err != nil {
+		return err
+	}
+	// Refuse before generating rather than fail once the images are paid for
+	if body.removeBackgroundEnabled() {
+		if err := validateBackgroundRemover(body.BackgroundRemover, body.providerKeys); err != nil {
+			return err
+		}
+	}
+	if err := validateRemoveBGSize(body.RemoveBGSize); err != nil {
+		return err
+	}
+	if !body.removeBackgroundEnabled() && (body.DropShadow != nil || body.SmartCrop != "") {
+		return fmt.Errorf("drop_shadow and smart_crop work on the cutout and need remove_background")
+	}
+	if body.DropShadow != nil {
+		if err := body.DropShadow.validate(); err != nil {
+			return err
+		}
+	}
+	if body.Frame != "" && !frameNamePattern.MatchString(body.Frame) {
+		return fmt.Errorf("invalid frame %q, expected lowercase letters, digits, - and _", body.Frame)
+	}
+	for _, name := range body.Processors {
+		if _, ok := externalProcessors()[name]; !ok {
+			return fmt.Errorf("unknown processor %q", name)
+		}
+	}
+	if body.OutputFormat != "" && !containsString([]string{formatPNG, formatAVIF, formatHEIC}, body.OutputFormat) {
+		return fmt.Errorf("output_format must be %s, %s or %s", formatPNG, formatAVIF, formatHEIC)
+	}
+	if body.OutputQuality != nil && (*body.OutputQuality < 1 || *body.OutputQuality > 100) {
+		return fmt.Errorf("output_quality must be between 1 and 100, got %d", *body.OutputQuality)
+	}
+	for name, value := range map[string]*int{"upscale_resemblance": body.UpscaleResemblance, "upscale_detail": body.UpscaleDetail} {
+		if value != nil && (*value < 1 || *value > 100) {
+			return fmt.Errorf("%s must be between 1 and 100, got %d", name, *value)
+		}
+	}
+	if body.PostProcessingOrder != "" && body.PostProcessingOrder != orderUpscaleFirst && body.PostProcessingOrder != orderRemoveBackgroundFirst {
+		return fmt.Errorf("post_processing_order must be %s or %s", orderUpscaleFirst, orderRemoveBackgroundFirst)
+	}
+	if body.Intermediates != "" && !containsString([]string{intermediatesKeep, intermediatesDelete, intermediatesTemp}, body.Intermediates) {
+		return fmt.Errorf("intermediates must be %s, %s or %s", intermediatesKeep, intermediatesDelete, intermediatesTemp)
+	}
+	if body.SourceImageURL != "" && len(body.Prompts) > 0 {
+		return fmt.Errorf("source_image_url cannot be combined with line-item prompts")
+	}
+	if body.Edit != nil {
+		if err := body.Edit.validate(); err != nil {
+			return err
+		}
+		if body.SourceImageURL != "" || len(body.Prompts) > 0 || len(body.CompareStyles) > 0 {
+			return fmt.Errorf("edit cannot be combined with source_image_url, line-item prompts or compare_styles")
+		}
+	}
+	if body.Reframe != nil {
+		if err := body.Reframe.validate(); err != nil {
+			return err
+		}
+		if body.Resolution == nil {
+			return fmt.Errorf("reframe needs the target resolution")
+		}
+		if body.Edit != nil || body.SourceImageURL != "" || len(body.Prompts) > 0 || len(body.CompareStyles) > 0 {
+			return fmt.Errorf("reframe cannot be combined with edit, source_image_url, line-item prompts or compare_styles")
+		}
+	}
+	if err := validateStyleReferenceImages(body); err != nil {
+		return err
+	}
+	if err := validateFileNameTemplate(body); err != nil {
+		return err
+	}
+	if err := validateDraft(body); err != nil {
+		return err
+	}
+	if err := validateProvider(body); err != nil {
+		return err
+	}
+	if err := validateCompareProviders(body); err != nil {
+		return err
+	}
+	if body.ScoreVariants != nil && *body.ScoreVariants && len(body.CompareStyles) == 0 && len(body.CompareProviders) == 0 {
+		return fmt.Errorf("score_variants needs compare_style_types or compare_providers")
+	}
+	if body.ImageWeight != nil {
+		if body.SourceImageURL == "" {
+			return fmt.Errorf("image_weight needs a source_image_url to remix")
+		}
+		if *body.ImageWeight < 1 || *body.ImageWeight > 100 {
+			return fmt.Errorf("image_weight must be between 1 and 100, got %d", *body.ImageWeight)
+		}
+	}
+	if body.PromptTemplate != "" && !strings.Contains(body.PromptTemplate, "{description}") {
+		return fmt.Errorf("prompt_template must contain the {description} placeholder")
+	}
+	if body.Seed != nil && (*body.Seed < 0 || *body.Seed > maxIdeogramSeed) {
+		return fmt.Errorf("seed must be between 0 and %d, got %d", maxIdeogramSeed, *body.Seed)
+	}
+	if body.NumImages != nil && (*body.NumImages < 1 || *body.NumImages > 8) {
+		return fmt.Errorf("num_images must be between 1 and 8, got %d", *body.NumImages)
+	}
+	return validateObjectHeaders(body)
+}
+
+// Each compared provider must exist and support the request as it is sent
+func validateCompareProviders(body IdeogramRequestBody) error {
+	if len(body.CompareProviders) == 0 {
+		return nil
+	}
+	if body.Provider != "" || len(body.CompareStyles) > 0 || len(body.Prompts) > 0 {
+		return fmt.Errorf("compare_providers cannot be combined with provider, compare_style_types or line-item prompts")
+	}
+	seen := map[string]bool{}
+	for _, provider := range body.CompareProviders {
+		if seen[provider] {
+			return fmt.Errorf("compare_providers lists %s twice", provider)
+		}
+		seen[provider] = true
+		variant := body
+		variant.Provider = provider
+		if err := validateProvider(variant); err != nil {
+			return fmt.Errorf("compare_providers: %v", err)
+		}
+	}
+	return nil
+}
+
+// S3 caps user metadata at 2KB, leave room for the provenance manifest
+const maxCallerMetadataBytes = 1024
+
+var metadataKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+func validateObjectHeaders(body IdeogramRequestBody) error {
+	size := 0
+	for key, value := range body.Metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("metadata key %q may only contain letters, digits and dashes", key)
+		}
+		if !isPrintableASCII(value) {
+			return fmt.Errorf("metadata value for %q must be printable ASCII", key)
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxCallerMetadataBytes {
+		return fmt.Errorf("metadata is %d bytes, the limit is %d", size, maxCallerMetadataBytes)
+	}
+	if !isPrintableASCII(body.DownloadFileName) || strings.ContainsAny(body.DownloadFileName, `"\/`) {
+		return fmt.Errorf("download_filename must be printable ASCII without quotes or slashes")
+	}
+	if !isPrintableASCII(body.CacheControl) {
+		return fmt.Errorf("cache_control must be printable ASCII")
+	}
+	return validateObjectACL(body.ACL)
+}
+
+func isPrintableASCII(value string) bool {
+	for _, r := range value {
+		if r < 0x20 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
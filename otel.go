@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenTelemetry export over OTLP/HTTP with JSON encoding, enabled by setting
+// OTEL_EXPORTER_OTLP_ENDPOINT to the collector base URL. Spans join the
+// caller's trace through the traceparent header, so the function shows up in
+// the same Tempo traces as the rest of the stack.
+const otelScopeName = "ideogram-golang-lambda"
+
+// OTLP span kinds
+const (
+	otelSpanKindInternal = 1
+	otelSpanKindServer   = 2
+)
+
+type otelSpan struct {
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+}
+
+// Spans of one invocation, all in the same trace
+type invocationTracer struct {
+	endpoint   string
+	traceID    string
+	rootSpanID string
+	parentID   string
+	start      time.Time
+
+	mu    sync.Mutex
+	spans []otelSpan
+}
+
+// Start tracing the invocation, continuing the caller's trace when a valid
+// traceparent was sent. Returns nil when no collector is configured.
+func newInvocationTracer(traceparent string) *invocationTracer {
+	endpoint := strings.TrimSuffix(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/")
+	if endpoint == "" {
+		return nil
+	}
+	tracer := &invocationTracer{
+		endpoint:   endpoint,
+		traceID:    randomHex(16),
+		rootSpanID: randomHex(8),
+		start:      time.Now(),
+	}
+	// traceparent: version-traceid-parentid-flags
+	parts := strings.Split(traceparent, "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		tracer.traceID = parts[1]
+		tracer.parentID = parts[2]
+	}
+	return tracer
+}
+
+// Trace headers for outbound calls, with traceparent pointing at our span
+func (tracer *invocationTracer) outboundHeaders(headers map[string]string) map[string]string {
+	if tracer == nil {
+		return headers
+	}
+	outbound := make(map[string]string, len(headers)+1)
+	for name, value := range headers {
+		outbound[name] = value
+	}
+	outbound["traceparent"] = fmt.Sprintf("00-%s-%s-01", tracer.traceID, tracer.rootSpanID)
+	return outbound
+}
+
+// Record a pipeline stage as a child span of the invocation
+func (tracer *invocationTracer) addSpan(name string, start time.Time, end time.Time) {
+	if tracer == nil {
+		return
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	tracer.spans = append(tracer.spans, otelSpan{
+		SpanID:       randomHex(8),
+		ParentSpanID: tracer.rootSpanID,
+		Name:         name,
+		Kind:         otelSpanKindInternal,
+		Start:        start,
+		End:          end,
+	})
+}
+
+// Send the invocation's spans and metrics to the collector. This runs before
+// the handler returns, since the environment may be frozen right after.
+func (tracer *invocationTracer) export(summary *InvocationSummary) {
+	if tracer == nil {
+		return
+	}
+	end := time.Now()
+	tracer.mu.Lock()
+	spans := append([]otelSpan{{
+		SpanID:       tracer.rootSpanID,
+		ParentSpanID: tracer.parentID,
+		Name:         summary.Method + " " + summary.Path,
+		Kind:         otelSpanKindServer,
+		Start:        tracer.start,
+		End:          end,
+	}}, tracer.spans...)
+	tracer.mu.Unlock()
+
+	attributes := []map[string]interface{}{
+		otelAttribute("faas.invocation_id", summary.RequestID),
+		otelAttribute("http.response.status_code", summary.StatusCode),
+		otelAttribute("tenant", summary.Tenant),
+	}
+	statusCode := 1 // OK
+	if summary.StatusCode >= 500 {
+		statusCode = 2 // ERROR
+	}
+
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for i, span := range spans {
+		otlpSpan := map[string]interface{}{
+			"traceId":           tracer.traceID,
+			"spanId":            span.SpanID,
+			"name":              span.Name,
+			"kind":              span.Kind,
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.ParentSpanID != "" {
+			otlpSpan["parentSpanId"] = span.ParentSpanID
+		}
+		if i == 0 {
+			otlpSpan["attributes"] = attributes
+			otlpSpan["status"] = map[string]int{"code": statusCode}
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+	tracer.post("/v1/traces", map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource":   otelResource(),
+			"scopeSpans": []map[string]interface{}{{"scope": map[string]string{"name": otelScopeName}, "spans": otlpSpans}},
+		}},
+	})
+
+	now := strconv.FormatInt(end.UnixNano(), 10)
+	tracer.post("/v1/metrics", map[string]interface{}{
+		"resourceMetrics": []map[string]interface{}{{
+			"resource": otelResource(),
+			"scopeMetrics": []map[string]interface{}{{
+				"scope": map[string]string{"name": otelScopeName},
+				"metrics": []map[string]interface{}{
+					{
+						"name": "invocation.duration",
+						"unit": "ms",
+						"gauge": map[string]interface{}{
+							"dataPoints": []map[string]interface{}{{"asDouble": float64(summary.DurationMs), "timeUnixNano": now, "attributes": attributes}},
+						},
+					},
+					{
+						"name": "images.delivered",
+						"unit": "{image}",
+						"sum": map[string]interface{}{
+							"aggregationTemporality": 1, // DELTA
+							"isMonotonic":            true,
+							"dataPoints":             []map[string]interface{}{{"asInt": strconv.Itoa(summary.ImagesDelivered), "timeUnixNano": now, "attributes": attributes}},
+						},
+					},
+				},
+			}},
+		}},
+	})
+}
+
+func (tracer *invocationTracer) post(path string, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Error marshalling OTLP payload:", err)
+		return
+	}
+	req, err := http.NewRequest("POST", tracer.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		log.Println("Error creating OTLP request:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// OTEL_EXPORTER_OTLP_HEADERS follows the spec format: key1=value1,key2=value2
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if key, value, ok := strings.Cut(pair, "="); ok {
+			req.Header.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+	}
+
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Println("Error exporting to OTLP collector:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		log.Printf("OTLP collector rejected %s with status %d", path, resp.StatusCode)
+	}
+}
+
+func otelResource() map[string]interface{} {
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	}
+	return map[string]interface{}{
+		"attributes": []map[string]interface{}{
+			otelAttribute("service.name", serviceName),
+			otelAttribute("cloud.provider", "aws"),
+			otelAttribute("faas.name", os.Getenv("AWS_LAMBDA_FUNCTION_NAME")),
+		},
+	}
+}
+
+func otelAttribute(key string, value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case int:
+		return map[string]interface{}{"key": key, "value": map[string]string{"intValue": strconv.Itoa(v)}}
+	default:
+		return map[string]interface{}{"key": key, "value": map[string]string{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Values of output_format. AVIF and HEIC are encoded by the avifenc (libavif)
+// and heif-enc (libheif) command line tools, which must be available in the
+// Lambda environment, e.g. from a layer.
+const (
+	formatPNG  = "png"
+	formatAVIF = "avif"
+	formatHEIC = "heic"
+)
+
+// Quality used when output_quality is not set
+const defaultOutputQuality = 60
+
+// Encoding one image should never take this long
+const encodeTimeout = 60 * time.Second
+
+// File extension of a stored image. An empty format means PNG.
+func formatExtension(format string) string {
+	switch format {
+	case formatAVIF:
+		return ".avif"
+	case formatHEIC:
+		return ".heic"
+	}
+	return ".png"
+}
+
+func formatContentType(format string) string {
+	switch format {
+	case formatAVIF:
+		return "image/avif"
+	case formatHEIC:
+		return "image/heic"
+	}
+	return "image/png"
+}
+
+// Encoder command for the format, overridable with AVIFENC_PATH and
+// HEIF_ENC_PATH
+func encoderCommand(ctx context.Context, format string, quality int, input string, output string) *exec.Cmd {
+	if format == formatHEIC {
+		binary := os.Getenv("HEIF_ENC_PATH")
+		if binary == "" {
+			binary = "heif-enc"
+		}
+		return exec.CommandContext(ctx, binary, "-q", strconv.Itoa(quality), "-o", output, input)
+	}
+	binary := os.Getenv("AVIFENC_PATH")
+	if binary == "" {
+		binary = "avifenc"
+	}
+	return exec.CommandContext(ctx, binary, "-q", strconv.Itoa(quality), input, output)
+}
+
+// Convert the processed PNG into the requested output format
+func encodeOutputFormat(body IdeogramRequestBody, pngData []byte, summary *InvocationSummary) ([]byte, error) {
+	if body.OutputFormat == "" || body.OutputFormat == formatPNG {
+		return pngData, nil
+	}
+	quality := defaultOutputQuality
+	if body.OutputQuality != nil {
+		quality = *body.OutputQuality
+	}
+
+	stageStart := time.Now()
+	encoded, err := encodeWithTool(body.OutputFormat, quality, pngData)
+	summary.recordStage("encode", stageStart)
+	if err != nil {
+		log.Println("Error encoding image:", err)
+		summary.recordError("encode", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error encoding image as " + body.OutputFormat, Err: err}
+	}
+	return encoded, nil
+}
+
+func encodeWithTool(format string, quality int, pngData []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "encode-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.png")
+	output := filepath.Join(dir, "output"+formatExtension(format))
+	if err := os.WriteFile(input, pngData, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write input image: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), encodeTimeout)
+	defer cancel()
+	if out, err := encoderCommand(ctx, format, quality, input, output).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s encoder failed: %v: %s", format, err, out)
+	}
+	return os.ReadFile(output)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/bedrockruntime"
+)
+
+// Text model rewording rejected prompts unless PARAPHRASE_MODEL_ID is set
+const defaultParaphraseModelID = "anthropic.claude-3-haiku-20240307-v1:0"
+
+// How each provider tells a prompt refused under its content policy apart
+// from a malformed request. Bedrock answers both with a ValidationException,
+// so its refusals are not reworded.
+var contentRejections = map[string]func(providerErr *ProviderError) bool{
+	// Ideogram answers 422 only when the prompt fails its safety check
+	"ideogram": func(providerErr *ProviderError) bool {
+		return providerErr.StatusCode == 422
+	},
+	"openai": func(providerErr *ProviderError) bool {
+		var body struct {
+			Error struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.Unmarshal([]byte(providerErr.Body), &body)
+		return providerErr.StatusCode == 400 && (body.Error.Code == "content_policy_violation" || body.Error.Code == "moderation_blocked")
+	},
+	"stability": func(providerErr *ProviderError) bool {
+		var body struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal([]byte(providerErr.Body), &body)
+		return providerErr.StatusCode == 403 && body.Name == "content_moderation"
+	},
+	// Failed predictions with code E005, see replicateGenerator.Generate
+	"replicate": func(providerErr *ProviderError) bool {
+		return providerErr.StatusCode == 422 && strings.Contains(providerErr.Body, replicateSensitiveCode)
+	},
+}
+
+// Tells the model to keep the subject and drop what a content filter objects
+// to. It answers REFUSE when the subject itself is the problem.
+const paraphraseSystemPrompt = `You rewrite prompts for an image generator whose content filter rejected them.
+Keep the subject, composition, style, colours and any text to render.
+Remove or soften only what a content policy could object to: violence, gore, nudity, real people, trademarks, drugs, hate.
+Answer with the rewritten prompt alone, on one line, without quotes or commentary.
+If the prompt cannot be made acceptable without changing what it asks for, answer REFUSE.`
+
+// What happened when a rejected prompt was reworded and retried
+type PromptParaphraseReport struct {
+	OriginalPrompt    string `json:"original_prompt"`
+	ParaphrasedPrompt string `json:"paraphrased_prompt,omitempty"`
+	// Why the retry ran: "rejected" when the provider refused the prompt,
+	// "unsafe" when every image was flagged even after the safety retry
+	Reason    string `json:"reason"`
+	Succeeded bool   `json:"succeeded"`
+	// Why no reworded prompt could be tried
+	Error string `json:"error,omitempty"`
+}
+
+// Off unless the request or PARAPHRASE_ON_REJECTION turns it on, since it
+// sends the prompt to a second model
+func (body IdeogramRequestBody) paraphraseEnabled() bool {
+	return stageEnabled(body.ParaphraseOnRejection, "PARAPHRASE_ON_REJECTION", false)
+}
+
+func paraphraseModelID() string {
+	if model := strings.TrimSpace(os.Getenv("PARAPHRASE_MODEL_ID")); model != "" {
+		return model
+	}
+	return defaultParaphraseModelID
+}
+
+// The Bedrock guardrail the paraphrase runs through, nil when
+// PARAPHRASE_GUARDRAIL_ID is unset. The version defaults to DRAFT.
+func paraphraseGuardrail() *bedrockruntime.GuardrailConfiguration {
+	id := strings.TrimSpace(os.Getenv("PARAPHRASE_GUARDRAIL_ID"))
+	if id == "" {
+		return nil
+	}
+	version := strings.TrimSpace(os.Getenv("PARAPHRASE_GUARDRAIL_VERSION"))
+	if version == "" {
+		version = "DRAFT"
+	}
+	return &bedrockruntime.GuardrailConfiguration{
+		GuardrailIdentifier: aws.String(id),
+		GuardrailVersion:    aws.String(version),
+	}
+}
+
+// Whether the provider refused the prompt for content policy reasons
+func isContentRejection(err error) bool {
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) {
+		return false
+	}
+	rejected, ok := contentRejections[providerErr.Provider]
+	return ok && rejected(providerErr)
+}
+
+// Reword the prompt with the paraphrase model. A guardrail intervention, a
+// refusal, an empty answer or one over the prompt limit is an error, so only
+// a usable prompt is ever sent back to the provider.
+func paraphrasePrompt(prompt string, summary *InvocationSummary) (string, error) {
+	stageStart := time.Now()
+	defer summary.recordStage("paraphrase", stageStart)
+
+	sess, err := session.NewSession(newAWSConfig(bedrockRegion()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %v", err)
+	}
+	output, err := bedrockruntime.New(sess).Converse(&bedrockruntime.ConverseInput{
+		ModelId: aws.String(paraphraseModelID()),
+		System:  []*bedrockruntime.SystemContentBlock{{Text: aws.String(paraphraseSystemPrompt)}},
+		Messages: []*bedrockruntime.Message{{
+			Role:    aws.String(bedrockruntime.ConversationRoleUser),
+			Content: []*bedrockruntime.ContentBlock{{Text: aws.String(prompt)}},
+		}},
+		InferenceConfig: &bedrockruntime.InferenceConfiguration{
+			MaxTokens:   aws.Int64(int64(promptTokenLimit())),
+			Temperature: aws.Float64(0.2),
+		},
+		GuardrailConfig: paraphraseGuardrail(),
+	})
+	if err != nil {
+		if failure, ok := err.(awserr.RequestFailure); ok {
+			return "", &ProviderError{Provider: "bedrock", StatusCode: failure.StatusCode(), Body: failure.Message()}
+		}
+		return "", fmt.Errorf("error invoking Bedrock: %v", err)
+	}
+	if aws.StringValue(output.StopReason) == bedrockruntime.StopReasonGuardrailIntervened {
+		return "", fmt.Errorf("the paraphrase guardrail blocked the prompt")
+	}
+
+	var paraphrased string
+	if output.Output != nil && output.Output.Message != nil {
+		for _, block := range output.Output.Message.Content {
+			paraphrased += aws.StringValue(block.Text)
+		}
+	}
+	paraphrased = strings.Trim(strings.TrimSpace(paraphrased), `"`)
+	switch {
+	case paraphrased == "":
+		return "", fmt.Errorf("the paraphrase model returned nothing")
+	case strings.EqualFold(paraphrased, "REFUSE"):
+		return "", fmt.Errorf("the prompt cannot be reworded without changing what it asks for")
+	case strings.EqualFold(paraphrased, strings.TrimSpace(prompt)):
+		return "", fmt.Errorf("the paraphrase model returned the prompt unchanged")
+	case estimatePromptTokens(paraphrased) > promptTokenLimit():
+		return "", fmt.Errorf("the paraphrased prompt is over the %d token limit", promptTokenLimit())
+	}
+	return paraphrased, nil
+}
+
+// Reword the rejected prompt and generate once more. The report is nil when
+// paraphrasing is off; otherwise it says what was tried, and the images and
+// error are those of the retry, or the original ones when no usable
+// paraphrase came back.
+func retryWithParaphrase(ctx context.Context, ideogramRequestBody IdeogramRequestBody, originalPrompt string, reason string, images []Image, genErr error, summary *InvocationSummary) (IdeogramRequestBody, []Image, *PromptParaphraseReport, error) {
+	if !ideogramRequestBody.paraphraseEnabled() {
+		return ideogramRequestBody, images, nil, genErr
+	}
+	report := &PromptParaphraseReport{OriginalPrompt: originalPrompt, Reason: reason}
+	paraphrased, err := paraphrasePrompt(originalPrompt, summary)
+	if err != nil {
+		log.Println("Error paraphrasing rejected prompt:", err)
+		summary.recordError("paraphrase", err)
+		report.Error = err.Error()
+		return ideogramRequestBody, images, report, genErr
+	}
+
+	retryBody := ideogramRequestBody
+	retryBody.Prompt = paraphrased
+	report.ParaphrasedPrompt = paraphrased
+	if err := checkParaphrasedRequest(retryBody); err != nil {
+		log.Println("Paraphrased prompt not sent:", err)
+		summary.recordError("paraphrase", err)
+		report.Error = err.Error()
+		return ideogramRequestBody, images, report, genErr
+	}
+	summary.recordRetry("paraphrase")
+	log.Println("Prompt rejected, retrying with paraphrased prompt:", paraphrased)
+
+	images, err = generateImages(ctx, retryBody, summary)
+	report.Succeeded = err == nil && !allImagesUnsafe(images)
+	if report.Succeeded {
+		summary.recordFallback("paraphrase", "The prompt was rejected by the image provider and was reworded: "+paraphrased)
+	}
+	return retryBody, images, report, err
+}
+
+// Hold the reworded request to the caller's key policy again, and treat the
+// model's prompt like end-user text: anything the prompt sanitization would
+// strip keeps it from being sent
+func checkParaphrasedRequest(body IdeogramRequestBody) error {
+	if body.policyKey != nil {
+		if err := enforceKeyPolicy(*body.policyKey, body); err != nil {
+			return err
+		}
+	}
+	if _, removed := stripPromptFragment(body.Prompt); len(removed) > 0 {
+		return fmt.Errorf("the paraphrased prompt has content the prompt sanitization removes: %s", strings.Join(removed, "; "))
+	}
+	return nil
+}
+
+// A 422 Zap owners can act on, saying the prompt was refused and whether
+// rewording it helped
+func contentRejectionError(report *PromptParaphraseReport, err error) error {
+	message := "The image provider rejected the prompt under its content policy. Try rewording it"
+	if report == nil {
+		message += ", or send paraphrase_on_rejection true to have it reworded automatically"
+	} else if report.ParaphrasedPrompt != "" {
+		message = fmt.Sprintf("The image provider rejected the prompt under its content policy, and also rejected the reworded prompt %q. Try a different prompt", report.ParaphrasedPrompt)
+	} else {
+		message += fmt.Sprintf(" (automatic rewording failed: %s)", report.Error)
+	}
+	return &PipelineError{StatusCode: 422, Message: message, Err: err}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// Seamless patterns for packaging and backgrounds. The prompt asks for a
+// tileable image, the opposite borders are compared to check it tiles, and a
+// visible seam can be blended away. Unset fields take the defaults below.
+type PatternOptions struct {
+	// Blend the borders into each other when the seams are visible
+	AutoFix *bool `json:"auto_fix,omitempty"`
+	// Largest seam_difference that still tiles without a visible seam
+	MaxSeamDifference *float64 `json:"max_seam_difference,omitempty"`
+	// Copies per side in the tiled preview
+	PreviewTiles *int `json:"preview_tiles,omitempty"`
+}
+
+const (
+	defaultMaxSeamDifference = 8
+	defaultPreviewTiles      = 3
+)
+
+// Appended to the prompt in pattern mode
+const patternPromptSuffix = "seamless tileable repeating pattern, motifs continue across the edges, even lighting, no border, no vignette"
+
+// Key suffix of the tiled preview
+const patternPreviewSuffix = "-tiled"
+
+// How one image tiles, reported under its image_metadata
+type PatternReport struct {
+	// Mean difference across the wrap-around seams, from 0 to 255, beyond the
+	// image's own difference between neighbouring pixels
+	SeamDifference float64 `json:"seam_difference"`
+	// The difference before auto_fix blended the borders, when it ran
+	OriginalSeamDifference *float64 `json:"original_seam_difference,omitempty"`
+	Fixed                  bool     `json:"fixed,omitempty"`
+	Seamless               bool     `json:"seamless"`
+	// The image tiled preview_tiles times each way, scaled to its size
+	PreviewURL string `json:"preview_url,omitempty"`
+}
+
+// Resolved pattern settings
+func (pattern PatternOptions) settings() (autoFix bool, maxSeamDifference float64, previewTiles int) {
+	autoFix, maxSeamDifference, previewTiles = true, defaultMaxSeamDifference, defaultPreviewTiles
+	if pattern.AutoFix != nil {
+		autoFix = *pattern.AutoFix
+	}
+	if pattern.MaxSeamDifference != nil {
+		maxSeamDifference = *pattern.MaxSeamDifference
+	}
+	if pattern.PreviewTiles != nil {
+		previewTiles = *pattern.PreviewTiles
+	}
+	return autoFix, maxSeamDifference, previewTiles
+}
+
+func (pattern PatternOptions) validate() error {
+	_, maxSeamDifference, previewTiles := pattern.settings()
+	if math.IsNaN(maxSeamDifference) || maxSeamDifference < 0 || maxSeamDifference > 255 {
+		return fmt.Errorf("pattern.max_seam_difference must be between 0 and 255")
+	}
+	if previewTiles < 2 || previewTiles > 6 {
+		return fmt.Errorf("pattern.preview_tiles must be between 2 and 6, got %d", previewTiles)
+	}
+	return nil
+}
+
+// Patterns fill the whole tile, so the stages that cut out or frame the
+// subject cannot be combined with them
+func validatePattern(body IdeogramRequestBody) error {
+	if body.Pattern == nil {
+		return nil
+	}
+	if err := body.Pattern.validate(); err != nil {
+		return err
+	}
+	if body.removeBackgroundEnabled() {
+		return fmt.Errorf("pattern keeps the image's background and cannot be combined with remove_background")
+	}
+	if body.PlainBackground || body.Frame != "" {
+		return fmt.Errorf("pattern cannot be combined with plain_background or frame")
+	}
+	return nil
+}
+
+// Ask for a tileable image in pattern mode
+func applyPattern(body IdeogramRequestBody) IdeogramRequestBody {
+	if body.Pattern != nil {
+		body.Prompt = strings.TrimRight(strings.TrimSpace(body.Prompt), ".,") + ", " + patternPromptSuffix
+	}
+	return body
+}
+
+// Check the image tiles and, with auto_fix, blend visible seams away
+func seamlessPatternStep(ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) ([]byte, *PatternReport, error) {
+	autoFix, maxSeamDifference, _ := ideogramRequestBody.Pattern.settings()
+	stageStart := time.Now()
+	defer summary.recordStage("pattern", stageStart)
+
+	img, err := decodeNRGBA(imageData)
+	if err != nil {
+		log.Println("Error checking pattern seams:", err)
+		summary.recordError("pattern", err)
+		return nil, nil, &PipelineError{StatusCode: 500, Message: "Error checking pattern seams", Err: err}
+	}
+	report := &PatternReport{SeamDifference: seamDifference(img)}
+	if report.SeamDifference > maxSeamDifference && autoFix {
+		original := report.SeamDifference
+		report.OriginalSeamDifference = &original
+		blendSeams(img)
+		report.SeamDifference = seamDifference(img)
+		report.Fixed = true
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			summary.recordError("pattern", err)
+			return nil, nil, &PipelineError{StatusCode: 500, Message: "Error checking pattern seams", Err: err}
+		}
+		imageData = buf.Bytes()
+	}
+	report.SeamDifference = math.Round(report.SeamDifference*100) / 100
+	report.Seamless = report.SeamDifference <= maxSeamDifference
+	if !report.Seamless {
+		summary.recordFallback("pattern_seams", fmt.Sprintf("Pattern seams remain visible (seam_difference %.2f over %g)", report.SeamDifference, maxSeamDifference))
+	}
+	return imageData, report, nil
+}
+
+func decodeNRGBA(imageData []byte) (*image.NRGBA, error) {
+	src, err := png.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+	bounds := src.Bounds()
+	img := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(img, img.Rect, src, bounds.Min, draw.Src)
+	return img, nil
+}
+
+// How much more the opposite borders differ than neighbouring pixels do on
+// average, the worse of the two axes. Textured patterns differ from pixel to
+// pixel anyway; only a jump beyond that shows as a seam.
+func seamDifference(img *image.NRGBA) float64 {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if width < 2 || height < 2 {
+		return 0
+	}
+	columns := func(a, b int) float64 {
+		var sum float64
+		for y := 0; y < height; y++ {
+			sum += pixelDifference(img, a, y, b, y)
+		}
+		return sum / float64(height)
+	}
+	rows := func(a, b int) float64 {
+		var sum float64
+		for x := 0; x < width; x++ {
+			sum += pixelDifference(img, x, a, x, b)
+		}
+		return sum / float64(width)
+	}
+
+	var neighbours float64
+	for x := 0; x < width-1; x++ {
+		neighbours += columns(x, x+1)
+	}
+	horizontal := columns(width-1, 0) - neighbours/float64(width-1)
+	neighbours = 0
+	for y := 0; y < height-1; y++ {
+		neighbours += rows(y, y+1)
+	}
+	vertical := rows(height-1, 0) - neighbours/float64(height-1)
+	return math.Max(0, math.Max(horizontal, vertical))
+}
+
+// Mean absolute difference of the colour channels of two pixels
+func pixelDifference(img *image.NRGBA, x1, y1, x2, y2 int) float64 {
+	a := img.Pix[img.PixOffset(x1, y1):]
+	b := img.Pix[img.PixOffset(x2, y2):]
+	var sum float64
+	for c := 0; c < 3; c++ {
+		sum += math.Abs(float64(a[c]) - float64(b[c]))
+	}
+	return sum / 3
+}
+
+// Blend a band along each border with its mirror image across the seam.
+// Pixels on the border become the average of both sides, so the tile's edges
+// meet, fading to untouched a sixteenth of the way in.
+func blendSeams(img *image.NRGBA) {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	blend := func(x1, y1, x2, y2 int, weight float64) {
+		a := img.Pix[img.PixOffset(x1, y1):]
+		b := img.Pix[img.PixOffset(x2, y2):]
+		for c := 0; c < 4; c++ {
+			va, vb := float64(a[c]), float64(b[c])
+			a[c] = uint8(math.Round(va*(1-weight) + vb*weight))
+			b[c] = uint8(math.Round(vb*(1-weight) + va*weight))
+		}
+	}
+	band := max(width/16, 1)
+	for d := 0; d < band && d < width/2; d++ {
+		weight := 0.5 * (1 - float64(d)/float64(band))
+		for y := 0; y < height; y++ {
+			blend(d, y, width-1-d, y, weight)
+		}
+	}
+	band = max(height/16, 1)
+	for d := 0; d < band && d < height/2; d++ {
+		weight := 0.5 * (1 - float64(d)/float64(band))
+		for x := 0; x < width; x++ {
+			blend(x, d, x, height-1-d, weight)
+		}
+	}
+}
+
+// The image tiled n times each way, averaged down to its own size
+func renderTiledPreview(imageData []byte, tiles int) ([]byte, error) {
+	img, err := decodeNRGBA(imageData)
+	if err != nil {
+		return nil, err
+	}
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	preview := image.NewNRGBA(img.Rect)
+	samples := float64(tiles * tiles)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var sum [4]float64
+			for j := 0; j < tiles; j++ {
+				for i := 0; i < tiles; i++ {
+					p := img.Pix[img.PixOffset((x*tiles+i)%width, (y*tiles+j)%height):]
+					for c := 0; c < 4; c++ {
+						sum[c] += float64(p[c])
+					}
+				}
+			}
+			out := preview.Pix[preview.PixOffset(x, y):]
+			for c := 0; c < 4; c++ {
+				out[c] = uint8(math.Round(sum[c] / samples))
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, preview); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Store the tiled preview as <filename>-tiled next to the image
+func storePatternPreview(ideogramRequestBody IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) (string, error) {
+	_, _, tiles := ideogramRequestBody.Pattern.settings()
+	stageStart := time.Now()
+	preview, err := renderTiledPreview(imageData, tiles)
+	summary.recordStage("pattern", stageStart)
+	if err != nil {
+		log.Println("Error rendering tiled preview:", err)
+		summary.recordError("pattern", err)
+		return "", &PipelineError{StatusCode: 500, Message: "Error rendering tiled preview", Err: err}
+	}
+
+	provenance, err := buildProvenanceMetadata(preview, ideogramRequestBody.Prompt, generator+"+tiled-preview")
+	if err != nil {
+		log.Println("Error building provenance manifest:", err)
+		return "", &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+
+	stageStart = time.Now()
+	options := ideogramRequestBody.uploadOptions(provenance)
+	previewURL, err := uploadImageToS3(preview, ideogramRequestBody.FileName+patternPreviewSuffix, options, summary)
+	summary.recordStage("s3_upload", stageStart)
+	if err != nil {
+		log.Println("Error uploading tiled preview to S3:", err)
+		summary.recordError("s3_upload", err)
+		return "", &PipelineError{StatusCode: 500, Message: "Error uploading image to S3", Err: err}
+	}
+	summary.addUploadedBytes(uploadDestination(options), len(preview))
+	summary.addAssets(previewURL)
+	return previewURL, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultPhotoroomURL = "https://sdk.photoroom.com/v1/segment"
+
+// Output sizes Photoroom accepts; full keeps the source's resolution
+var photoroomSizes = []string{"preview", "medium", "hd", "full"}
+
+func photoroomURL() string {
+	if url := strings.TrimSpace(os.Getenv("PHOTOROOM_URL")); url != "" {
+		return url
+	}
+	return defaultPhotoroomURL
+}
+
+// PHOTOROOM_SIZE when it is one Photoroom accepts, else full
+func photoroomSize() string {
+	if size := strings.TrimSpace(os.Getenv("PHOTOROOM_SIZE")); containsString(photoroomSizes, size) {
+		return size
+	}
+	return "full"
+}
+
+// Photoroom only takes the image as an upload and answers with the cutout's
+// bytes, so it never needs to reach our bucket
+type photoroomRemover struct{}
+
+func init() {
+	registerBackgroundRemover(photoroomRemover{})
+}
+
+func (photoroomRemover) Name() string { return "photoroom" }
+
+func (photoroomRemover) Configured(keys ProviderKeys) error {
+	if os.Getenv("PHOTOROOM_API_KEY") == "" {
+		return fmt.Errorf("background remover photoroom is not configured in this deployment, set PHOTOROOM_API_KEY")
+	}
+	return nil
+}
+
+func (photoroomRemover) RemoveBackground(ctx context.Context, source BackgroundRemovalSource, summary *InvocationSummary) ([]byte, error) {
+	imageData, err := source.bytes(ctx, summary)
+	if err != nil {
+		log.Println("Error downloading image:", err)
+		summary.recordError("download", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error downloading image", Err: err}
+	}
+
+	var payload bytes.Buffer
+	writer := multipart.NewWriter(&payload)
+	writer.WriteField("format", "png")
+	writer.WriteField("size", photoroomSize())
+	part, err := writer.CreateFormFile("image_file", "image.png")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(imageData)
+	writer.Close()
+
+	req, err := newProviderRequest(ctx, "POST", photoroomURL(), &payload)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Photoroom request: %v", err)
+	}
+	req.Header.Set("X-Api-Key", os.Getenv("PHOTOROOM_API_KEY"))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "image/png, application/json")
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	stageStart := time.Now()
+	resp, err := client.Do(req)
+	summary.recordStage("photoroom", stageStart)
+	if err != nil {
+		summary.recordError("photoroom", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error removing image background", Err: fmt.Errorf("error sending request to Photoroom: %v", err)}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		summary.recordError("photoroom", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error removing image background", Err: err}
+	}
+
+	if resp.StatusCode >= 400 {
+		err := &ProviderError{Provider: "photoroom", StatusCode: resp.StatusCode, Body: photoroomErrorMessage(body), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		log.Println("Error removing image background:", err)
+		summary.recordError("photoroom", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error removing image background", Err: err}
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") || http.DetectContentType(body) != "image/png" {
+		err := newSchemaError("photoroom", "response is not a PNG", string(body))
+		summary.recordError("photoroom", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+	summary.addDownloadedBytes(len(body))
+	return body, nil
+}
+
+// Photoroom reports errors as {"detail": ...}, older versions as
+// {"error": {"message": ...}}; keep the message rather than the whole body
+func photoroomErrorMessage(body []byte) string {
+	var response struct {
+		Detail string `json:"detail"`
+		Error  struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &response) != nil {
+		return string(body)
+	}
+	if response.Detail != "" {
+		return response.Detail
+	}
+	if response.Error.Message != "" {
+		return response.Error.Message
+	}
+	return string(body)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Header identifying the caller whose policy applies
+const callerAPIKeyHeader = "x-api-key"
+
+// What one caller API key may request, configured as a JSON map from API key
+// to policy in KEY_POLICIES. The "*" entry applies to keys without their own.
+// Empty lists and a zero max_num_images leave that field unrestricted.
+type KeyPolicy struct {
+	StyleTypes      []string `json:"style_types,omitempty"`
+	Resolutions     []string `json:"resolutions,omitempty"`
+	RenderingSpeeds []string `json:"rendering_speeds,omitempty"`
+	MaxNumImages    int      `json:"max_num_images,omitempty"`
+	// Tenant the key belongs to. Its requests are confined to the tenant's
+	// prefix whatever X-Tenant-Id they send.
+	Tenant string `json:"tenant,omitempty"`
+	// Lets a tenant's key use the admin routes for that tenant's assets
+	Admin bool `json:"admin,omitempty"`
+}
+
+// Policy violations are answered with a 403 rather than a 400: the request is
+// valid, just not for this key
+type PolicyError struct {
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Message
+}
+
+// Look up the policy for the caller's key. Returns nil when no policy applies.
+func loadKeyPolicy(apiKey string) (*KeyPolicy, error) {
+	policies, err := loadKeyPolicies()
+	if err != nil {
+		return nil, err
+	}
+	if policy, ok := policies[apiKey]; ok && apiKey != "" {
+		return &policy, nil
+	}
+	if policy, ok := policies["*"]; ok {
+		return &policy, nil
+	}
+	return nil, nil
+}
+
+func loadKeyPolicies() (map[string]KeyPolicy, error) {
+	raw := os.Getenv("KEY_POLICIES")
+	if raw == "" {
+		return nil, nil
+	}
+	var policies map[string]KeyPolicy
+	if err := json.Unmarshal([]byte(raw), &policies); err != nil {
+		return nil, fmt.Errorf("KEY_POLICIES is not valid JSON: %v", err)
+	}
+	return policies, nil
+}
+
+// Check the request against the caller's policy. Fields left out fall back to
+// Ideogram's defaults and are not checked.
+func enforceKeyPolicy(apiKey string, body IdeogramRequestBody) error {
+	policy, err := loadKeyPolicy(apiKey)
+	if err != nil || policy == nil {
+		return err
+	}
+
+	styles := append([]string{}, body.CompareStyles...)
+	if body.StyleType != nil {
+		styles = append(styles, string(*body.StyleType))
+	}
+	for _, style := range styles {
+		style = strings.ToUpper(strings.TrimSpace(style))
+		if len(policy.StyleTypes) > 0 && !containsString(policy.StyleTypes, style) {
+			return &PolicyError{fmt.Sprintf("style_type %s is not allowed for this API key, allowed: %s", style, strings.Join(policy.StyleTypes, ", "))}
+		}
+	}
+	if body.Resolution != nil && len(policy.Resolutions) > 0 && !containsString(policy.Resolutions, string(*body.Resolution)) {
+		return &PolicyError{fmt.Sprintf("resolution %s is not allowed for this API key, allowed: %s", *body.Resolution, strings.Join(policy.Resolutions, ", "))}
+	}
+	if body.RenderingSpeed != nil && len(policy.RenderingSpeeds) > 0 && !containsString(policy.RenderingSpeeds, string(*body.RenderingSpeed)) {
+		return &PolicyError{fmt.Sprintf("rendering_speed %s is not allowed for this API key, allowed: %s", *body.RenderingSpeed, strings.Join(policy.RenderingSpeeds, ", "))}
+	}
+	if body.NumImages != nil && policy.MaxNumImages > 0 && *body.NumImages > policy.MaxNumImages {
+		return &PolicyError{fmt.Sprintf("num_images %d is above the limit of %d for this API key", *body.NumImages, policy.MaxNumImages)}
+	}
+	return nil
+}
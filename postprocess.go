@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+// Post-processing steps applied to every generated image
+const (
+	stepUpscale          = "upscale"
+	stepRemoveBackground = "remove_background"
+	stepSmartCrop        = "smart_crop"
+	stepDropShadow       = "drop_shadow"
+	stepFrame            = "frame"
+	stepWatermark        = "watermark"
+	stepBrandLogo        = "brand_logo"
+	stepBrandWatermark   = "brand_watermark"
+)
+
+// Values of post_processing_order. Cutout edges around hair and text come out
+// differently depending on which step runs first.
+const (
+	orderUpscaleFirst          = "upscale_first"
+	orderRemoveBackgroundFirst = "remove_background_first"
+)
+
+// Steps to run, in order. Background removal runs unless switched off;
+// upscaling is opt-in and runs after it unless the caller asks for
+// upscale_first. Smart cropping needs the cutout's alpha channel and runs
+// after the drop shadow, so the frame takes the shadow into account. External
+// processors run on the finished cutout, and brand frames wrap the result.
+// Drafts are watermarked last, over everything else.
+func (body IdeogramRequestBody) postProcessingSteps() []string {
+	var steps []string
+	if body.removeBackgroundEnabled() {
+		steps = append(steps, stepRemoveBackground)
+	}
+	if body.upscaleEnabled() {
+		if body.PostProcessingOrder == orderUpscaleFirst {
+			steps = append([]string{stepUpscale}, steps...)
+		} else {
+			steps = append(steps, stepUpscale)
+		}
+	}
+	if body.DropShadow != nil {
+		steps = append(steps, stepDropShadow)
+	}
+	if body.SmartCrop != "" {
+		steps = append(steps, stepSmartCrop)
+	}
+	for _, name := range body.Processors {
+		steps = append(steps, externalStepPrefix+name)
+	}
+	if body.Frame != "" {
+		steps = append(steps, stepFrame)
+	}
+	if body.brandLogoEnabled() {
+		steps = append(steps, stepBrandLogo)
+	}
+	if body.brandWatermarkEnabled() {
+		steps = append(steps, stepBrandWatermark)
+	}
+	if body.Draft {
+		steps = append(steps, stepWatermark)
+	}
+	return steps
+}
+
+// Key suffix of the image kept from before upscaling
+const originalSuffix = "-original"
+
+// Settings sent to Ideogram's upscale endpoint, from 1 to 100. Unset values
+// take Ideogram's defaults.
+type UpscaleParams struct {
+	Resemblance *int `json:"resemblance,omitempty"`
+	Detail      *int `json:"detail,omitempty"`
+}
+
+func upscaleStep(ctx context.Context, ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) ([]byte, error) {
+	stageStart := time.Now()
+	upscaled, err := upscaleImage(ctx, imageData, UpscaleParams{
+		Resemblance: ideogramRequestBody.UpscaleResemblance,
+		Detail:      ideogramRequestBody.UpscaleDetail,
+	}, ideogramRequestBody.providerKeys, summary)
+	summary.recordStage("upscale", stageStart)
+	if err != nil {
+		log.Println("Error upscaling image:", err)
+		summary.recordError("upscale", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error upscaling image", Err: err}
+	}
+	// Ideogram upscales onto an opaque canvas, so a cutout gets its mask back
+	upscaled, err = reapplyCutoutMask(imageData, upscaled)
+	if err != nil {
+		log.Println("Error restoring cutout transparency:", err)
+		summary.recordError("upscale", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error restoring cutout transparency", Err: err}
+	}
+	return upscaled, nil
+}
+
+// Give the upscaled image the alpha channel of the cutout it was made from,
+// scaled up bilinearly. Images without transparency are returned unchanged.
+func reapplyCutoutMask(cutoutData []byte, upscaledData []byte) ([]byte, error) {
+	cutout, err := png.Decode(bytes.NewReader(cutoutData))
+	if err != nil {
+		// Not a PNG, so there is no mask to keep
+		return upscaledData, nil
+	}
+	if opaque, ok := cutout.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return upscaledData, nil
+	}
+	upscaled, err := png.Decode(bytes.NewReader(upscaledData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode upscaled image: %v", err)
+	}
+
+	mask := image.NewAlpha(image.Rect(0, 0, cutout.Bounds().Dx(), cutout.Bounds().Dy()))
+	draw.Draw(mask, mask.Rect, cutout, cutout.Bounds().Min, draw.Src)
+	bounds := upscaled.Bounds()
+	out := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(out, out.Rect, upscaled, bounds.Min, draw.Src)
+
+	scaleX := float64(mask.Rect.Dx()) / float64(out.Rect.Dx())
+	scaleY := float64(mask.Rect.Dy()) / float64(out.Rect.Dy())
+	for y := 0; y < out.Rect.Dy(); y++ {
+		for x := 0; x < out.Rect.Dx(); x++ {
+			alpha := sampleAlpha(mask, (float64(x)+0.5)*scaleX-0.5, (float64(y)+0.5)*scaleY-0.5)
+			out.Pix[out.PixOffset(x, y)+3] = alpha
+		}
+	}
+	return encodePNG(out)
+}
+
+// Bilinear sample of the mask, clamped at its edges
+func sampleAlpha(mask *image.Alpha, fx float64, fy float64) uint8 {
+	clamp := func(v int, limit int) int {
+		return min(max(v, 0), limit-1)
+	}
+	x0, y0 := int(math.Floor(fx)), int(math.Floor(fy))
+	tx, ty := fx-float64(x0), fy-float64(y0)
+	at := func(x int, y int) float64 {
+		return float64(mask.AlphaAt(clamp(x, mask.Rect.Dx()), clamp(y, mask.Rect.Dy())).A)
+	}
+	top := at(x0, y0)*(1-tx) + at(x0+1, y0)*tx
+	bottom := at(x0, y0+1)*(1-tx) + at(x0+1, y0+1)*tx
+	return uint8(math.Round(top*(1-ty) + bottom*ty))
+}
+
+// Store the image about to be upscaled as <filename>-original.png
+func storeOriginalBeforeUpscale(ideogramRequestBody IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) (string, error) {
+	provenance, err := buildProvenanceMetadata(imageData, ideogramRequestBody.Prompt, generator)
+	if err != nil {
+		log.Println("Error building provenance manifest:", err)
+		return "", &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+
+	stageStart := time.Now()
+	options := ideogramRequestBody.uploadOptions(provenance)
+	originalURL, err := uploadImageToS3(imageData, ideogramRequestBody.FileName+originalSuffix, options, summary)
+	summary.recordStage("s3_upload", stageStart)
+	if err != nil {
+		log.Println("Error uploading original image to S3:", err)
+		summary.recordError("s3_upload", err)
+		return "", &PipelineError{StatusCode: 500, Message: "Error uploading image to S3", Err: err}
+	}
+	summary.addUploadedBytes(uploadDestination(options), len(imageData))
+	summary.addAssets(originalURL)
+	return originalURL, nil
+}
+
+// Upscale the image with Ideogram and download the result
+func upscaleImage(ctx context.Context, imageData []byte, params UpscaleParams, keys ProviderKeys, summary *InvocationSummary) ([]byte, error) {
+	api_key := keys.ideogramAPIKey()
+
+	if api_key == "" {
+		return nil, fmt.Errorf("API_KEY is not set")
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, err := writer.CreateFormFile("image_file", "image.png")
+	if err != nil {
+		return nil, fmt.Errorf("error creating form file: %v", err)
+	}
+	part.Write(imageData)
+	imageRequest, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding upscale parameters: %v", err)
+	}
+	writer.WriteField("image_request", string(imageRequest))
+	writer.Close()
+
+	req, err := newProviderRequest(ctx, "POST", "https://api.ideogram.ai/upscale", &buf)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Api-Key", api_key)
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := new(bytes.Buffer)
+	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return nil, &ProviderError{Provider: "ideogram", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	var upscaleResponse IdeogramResponse
+	if err := decodeProviderResponse("ideogram", respBody.Bytes(), &upscaleResponse); err != nil {
+		return nil, err
+	}
+	if err := checkIdeogramResponse(upscaleResponse, respBody.String()); err != nil {
+		return nil, err
+	}
+	if upscaleResponse.Data[0].URL == "" {
+		return nil, fmt.Errorf("upscale returned no image")
+	}
+
+	// Like generated images, the upscaled image link expires quickly
+	upscaled, err := downloadImageWithRetries(ctx, upscaleResponse.Data[0].URL, summary)
+	summary.addDownloadedBytes(len(upscaled))
+	return upscaled, err
+}
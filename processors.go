@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+)
+
+// A post-processing step applied to every generated image
+type PostProcessor interface {
+	// Name appended to the provenance generator once the step has run
+	Name() string
+	Process(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error)
+}
+
+// Built-in step backed by a function of this package
+type builtinProcessor struct {
+	name    string
+	process func(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error)
+}
+
+func (p builtinProcessor) Name() string { return p.name }
+
+func (p builtinProcessor) Process(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+	return p.process(ctx, body, imageData, generator, summary)
+}
+
+var builtinProcessors = map[string]PostProcessor{
+	stepUpscale: builtinProcessor{"ideogram-upscale", func(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+		return upscaleStep(ctx, body, imageData, summary)
+	}},
+	stepSmartCrop: builtinProcessor{"smart-crop", func(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+		return smartCropStep(body, imageData, summary)
+	}},
+	stepDropShadow: builtinProcessor{"drop-shadow", func(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+		return dropShadowStep(body, imageData, summary)
+	}},
+	stepFrame: builtinProcessor{"frame", func(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+		return frameStep(body, imageData, summary)
+	}},
+	stepWatermark: builtinProcessor{"draft-watermark", func(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+		return watermarkStep(body, imageData, summary)
+	}},
+	stepBrandLogo: builtinProcessor{"brand-logo", func(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+		return brandLogoStep(body, imageData, summary)
+	}},
+	stepBrandWatermark: builtinProcessor{"brand-watermark", func(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+		return brandWatermarkStep(body, imageData, summary)
+	}},
+}
+
+// Steps naming an external processor from EXTERNAL_PROCESSORS
+const externalStepPrefix = "external:"
+
+// Synchronous Lambda invocations accept at most 6MB of payload
+const externalProcessorPayloadLimit = 6 * 1024 * 1024
+
+// Find the processor for a step from postProcessingSteps. Background removal
+// runs on the request's background remover.
+func lookupPostProcessor(body IdeogramRequestBody, step string) (PostProcessor, error) {
+	if step == stepRemoveBackground {
+		remover, err := lookupBackgroundRemover(backgroundRemoverName(body.BackgroundRemover))
+		if err != nil {
+			return nil, err
+		}
+		return backgroundRemovalProcessor{remover}, nil
+	}
+	if name, ok := strings.CutPrefix(step, externalStepPrefix); ok {
+		target, ok := externalProcessors()[name]
+		if !ok {
+			return nil, fmt.Errorf("external processor %q is not configured", name)
+		}
+		return externalProcessor{name: name, target: target}, nil
+	}
+	processor, ok := builtinProcessors[step]
+	if !ok {
+		return nil, fmt.Errorf("unknown post-processing step %q", step)
+	}
+	return processor, nil
+}
+
+// External processors by name, from the EXTERNAL_PROCESSORS JSON object. Each
+// target is a Lambda function name or ARN, or the http(s) URL of a sidecar.
+func externalProcessors() map[string]string {
+	processors := map[string]string{}
+	raw := os.Getenv("EXTERNAL_PROCESSORS")
+	if raw == "" {
+		return processors
+	}
+	if err := json.Unmarshal([]byte(raw), &processors); err != nil {
+		log.Println("Error parsing EXTERNAL_PROCESSORS:", err)
+	}
+	return processors
+}
+
+// Payload sent to an external Lambda processor. It answers with the processed
+// PNG in image, or with an error.
+type ExternalProcessorRequest struct {
+	Image  string `json:"image"`
+	Prompt string `json:"prompt"`
+}
+
+type ExternalProcessorResponse struct {
+	Image string `json:"image,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// Custom step run by another team's Lambda function or HTTP sidecar
+type externalProcessor struct {
+	name   string
+	target string
+}
+
+func (p externalProcessor) Name() string { return "external-" + p.name }
+
+func (p externalProcessor) Process(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+	stageStart := time.Now()
+	var processed []byte
+	var err error
+	if strings.HasPrefix(p.target, "https://") || strings.HasPrefix(p.target, "http://") {
+		processed, err = p.processOverHTTP(ctx, imageData)
+	} else {
+		processed, err = p.processWithLambda(ctx, body, imageData)
+	}
+	summary.recordStage("external_"+p.name, stageStart)
+	if err != nil {
+		log.Printf("Error running external processor %s: %v", p.name, err)
+		summary.recordError("external_"+p.name, err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error running external processor " + p.name, Err: err}
+	}
+	return processed, nil
+}
+
+func (p externalProcessor) processWithLambda(ctx context.Context, body IdeogramRequestBody, imageData []byte) ([]byte, error) {
+	payload, err := json.Marshal(ExternalProcessorRequest{
+		Image:  base64.StdEncoding.EncodeToString(imageData),
+		Prompt: body.Prompt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > externalProcessorPayloadLimit {
+		return nil, fmt.Errorf("image is too large for a Lambda processor: %d byte payload", len(payload))
+	}
+
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	output, err := lambda.New(sess).InvokeWithContext(ctx, &lambda.InvokeInput{
+		FunctionName:   aws.String(p.target),
+		InvocationType: aws.String(lambda.InvocationTypeRequestResponse),
+		Payload:        payload,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to invoke %s: %v", p.target, err)
+	}
+	if output.FunctionError != nil {
+		return nil, fmt.Errorf("%s failed: %s", p.target, string(output.Payload))
+	}
+
+	var response ExternalProcessorResponse
+	if err := json.Unmarshal(output.Payload, &response); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %v", p.target, err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("%s: %s", p.target, response.Error)
+	}
+	processed, err := base64.StdEncoding.DecodeString(response.Image)
+	if err != nil || len(processed) == 0 {
+		return nil, fmt.Errorf("%s returned no image", p.target)
+	}
+	return processed, nil
+}
+
+// Sidecars receive the PNG as the request body and answer with the processed PNG
+func (p externalProcessor) processOverHTTP(ctx context.Context, imageData []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.target, bytes.NewReader(imageData))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "image/png")
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	processed, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("%s returned status %d: %.200s", p.target, resp.StatusCode, processed)
+	}
+	return processed, nil
+}
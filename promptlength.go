@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Estimated tokens Ideogram reads from a prompt before silently cutting it
+// off, unless PROMPT_TOKEN_LIMIT is set
+const defaultPromptTokenLimit = 512
+
+// Values of prompt_overflow, what happens to prompts over the limit
+const (
+	// Cut the prompt at the last sentence boundary that fits
+	promptOverflowTruncate = "truncate"
+	// Reject the request with a 400 stating the limit
+	promptOverflowReject = "reject"
+)
+
+// How a prompt over the limit was shortened
+type PromptTruncation struct {
+	// "prompt", or "prompts[i]" for line items
+	Field           string `json:"field"`
+	EstimatedTokens int    `json:"estimated_tokens"`
+	Limit           int    `json:"limit"`
+	Removed         string `json:"removed"`
+}
+
+func promptTokenLimit() int {
+	limit, err := strconv.Atoi(os.Getenv("PROMPT_TOKEN_LIMIT"))
+	if err != nil || limit <= 0 {
+		return defaultPromptTokenLimit
+	}
+	return limit
+}
+
+// Rough token count without Ideogram's tokenizer: about four characters or
+// three quarters of a word per token, whichever is higher
+func estimatePromptTokens(prompt string) int {
+	words := len(strings.Fields(prompt))
+	byWords := int(math.Ceil(float64(words) * 4 / 3))
+	byChars := int(math.Ceil(float64(len(prompt)) / 4))
+	return max(byWords, byChars)
+}
+
+// Check the prompts against the limit before anything is generated, and
+// truncate or reject those over it according to prompt_overflow
+func enforcePromptLimit(body *IdeogramRequestBody) ([]PromptTruncation, error) {
+	overflow := strings.ToLower(strings.TrimSpace(body.PromptOverflow))
+	if overflow == "" {
+		overflow = promptOverflowTruncate
+	}
+	if overflow != promptOverflowTruncate && overflow != promptOverflowReject {
+		return nil, fmt.Errorf("prompt_overflow must be %s or %s", promptOverflowTruncate, promptOverflowReject)
+	}
+
+	// plain_background appends its own instructions later
+	limit := promptTokenLimit()
+	if body.PlainBackground {
+		limit -= estimatePromptTokens(", " + plainBackgroundPromptSuffix)
+	}
+
+	var truncations []PromptTruncation
+	shorten := func(field string, prompt string) (string, error) {
+		tokens := estimatePromptTokens(prompt)
+		if tokens <= limit {
+			return prompt, nil
+		}
+		if overflow == promptOverflowReject {
+			return "", fmt.Errorf("%s is about %d tokens, the limit is %d", field, tokens, limit)
+		}
+		shortened := truncatePrompt(prompt, limit)
+		// Sending nothing would generate from an empty prompt
+		if strings.TrimSpace(shortened) == "" {
+			return "", fmt.Errorf("%s is about %d tokens and cannot be cut to the limit of %d without cutting inside its first word", field, tokens, limit)
+		}
+		truncations = append(truncations, PromptTruncation{
+			Field:           field,
+			EstimatedTokens: tokens,
+			Limit:           limit,
+			Removed:         strings.TrimSpace(prompt[len(shortened):]),
+		})
+		return shortened, nil
+	}
+
+	var err error
+	if body.Prompt, err = shorten("prompt", body.Prompt); err != nil {
+		return nil, err
+	}
+	for i := range body.Prompts {
+		if body.Prompts[i], err = shorten(fmt.Sprintf("prompts[%d]", i), body.Prompts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return truncations, nil
+}
+
+// Longest prefix within the limit that ends at a sentence boundary, or at a
+// clause or word boundary when a sentence would lose too much. Never cuts
+// inside a word, so it is empty when the first word is over the limit.
+func truncatePrompt(prompt string, limit int) string {
+	end := 0
+	for i, r := range prompt {
+		// A word ends where whitespace follows a non-space
+		if !unicode.IsSpace(r) || i == 0 || unicode.IsSpace(rune(prompt[i-1])) {
+			continue
+		}
+		if estimatePromptTokens(prompt[:i]) > limit {
+			break
+		}
+		end = i
+	}
+	fitting := prompt[:end]
+
+	// Keep at least half of what fits rather than dropping most of it
+	if cut := strings.LastIndexAny(fitting, ".!?"); cut >= len(fitting)/2 {
+		return fitting[:cut+1]
+	}
+	if cut := strings.LastIndexAny(fitting, ";,"); cut >= len(fitting)/2 {
+		return fitting[:cut]
+	}
+	return fitting
+}
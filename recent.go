@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Key suffix of the dashboard thumbnail, stored next to the master
+const thumbnailSuffix = "-thumb"
+
+// Thumbnails are scaled down to this width unless THUMBNAIL_WIDTH is set
+const defaultThumbnailWidth = 128
+
+const (
+	defaultRecentLimit = 20
+	maxRecentLimit     = 50
+	// Days of audit log searched for recent generations
+	recentLookbackDays = 7
+)
+
+// A recent generation for the monitoring page, with its thumbnail inline
+type RecentGeneration struct {
+	RequestID  string   `json:"request_id"`
+	Timestamp  string   `json:"timestamp"`
+	Tenant     string   `json:"tenant,omitempty"`
+	StatusCode int      `json:"status_code"`
+	Prompts    []string `json:"prompts,omitempty"`
+	Assets     []string `json:"assets,omitempty"`
+	// data:image/png;base64,... of the first image, when one was stored
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+type RecentResponse struct {
+	Generations []RecentGeneration `json:"generations"`
+}
+
+func thumbnailWidth() int {
+	width, err := strconv.Atoi(os.Getenv("THUMBNAIL_WIDTH"))
+	if err != nil || width <= 0 {
+		return defaultThumbnailWidth
+	}
+	return width
+}
+
+// Store a small thumbnail of the master as <filename>-thumb.png for the
+// dashboard. It is a convenience, so failures are only logged.
+func storeThumbnail(ideogramRequestBody IdeogramRequestBody, master []byte, summary *InvocationSummary) {
+	thumbnail, err := makeWebVariant(master, thumbnailWidth())
+	if err == nil {
+		var thumbnailURL string
+		options := UploadOptions{Folder: ideogramRequestBody.Folder}
+		thumbnailURL, err = uploadImageToS3(thumbnail, ideogramRequestBody.FileName+thumbnailSuffix, options, summary)
+		if err == nil {
+			summary.addUploadedBytes(uploadDestination(options), len(thumbnail))
+			summary.addThumbnails(thumbnailURL)
+			return
+		}
+	}
+	log.Println("Error storing thumbnail:", err)
+	summary.recordError("thumbnail", err)
+}
+
+// GET /recent?limit=20 returns the tenant's latest generations from the audit
+// log, newest first, with their thumbnails inline. It only ever answers for an
+// authenticated tenant; admins name one with X-Tenant-Id.
+func handleRecentRequest(request events.LambdaFunctionURLRequest, tenant string) (events.LambdaFunctionURLResponse, error) {
+	if tenant == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 403,
+			Body:       "Forbidden: /recent needs a bearer token or an API key bound to a tenant",
+		}, nil
+	}
+	bucket, prefix := auditLocation()
+	if bucket == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Audit log is not configured",
+		}, nil
+	}
+	limit := defaultRecentLimit
+	if value := request.QueryStringParameters["limit"]; value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxRecentLimit {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("Bad Request: limit must be between 1 and %d", maxRecentLimit),
+			}, nil
+		}
+		limit = parsed
+	}
+
+	auditSvc, err := newAuditS3Client()
+	if err != nil {
+		log.Println("Error reading audit log:", err)
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	settings, err := loadS3Settings()
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	imageSvc, err := newS3Client(settings)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+
+	recent := RecentResponse{Generations: make([]RecentGeneration, 0, limit)}
+	day := time.Now().UTC()
+	for i := 0; i < recentLookbackDays && len(recent.Generations) < limit; i++ {
+		// Only the tenant's own index is read, not every tenant's records
+		keys, err := listAuditKeys(auditSvc, bucket, auditTenantPrefix(prefix, tenant, day))
+		if err != nil {
+			log.Println("Error listing audit records:", err)
+			return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+		}
+		// Keys start with the timestamp, so the newest sort last
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+		for _, key := range keys {
+			if len(recent.Generations) == limit {
+				break
+			}
+			record, err := readAuditRecord(auditSvc, bucket, key)
+			if err != nil {
+				log.Println("Error reading audit record:", err)
+				continue
+			}
+			if len(record.Assets) == 0 {
+				continue
+			}
+			generation := RecentGeneration{
+				RequestID:  record.RequestID,
+				Timestamp:  record.Timestamp,
+				Tenant:     record.Tenant,
+				StatusCode: record.StatusCode,
+				Prompts:    record.Prompts,
+				Assets:     record.Assets,
+			}
+			if len(record.Thumbnails) > 0 {
+				generation.Thumbnail, err = readThumbnail(imageSvc, settings.Bucket, record.Thumbnails[0])
+				if err != nil {
+					log.Println("Error reading thumbnail:", err)
+				}
+			}
+			recent.Generations = append(recent.Generations, generation)
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+
+	responseBody, err := json.Marshal(recent)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+func listAuditKeys(s3Svc *s3.S3, bucket string, prefix string) ([]string, error) {
+	var keys []string
+	err := s3Svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	return keys, err
+}
+
+// Read a stored thumbnail as a data URI
+func readThumbnail(s3Svc *s3.S3, bucket string, thumbnailURL string) (string, error) {
+	key, err := archiveKey(thumbnailURL)
+	if err != nil {
+		return "", err
+	}
+	object, err := s3Svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s: %v", key, err)
+	}
+	defer object.Body.Close()
+	data, err := io.ReadAll(object.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	contentType := aws.StringValue(object.ContentType)
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = "image/png"
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime/debug"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Turn a recovered panic into a structured 500 so Zapier shows something
+// actionable instead of a raw Lambda error
+func recoverPanic(recovered interface{}, summary *InvocationSummary) events.LambdaFunctionURLResponse {
+	log.Printf("Recovered from panic: %v\n%s", recovered, debug.Stack())
+	summary.recordError("panic", fmt.Errorf("%v", recovered))
+	emitMetric("Panics", 1, "Count")
+
+	responseBody, _ := json.Marshal(map[string]string{
+		"error":      "internal_error",
+		"message":    "The request failed unexpectedly. It is safe to retry; quote the request ID if the problem persists.",
+		"request_id": summary.RequestID,
+	})
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 500,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+// Existing image to extend to the request's resolution with Ideogram's
+// reframe (outpainting) endpoint, given as a URL or base64
+type ReframeRequest struct {
+	ImageURL    string `json:"image_url,omitempty"`
+	ImageBase64 string `json:"image_base64,omitempty"`
+}
+
+func (reframe ReframeRequest) validate() error {
+	if (reframe.ImageURL == "") == (reframe.ImageBase64 == "") {
+		return fmt.Errorf("reframe needs exactly one of image_url and image_base64")
+	}
+	return nil
+}
+
+// Extend the source image's canvas to the target resolution. Reframing takes
+// no prompt; Ideogram fills the new area from the image itself.
+func sendReframeRequestToIdeogram(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) (string, error) {
+	api_key := body.providerKeys.ideogramAPIKey()
+
+	if api_key == "" {
+		return "", fmt.Errorf("API_KEY is not set")
+	}
+	if summary.injectFault(faultIdeogram429) {
+		return "", injectedIdeogramThrottle()
+	}
+
+	image, err := loadEditInput(ctx, body.Reframe.ImageURL, body.Reframe.ImageBase64, summary)
+	if err != nil {
+		return "", fmt.Errorf("error loading reframe image: %v", err)
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, err := writer.CreateFormFile("image", "image.png")
+	if err != nil {
+		return "", fmt.Errorf("error creating form file: %v", err)
+	}
+	part.Write(image)
+	writer.WriteField("resolution", string(*body.Resolution))
+	if body.NumImages != nil {
+		writer.WriteField("num_images", fmt.Sprintf("%d", *body.NumImages))
+	}
+	if body.RenderingSpeed != nil {
+		writer.WriteField("rendering_speed", string(*body.RenderingSpeed))
+	}
+	writeSeed(writer, body.Seed)
+	writer.Close()
+
+	req, err := newProviderRequest(ctx, "POST", "https://api.ideogram.ai/v1/ideogram-v3/reframe", &buf)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Api-Key", api_key)
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := new(bytes.Buffer)
+	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return "", &ProviderError{Provider: "ideogram", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return respBody.String(), nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+// Requests with image_weight remix source_image_url instead of regenerating it
+// from a description
+func (body IdeogramRequestBody) isRemix() bool {
+	return body.SourceImageURL != "" && body.ImageWeight != nil
+}
+
+// Generate variations of the source image with Ideogram's remix endpoint
+func sendRemixRequestToIdeogram(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) (string, error) {
+	api_key := body.providerKeys.ideogramAPIKey()
+
+	if api_key == "" {
+		return "", fmt.Errorf("API_KEY is not set")
+	}
+	if summary.injectFault(faultIdeogram429) {
+		return "", injectedIdeogramThrottle()
+	}
+
+	stageStart := time.Now()
+	image, err := fetchCallerImageWithRetries(ctx, body.SourceImageURL, summary)
+	summary.recordStage("download", stageStart)
+	summary.addDownloadedBytes(len(image))
+	if err != nil {
+		return "", fmt.Errorf("error downloading source image: %v", err)
+	}
+
+	styleReferences, err := loadStyleReferenceImages(ctx, body.StyleReferenceImages, summary)
+	if err != nil {
+		return "", err
+	}
+
+	body, negativePrompt := applyPlainBackground(applyPattern(applyBrandFonts(body)))
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	part, err := writer.CreateFormFile("image", "image.png")
+	if err != nil {
+		return "", fmt.Errorf("error creating form file: %v", err)
+	}
+	part.Write(image)
+	if err := writeStyleReferenceImages(writer, styleReferences); err != nil {
+		return "", err
+	}
+	writer.WriteField("prompt", body.Prompt)
+	writer.WriteField("image_weight", fmt.Sprintf("%d", *body.ImageWeight))
+	if negativePrompt != "" {
+		writer.WriteField("negative_prompt", negativePrompt)
+	}
+	if body.Resolution != nil {
+		writer.WriteField("resolution", string(*body.Resolution))
+	} else if body.AspectRatio != nil {
+		writer.WriteField("aspect_ratio", string(*body.AspectRatio))
+	}
+	if body.NumImages != nil {
+		writer.WriteField("num_images", fmt.Sprintf("%d", *body.NumImages))
+	}
+	if body.StyleType != nil {
+		writer.WriteField("style_type", string(*body.StyleType))
+	}
+	if body.RenderingSpeed != nil {
+		writer.WriteField("rendering_speed", string(*body.RenderingSpeed))
+	}
+	if body.MagicPrompt != nil {
+		writer.WriteField("magic_prompt", *body.MagicPrompt)
+	}
+	writeSeed(writer, body.Seed)
+	writeStyleCodes(writer, body.StyleCodes)
+	writeColourPalette(writer, body.ColourPalette)
+	writer.Close()
+
+	req, err := newProviderRequest(ctx, "POST", "https://api.ideogram.ai/v1/ideogram-v3/remix", &buf)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Api-Key", api_key)
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := new(bytes.Buffer)
+	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return "", &ProviderError{Provider: "ideogram", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return respBody.String(), nil
+}
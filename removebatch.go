@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Sources per batch, so a batch finishes well within the Lambda timeout.
+// Larger backfills are split into several calls.
+const maxBatchSources = 500
+
+// How long Freepik has to fetch a source stored in our bucket
+const batchSourceURLExpiry = 15 * time.Minute
+
+// Sources are only started with this much time left before the function
+// times out: enough for a slow remover, the upload and the response
+const batchSourceReserve = 90 * time.Second
+
+// Existing images to cut out, without generating anything
+type BatchRemoveBackgroundRequest struct {
+	// Object keys in the image bucket or http(s) URLs
+	Sources []string `json:"sources"`
+	// Folder the cutouts are stored under, FOLDER_NAME when empty
+	Folder string `json:"folder,omitempty"`
+	// Service removing the backgrounds, BACKGROUND_REMOVER when empty.
+	// bg_provider is accepted for it too.
+	BackgroundRemover string `json:"background_remover,omitempty"`
+	BGProvider        string `json:"bg_provider,omitempty"`
+	RemoveBGSize      string `json:"removebg_size,omitempty"`
+}
+
+type BatchRemoveBackgroundResult struct {
+	Source string `json:"source"`
+	URL    string `json:"url,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Not started before the function ran out of time; send it again
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+type BatchRemoveBackgroundResponse struct {
+	Succeeded int                           `json:"succeeded"`
+	Failed    int                           `json:"failed"`
+	Skipped   int                           `json:"skipped"`
+	Results   []BatchRemoveBackgroundResult `json:"results"`
+}
+
+// Number of sources sent to Freepik at once
+func batchConcurrency() int {
+	concurrency, err := strconv.Atoi(os.Getenv("BATCH_CONCURRENCY"))
+	if err != nil || concurrency <= 0 {
+		return 8
+	}
+	return concurrency
+}
+
+// Remove the backgrounds of existing images. Each source succeeds or fails on
+// its own, and results are returned in the order of the sources. Sources still
+// waiting when the function is about to time out are skipped rather than
+// started, so the response always makes it back.
+func handleBatchRemoveBackgroundRequest(ctx context.Context, request events.LambdaFunctionURLRequest, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	body, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	var batchRequest BatchRemoveBackgroundRequest
+	if err := json.Unmarshal(body, &batchRequest); err != nil || len(batchRequest.Sources) == 0 {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: sources are required",
+		}, nil
+	}
+	if len(batchRequest.Sources) > maxBatchSources {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Bad Request: at most %d sources per batch", maxBatchSources),
+		}, nil
+	}
+
+	if batchRequest.BackgroundRemover == "" {
+		batchRequest.BackgroundRemover = batchRequest.BGProvider
+	}
+	remover, err := lookupBackgroundRemover(backgroundRemoverName(batchRequest.BackgroundRemover))
+	if err == nil {
+		err = remover.Configured(ProviderKeys{})
+	}
+	if err == nil {
+		err = validateRemoveBGSize(batchRequest.RemoveBGSize)
+	}
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}, nil
+	}
+
+	if summary.Tenant != "" {
+		folder, err := confineFolder(summary.Tenant, batchRequest.Folder)
+		if err != nil {
+			summary.recordError("tenant", err)
+			return tenantErrorResponse(err), nil
+		}
+		batchRequest.Folder = folder
+	}
+
+	settings, err := loadS3Settings()
+	if err != nil {
+		log.Println("Error loading S3 settings:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		log.Println("Error creating S3 client:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+
+	results := make([]BatchRemoveBackgroundResult, len(batchRequest.Sources))
+	slots := make(chan struct{}, batchConcurrency())
+	var wg sync.WaitGroup
+	for i, source := range batchRequest.Sources {
+		results[i].Source = source
+		wg.Add(1)
+		go func(i int, source string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if summary.remainingTime() < batchSourceReserve {
+				results[i].Skipped = true
+				return
+			}
+			// A panic in a goroutine is out of reach of the handler's recovery
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					log.Printf("Recovered from panic removing background of %s: %v\n%s", source, recovered, debug.Stack())
+					emitMetric("Panics", 1, "Count")
+					results[i].Error = fmt.Sprintf("panicked: %v", recovered)
+				}
+			}()
+			cutoutURL, err := removeBackgroundOfSource(ctx, remover, batchRequest.RemoveBGSize, s3Svc, settings, source, batchRequest.Folder, summary)
+			if err != nil {
+				log.Printf("Error removing background of %s: %v", source, err)
+				results[i].Error = err.Error()
+				return
+			}
+			results[i].URL = cutoutURL
+		}(i, source)
+	}
+	wg.Wait()
+
+	signer, err := newURLSigner()
+	if err != nil {
+		log.Println("Error signing asset URLs:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error signing asset URLs",
+		}, nil
+	}
+	responseBody := BatchRemoveBackgroundResponse{Results: results}
+	for i, result := range results {
+		if result.Skipped {
+			responseBody.Skipped++
+			continue
+		}
+		if result.Error != "" {
+			responseBody.Failed++
+			continue
+		}
+		responseBody.Succeeded++
+		summary.addAssets(result.URL)
+		if results[i].URL, err = signer.sign(result.URL); err != nil {
+			log.Println("Error signing asset URLs:", err)
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Body:       "Error signing asset URLs",
+			}, nil
+		}
+	}
+	payload, err := json.Marshal(responseBody)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	statusCode := 200
+	if responseBody.Succeeded == 0 && responseBody.Failed == 0 {
+		statusCode = 503
+	} else if responseBody.Succeeded == 0 {
+		statusCode = 500
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(payload),
+	}, nil
+}
+
+// Cut out one source and store it as <folder>/<source path>-cutout.png
+func removeBackgroundOfSource(ctx context.Context, remover BackgroundRemover, size string, s3Svc *s3.S3, settings S3Settings, source string, folder string, summary *InvocationSummary) (string, error) {
+	callerURL := strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://")
+	if !callerURL {
+		if err := checkTenantKey(summary.Tenant, strings.TrimPrefix(source, "/")); err != nil {
+			return "", err
+		}
+	}
+	sourceURL, sourcePath, err := resolveBatchSource(s3Svc, settings, source)
+	if err != nil {
+		return "", err
+	}
+
+	cutout, err := remover.RemoveBackground(ctx, BackgroundRemovalSource{URL: sourceURL, Size: size, CallerURL: callerURL}, summary)
+	if err != nil {
+		return "", err
+	}
+	summary.addBackgroundRemovals(remover.Name(), 1)
+
+	// Sources already under the target folder keep their place in it
+	sourcePath = strings.TrimPrefix(sourcePath, settings.withFolder(folder).Folder+"/")
+	filename := strings.TrimSuffix(sourcePath, path.Ext(sourcePath)) + "-cutout"
+	stageStart := time.Now()
+	options := UploadOptions{Folder: folder}
+	cutoutURL, err := uploadImageToS3(cutout, filename, options, summary)
+	summary.recordStage("s3_upload", stageStart)
+	if err != nil {
+		summary.recordError("s3_upload", err)
+		return "", err
+	}
+	summary.addUploadedBytes(uploadDestination(options), len(cutout))
+	return cutoutURL, nil
+}
+
+// URL Freepik can fetch the source from, and the path used to name its cutout.
+// Keys in our bucket get a short-lived presigned URL.
+func resolveBatchSource(s3Svc *s3.S3, settings S3Settings, source string) (string, string, error) {
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		parsed, err := url.Parse(source)
+		if err != nil || strings.Trim(parsed.Path, "/") == "" {
+			return "", "", fmt.Errorf("invalid source URL %q", source)
+		}
+		return source, strings.Trim(parsed.Path, "/"), nil
+	}
+
+	key := strings.TrimPrefix(source, "/")
+	// The function's own state lives in the same bucket and is not a source
+	if key == "" || hasAnyPrefix(key, internalKeyPrefixes()) {
+		return "", "", fmt.Errorf("invalid source key %q", source)
+	}
+	req, _ := s3Svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(settings.Bucket),
+		Key:    aws.String(key),
+	})
+	presignedURL, err := req.Presign(batchSourceURLExpiry)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to presign %s: %v", key, err)
+	}
+	return presignedURL, key, nil
+}
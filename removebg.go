@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultRemoveBGURL = "https://api.remove.bg/v1.0/removebg"
+
+// Output sizes remove.bg accepts. Larger sizes cost more credits; auto picks
+// the largest the account allows.
+var removeBGSizes = []string{"auto", "preview", "small", "regular", "medium", "hd", "full", "4k", "50MP"}
+
+func removeBGURL() string {
+	if url := strings.TrimSpace(os.Getenv("REMOVEBG_URL")); url != "" {
+		return url
+	}
+	return defaultRemoveBGURL
+}
+
+// The request's removebg_size, else REMOVEBG_SIZE, else auto
+func removeBGSize(requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if size := strings.TrimSpace(os.Getenv("REMOVEBG_SIZE")); size != "" {
+		return size
+	}
+	return "auto"
+}
+
+func validateRemoveBGSize(size string) error {
+	if size != "" && !containsString(removeBGSizes, size) {
+		return fmt.Errorf("unsupported removebg_size %q, expected one of %s", size, strings.Join(removeBGSizes, ", "))
+	}
+	return nil
+}
+
+// remove.bg answers with the cutout's bytes rather than a link to it
+type removeBGRemover struct{}
+
+func init() {
+	registerBackgroundRemover(removeBGRemover{})
+}
+
+func (removeBGRemover) Name() string { return "removebg" }
+
+func (removeBGRemover) Configured(keys ProviderKeys) error {
+	if os.Getenv("REMOVEBG_API_KEY") == "" {
+		return fmt.Errorf("background remover removebg is not configured in this deployment, set REMOVEBG_API_KEY")
+	}
+	return nil
+}
+
+// Upload the image when it is at hand, so remove.bg never needs access to our
+// bucket, otherwise let it fetch the URL
+func (removeBGRemover) RemoveBackground(ctx context.Context, source BackgroundRemovalSource, summary *InvocationSummary) ([]byte, error) {
+	var payload bytes.Buffer
+	writer := multipart.NewWriter(&payload)
+	writer.WriteField("size", removeBGSize(source.Size))
+	writer.WriteField("format", "png")
+	if source.Data != nil {
+		part, err := writer.CreateFormFile("image_file", "image.png")
+		if err != nil {
+			return nil, err
+		}
+		part.Write(source.Data)
+	} else {
+		writer.WriteField("image_url", source.URL)
+	}
+	writer.Close()
+
+	req, err := newProviderRequest(ctx, "POST", removeBGURL(), &payload)
+	if err != nil {
+		return nil, fmt.Errorf("error creating remove.bg request: %v", err)
+	}
+	req.Header.Set("X-Api-Key", os.Getenv("REMOVEBG_API_KEY"))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "image/png, application/json")
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	stageStart := time.Now()
+	resp, err := client.Do(req)
+	summary.recordStage("removebg", stageStart)
+	if err != nil {
+		summary.recordError("removebg", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error removing image background", Err: fmt.Errorf("error sending request to remove.bg: %v", err)}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		summary.recordError("removebg", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error removing image background", Err: err}
+	}
+
+	if resp.StatusCode >= 400 {
+		err := &ProviderError{Provider: "removebg", StatusCode: resp.StatusCode, Body: removeBGErrorMessage(body), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+		log.Println("Error removing image background:", err)
+		summary.recordError("removebg", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error removing image background", Err: err}
+	}
+	// A success is the PNG itself; anything else means the API changed
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "image/") || http.DetectContentType(body) != "image/png" {
+		err := newSchemaError("removebg", "response is not a PNG", string(body))
+		summary.recordError("removebg", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+	if credits := resp.Header.Get("X-Credits-Charged"); credits != "" {
+		log.Printf("remove.bg charged %s credits", credits)
+	}
+	summary.addDownloadedBytes(len(body))
+	return body, nil
+}
+
+// remove.bg reports errors as {"errors": [{"title": ...}]}; keep the titles
+// rather than the whole body
+func removeBGErrorMessage(body []byte) string {
+	var response struct {
+		Errors []struct {
+			Title string `json:"title"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &response) != nil || len(response.Errors) == 0 {
+		return string(body)
+	}
+	titles := make([]string, 0, len(response.Errors))
+	for _, e := range response.Errors {
+		titles = append(titles, e.Title)
+	}
+	return strings.Join(titles, "; ")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A background-removal service
+type BackgroundRemover interface {
+	// Name of the service, e.g. "freepik". The provenance generator records
+	// it as "<name>-remove-background".
+	Name() string
+	// Nil when the deployment or the caller's keys have what the service
+	// needs, otherwise an error saying what is missing
+	Configured(keys ProviderKeys) error
+	// Cut out the image's subject and return the cutout's bytes, giving up
+	// once the context is cancelled
+	RemoveBackground(ctx context.Context, source BackgroundRemovalSource, summary *InvocationSummary) ([]byte, error)
+}
+
+// An image to cut out. URL is always set, so services can fetch the image
+// themselves; Data is set when the image is at hand, for services taking an
+// upload.
+type BackgroundRemovalSource struct {
+	URL  string
+	Data []byte
+	// Output size the caller asked for, for services offering several;
+	// empty for the service's default
+	Size string
+	// Keys of the request the image belongs to
+	Keys ProviderKeys
+	// Set when URL came from the caller rather than our bucket, so it is
+	// fetched like any other caller URL
+	CallerURL bool
+}
+
+// The image's bytes, downloaded from its URL when they are not at hand
+func (source BackgroundRemovalSource) bytes(ctx context.Context, summary *InvocationSummary) ([]byte, error) {
+	if source.Data != nil {
+		return source.Data, nil
+	}
+	stageStart := time.Now()
+	download := downloadImageWithRetries
+	if source.CallerURL {
+		download = fetchCallerImageWithRetries
+	}
+	data, err := download(ctx, source.URL, summary)
+	summary.recordStage("download", stageStart)
+	summary.addDownloadedBytes(len(data))
+	return data, err
+}
+
+// Service used unless BACKGROUND_REMOVER or the request names another
+const defaultBackgroundRemover = "freepik"
+
+// Background removers by name. Services register themselves here; the
+// pipeline only ever talks to the BackgroundRemover interface.
+var backgroundRemovers = map[string]BackgroundRemover{
+	defaultBackgroundRemover: freepikRemover{},
+}
+
+func registerBackgroundRemover(remover BackgroundRemover) {
+	backgroundRemovers[remover.Name()] = remover
+}
+
+// Name of the service removing the request's backgrounds: the request's
+// background_remover, else BACKGROUND_REMOVER, else Freepik
+func backgroundRemoverName(requested string) string {
+	if name := strings.ToLower(strings.TrimSpace(requested)); name != "" {
+		return name
+	}
+	if name := strings.ToLower(strings.TrimSpace(os.Getenv("BACKGROUND_REMOVER"))); name != "" {
+		return name
+	}
+	return defaultBackgroundRemover
+}
+
+func lookupBackgroundRemover(name string) (BackgroundRemover, error) {
+	remover, ok := backgroundRemovers[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported background_remover %q, expected one of %s", name, strings.Join(backgroundRemoverNames(), ", "))
+	}
+	return remover, nil
+}
+
+// Names of the registered background removers, for GET /options
+func backgroundRemoverNames() []string {
+	names := make([]string, 0, len(backgroundRemovers))
+	for name := range backgroundRemovers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check the background remover a request would use exists and can be called
+func validateBackgroundRemover(requested string, keys ProviderKeys) error {
+	remover, err := lookupBackgroundRemover(backgroundRemoverName(requested))
+	if err != nil {
+		return err
+	}
+	return remover.Configured(keys)
+}
+
+// Runs the request's background remover as the remove_background step
+type backgroundRemovalProcessor struct {
+	remover BackgroundRemover
+}
+
+func (p backgroundRemovalProcessor) Name() string {
+	return p.remover.Name() + "-remove-background"
+}
+
+func (p backgroundRemovalProcessor) Process(ctx context.Context, body IdeogramRequestBody, imageData []byte, generator string, summary *InvocationSummary) ([]byte, error) {
+	return removeBackgroundStep(ctx, p.remover, body, imageData, generator, summary)
+}
+
+// Freepik's background removal, which fetches the image from its URL
+type freepikRemover struct{}
+
+func (freepikRemover) Name() string { return "freepik" }
+
+func (freepikRemover) Configured(keys ProviderKeys) error {
+	if keys.freepikAPIKey() == "" {
+		return fmt.Errorf("remove_background needs a Freepik key: set FREEPIK_API_KEY, send freepik_api_key, or send remove_background false to store the images as generated")
+	}
+	return nil
+}
+
+func (freepikRemover) RemoveBackground(ctx context.Context, source BackgroundRemovalSource, summary *InvocationSummary) ([]byte, error) {
+	stageStart := time.Now()
+	response, err := removeImageBGviaFreepik(ctx, source.URL, source.Keys.freepikAPIKey(), summary)
+	summary.recordStage("freepik", stageStart)
+	if err != nil {
+		recordFreepikOutcome(err)
+		log.Println("Error removing image background:", err)
+		summary.recordError("freepik", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error removing image background", Err: err}
+	}
+
+	// After getting the response from Freepik, download the cutout
+	cutoutURL, err := parseFreepikResponse(response)
+	recordFreepikOutcome(err)
+	if err != nil {
+		log.Println("Error reading freepik response:", err)
+		summary.recordError("freepik", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+
+	stageStart = time.Now()
+	cutout, err := downloadImageWithRetries(ctx, cutoutURL, summary)
+	summary.recordStage("download", stageStart)
+	summary.addDownloadedBytes(len(cutout))
+	if err != nil {
+		log.Println("Error downloading image:", err)
+		summary.recordError("download", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error downloading image", Err: err}
+	}
+	return cutout, nil
+}
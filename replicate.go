@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flux models on Replicate, selected with REPLICATE_MODEL
+var replicateModels = map[string]string{
+	"flux-schnell": "black-forest-labs/flux-schnell",
+	"flux-dev":     "black-forest-labs/flux-dev",
+}
+
+const defaultReplicateModel = "flux-schnell"
+
+const defaultReplicateAPIURL = "https://api.replicate.com/v1"
+
+// Aspect ratios Flux accepts, in our notation
+var replicateAspectRatios = []string{
+	"1x1", "16x9", "9x16", "21x9", "9x21", "3x2", "2x3", "4x5", "5x4", "3x4", "4x3",
+}
+
+// Images per prediction, the most Flux makes at once
+const maxReplicateImages = 4
+
+// How often and for how long a running prediction is polled
+const (
+	replicatePollInterval = time.Second
+	replicatePollTimeout  = 3 * time.Minute
+)
+
+// Error code of predictions whose input or output was flagged as sensitive
+const replicateSensitiveCode = "(E005)"
+
+// Flux logs the seed it ran with, random or not
+var replicateSeedPattern = regexp.MustCompile(`Using seed: (\d+)`)
+
+func init() {
+	registerGenerator("replicate", replicateGenerator{})
+}
+
+// Black Forest Labs' Flux models, run as Replicate predictions. A prediction
+// is asynchronous: it is created, then polled until it finishes.
+type replicateGenerator struct{}
+
+func replicateModel() string {
+	model := strings.ToLower(strings.TrimSpace(os.Getenv("REPLICATE_MODEL")))
+	if _, ok := replicateModels[model]; !ok {
+		return defaultReplicateModel
+	}
+	return model
+}
+
+func replicateAPIURL() string {
+	if url := strings.TrimRight(strings.TrimSpace(os.Getenv("REPLICATE_API_URL")), "/"); url != "" {
+		return url
+	}
+	return defaultReplicateAPIURL
+}
+
+func (replicateGenerator) Name(body IdeogramRequestBody) string {
+	return "replicate-" + replicateModel()
+}
+
+func (replicateGenerator) Validate(body IdeogramRequestBody) error {
+	if err := rejectIdeogramOnlyFeatures(body); err != nil {
+		return err
+	}
+	if body.NegativePrompt != "" {
+		return fmt.Errorf("negative_prompt is not available with the replicate provider")
+	}
+	if body.AspectRatio != nil && !containsString(replicateAspectRatios, string(*body.AspectRatio)) {
+		return fmt.Errorf("aspect_ratio %q is not available with the replicate provider, expected one of %s", *body.AspectRatio, strings.Join(replicateAspectRatios, ", "))
+	}
+	if body.NumImages != nil && *body.NumImages > maxReplicateImages {
+		return fmt.Errorf("num_images must be at most %d with the replicate provider", maxReplicateImages)
+	}
+	return nil
+}
+
+type replicateInput struct {
+	Prompt       string `json:"prompt"`
+	AspectRatio  string `json:"aspect_ratio,omitempty"`
+	NumOutputs   int    `json:"num_outputs"`
+	Seed         *int   `json:"seed,omitempty"`
+	OutputFormat string `json:"output_format"`
+}
+
+type replicatePrediction struct {
+	ID     string          `json:"id"`
+	Status string          `json:"status"`
+	Output json.RawMessage `json:"output"`
+	Error  interface{}     `json:"error"`
+	Logs   string          `json:"logs"`
+	URLs   struct {
+		Get string `json:"get"`
+	} `json:"urls"`
+}
+
+func (prediction replicatePrediction) finished() bool {
+	return prediction.Status == "succeeded" || prediction.Status == "failed" || prediction.Status == "canceled"
+}
+
+func (replicateGenerator) Generate(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) ([]Image, error) {
+	apiKey := providerCredential("replicate")
+	if apiKey == "" {
+		return nil, missingCredentialError("replicate")
+	}
+	// Flux has no negative prompt; the plain background prompt suffix carries
+	// the convention on its own
+	body, _ = applyPlainBackground(applyPattern(applyBrandFonts(body)))
+
+	input := replicateInput{Prompt: body.Prompt, NumOutputs: 1, Seed: body.Seed, OutputFormat: "png"}
+	if body.AspectRatio != nil {
+		input.AspectRatio = body.AspectRatio.Colon()
+	}
+	if body.NumImages != nil {
+		input.NumOutputs = *body.NumImages
+	}
+	payload, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling Replicate request: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, replicatePollTimeout)
+	defer cancel()
+	createURL := replicateAPIURL() + "/models/" + replicateModels[replicateModel()] + "/predictions"
+	prediction, err := sendRequestToReplicate(ctx, apiKey, "POST", createURL, payload)
+	if err != nil {
+		return nil, err
+	}
+	for !prediction.finished() {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("replicate prediction %s did not finish in %s", prediction.ID, replicatePollTimeout)
+		case <-time.After(replicatePollInterval):
+		}
+		prediction, err = sendRequestToReplicate(ctx, apiKey, "GET", prediction.URLs.Get, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Replicate flags sensitive inputs and outputs with error code E005
+	if message := fmt.Sprint(prediction.Error); prediction.Status == "failed" && strings.Contains(message, replicateSensitiveCode) {
+		return nil, &ProviderError{Provider: "replicate", StatusCode: 422, Body: message}
+	}
+	if prediction.Status != "succeeded" {
+		return nil, fmt.Errorf("replicate prediction %s %s: %v", prediction.ID, prediction.Status, prediction.Error)
+	}
+
+	// Flux returns one URL per image
+	var urls []string
+	if err := json.Unmarshal(prediction.Output, &urls); err != nil {
+		return nil, fmt.Errorf("error unmarshalling Replicate output: %v", err)
+	}
+	images := make([]Image, 0, len(urls))
+	for _, url := range urls {
+		images = append(images, Image{URL: url, Prompt: body.Prompt, IsImageSafe: true})
+	}
+	// Flux draws all outputs of a prediction from one seeded batch, so only a
+	// single output can be reproduced from the seed; several report none
+	if len(images) == 1 {
+		if seed, ok := prediction.seed(); ok {
+			images[0].Seed = seed
+		} else if body.Seed != nil {
+			images[0].Seed = *body.Seed
+		}
+	}
+	return images, nil
+}
+
+// Seed the prediction ran with, from its logs
+func (prediction replicatePrediction) seed() (int, bool) {
+	match := replicateSeedPattern.FindStringSubmatch(prediction.Logs)
+	if match == nil {
+		return 0, false
+	}
+	seed, err := strconv.Atoi(match[1])
+	return seed, err == nil
+}
+
+// Create or poll a prediction. Creating waits up to a minute for it to finish
+// before returning, which covers most Flux runs without polling.
+func sendRequestToReplicate(ctx context.Context, apiKey string, method string, url string, payload []byte) (replicatePrediction, error) {
+	var prediction replicatePrediction
+	req, err := newProviderRequest(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return prediction, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	if method == "POST" {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", "wait=60")
+	}
+
+	client := &http.Client{
+		Timeout: 90 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return prediction, fmt.Errorf("error sending request to Replicate: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := new(bytes.Buffer)
+	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return prediction, &ProviderError{Provider: "replicate", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	if err := json.Unmarshal(respBody.Bytes(), &prediction); err != nil {
+		return prediction, fmt.Errorf("error unmarshalling Replicate prediction: %v", err)
+	}
+	return prediction, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+const defaultSafetyRetrySuffix = "family friendly, SFW"
+
+// What happened when an all-unsafe generation was retried
+type SafetyRetryReport struct {
+	OriginalPrompt string `json:"original_prompt"`
+	AdjustedPrompt string `json:"adjusted_prompt"`
+	Succeeded      bool   `json:"succeeded"`
+}
+
+// Report whether the provider flagged every returned image as unsafe
+func allImagesUnsafe(images []Image) bool {
+	if len(images) == 0 {
+		return false
+	}
+	for _, image := range images {
+		if image.IsImageSafe {
+			return false
+		}
+	}
+	return true
+}
+
+// The sanitizing suffix comes from SAFETY_RETRY_SUFFIX; setting SAFETY_RETRY
+// to "off" disables the retry altogether
+func safetyRetrySuffix() (string, bool) {
+	if strings.EqualFold(os.Getenv("SAFETY_RETRY"), "off") {
+		return "", false
+	}
+	suffix := os.Getenv("SAFETY_RETRY_SUFFIX")
+	if suffix == "" {
+		suffix = defaultSafetyRetrySuffix
+	}
+	return suffix, true
+}
+
+func adjustPromptForSafety(prompt string, suffix string) string {
+	return strings.TrimRight(strings.TrimSpace(prompt), ".,") + ", " + suffix
+}
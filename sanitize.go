@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// User-supplied fragments are cut to this many characters unless
+// PROMPT_VARIABLE_MAX_LENGTH is set
+const defaultPromptVariableMaxLength = 200
+
+// Runs of the same character longer than this are cut down, e.g. "!!!!!!!!!!!!"
+const maxRepeatedRun = 8
+
+var (
+	urlPattern        = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+`)
+	whitespacePattern = regexp.MustCompile(`\s+`)
+)
+
+// Phrases that try to steer the generation instead of supplying content.
+// PROMPT_BLOCKLIST adds more, comma-separated.
+var promptJailbreakPatterns = []string{
+	`ignore (?:all |any )?(?:the )?(?:previous|prior|above|earlier) (?:instructions|prompts?|text)`,
+	`disregard (?:all |any )?(?:the )?(?:previous|prior|above|earlier)\b[^,.]*`,
+	`negative[ _]prompt\s*:?`,
+	`style[ _]type\s*:?\s*\w*`,
+	`in the style of [^,.]+`,
+	`\bnsfw\b`,
+	`\bnude\b|\bnaked\b`,
+	`--\w+(?:\s+\S+)?`,
+}
+
+// What was removed from one prompt variable before it was rendered
+type SanitizationReport struct {
+	Variable string   `json:"variable"`
+	Removed  []string `json:"removed"`
+}
+
+func promptVariableMaxLength() int {
+	length, err := strconv.Atoi(os.Getenv("PROMPT_VARIABLE_MAX_LENGTH"))
+	if err != nil || length <= 0 {
+		return defaultPromptVariableMaxLength
+	}
+	return length
+}
+
+func jailbreakPatterns() []*regexp.Regexp {
+	sources := append([]string{}, promptJailbreakPatterns...)
+	for _, phrase := range strings.Split(os.Getenv("PROMPT_BLOCKLIST"), ",") {
+		if phrase = strings.TrimSpace(phrase); phrase != "" {
+			sources = append(sources, regexp.QuoteMeta(phrase))
+		}
+	}
+	patterns := make([]*regexp.Regexp, 0, len(sources))
+	for _, source := range sources {
+		patterns = append(patterns, regexp.MustCompile(`(?i)`+source))
+	}
+	return patterns
+}
+
+// Strip URLs, jailbreak phrases and length bombs from an end-user fragment,
+// returning the clean text and what was removed
+func sanitizePromptFragment(value string) (string, []string) {
+	value, removed := stripPromptFragment(value)
+	if maxLength := promptVariableMaxLength(); len([]rune(value)) > maxLength {
+		removed = append(removed, fmt.Sprintf("truncated %d characters", len([]rune(value))-maxLength))
+		value = strings.TrimSpace(string([]rune(value)[:maxLength]))
+	}
+	return value, removed
+}
+
+// Strip URLs, jailbreak phrases and repeated runs, whatever the length
+func stripPromptFragment(value string) (string, []string) {
+	var removed []string
+
+	value = urlPattern.ReplaceAllStringFunc(value, func(match string) string {
+		removed = append(removed, "url: "+match)
+		return ""
+	})
+	for _, pattern := range jailbreakPatterns() {
+		value = pattern.ReplaceAllStringFunc(value, func(match string) string {
+			removed = append(removed, "phrase: "+match)
+			return ""
+		})
+	}
+	value = collapseRepeatedRuns(value, &removed)
+	value = strings.TrimSpace(whitespacePattern.ReplaceAllString(value, " "))
+	return value, removed
+}
+
+// Cut runs of the same character down to three, since RE2 has no
+// backreferences to match them with
+func collapseRepeatedRuns(value string, removed *[]string) string {
+	runes := []rune(value)
+	var out []rune
+	for start := 0; start < len(runes); {
+		end := start
+		for end < len(runes) && runes[end] == runes[start] {
+			end++
+		}
+		run := end - start
+		if run > maxRepeatedRun {
+			*removed = append(*removed, fmt.Sprintf("repeated character: %d x %q", run, runes[start]))
+			run = 3
+		}
+		for i := 0; i < run; i++ {
+			out = append(out, runes[start])
+		}
+		start = end
+	}
+	return string(out)
+}
+
+// Sanitize the prompt_variables and substitute them for their {name}
+// placeholders in the prompts and prompt template
+func renderPromptVariables(body *IdeogramRequestBody) []SanitizationReport {
+	if len(body.PromptVariables) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(body.PromptVariables))
+	for name := range body.PromptVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var reports []SanitizationReport
+	replacements := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		clean, removed := sanitizePromptFragment(body.PromptVariables[name])
+		if len(removed) > 0 {
+			reports = append(reports, SanitizationReport{Variable: name, Removed: removed})
+		}
+		replacements = append(replacements, "{"+name+"}", clean)
+	}
+
+	replacer := strings.NewReplacer(replacements...)
+	body.Prompt = replacer.Replace(body.Prompt)
+	body.PromptTemplate = replacer.Replace(body.PromptTemplate)
+	for i, prompt := range body.Prompts {
+		body.Prompts[i] = replacer.Replace(prompt)
+	}
+	return reports
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// A provider answered successfully but in a shape we cannot read, e.g. the
+// image URL moved to a field we don't know. Retrying will not help; the
+// decoder needs updating, or an alias in PROVIDER_FIELD_ALIASES.
+type SchemaError struct {
+	Provider string
+	Detail   string
+	Body     string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s provider schema changed: %s: %.200s", e.Provider, e.Detail, e.Body)
+}
+
+func newSchemaError(provider string, detail string, body string) error {
+	emitMetric("ProviderSchemaChanged", 1, "Count")
+	return &SchemaError{Provider: provider, Detail: detail, Body: body}
+}
+
+func isSchemaChanged(err error) bool {
+	var schemaErr *SchemaError
+	return errors.As(err, &schemaErr)
+}
+
+// Fields providers are known to have renamed, by provider: new name to the
+// name we decode. PROVIDER_FIELD_ALIASES adds to these without a deploy, e.g.
+// {"freepik": {"output_url": "url"}}.
+var builtinFieldAliases = map[string]map[string]string{
+	"ideogram": {"image_url": "url"},
+	"freepik":  {"image_url": "url", "cutout_url": "url"},
+}
+
+func providerFieldAliases(provider string) map[string]string {
+	aliases := map[string]string{}
+	for from, to := range builtinFieldAliases[provider] {
+		aliases[from] = to
+	}
+	raw := os.Getenv("PROVIDER_FIELD_ALIASES")
+	if raw == "" {
+		return aliases
+	}
+	var configured map[string]map[string]string
+	if err := json.Unmarshal([]byte(raw), &configured); err != nil {
+		log.Println("Ignoring PROVIDER_FIELD_ALIASES, not valid JSON:", err)
+		return aliases
+	}
+	for from, to := range configured[provider] {
+		aliases[from] = to
+	}
+	return aliases
+}
+
+// Unknown fields already logged by this container, so a provider adding a
+// field logs it once rather than on every image
+var reportedSchemaFields sync.Map
+
+// Decode a provider's response into target, tolerating fields it has added
+// and, through the aliases, fields it has renamed. Both are logged as
+// warnings. Only a body that is not JSON at all fails here; whether the
+// fields we need came through is up to the caller.
+func decodeProviderResponse(provider string, body []byte, target interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var raw interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return newSchemaError(provider, "response is not JSON", string(body))
+	}
+
+	aliases := providerFieldAliases(provider)
+	renamed := map[string]bool{}
+	raw = renameAliasedFields(raw, aliases, renamed)
+	for field := range renamed {
+		warnSchemaField(provider, fmt.Sprintf("renamed field %s read as %s", field, aliases[field]))
+	}
+	unknown := map[string]bool{}
+	collectUnknownFields(raw, reflect.TypeOf(target), "", unknown)
+	for field := range unknown {
+		warnSchemaField(provider, "unknown field "+field)
+	}
+
+	normalized, err := json.Marshal(raw)
+	if err != nil {
+		return fmt.Errorf("error re-encoding %s response: %v", provider, err)
+	}
+	if err := json.Unmarshal(normalized, target); err != nil {
+		return newSchemaError(provider, err.Error(), string(body))
+	}
+	return nil
+}
+
+func warnSchemaField(provider string, warning string) {
+	if _, seen := reportedSchemaFields.LoadOrStore(provider+" "+warning, true); seen {
+		return
+	}
+	log.Printf("Warning: %s response has %s", provider, warning)
+	emitMetric("ProviderSchemaWarnings", 1, "Count")
+}
+
+// Rename aliased keys in every object of a decoded JSON value. A key already
+// present under its canonical name wins over the alias.
+func renameAliasedFields(value interface{}, aliases map[string]string, renamed map[string]bool) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for from, to := range aliases {
+			if field, ok := value[from]; ok {
+				if _, exists := value[to]; !exists {
+					value[to] = field
+					renamed[from] = true
+				}
+				delete(value, from)
+			}
+		}
+		for key, field := range value {
+			value[key] = renameAliasedFields(field, aliases, renamed)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = renameAliasedFields(item, aliases, renamed)
+		}
+	}
+	return value
+}
+
+// Record the keys of value that the type t has no field for, by path, e.g.
+// "data[].upsampled_prompt". Raw JSON and interface{} fields take anything.
+func collectUnknownFields(value interface{}, t reflect.Type, path string, unknown map[string]bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if t.Kind() != reflect.Struct {
+			return
+		}
+		fields := jsonFields(t)
+		for key, field := range value {
+			fieldType, ok := fields[key]
+			if !ok {
+				unknown[path+key] = true
+				continue
+			}
+			collectUnknownFields(field, fieldType, path+key+".", unknown)
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return
+		}
+		for _, item := range value {
+			collectUnknownFields(item, t.Elem(), strings.TrimSuffix(path, ".")+"[].", unknown)
+		}
+	}
+}
+
+// JSON names of a struct's fields, including those of embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			for embedded, fieldType := range jsonFields(field.Type) {
+				fields[embedded] = fieldType
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// Check an Ideogram generate or upscale response carries what we use: at
+// least one image, and a URL for every safe one
+func checkIdeogramResponse(response IdeogramResponse, body string) error {
+	if len(response.Data) == 0 {
+		return newSchemaError("ideogram", "no images under data", body)
+	}
+	var missing []string
+	for i, data := range response.Data {
+		if data.IsImageSafe && data.URL == "" {
+			missing = append(missing, fmt.Sprint(i))
+		}
+	}
+	if len(missing) > 0 {
+		return newSchemaError("ideogram", "no url for images "+strings.Join(missing, ", "), body)
+	}
+	return nil
+}
+
+// Reported with a stable error code, so alerts and Zaps can tell a changed
+// provider format from an outage
+func schemaChangedResponse(err error) events.LambdaFunctionURLResponse {
+	responseBody, _ := json.Marshal(map[string]string{
+		"error":   "provider_schema_changed",
+		"message": err.Error(),
+	})
+	return events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusBadGateway,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image/png"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/bedrockruntime"
+)
+
+// Vision model rating comparison variants unless SCORING_MODEL_ID is set
+const defaultScoringModelID = "anthropic.claude-3-haiku-20240307-v1:0"
+
+// PNGs are scaled down to this width before scoring, which is plenty for a
+// rating and keeps upscaled images under Bedrock's image size limit
+const scoringImageMaxWidth = 1024
+
+// Asks for a bare number so the answer needs no parsing beyond Atoi
+const scoringSystemPrompt = `You judge images made by an image generator for an editor choosing between them.
+Rate how well the image matches the prompt and how good it looks overall, from 1 (unusable) to 10 (excellent).
+Answer with the number alone.`
+
+// Off unless the request or SCORE_VARIANTS turns it on, since every image
+// costs a model call
+func (body IdeogramRequestBody) scoringEnabled() bool {
+	return stageEnabled(body.ScoreVariants, "SCORE_VARIANTS", false)
+}
+
+func scoringModelID() string {
+	if model := strings.TrimSpace(os.Getenv("SCORING_MODEL_ID")); model != "" {
+		return model
+	}
+	return defaultScoringModelID
+}
+
+// Rate one image against the prompt it was generated from, from 1 to 10
+func scoreImage(prompt string, imageData []byte, summary *InvocationSummary) (int, error) {
+	stageStart := time.Now()
+	defer summary.recordStage("scoring", stageStart)
+
+	format := strings.TrimPrefix(http.DetectContentType(imageData), "image/")
+	if format == bedrockruntime.ImageFormatPng {
+		img, err := png.Decode(bytes.NewReader(imageData))
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode image: %v", err)
+		}
+		if bounds := img.Bounds(); bounds.Dx() > scoringImageMaxWidth {
+			img = downscale(img, scoringImageMaxWidth, max(bounds.Dy()*scoringImageMaxWidth/bounds.Dx(), 1))
+			if imageData, err = encodePNG(img); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	sess, err := session.NewSession(newAWSConfig(bedrockRegion()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create session: %v", err)
+	}
+	output, err := bedrockruntime.New(sess).Converse(&bedrockruntime.ConverseInput{
+		ModelId: aws.String(scoringModelID()),
+		System:  []*bedrockruntime.SystemContentBlock{{Text: aws.String(scoringSystemPrompt)}},
+		Messages: []*bedrockruntime.Message{{
+			Role: aws.String(bedrockruntime.ConversationRoleUser),
+			Content: []*bedrockruntime.ContentBlock{
+				{Image: &bedrockruntime.ImageBlock{
+					Format: aws.String(format),
+					Source: &bedrockruntime.ImageSource{Bytes: imageData},
+				}},
+				{Text: aws.String("Prompt: " + prompt)},
+			},
+		}},
+		InferenceConfig: &bedrockruntime.InferenceConfiguration{
+			MaxTokens:   aws.Int64(4),
+			Temperature: aws.Float64(0),
+		},
+	})
+	if err != nil {
+		if failure, ok := err.(awserr.RequestFailure); ok {
+			return 0, &ProviderError{Provider: "bedrock", StatusCode: failure.StatusCode(), Body: failure.Message()}
+		}
+		return 0, fmt.Errorf("error invoking Bedrock: %v", err)
+	}
+
+	var answer string
+	if output.Output != nil && output.Output.Message != nil {
+		for _, block := range output.Output.Message.Content {
+			answer += aws.StringValue(block.Text)
+		}
+	}
+	score, err := strconv.Atoi(strings.TrimSpace(answer))
+	if err != nil || score < 1 || score > 10 {
+		return 0, fmt.Errorf("the scoring model answered %q instead of a score from 1 to 10", answer)
+	}
+	return score, nil
+}
+
+// Score the variant's images, which the run returned as base64 for the
+// purpose. The variant's score is that of its best image.
+func scoreVariant(variant *VariantResult, prompt string, images []string, summary *InvocationSummary) error {
+	variant.Scores = make([]int, 0, len(images))
+	for _, encoded := range images {
+		imageData, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("failed to decode image: %v", err)
+		}
+		score, err := scoreImage(prompt, imageData, summary)
+		if err != nil {
+			return err
+		}
+		variant.Scores = append(variant.Scores, score)
+		variant.Score = max(variant.Score, score)
+	}
+	return nil
+}
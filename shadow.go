@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"time"
+)
+
+// Soft shadow rendered under a cutout. Unset fields take the defaults below.
+type DropShadow struct {
+	// Direction the shadow falls, in degrees clockwise from pointing right,
+	// so 90 is straight down
+	Angle *float64 `json:"angle,omitempty"`
+	// Offset from the subject, in pixels
+	Distance *int `json:"distance,omitempty"`
+	// Blur radius, in pixels
+	Blur *int `json:"blur,omitempty"`
+	// Shadow opacity from 0 to 1
+	Opacity *float64 `json:"opacity,omitempty"`
+}
+
+const (
+	defaultShadowAngle    = 90
+	defaultShadowDistance = 20
+	defaultShadowBlur     = 15
+	defaultShadowOpacity  = 0.4
+)
+
+// Resolved shadow settings
+func (shadow DropShadow) settings() (angle float64, distance int, blur int, opacity float64) {
+	angle, distance, blur, opacity = defaultShadowAngle, defaultShadowDistance, defaultShadowBlur, defaultShadowOpacity
+	if shadow.Angle != nil {
+		angle = *shadow.Angle
+	}
+	if shadow.Distance != nil {
+		distance = *shadow.Distance
+	}
+	if shadow.Blur != nil {
+		blur = *shadow.Blur
+	}
+	if shadow.Opacity != nil {
+		opacity = *shadow.Opacity
+	}
+	return angle, distance, blur, opacity
+}
+
+func (shadow DropShadow) validate() error {
+	angle, distance, blur, opacity := shadow.settings()
+	if math.IsNaN(angle) || math.IsInf(angle, 0) {
+		return fmt.Errorf("drop_shadow.angle must be a number of degrees")
+	}
+	if distance < 0 || distance > 500 {
+		return fmt.Errorf("drop_shadow.distance must be between 0 and 500, got %d", distance)
+	}
+	if blur < 0 || blur > 200 {
+		return fmt.Errorf("drop_shadow.blur must be between 0 and 200, got %d", blur)
+	}
+	if opacity < 0 || opacity > 1 {
+		return fmt.Errorf("drop_shadow.opacity must be between 0 and 1, got %g", opacity)
+	}
+	return nil
+}
+
+func dropShadowStep(ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) ([]byte, error) {
+	stageStart := time.Now()
+	shadowed, err := renderDropShadow(imageData, *ideogramRequestBody.DropShadow)
+	summary.recordStage("drop_shadow", stageStart)
+	if err != nil {
+		log.Println("Error rendering drop shadow:", err)
+		summary.recordError("drop_shadow", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error rendering drop shadow", Err: err}
+	}
+	return shadowed, nil
+}
+
+// Render the shadow of the cutout's alpha channel under it. The canvas grows
+// by the shadow's reach on every side so the shadow is never clipped.
+func renderDropShadow(imageData []byte, shadow DropShadow) ([]byte, error) {
+	angle, distance, blur, opacity := shadow.settings()
+	src, err := png.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	margin := distance + blur
+	bounds := src.Bounds()
+	canvas := image.NewNRGBA(image.Rect(0, 0, bounds.Dx()+2*margin, bounds.Dy()+2*margin))
+	width, height := canvas.Rect.Dx(), canvas.Rect.Dy()
+
+	// Shadow mask: the subject's alpha, offset and scaled by the opacity
+	radians := angle * math.Pi / 180
+	offsetX := int(math.Round(math.Cos(radians) * float64(distance)))
+	offsetY := int(math.Round(math.Sin(radians) * float64(distance)))
+	mask := make([]float32, width*height)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			_, _, _, a := src.At(x, y).RGBA()
+			if a == 0 {
+				continue
+			}
+			mx, my := x-bounds.Min.X+margin+offsetX, y-bounds.Min.Y+margin+offsetY
+			if mx >= 0 && mx < width && my >= 0 && my < height {
+				mask[my*width+mx] = float32(a) / 0xffff * float32(opacity)
+			}
+		}
+	}
+	// Three box blurs approximate a gaussian
+	for pass := 0; pass < 3 && blur > 0; pass++ {
+		boxBlur(mask, width, height, blur/3+1)
+	}
+
+	for i, a := range mask {
+		canvas.Pix[i*4+3] = uint8(math.Min(float64(a)*255+0.5, 255))
+	}
+	draw.Draw(canvas, bounds.Sub(bounds.Min).Add(image.Pt(margin, margin)), src, bounds.Min, draw.Over)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return nil, fmt.Errorf("failed to encode image: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Blur the values in place with a horizontal then a vertical running average
+func boxBlur(values []float32, width int, height int, radius int) {
+	line := make([]float32, max(width, height))
+	blurLine := func(get func(int) float32, set func(int, float32), length int) {
+		var sum float32
+		for i := -radius; i < length+radius; i++ {
+			if i+radius < length && i+radius >= 0 {
+				sum += get(i + radius)
+			}
+			if i-radius-1 >= 0 && i-radius-1 < length {
+				sum -= get(i - radius - 1)
+			}
+			if i >= 0 && i < length {
+				line[i] = sum / float32(2*radius+1)
+			}
+		}
+		for i := 0; i < length; i++ {
+			set(i, line[i])
+		}
+	}
+	for y := 0; y < height; y++ {
+		row := values[y*width : (y+1)*width]
+		blurLine(func(i int) float32 { return row[i] }, func(i int, v float32) { row[i] = v }, width)
+	}
+	for x := 0; x < width; x++ {
+		blurLine(func(i int) float32 { return values[i*width+x] }, func(i int, v float32) { values[i*width+x] = v }, height)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Header carrying the shard index on the self-invocations of a sharded job
+const jobShardHeader = "x-job-shard"
+
+// Line items one invocation generates, overridable with SHARD_SIZE. Each
+// item takes up to a minute with background removal and upscaling, so ten
+// stay well inside the function timeout.
+const defaultShardSize = 10
+
+// Shard results are kept for a week, long enough to collect them
+const jobShardRetention = 7 * 24 * time.Hour
+
+// Lambda drops async invocations still not run after six hours, so a shard
+// missing by then never reports
+const jobShardDeadline = 6 * time.Hour
+
+// A shard still running this long after it started has crashed or been
+// killed: three attempts at the function's 5 minute timeout, and Lambda's
+// retry delays between them
+const jobShardStaleAfter = 20 * time.Minute
+
+// Time a shard keeps to record its outcome before the function times out
+const jobShardReserve = 15 * time.Second
+
+// Status of a shard that has started and not reported yet
+const jobShardRunning = "running"
+
+// Outcome of one shard, stored in JOB_SHARDS_TABLE keyed by job_id and shard
+type JobShard struct {
+	JobID      string   `dynamodbav:"job_id"`
+	Shard      int      `dynamodbav:"shard"`
+	Status     string   `dynamodbav:"status"`
+	StatusCode int      `dynamodbav:"status_code,omitempty"`
+	Prompts    []string `dynamodbav:"prompts"`
+	FileNames  []string `dynamodbav:"filenames"`
+	// The shard's response body, when it answered JSON
+	Result    string `dynamodbav:"result,omitempty"`
+	Error     string `dynamodbav:"error,omitempty"`
+	UpdatedAt string `dynamodbav:"updated_at"`
+	// The invocation running the shard, and since when. The ID is stored even
+	// when empty, outside Lambda, so the conditions on it still match.
+	InvocationID string `dynamodbav:"invocation_id"`
+
+	StartedAt string `dynamodbav:"started_at,omitempty"`
+}
+
+func jobShardsTable() string {
+	return os.Getenv("JOB_SHARDS_TABLE")
+}
+
+func shardSize() int {
+	size, err := strconv.Atoi(os.Getenv("SHARD_SIZE"))
+	if err != nil || size <= 0 {
+		return defaultShardSize
+	}
+	return size
+}
+
+// Line-item batches over the shard size are split when a shards table is
+// configured. Inline base64 images would not fit in the shard records.
+func shouldShard(body IdeogramRequestBody) bool {
+	return jobShardsTable() != "" && len(body.Prompts) > shardSize() && !body.ReturnBase64
+}
+
+func jobShardIndex(request events.LambdaFunctionURLRequest) (int, bool) {
+	shard, err := strconv.Atoi(headerValue(request.Headers, jobShardHeader))
+	return shard, err == nil && shard >= 0
+}
+
+// Split the line items into shards of SHARD_SIZE, invoke the function
+// asynchronously once per shard and answer 202 with the job collecting them
+func startShardedJob(jobID string, decodedBody []byte, body IdeogramRequestBody, summary *InvocationSummary) events.LambdaFunctionURLResponse {
+	items, err := expandLineItems(body)
+	if err != nil {
+		summary.recordError("parse", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}
+	}
+	// Shards get the prompts as sent, so they are sanitized and checked once
+	// more like any request, and the filenames already derived for them
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(decodedBody, &fields); err != nil {
+		summary.recordError("parse", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request",
+		}
+	}
+	var sentPrompts StringList
+	json.Unmarshal(fields["prompts"], &sentPrompts)
+	if len(sentPrompts) != len(items) {
+		sentPrompts = body.Prompts
+	}
+
+	size := shardSize()
+	shards := (len(items) + size - 1) / size
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := saveJob(Job{JobID: jobID, Status: jobStatusPending, CreatedAt: now, UpdatedAt: now, Shards: shards, Tenant: summary.Tenant}); err != nil {
+		log.Println("Error starting sharded job:", err)
+		summary.recordError("async", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}
+	}
+
+	keyHeaders := body.providerKeyHeaders()
+	started := 0
+	var lastErr error
+	for shard := 0; shard < shards; shard++ {
+		end := (shard + 1) * size
+		if end > len(items) {
+			end = len(items)
+		}
+		prompts := []string(sentPrompts[shard*size : end])
+		fileNames := make([]string, 0, len(prompts))
+		for _, item := range items[shard*size : end] {
+			fileNames = append(fileNames, item.FileName)
+		}
+
+		shardFields := make(map[string]json.RawMessage, len(fields))
+		for name, value := range fields {
+			shardFields[name] = value
+		}
+		shardFields["prompts"], _ = json.Marshal(prompts)
+		shardFields["filenames"], _ = json.Marshal(fileNames)
+		// The shard is already asynchronous
+		delete(shardFields, "max_wait_seconds")
+		// Record the shard with its line items before starting it, so the job
+		// can fail them should it never run
+		err := saveJobShard(JobShard{JobID: jobID, Shard: shard, Status: jobStatusPending, Prompts: prompts, FileNames: fileNames})
+		var shardBody []byte
+		if err == nil {
+			shardBody, err = json.Marshal(shardFields)
+		}
+		if err == nil {
+			// Caller keys travel sealed to the job, never in the payload
+			var shardHeaders map[string]string
+			shardHeaders, shardBody, err = sealProviderKeys(jobID, shardBody, keyHeaders)
+			if err == nil {
+				shardHeaders[jobShardHeader] = strconv.Itoa(shard)
+				if summary.Tenant != "" {
+					shardHeaders["x-tenant-id"] = summary.Tenant
+				}
+				summary.addTraceHeaders(shardHeaders)
+				err = invokeAsyncJob(jobID, shardBody, shardHeaders)
+			}
+		}
+		if err != nil {
+			log.Printf("Error starting shard %d of job %s: %v", shard, jobID, err)
+			summary.recordError("async", err)
+			lastErr = err
+			failed := JobShard{JobID: jobID, Shard: shard, Status: jobStatusFailed, StatusCode: 500, Prompts: prompts, FileNames: fileNames, Error: err.Error()}
+			if err := saveJobShard(failed); err != nil {
+				log.Println("Error saving job shard:", err)
+			}
+			continue
+		}
+		started++
+	}
+
+	if started == 0 {
+		if throttleErr, ok := throttleFromError(lastErr); ok {
+			return throttledResponse(throttleErr)
+		}
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}
+	}
+	log.Printf("Split %d line items into %d shards of job %s", len(items), shards, jobID)
+	return jobAcceptedResponse(jobID, shards)
+}
+
+// Run one shard of a sharded job and record its outcome for the job to
+// collect. The shard is claimed first, so a duplicate delivery or a retry
+// after the shard finished does not generate and bill it twice; only a retry
+// of the invocation that claimed it runs it again. Reports whether it ran.
+func runJobShard(ctx context.Context, jobID string, shard int, body IdeogramRequestBody, summary *InvocationSummary) (events.LambdaFunctionURLResponse, bool) {
+	record := JobShard{JobID: jobID, Shard: shard, Prompts: body.Prompts, FileNames: body.FileNames, InvocationID: summary.invocationID}
+	claimed, err := claimJobShard(record)
+	if err != nil {
+		log.Println("Error claiming job shard:", err)
+		summary.recordError("async", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, false
+	}
+	if !claimed {
+		log.Printf("Shard %d of job %s was already run, skipping", shard, jobID)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: http.StatusConflict,
+			Body:       "Shard already run",
+		}, false
+	}
+
+	// A panic or running out of time fails the shard rather than leaving it
+	// running until the job gives up on it
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			record.Status = jobStatusFailed
+			record.StatusCode = 500
+			record.Error = fmt.Sprintf("shard failed unexpectedly: %v", recovered)
+			if err := finishJobShard(record); err != nil {
+				log.Println("Error saving job shard:", err)
+			}
+			panic(recovered)
+		}
+	}()
+	if !summary.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, summary.deadline.Add(-jobShardReserve))
+		defer cancel()
+	}
+
+	log.Printf("Running shard %d of job %s", shard, jobID)
+	response := dispatchGeneration(ctx, body, summary)
+
+	record.StatusCode = response.StatusCode
+	if response.StatusCode < 300 {
+		record.Status = jobStatusSucceeded
+	} else {
+		record.Status = jobStatusFailed
+	}
+	if ctx.Err() == context.DeadlineExceeded && response.StatusCode >= 300 {
+		record.Error = "shard ran out of time"
+	} else if json.Valid([]byte(response.Body)) {
+		record.Result = response.Body
+	} else {
+		record.Error = response.Body
+	}
+	if err := finishJobShard(record); err != nil {
+		log.Println("Error saving job shard:", err)
+		summary.recordError("async", err)
+		return response, true
+	}
+
+	// The last shard to report completes the job, so polls only read it
+	job, err := loadJob(jobID)
+	if err == nil && job.Status == jobStatusPending {
+		if job, err = collectJobShards(job); err == nil && job.Status != jobStatusPending {
+			err = saveJob(job)
+		}
+	}
+	if err != nil {
+		log.Println("Error completing sharded job:", err)
+		summary.recordError("async", err)
+	}
+	return response, true
+}
+
+func jobShardItem(shard JobShard) (map[string]*dynamodb.AttributeValue, error) {
+	shard.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	item, err := dynamodbattribute.MarshalMap(shard)
+	if err != nil {
+		return nil, err
+	}
+	item["expires_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(jobShardRetention).Unix(), 10))}
+	return item, nil
+}
+
+// Record a shard outcome without conditions, for shards that never started
+func saveJobShard(shard JobShard) error {
+	return putJobShard(shard, nil, nil)
+}
+
+// Mark the queued shard running for this invocation. Returns false when
+// another invocation holds it, or it has already reported.
+func claimJobShard(shard JobShard) (bool, error) {
+	shard.Status = jobShardRunning
+	shard.StartedAt = time.Now().UTC().Format(time.RFC3339)
+	err := putJobShard(shard, aws.String("attribute_not_exists(job_id) OR #status = :pending OR (#status = :running AND invocation_id = :invocation)"), map[string]*dynamodb.AttributeValue{
+		":pending":    {S: aws.String(jobStatusPending)},
+		":running":    {S: aws.String(jobShardRunning)},
+		":invocation": {S: aws.String(shard.InvocationID)},
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Record the outcome of a shard this invocation claimed
+func finishJobShard(shard JobShard) error {
+	return putJobShard(shard, aws.String("#status = :running AND invocation_id = :invocation"), map[string]*dynamodb.AttributeValue{
+		":running":    {S: aws.String(jobShardRunning)},
+		":invocation": {S: aws.String(shard.InvocationID)},
+	})
+}
+
+func putJobShard(shard JobShard, condition *string, values map[string]*dynamodb.AttributeValue) error {
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return err
+	}
+	item, err := jobShardItem(shard)
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(jobShardsTable()),
+		Item:      item,
+	}
+	if condition != nil {
+		input.ConditionExpression = condition
+		input.ExpressionAttributeNames = map[string]*string{"#status": aws.String("status")}
+		input.ExpressionAttributeValues = values
+	}
+	if _, err := dynamoSvc.PutItem(input); err != nil {
+		return fmt.Errorf("failed to save shard %d of job %s: %w", shard.Shard, shard.JobID, err)
+	}
+	return nil
+}
+
+func loadJobShards(jobID string) ([]JobShard, error) {
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return nil, err
+	}
+	var shards []JobShard
+	var startKey map[string]*dynamodb.AttributeValue
+	for {
+		output, err := dynamoSvc.Query(&dynamodb.QueryInput{
+			TableName:              aws.String(jobShardsTable()),
+			KeyConditionExpression: aws.String("job_id = :job_id"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":job_id": {S: aws.String(jobID)},
+			},
+			ExclusiveStartKey: startKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load shards of job %s: %v", jobID, err)
+		}
+		var page []JobShard
+		if err := dynamodbattribute.UnmarshalListOfMaps(output.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to decode shards of job %s: %v", jobID, err)
+		}
+		shards = append(shards, page...)
+		if len(output.LastEvaluatedKey) == 0 {
+			return shards, nil
+		}
+		startKey = output.LastEvaluatedKey
+	}
+}
+
+// Update a pending sharded job from its shards, without saving it. Once every
+// shard has reported, their line items are combined in order into the job's
+// result. A shard running past jobShardStaleAfter crashed or was killed, and
+// counts as failed, as does one still queued or running when the job gives up
+// on it after jobShardDeadline.
+func collectJobShards(job Job) (Job, error) {
+	shards, err := loadJobShards(job.JobID)
+	if err != nil {
+		return job, err
+	}
+	byIndex := make(map[int]JobShard, len(shards))
+	job.ShardsDone = 0
+	for _, shard := range shards {
+		switch shard.Status {
+		case jobStatusPending:
+			shard.Status = jobStatusFailed
+			shard.Error = "shard never ran"
+			byIndex[shard.Shard] = shard
+			continue
+		case jobShardRunning:
+			started, _ := time.Parse(time.RFC3339, shard.StartedAt)
+			shard.Status = jobStatusFailed
+			if time.Since(started) < jobShardStaleAfter {
+				shard.Error = "shard did not finish in time"
+				byIndex[shard.Shard] = shard
+				continue
+			}
+			shard.Error = "shard stopped without reporting, it crashed or timed out"
+		}
+		byIndex[shard.Shard] = shard
+		job.ShardsDone++
+	}
+	created, _ := time.Parse(time.RFC3339, job.CreatedAt)
+	if job.ShardsDone < job.Shards && time.Since(created) < jobShardDeadline {
+		return job, nil
+	}
+
+	combined := LambdaResponseBody{ImageURLs: make([]string, 0)}
+	failed := 0
+	for i := 0; i < job.Shards; i++ {
+		shard, ok := byIndex[i]
+		if !ok {
+			combined.Warnings = append(combined.Warnings, fmt.Sprintf("shard %d did not report", i))
+			continue
+		}
+		var result LambdaResponseBody
+		if shard.Result != "" && json.Unmarshal([]byte(shard.Result), &result) == nil && len(result.LineItems) > 0 {
+			for _, lineItem := range result.LineItems {
+				if lineItem.Error != "" {
+					failed++
+				}
+			}
+			combined.LineItems = append(combined.LineItems, result.LineItems...)
+			combined.ImageURLs = append(combined.ImageURLs, result.ImageURLs...)
+			combined.WebImageURLs = append(combined.WebImageURLs, result.WebImageURLs...)
+			combined.OriginalImageURLs = append(combined.OriginalImageURLs, result.OriginalImageURLs...)
+			combined.Seeds = append(combined.Seeds, result.Seeds...)
+			combined.ImageMetadata = append(combined.ImageMetadata, result.ImageMetadata...)
+			combined.ReviewRequired = append(combined.ReviewRequired, result.ReviewRequired...)
+			combined.Sanitization = append(combined.Sanitization, result.Sanitization...)
+			combined.PromptTruncations = append(combined.PromptTruncations, result.PromptTruncations...)
+			combined.Downgraded = combined.Downgraded || result.Downgraded
+			continue
+		}
+		// A shard that failed as a whole fails each of its line items
+		reason := shard.Error
+		if reason == "" {
+			reason = shard.Result
+		}
+		for j, prompt := range shard.Prompts {
+			lineItem := LineItemResult{Prompt: prompt, ImageURLs: make([]string, 0), Error: reason}
+			if j < len(shard.FileNames) {
+				lineItem.FileName = shard.FileNames[j]
+			}
+			combined.LineItems = append(combined.LineItems, lineItem)
+			failed++
+		}
+	}
+
+	job.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	if failed == len(combined.LineItems) {
+		job.Status = jobStatusFailed
+		job.StatusCode = 500
+	} else {
+		job.Status = jobStatusSucceeded
+		job.StatusCode = http.StatusOK
+		if failed > 0 {
+			combined.Warnings = append(combined.Warnings, fmt.Sprintf("%d of %d line items failed", failed, len(combined.LineItems)))
+		}
+	}
+	result, err := json.Marshal(combined)
+	if err != nil {
+		return job, err
+	}
+	job.Result = json.RawMessage(result)
+	return job, nil
+}
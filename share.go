@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Presigned URLs are signed with SigV4, which caps their lifetime at 7 days
+const (
+	defaultShareExpiry = time.Hour
+	maxShareExpiry     = 7 * 24 * time.Hour
+)
+
+var shortCodePattern = regexp.MustCompile(`^[a-f0-9]{10}$`)
+
+// Fresh codes tried when one is already taken
+const shortCodeAttempts = 5
+
+type ShareRequestBody struct {
+	// Object keys in BUCKET_NAME, e.g. "images/fox.png"
+	Keys             []string `json:"keys"`
+	ExpiresInSeconds int      `json:"expires_in_seconds,omitempty"`
+	// Also create a short /s/<code> link per URL (needs SHORT_LINKS_TABLE)
+	Shorten bool `json:"shorten,omitempty"`
+}
+
+type SharedLink struct {
+	Key      string `json:"key"`
+	URL      string `json:"url"`
+	ShortURL string `json:"short_url,omitempty"`
+}
+
+type ShareResponseBody struct {
+	ExpiresAt string       `json:"expires_at"`
+	Links     []SharedLink `json:"links"`
+}
+
+// Expiry of share links when the request doesn't set one, from
+// SHARE_LINK_EXPIRY_SECONDS
+func defaultShareLinkExpiry() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("SHARE_LINK_EXPIRY_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultShareExpiry
+}
+
+// Create short-lived presigned URLs for stored images, so drafts can be
+// shared with external reviewers without making the bucket public. Keys must
+// be under the caller's tenant prefix; the route refuses callers without an
+// authenticated tenant unless they are admins.
+func handleShareRequest(request events.LambdaFunctionURLRequest, tenant string) (events.LambdaFunctionURLResponse, error) {
+	body, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	var shareRequest ShareRequestBody
+	if err := json.Unmarshal(body, &shareRequest); err != nil || len(shareRequest.Keys) == 0 {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: keys are required",
+		}, nil
+	}
+
+	expiry := defaultShareLinkExpiry()
+	if shareRequest.ExpiresInSeconds > 0 {
+		expiry = time.Duration(shareRequest.ExpiresInSeconds) * time.Second
+	}
+	if expiry > maxShareExpiry {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Bad Request: expires_in_seconds must be at most %d", int(maxShareExpiry.Seconds())),
+		}, nil
+	}
+	for _, key := range shareRequest.Keys {
+		// Job state, drafts, audit records, intermediates and templates live
+		// in the same bucket and are not meant for sharing
+		if key == "" || hasAnyPrefix(strings.TrimPrefix(key, "/"), internalKeyPrefixes()) {
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf("Bad Request: key %q cannot be shared", key),
+			}, nil
+		}
+		if rejection := authorizeTenantKey(tenant, strings.TrimPrefix(key, "/")); rejection != nil {
+			return *rejection, nil
+		}
+	}
+
+	settings, err := loadS3Settings()
+	if err != nil {
+		log.Println("Error loading S3 settings:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		log.Println("Error creating S3 client:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Internal Server Error",
+		}, nil
+	}
+
+	expiresAt := time.Now().Add(expiry)
+	responseBody := ShareResponseBody{
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+		Links:     make([]SharedLink, 0, len(shareRequest.Keys)),
+	}
+	for _, key := range shareRequest.Keys {
+		req, _ := s3Svc.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(settings.Bucket),
+			Key:    aws.String(strings.TrimPrefix(key, "/")),
+		})
+		presignedURL, err := req.Presign(expiry)
+		if err != nil {
+			log.Println("Error presigning URL:", err)
+			return events.LambdaFunctionURLResponse{
+				StatusCode: 500,
+				Body:       "Error creating share link",
+			}, nil
+		}
+		link := SharedLink{Key: key, URL: presignedURL}
+
+		if shareRequest.Shorten {
+			code, err := saveShortLink(presignedURL, expiresAt, nil)
+			if err != nil {
+				log.Println("Error saving short link:", err)
+				return events.LambdaFunctionURLResponse{
+					StatusCode: 500,
+					Body:       "Error creating short link",
+				}, nil
+			}
+			link.ShortURL = fmt.Sprintf("https://%s/s/%s", request.RequestContext.DomainName, code)
+		}
+		responseBody.Links = append(responseBody.Links, link)
+	}
+
+	responseJSON, err := json.Marshal(responseBody)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseJSON),
+	}, nil
+}
+
+// Redirect a short link to its presigned URL. Links restricted to networks
+// only redirect callers from them.
+func handleShortLinkRequest(code string, sourceIP string) (events.LambdaFunctionURLResponse, error) {
+	if !shortCodePattern.MatchString(code) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Link not found",
+		}, nil
+	}
+	link, err := loadShortLink(code)
+	if err != nil {
+		log.Println("Error loading short link:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 404,
+			Body:       "Link not found",
+		}, nil
+	}
+	// DynamoDB TTL deletes lazily, so expired items may still be returned
+	if time.Now().After(link.ExpiresAt) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 410,
+			Body:       "Link expired",
+		}, nil
+	}
+	if len(link.AllowedCIDRs) > 0 && !ipAllowed(sourceIP, link.AllowedCIDRs) {
+		log.Printf("Short link %s requested from %s outside its allowed networks", code, sourceIP)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 403,
+			Body:       "Forbidden",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 302,
+		Headers:    map[string]string{"Location": link.URL},
+	}, nil
+}
+
+func newDynamoDBClient() (*dynamodb.DynamoDB, error) {
+	sess, err := session.NewSession(newAWSConfig(os.Getenv("AWS_REGION")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	return dynamodb.New(sess), nil
+}
+
+// A short link as stored in SHORT_LINKS_TABLE
+type ShortLink struct {
+	URL       string
+	ExpiresAt time.Time
+	// Networks allowed to follow the link, any when empty
+	AllowedCIDRs []string
+}
+
+// Store the URL under a new short code in SHORT_LINKS_TABLE, keyed by code
+// with an expires_at TTL attribute. The put only succeeds for an unused code,
+// and a taken one is retried with another.
+func saveShortLink(target string, expiresAt time.Time, allowedCIDRs []string) (string, error) {
+	tableName := os.Getenv("SHORT_LINKS_TABLE")
+	if tableName == "" {
+		return "", fmt.Errorf("SHORT_LINKS_TABLE is not set")
+	}
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return "", err
+	}
+
+	item := map[string]*dynamodb.AttributeValue{
+		"url":        {S: aws.String(target)},
+		"expires_at": {N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))},
+	}
+	if len(allowedCIDRs) > 0 {
+		item["allowed_cidrs"] = &dynamodb.AttributeValue{S: aws.String(strings.Join(allowedCIDRs, ","))}
+	}
+	for attempt := 1; attempt <= shortCodeAttempts; attempt++ {
+		code := randomHex(5)
+		item["code"] = &dynamodb.AttributeValue{S: aws.String(code)}
+		_, err = dynamoSvc.PutItem(&dynamodb.PutItemInput{
+			TableName:           aws.String(tableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(code)"),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			log.Printf("Short code %s is taken, trying another", code)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to store short link: %v", err)
+		}
+		return code, nil
+	}
+	return "", fmt.Errorf("failed to store short link: no free code after %d attempts", shortCodeAttempts)
+}
+
+func loadShortLink(code string) (ShortLink, error) {
+	tableName := os.Getenv("SHORT_LINKS_TABLE")
+	if tableName == "" {
+		return ShortLink{}, fmt.Errorf("SHORT_LINKS_TABLE is not set")
+	}
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return ShortLink{}, err
+	}
+
+	output, err := dynamoSvc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"code": {S: aws.String(code)},
+		},
+	})
+	if err != nil {
+		return ShortLink{}, fmt.Errorf("failed to load short link %s: %v", code, err)
+	}
+	if len(output.Item) == 0 || output.Item["url"] == nil || output.Item["expires_at"] == nil {
+		return ShortLink{}, fmt.Errorf("short link %s does not exist", code)
+	}
+	expiresAt, err := strconv.ParseInt(aws.StringValue(output.Item["expires_at"].N), 10, 64)
+	if err != nil {
+		return ShortLink{}, fmt.Errorf("short link %s has an invalid expiry: %v", code, err)
+	}
+	link := ShortLink{
+		URL:       aws.StringValue(output.Item["url"].S),
+		ExpiresAt: time.Unix(expiresAt, 0),
+	}
+	if output.Item["allowed_cidrs"] != nil {
+		link.AllowedCIDRs = strings.Split(aws.StringValue(output.Item["allowed_cidrs"].S), ",")
+	}
+	return link, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Expiry of signed asset URLs when SIGNED_URL_EXPIRY_SECONDS is not set
+const defaultSignedURLExpiry = 24 * time.Hour
+
+// A presigned URL stops working when the credentials that signed it expire.
+// The execution role's session does not say when that is, so URLs it signs
+// are capped at an hour, the shortest session STS hands out by default.
+const roleSignedURLMaxExpiry = time.Hour
+
+// Whether SIGNED_URLS asks for presigned asset URLs in every response, so the
+// bucket can be private
+func signedURLsEnabled() bool {
+	switch strings.ToLower(os.Getenv("SIGNED_URLS")) {
+	case "on", "true", "1":
+		return true
+	}
+	return false
+}
+
+func signedURLExpiry() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("SIGNED_URL_EXPIRY_SECONDS"))
+	if err != nil || seconds <= 0 {
+		return defaultSignedURLExpiry
+	}
+	if expiry := time.Duration(seconds) * time.Second; expiry < maxShareExpiry {
+		return expiry
+	}
+	return maxShareExpiry
+}
+
+// Networks allowed to fetch signed assets, from the comma-separated
+// SIGNED_URL_ALLOWED_CIDRS
+func signedURLAllowedCIDRs() []string {
+	var cidrs []string
+	for _, cidr := range strings.Split(os.Getenv("SIGNED_URL_ALLOWED_CIDRS"), ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	return cidrs
+}
+
+// Report whether the IP falls in one of the networks. Invalid entries match
+// nothing.
+func ipAllowed(sourceIP string, cidrs []string) bool {
+	ip := net.ParseIP(sourceIP)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrites URLs of objects in our bucket into presigned GET URLs. Presigned
+// URLs can't carry an IP condition, so with allowed networks configured the
+// caller gets a short link that checks the caller's IP before redirecting.
+type urlSigner struct {
+	s3Svc    *s3.S3
+	bucket   string
+	prefix   string
+	expiry   time.Duration
+	cidrs    []string
+	linkBase string
+}
+
+// S3 client to presign with, and the longest expiry its credentials allow.
+// SIGNING_ACCESS_KEY_ID and SIGNING_SECRET_ACCESS_KEY name a long-lived IAM
+// user with s3:GetObject on the bucket, whose URLs last their full expiry.
+// Without them the execution role signs, and its URLs end with its session.
+func newPresignClient(settings S3Settings) (*s3.S3, time.Duration, error) {
+	config := newAWSConfig(settings.Region)
+	accessKey, secretKey := os.Getenv("SIGNING_ACCESS_KEY_ID"), os.Getenv("SIGNING_SECRET_ACCESS_KEY")
+	if accessKey != "" && secretKey != "" {
+		config.Credentials = credentials.NewStaticCredentials(accessKey, secretKey, "")
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create session: %v", err)
+	}
+	s3Svc := s3.New(sess)
+	if config.Credentials != nil {
+		return s3Svc, maxShareExpiry, nil
+	}
+
+	value, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load signing credentials: %v", err)
+	}
+	if expiresAt, err := sess.Config.Credentials.ExpiresAt(); err == nil {
+		return s3Svc, time.Until(expiresAt), nil
+	}
+	// Keys without a session token do not expire
+	if value.SessionToken == "" {
+		return s3Svc, maxShareExpiry, nil
+	}
+	return s3Svc, roleSignedURLMaxExpiry, nil
+}
+
+// Signer for the configured bucket, or nil when signing is off
+func newURLSigner() (*urlSigner, error) {
+	if !signedURLsEnabled() {
+		return nil, nil
+	}
+	settings, err := loadS3Settings()
+	if err != nil {
+		return nil, err
+	}
+	s3Svc, maxExpiry, err := newPresignClient(settings)
+	if err != nil {
+		return nil, err
+	}
+	signer := &urlSigner{
+		s3Svc:    s3Svc,
+		bucket:   settings.Bucket,
+		prefix:   settings.objectURL(""),
+		expiry:   min(signedURLExpiry(), maxExpiry),
+		cidrs:    signedURLAllowedCIDRs(),
+		linkBase: strings.TrimRight(os.Getenv("PUBLIC_BASE_URL"), "/"),
+	}
+	if len(signer.cidrs) > 0 && signer.linkBase == "" {
+		return nil, fmt.Errorf("PUBLIC_BASE_URL is required with SIGNED_URL_ALLOWED_CIDRS")
+	}
+	return signer, nil
+}
+
+// Sign the URL if it points into our bucket, leaving others, such as a
+// placeholder image, as they are. Nil signers return the URL unchanged.
+func (signer *urlSigner) sign(rawURL string) (string, error) {
+	if signer == nil {
+		return rawURL, nil
+	}
+	key, ok := strings.CutPrefix(rawURL, signer.prefix)
+	if !ok || key == "" {
+		return rawURL, nil
+	}
+	req, _ := signer.s3Svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(signer.bucket),
+		Key:    aws.String(key),
+	})
+	presignedURL, err := req.Presign(signer.expiry)
+	if err != nil {
+		return "", fmt.Errorf("failed to presign %s: %v", key, err)
+	}
+	if len(signer.cidrs) == 0 {
+		return presignedURL, nil
+	}
+	code, err := saveShortLink(presignedURL, time.Now().Add(signer.expiry), signer.cidrs)
+	if err != nil {
+		return "", err
+	}
+	return signer.linkBase + "/s/" + code, nil
+}
+
+// URL a background remover fetches a stored intermediate from. With signing
+// on the bucket is private, so the remover gets a URL presigned for as long
+// as a batch source's. It is never a short link: the remover's addresses are
+// not among the caller's allowed networks. The signature is in the query
+// string, so removers must send the URL encoded, e.g. as a form value.
+func removerSourceURL(rawURL string) (string, error) {
+	signer, err := newURLSigner()
+	if err != nil || signer == nil {
+		return rawURL, err
+	}
+	signer.expiry = min(signer.expiry, batchSourceURLExpiry)
+	signer.cidrs = nil
+	return signer.sign(rawURL)
+}
+
+func (signer *urlSigner) signAll(urls []string) error {
+	for i, rawURL := range urls {
+		signed, err := signer.sign(rawURL)
+		if err != nil {
+			return err
+		}
+		urls[i] = signed
+	}
+	return nil
+}
+
+// Sign every asset URL in the response body in place
+func signResponseURLs(responseBody *LambdaResponseBody) error {
+	signer, err := newURLSigner()
+	if err != nil || signer == nil {
+		return err
+	}
+	lists := [][]string{responseBody.ImageURLs, responseBody.WebImageURLs, responseBody.OriginalImageURLs}
+	for _, lineItem := range responseBody.LineItems {
+		lists = append(lists, lineItem.ImageURLs, lineItem.WebImageURLs, lineItem.OriginalImageURLs)
+	}
+	for _, variant := range responseBody.Variants {
+		lists = append(lists, variant.ImageURLs, variant.WebImageURLs, variant.OriginalImageURLs)
+	}
+	for _, urls := range lists {
+		if err := signer.signAll(urls); err != nil {
+			return err
+		}
+	}
+	for _, image := range responseBody.ImageMetadata {
+		if image.Pattern == nil {
+			continue
+		}
+		if image.Pattern.PreviewURL, err = signer.sign(image.Pattern.PreviewURL); err != nil {
+			return err
+		}
+	}
+	for i := range responseBody.ReviewRequired {
+		if responseBody.ReviewRequired[i].URL, err = signer.sign(responseBody.ReviewRequired[i].URL); err != nil {
+			return err
+		}
+	}
+	if responseBody.GalleryURL, err = signer.sign(responseBody.GalleryURL); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pixels at or below this alpha count as background when finding the subject
+const subjectAlphaThreshold = 16
+
+// Margin around the subject, as a fraction of its larger side
+const smartCropPadding = 0.08
+
+func smartCropStep(ideogramRequestBody IdeogramRequestBody, imageData []byte, summary *InvocationSummary) ([]byte, error) {
+	stageStart := time.Now()
+	cropped, err := smartCrop(imageData, ideogramRequestBody.SmartCrop)
+	summary.recordStage("smart_crop", stageStart)
+	if err != nil {
+		log.Println("Error cropping image:", err)
+		summary.recordError("smart_crop", err)
+		return nil, &PipelineError{StatusCode: 500, Message: "Error cropping image", Err: err}
+	}
+	return cropped, nil
+}
+
+// Parse an aspect ratio such as "4x5" into width and height
+func parseAspectRatio(value string) (int, int, error) {
+	width, height, ok := strings.Cut(value, "x")
+	w, errW := strconv.Atoi(width)
+	h, errH := strconv.Atoi(height)
+	if !ok || errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("invalid aspect ratio %q, expected e.g. 1x1 or 16x9", value)
+	}
+	return w, h, nil
+}
+
+// Crop the cutout to the aspect ratio, centered on the subject's bounding box
+// from the alpha channel. Where the frame reaches past the image, the canvas
+// is extended with transparency.
+func smartCrop(imageData []byte, aspectRatio string) ([]byte, error) {
+	ratioW, ratioH, err := parseAspectRatio(aspectRatio)
+	if err != nil {
+		return nil, err
+	}
+	src, err := png.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	subject := subjectBounds(src)
+	if subject.Empty() {
+		// Nothing opaque to center on, frame the whole image instead
+		subject = src.Bounds()
+	}
+	padding := int(float64(max(subject.Dx(), subject.Dy())) * smartCropPadding)
+	subject = subject.Inset(-padding)
+
+	// Grow the shorter side of the subject box to reach the aspect ratio
+	width, height := subject.Dx(), subject.Dy()
+	if width*ratioH < height*ratioW {
+		width = (height*ratioW + ratioH - 1) / ratioH
+	} else {
+		height = (width*ratioH + ratioW - 1) / ratioW
+	}
+	center := image.Pt((subject.Min.X+subject.Max.X)/2, (subject.Min.Y+subject.Max.Y)/2)
+	frame := image.Rect(center.X-width/2, center.Y-height/2, center.X-width/2+width, center.Y-height/2+height)
+
+	// Prefer moving the frame inside the image over adding empty canvas
+	frame = shiftInside(frame, src.Bounds())
+
+	dst := image.NewNRGBA(image.Rect(0, 0, frame.Dx(), frame.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, frame.Min, draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, fmt.Errorf("failed to encode cropped image: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Bounding box of the pixels above the alpha threshold
+func subjectBounds(img image.Image) image.Rectangle {
+	bounds := img.Bounds()
+	subject := image.Rectangle{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			_, _, _, a := img.At(x, y).RGBA()
+			if a>>8 > subjectAlphaThreshold {
+				subject = subject.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return subject
+}
+
+// Move the frame along each axis so it stays within bounds where it fits
+func shiftInside(frame image.Rectangle, bounds image.Rectangle) image.Rectangle {
+	shift := image.Point{}
+	if frame.Dx() <= bounds.Dx() {
+		if frame.Min.X < bounds.Min.X {
+			shift.X = bounds.Min.X - frame.Min.X
+		} else if frame.Max.X > bounds.Max.X {
+			shift.X = bounds.Max.X - frame.Max.X
+		}
+	}
+	if frame.Dy() <= bounds.Dy() {
+		if frame.Min.Y < bounds.Min.Y {
+			shift.Y = bounds.Min.Y - frame.Min.Y
+		} else if frame.Max.Y > bounds.Max.Y {
+			shift.Y = bounds.Max.Y - frame.Max.Y
+		}
+	}
+	return frame.Add(shift)
+}
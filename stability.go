@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stability AI's Stable Image models, selected with STABILITY_MODEL
+var stabilityGenerateURLs = map[string]string{
+	"core":  "https://api.stability.ai/v2beta/stable-image/generate/core",
+	"ultra": "https://api.stability.ai/v2beta/stable-image/generate/ultra",
+	"sd3":   "https://api.stability.ai/v2beta/stable-image/generate/sd3",
+}
+
+const defaultStabilityModel = "core"
+
+// Aspect ratios Stable Image accepts, in our notation
+var stabilityAspectRatios = []string{
+	"1x1", "16x9", "9x16", "21x9", "9x21", "3x2", "2x3", "4x5", "5x4",
+}
+
+// Stability returns this finish reason for images its filter withheld
+const stabilityContentFiltered = "CONTENT_FILTERED"
+
+func init() {
+	registerGenerator("stability", stabilityGenerator{})
+}
+
+// Stability AI's Stable Image API. It makes one image per call, so the
+// calls for num_images run concurrently.
+type stabilityGenerator struct{}
+
+func stabilityModel() string {
+	model := strings.ToLower(strings.TrimSpace(os.Getenv("STABILITY_MODEL")))
+	if _, ok := stabilityGenerateURLs[model]; !ok {
+		return defaultStabilityModel
+	}
+	return model
+}
+
+func stabilityGenerateURL() string {
+	if url := strings.TrimSpace(os.Getenv("STABILITY_GENERATE_URL")); url != "" {
+		return url
+	}
+	return stabilityGenerateURLs[stabilityModel()]
+}
+
+func (stabilityGenerator) Name(body IdeogramRequestBody) string {
+	return "stability-" + stabilityModel()
+}
+
+// Edits, reframes, remixes and Ideogram's style references have no Stable
+// Image counterpart, and only some aspect ratios do
+func (stabilityGenerator) Validate(body IdeogramRequestBody) error {
+	if err := rejectIdeogramOnlyFeatures(body); err != nil {
+		return err
+	}
+	if body.AspectRatio != nil && !containsString(stabilityAspectRatios, string(*body.AspectRatio)) {
+		return fmt.Errorf("aspect_ratio %q is not available with the stability provider, expected one of %s", *body.AspectRatio, strings.Join(stabilityAspectRatios, ", "))
+	}
+	return nil
+}
+
+// Body of a Stable Image response requested as JSON
+type stabilityResponse struct {
+	Image        string `json:"image"`
+	FinishReason string `json:"finish_reason"`
+	Seed         int    `json:"seed"`
+}
+
+func (stabilityGenerator) Generate(ctx context.Context, body IdeogramRequestBody, summary *InvocationSummary) ([]Image, error) {
+	apiKey := providerCredential("stability")
+	if apiKey == "" {
+		return nil, missingCredentialError("stability")
+	}
+	body, negativePrompt := applyPlainBackground(applyPattern(applyBrandFonts(body)))
+
+	count := 1
+	if body.NumImages != nil {
+		count = *body.NumImages
+	}
+	images := make([]Image, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Successive seeds keep a fixed-seed batch reproducible
+			var seed *int
+			if body.Seed != nil {
+				next := *body.Seed + i
+				seed = &next
+			}
+			images[i], errs[i] = sendRequestToStability(ctx, apiKey, body.Prompt, negativePrompt, body.AspectRatio, seed)
+		}(i)
+	}
+	wg.Wait()
+
+	// One failed call fails the generation, as a failed Ideogram call would
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// Generate one image. Stable Image takes aspect ratios as "16:9".
+func sendRequestToStability(ctx context.Context, apiKey string, prompt string, negativePrompt string, aspectRatio *AspectRatio, seed *int) (Image, error) {
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	writer.WriteField("prompt", prompt)
+	if negativePrompt != "" {
+		writer.WriteField("negative_prompt", negativePrompt)
+	}
+	if aspectRatio != nil {
+		writer.WriteField("aspect_ratio", aspectRatio.Colon())
+	}
+	if seed != nil {
+		writer.WriteField("seed", strconv.Itoa(*seed))
+	}
+	writer.WriteField("output_format", "png")
+	if err := writer.Close(); err != nil {
+		return Image{}, fmt.Errorf("error closing writer: %v", err)
+	}
+
+	req, err := newProviderRequest(ctx, "POST", stabilityGenerateURL(), payload)
+	if err != nil {
+		return Image{}, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{
+		Timeout: 60 * time.Second,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Image{}, fmt.Errorf("error sending request to Stability: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody := new(bytes.Buffer)
+	respBody.ReadFrom(resp.Body)
+	if resp.StatusCode >= 400 {
+		return Image{}, &ProviderError{Provider: "stability", StatusCode: resp.StatusCode, Body: respBody.String(), RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	var stabilityResp stabilityResponse
+	if err := json.Unmarshal(respBody.Bytes(), &stabilityResp); err != nil {
+		return Image{}, fmt.Errorf("error unmarshalling Stability response: %v", err)
+	}
+	image := Image{
+		Prompt:      prompt,
+		Seed:        stabilityResp.Seed,
+		IsImageSafe: stabilityResp.FinishReason != stabilityContentFiltered,
+	}
+	if image.IsImageSafe {
+		image.Data, err = base64.StdEncoding.DecodeString(stabilityResp.Image)
+		if err != nil {
+			return Image{}, fmt.Errorf("error decoding Stability image: %v", err)
+		}
+	}
+	return image, nil
+}
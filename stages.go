@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Optional stages a request can switch on or off. Each flag left out of the
+// request falls back to its environment variable, then to the built-in
+// default, so one deployment can serve Zaps wanting different subsets.
+type StageFlags struct {
+	RemoveBackground *bool `json:"remove_background,omitempty"`
+	Upscale          *bool `json:"upscale,omitempty"`
+	// Keep the image as it was before upscaling
+	ArchiveOriginal *bool `json:"archive_original,omitempty"`
+	Thumbnails      *bool `json:"thumbnails,omitempty"`
+	Notify          *bool `json:"notify,omitempty"`
+}
+
+// Parse a boolean environment variable, accepting on/off besides true/false
+func envFlag(name string, fallback bool) bool {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(name)))
+	switch value {
+	case "on":
+		return true
+	case "off":
+		return false
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fallback
+	}
+	return enabled
+}
+
+func stageEnabled(flag *bool, envName string, fallback bool) bool {
+	if flag != nil {
+		return *flag
+	}
+	return envFlag(envName, fallback)
+}
+
+// Patterns fill the whole tile, so they keep their background by default
+func (body IdeogramRequestBody) removeBackgroundEnabled() bool {
+	if body.Pattern != nil && body.RemoveBackground == nil {
+		return false
+	}
+	return stageEnabled(body.RemoveBackground, "DEFAULT_REMOVE_BACKGROUND", true)
+}
+
+func (body IdeogramRequestBody) upscaleEnabled() bool {
+	return stageEnabled(body.Upscale, "DEFAULT_UPSCALE", false)
+}
+
+func (body IdeogramRequestBody) archiveOriginalEnabled() bool {
+	return stageEnabled(body.ArchiveOriginal, "DEFAULT_ARCHIVE_ORIGINAL", true)
+}
+
+// Dashboard thumbnails default to DASHBOARD_THUMBNAILS
+func (body IdeogramRequestBody) thumbnailsEnabled() bool {
+	return stageEnabled(body.Thumbnails, "DASHBOARD_THUMBNAILS", false)
+}
+
+func (body IdeogramRequestBody) notifyEnabled() bool {
+	return stageEnabled(body.Notify, "DEFAULT_NOTIFY", true)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Most style reference images sent with one generation
+const maxStyleReferenceImages = 3
+
+// Ideogram rejects requests whose style references add up to more than this
+const maxStyleReferenceBytes = 10 << 20
+
+// Style reference images are URLs or base64, optionally as data URIs
+func isStyleReferenceURL(reference string) bool {
+	return strings.HasPrefix(reference, "https://") || strings.HasPrefix(reference, "http://")
+}
+
+func validateStyleReferenceImages(body IdeogramRequestBody) error {
+	if len(body.StyleReferenceImages) == 0 {
+		return nil
+	}
+	if len(body.StyleReferenceImages) > maxStyleReferenceImages {
+		return fmt.Errorf("at most %d style_reference_images are allowed, got %d", maxStyleReferenceImages, len(body.StyleReferenceImages))
+	}
+	if body.Edit != nil || body.Reframe != nil {
+		return fmt.Errorf("style_reference_images cannot be combined with edit or reframe")
+	}
+	// Inline images are checked now; URLs only once they are downloaded
+	for i, reference := range body.StyleReferenceImages {
+		if isStyleReferenceURL(reference) {
+			continue
+		}
+		data, err := loadEditInput(context.Background(), "", reference, nil)
+		if err != nil || len(data) == 0 {
+			return fmt.Errorf("style_reference_images[%d] must be a URL or base64 image", i)
+		}
+		if contentType := http.DetectContentType(data); !strings.HasPrefix(contentType, "image/") {
+			return fmt.Errorf("style_reference_images[%d] is not an image (%s)", i, contentType)
+		}
+	}
+	return nil
+}
+
+// Download or decode the style reference images, checking that each is an
+// image and that together they stay within Ideogram's size limit
+func loadStyleReferenceImages(ctx context.Context, references []string, summary *InvocationSummary) ([][]byte, error) {
+	if len(references) == 0 {
+		return nil, nil
+	}
+	stageStart := time.Now()
+	defer summary.recordStage("style_references", stageStart)
+
+	images := make([][]byte, 0, len(references))
+	total := 0
+	for i, reference := range references {
+		var data []byte
+		var err error
+		if isStyleReferenceURL(reference) {
+			data, err = loadEditInput(ctx, reference, "", summary)
+		} else {
+			data, err = loadEditInput(ctx, "", reference, summary)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error loading style_reference_images[%d]: %v", i, err)
+		}
+		if contentType := http.DetectContentType(data); !strings.HasPrefix(contentType, "image/") {
+			return nil, fmt.Errorf("style_reference_images[%d] is not an image (%s)", i, contentType)
+		}
+		total += len(data)
+		if total > maxStyleReferenceBytes {
+			return nil, fmt.Errorf("style_reference_images add up to more than %dMB", maxStyleReferenceBytes>>20)
+		}
+		images = append(images, data)
+	}
+	return images, nil
+}
+
+// Attach the style reference images to an Ideogram form, one file part each
+func writeStyleReferenceImages(writer *multipart.Writer, images [][]byte) error {
+	for i, image := range images {
+		part, err := writer.CreateFormFile("style_reference_images", fmt.Sprintf("style-reference-%d.png", i+1))
+		if err != nil {
+			return fmt.Errorf("error creating form file: %v", err)
+		}
+		part.Write(image)
+	}
+	return nil
+}
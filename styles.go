@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// What each Ideogram v3 style type is for, shown next to it in dropdowns
+var ideogramStyleTypeDescriptions = map[string]string{
+	"AUTO":      "Let Ideogram pick a style for the prompt",
+	"GENERAL":   "Versatile style suited to most prompts",
+	"REALISTIC": "Photographic, true-to-life images",
+	"DESIGN":    "Graphic design, typography and illustration",
+}
+
+// A style type with its description
+type StyleTypeInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// A named style code, usable in a request's style_codes. Ideogram has no
+// endpoint listing codes, so these are kept in the image bucket as a JSON
+// array at STYLE_PRESETS_KEY.
+type StylePreset struct {
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type StylesResponse struct {
+	StyleTypes []StyleTypeInfo `json:"style_types"`
+	Presets    []StylePreset   `json:"presets"`
+}
+
+// Style presets read by this container
+var stylePresetsCache = newWarmCache("StylePresets")
+
+// Load the configured style presets. Returns none when STYLE_PRESETS_KEY is
+// unset. Entries with invalid codes are skipped so one typo doesn't hide the
+// rest.
+func loadStylePresets() ([]StylePreset, error) {
+	key := strings.Trim(os.Getenv("STYLE_PRESETS_KEY"), "/")
+	if key == "" {
+		return nil, nil
+	}
+	settings, err := loadS3Settings()
+	if err != nil {
+		return nil, err
+	}
+	presets, err := stylePresetsCache.get(settings.Bucket+"/"+key, func() (interface{}, error) {
+		s3Svc, err := newS3Client(settings)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := readS3Object(s3Svc, settings.Bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		var stored []StylePreset
+		if err := json.Unmarshal(payload, &stored); err != nil {
+			return nil, fmt.Errorf("failed to decode style presets %s: %v", key, err)
+		}
+		valid := make([]StylePreset, 0, len(stored))
+		for _, preset := range stored {
+			preset.Code = strings.ToUpper(strings.TrimSpace(preset.Code))
+			if !styleCodePattern.MatchString(preset.Code) {
+				log.Printf("Skipping style preset %q, code %q is not 8 hex characters", preset.Name, preset.Code)
+				continue
+			}
+			valid = append(valid, preset)
+		}
+		return valid, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return presets.([]StylePreset), nil
+}
+
+func handleStylesRequest() (events.LambdaFunctionURLResponse, error) {
+	presets, err := loadStylePresets()
+	if err != nil {
+		log.Println("Error loading style presets:", err)
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error loading style presets",
+		}, nil
+	}
+	if presets == nil {
+		presets = []StylePreset{}
+	}
+
+	styleTypes := make([]StyleTypeInfo, 0, len(ideogramStyleTypes))
+	for _, name := range ideogramStyleTypes {
+		styleTypes = append(styleTypes, StyleTypeInfo{Name: name, Description: ideogramStyleTypeDescriptions[name]})
+	}
+	responseBody, err := json.Marshal(StylesResponse{
+		StyleTypes: styleTypes,
+		Presets:    presets,
+	})
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// One structured line per invocation, shaped for CloudWatch Logs Insights:
+// fields @message.request_id, @message.duration_ms, @message.stage_ms.* etc.
+type InvocationSummary struct {
+	Type            string           `json:"type"`
+	RequestID       string           `json:"request_id"`
+	Tenant          string           `json:"tenant,omitempty"`
+	Environment     string           `json:"environment,omitempty"`
+	Method          string           `json:"method"`
+	Path            string           `json:"path"`
+	StatusCode      int              `json:"status_code"`
+	DurationMs      int64            `json:"duration_ms"`
+	StageMs         map[string]int64 `json:"stage_ms,omitempty"`
+	ImagesGenerated int              `json:"images_generated"`
+	ImagesDelivered int              `json:"images_delivered"`
+	RequestBytes    int              `json:"request_bytes"`
+	ResponseBytes   int              `json:"response_bytes"`
+	DownloadedBytes int              `json:"downloaded_bytes"`
+	UploadedBytes   int              `json:"uploaded_bytes"`
+	Errors          []string         `json:"errors,omitempty"`
+	Retries         map[string]int   `json:"retries,omitempty"`
+	// Degraded paths taken instead of failing, e.g. skipping a dependency
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	// Bytes uploaded per destination bucket, for storage and egress chargeback
+	UploadedBytesByDestination map[string]int `json:"uploaded_bytes_by_destination,omitempty"`
+	// Caller-provided X-Request-Id / traceparent, for joining with other services
+	Trace map[string]string `json:"trace,omitempty"`
+
+	// Stored asset URLs, provider key owners and prompts, kept out of the log
+	// line and written to the audit log
+	assets    []string
+	keyOwners map[string]string
+	prompts   []string
+	tracer    *invocationTracer
+	faults    *faultPlan
+	// Trace headers for outbound calls that opt in, see addTraceHeaders
+	outboundTrace map[string]string
+	// When the function times out, zero outside Lambda
+	deadline time.Time
+	// Lambda's ID for the invocation, which its async retries share
+	invocationID string
+	// Images generated per provider and cut out per background remover, which
+	// the estimated cost is priced from
+	generatedBy map[string]int
+	removedBy   map[string]int
+	// Who the bearer token identified, nil for callers without one
+	identity  *CallerIdentity
+	startedAt time.Time
+	mu        sync.Mutex
+
+	// Dashboard thumbnail URLs, also written to the audit log
+	thumbnails []string
+
+	// Warnings for the caller about the fallbacks taken
+	fallbackWarnings []string
+}
+
+func newInvocationSummary(request events.LambdaFunctionURLRequest) *InvocationSummary {
+	return &InvocationSummary{
+		Type:         "invocation_summary",
+		RequestID:    request.RequestContext.RequestID,
+		Method:       request.RequestContext.HTTP.Method,
+		Path:         request.RawPath,
+		RequestBytes: len(request.Body),
+		StageMs:      map[string]int64{},
+		faults:       parseFaults(request),
+		startedAt:    time.Now(),
+	}
+}
+
+// Add the time elapsed since start to the named pipeline stage. Pipelines may
+// run concurrently, so every update goes through the mutex.
+func (summary *InvocationSummary) recordStage(stage string, start time.Time) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.StageMs[stage] += time.Since(start).Milliseconds()
+	summary.tracer.addSpan(stage, start, time.Now())
+}
+
+func (summary *InvocationSummary) recordError(stage string, err error) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %v", stage, err))
+}
+
+// Count one retry of the named stage
+func (summary *InvocationSummary) recordRetry(stage string) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	if summary.Retries == nil {
+		summary.Retries = map[string]int{}
+	}
+	summary.Retries[stage]++
+}
+
+// Record a fallback once per request, however many images took it
+func (summary *InvocationSummary) recordFallback(fallback string, warning string) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	for _, recorded := range summary.Fallbacks {
+		if recorded == fallback {
+			return
+		}
+	}
+	summary.Fallbacks = append(summary.Fallbacks, fallback)
+	summary.fallbackWarnings = append(summary.fallbackWarnings, warning)
+}
+
+// Copy the retries, fallbacks and upload byte counts so far onto the
+// response, so intermittent slowness or missing steps can be explained from
+// the Zap history alone
+func (summary *InvocationSummary) reportRetries(responseBody *LambdaResponseBody) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	responseBody.Fallbacks = append(responseBody.Fallbacks, summary.Fallbacks...)
+	responseBody.Warnings = append(responseBody.Warnings, summary.fallbackWarnings...)
+	if len(summary.UploadedBytesByDestination) > 0 {
+		responseBody.UploadedBytes = make(map[string]int, len(summary.UploadedBytesByDestination))
+		for destination, count := range summary.UploadedBytesByDestination {
+			responseBody.UploadedBytes[destination] = count
+		}
+	}
+	if len(summary.Retries) == 0 {
+		return
+	}
+	responseBody.Retries = make(map[string]int, len(summary.Retries))
+	for stage, count := range summary.Retries {
+		responseBody.Retries[stage] = count
+	}
+}
+
+func (summary *InvocationSummary) addPrompt(prompt string) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.prompts = append(summary.prompts, prompt)
+}
+
+func (summary *InvocationSummary) addImagesGenerated(provider string, count int) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.ImagesGenerated += count
+	if summary.generatedBy == nil {
+		summary.generatedBy = map[string]int{}
+	}
+	summary.generatedBy[provider] += count
+}
+
+func (summary *InvocationSummary) addBackgroundRemovals(remover string, count int) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	if summary.removedBy == nil {
+		summary.removedBy = map[string]int{}
+	}
+	summary.removedBy[remover] += count
+}
+
+func (summary *InvocationSummary) addImagesDelivered(count int) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.ImagesDelivered += count
+}
+
+func (summary *InvocationSummary) addAssets(urls ...string) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.assets = append(summary.assets, urls...)
+}
+
+func (summary *InvocationSummary) addThumbnails(urls ...string) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.thumbnails = append(summary.thumbnails, urls...)
+}
+
+func (summary *InvocationSummary) setKeyOwner(provider string, owner string) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	if summary.keyOwners == nil {
+		summary.keyOwners = map[string]string{}
+	}
+	summary.keyOwners[provider] = owner
+}
+
+func (summary *InvocationSummary) addDownloadedBytes(count int) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.DownloadedBytes += count
+}
+
+// Count an upload to the destination bucket. Each upload is also emitted as
+// an UploadedBytes metric per destination and tenant, so unexpectedly large
+// outputs show up in its Maximum statistic.
+func (summary *InvocationSummary) addUploadedBytes(destination string, count int) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.UploadedBytes += count
+	if summary.UploadedBytesByDestination == nil {
+		summary.UploadedBytesByDestination = map[string]int{}
+	}
+	summary.UploadedBytesByDestination[destination] += count
+	emitDimensionedMetric("UploadedBytes", float64(count), "Bytes", map[string]string{
+		"Destination": destination,
+		"Tenant":      summary.Tenant,
+	})
+}
+
+// Time left before the function times out. Outside Lambda there is no
+// deadline, and all the time in the world.
+func (summary *InvocationSummary) remainingTime() time.Duration {
+	if summary.deadline.IsZero() {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Until(summary.deadline)
+}
+
+// Fill in the response details and emit the summary line
+func (summary *InvocationSummary) finish(response events.LambdaFunctionURLResponse) {
+	summary.mu.Lock()
+	defer summary.mu.Unlock()
+	summary.StatusCode = response.StatusCode
+	summary.ResponseBytes = len(response.Body)
+	summary.DurationMs = summary.elapsedMs()
+
+	line, err := json.Marshal(summary)
+	if err != nil {
+		log.Println("Error marshalling invocation summary:", err)
+		return
+	}
+	// Printed without the log prefix so Logs Insights parses it as JSON
+	fmt.Println(string(line))
+}
+
+func (summary *InvocationSummary) elapsedMs() int64 {
+	return time.Since(summary.startedAt).Milliseconds()
+}
+
+// Case-insensitive header lookup; function URLs lowercase header names but
+// API Gateway test invocations may not
+func headerValue(headers map[string]string, name string) string {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
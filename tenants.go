@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// Defaults stored per tenant in the TENANT_DEFAULTS_TABLE DynamoDB table,
+// keyed by tenant_id
+type TenantDefaults struct {
+	TenantID      string         `dynamodbav:"tenant_id"`
+	Folder        string         `dynamodbav:"folder,omitempty"`
+	StyleType     *StyleType     `dynamodbav:"style_type,omitempty"`
+	AspectRatio   *AspectRatio   `dynamodbav:"aspect_ratio,omitempty"`
+	Resolution    *Resolution    `dynamodbav:"resolution,omitempty"`
+	NumImages     *int           `dynamodbav:"num_images,omitempty"`
+	ColourPalette *ColourPalette `dynamodbav:"colour_palette,omitempty"`
+	// Deliver final assets to the tenant's own bucket instead of ours
+	Delivery *TenantDelivery `dynamodbav:"delivery,omitempty"`
+}
+
+// Tenant defaults read by this container
+var tenantDefaultsCache = newWarmCache("TenantDefaults")
+
+// Load the tenant's stored defaults. Returns nil when no table is configured
+// or the tenant has no entry.
+func loadTenantDefaults(tenant string) (*TenantDefaults, error) {
+	tableName := os.Getenv("TENANT_DEFAULTS_TABLE")
+	if tableName == "" {
+		return nil, nil
+	}
+	defaults, err := tenantDefaultsCache.get(tableName+"/"+tenant, func() (interface{}, error) {
+		return fetchTenantDefaults(tableName, tenant)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return defaults.(*TenantDefaults), nil
+}
+
+func fetchTenantDefaults(tableName string, tenant string) (*TenantDefaults, error) {
+	dynamoSvc, err := newDynamoDBClient()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := dynamoSvc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"tenant_id": {S: aws.String(tenant)},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load defaults for tenant %s: %v", tenant, err)
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+
+	var defaults TenantDefaults
+	err = dynamodbattribute.UnmarshalMap(output.Item, &defaults)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode defaults for tenant %s: %v", tenant, err)
+	}
+	return &defaults, nil
+}
+
+// Apply the tenant's defaults to every field the request left unset, so each
+// team's payloads can stay small while the request still wins when explicit.
+// The delivery setting sends the uploads to the tenant's own bucket, so the
+// tenant must be an authenticated one from resolveRequestTenant or a draft
+// it created, never a header as sent.
+func applyTenantDefaults(tenant string, body *IdeogramRequestBody) error {
+	defaults, err := loadTenantDefaults(tenant)
+	if err != nil || defaults == nil {
+		return err
+	}
+
+	if body.Folder == "" {
+		body.Folder = defaults.Folder
+	}
+	// Style codes replace the style type, so they also replace its default
+	if body.StyleType == nil && len(body.StyleCodes) == 0 {
+		body.StyleType = defaults.StyleType
+	}
+	// Resolution takes precedence over aspect ratio, so only default the
+	// aspect ratio when neither was requested. Only Ideogram takes a
+	// resolution, so other providers just get the default aspect ratio.
+	if body.Resolution == nil && body.AspectRatio == nil {
+		if body.imageProvider() == defaultImageProvider && len(body.CompareProviders) == 0 {
+			body.Resolution = defaults.Resolution
+		}
+		body.AspectRatio = defaults.AspectRatio
+	}
+	if body.NumImages == nil {
+		body.NumImages = defaults.NumImages
+	}
+	if body.ColourPalette == nil {
+		body.ColourPalette = defaults.ColourPalette
+	}
+	if defaults.Delivery != nil {
+		if err := defaults.Delivery.validate(); err != nil {
+			return fmt.Errorf("invalid delivery for tenant %s: %v", tenant, err)
+		}
+		body.delivery = defaults.Delivery
+	}
+	return nil
+}
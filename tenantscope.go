@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Tenant IDs become part of object keys, so they cannot contain slashes
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+var errInvalidTenantID = errors.New("invalid X-Tenant-Id")
+
+// Tenant the request acts for: the tenant of its bearer token, or the tenant
+// its API key is bound to in KEY_POLICIES. The X-Tenant-Id header alone is
+// never trusted: it is only honored from admins acting for a tenant and from
+// our own async jobs, which carry the tenant they were started for. A token
+// or bound key sending another tenant's ID, and anyone else sending one, is
+// refused rather than silently rescoped.
+func resolveRequestTenant(request events.LambdaFunctionURLRequest, identity *CallerIdentity) (string, error) {
+	header := headerValue(request.Headers, "x-tenant-id")
+	if asyncJobID(request) != "" {
+		if header != "" && !tenantIDPattern.MatchString(header) {
+			return "", errInvalidTenantID
+		}
+		return header, nil
+	}
+
+	var tenant string
+	if identity != nil {
+		if header != "" && header != identity.Tenant {
+			return "", &PolicyError{"X-Tenant-Id does not match the tenant of this token"}
+		}
+		tenant = identity.Tenant
+	}
+	policy, err := loadKeyPolicy(headerValue(request.Headers, callerAPIKeyHeader))
+	if err != nil {
+		return "", err
+	}
+	if policy != nil && policy.Tenant != "" {
+		if header != "" && header != policy.Tenant {
+			return "", &PolicyError{"X-Tenant-Id does not match the tenant of this API key"}
+		}
+		tenant = policy.Tenant
+	}
+	if tenant == "" && header != "" {
+		if !isAdminRequest(request, identity) {
+			return "", &PolicyError{"X-Tenant-Id needs a bearer token or an API key bound to the tenant"}
+		}
+		tenant = header
+	}
+	if tenant != "" && !tenantIDPattern.MatchString(tenant) {
+		return "", errInvalidTenantID
+	}
+	return tenant, nil
+}
+
+func tenantErrorResponse(err error) events.LambdaFunctionURLResponse {
+	var policyErr *PolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		return events.LambdaFunctionURLResponse{StatusCode: 403, Body: "Forbidden: " + policyErr.Message}
+	case errors.Is(err, errInvalidTenantID):
+		return events.LambdaFunctionURLResponse{StatusCode: 400, Body: "Bad Request: " + err.Error()}
+	default:
+		log.Println("Error resolving tenant:", err)
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}
+	}
+}
+
+// Routes reading or writing stored assets act for a tenant proven by a token
+// or a bound key; only admins may go without one and reach every tenant's
+// assets. Returns the refusal, or nil when the request may go ahead.
+func requireTenant(request events.LambdaFunctionURLRequest, summary *InvocationSummary) *events.LambdaFunctionURLResponse {
+	if summary.Tenant != "" || isAdminRequest(request, summary.identity) {
+		return nil
+	}
+	summary.recordError("tenant", errors.New("no authenticated tenant"))
+	return &events.LambdaFunctionURLResponse{
+		StatusCode: 403,
+		Body:       "Forbidden: this route needs a bearer token or an API key bound to a tenant",
+	}
+}
+
+// Admin routes take ADMIN_API_KEY, a tenant's own key marked admin in
+// KEY_POLICIES, or a token in AUTH_JWT_ADMIN_GROUP. The "*" policy never
+// grants admin.
+func isAdminRequest(request events.LambdaFunctionURLRequest, identity *CallerIdentity) bool {
+	if identity != nil {
+		return identity.Admin
+	}
+	callerKey := headerValue(request.Headers, callerAPIKeyHeader)
+	if callerKey == "" {
+		return false
+	}
+	if adminKey := os.Getenv("ADMIN_API_KEY"); adminKey != "" && subtle.ConstantTimeCompare([]byte(callerKey), []byte(adminKey)) == 1 {
+		return true
+	}
+	policies, err := loadKeyPolicies()
+	if err != nil {
+		log.Println("Error loading key policies:", err)
+		return false
+	}
+	policy, ok := policies[callerKey]
+	return ok && policy.Admin && policy.Tenant != ""
+}
+
+// Folder holding the tenant's assets: its default folder, or a folder named
+// after it under FOLDER_NAME
+func tenantPrefix(tenant string) (string, error) {
+	defaults, err := loadTenantDefaults(tenant)
+	if err != nil {
+		return "", err
+	}
+	if defaults != nil {
+		if folder := strings.Trim(defaults.Folder, "/"); folder != "" {
+			return folder, nil
+		}
+	}
+	settings, err := loadS3Settings()
+	if err != nil {
+		return "", err
+	}
+	return settings.Folder + "/" + tenant, nil
+}
+
+// The tenant's prefix and each environment's copy of it
+func tenantRoots(tenant string) ([]string, error) {
+	prefix, err := tenantPrefix(tenant)
+	if err != nil {
+		return nil, err
+	}
+	environments, err := loadEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	roots := []string{prefix}
+	for _, environment := range environments {
+		if environment.FolderPrefix != "" {
+			roots = append(roots, environment.FolderPrefix+"/"+prefix)
+		}
+	}
+	return roots, nil
+}
+
+// Folder a tenant's request writes to. No folder means the tenant's prefix;
+// anything outside it is refused.
+func confineFolder(tenant string, folder string) (string, error) {
+	prefix, err := tenantPrefix(tenant)
+	if err != nil {
+		return "", err
+	}
+	folder = strings.Trim(folder, "/")
+	if folder == "" {
+		return prefix, nil
+	}
+	if folder != prefix && !strings.HasPrefix(folder, prefix+"/") {
+		return "", &PolicyError{fmt.Sprintf("folder %s is outside the prefix %s of tenant %s", folder, prefix, tenant)}
+	}
+	return folder, nil
+}
+
+// Listing prefix confined to the tenant. An empty prefix lists the tenant's
+// own folder.
+func confineListPrefix(tenant string, prefix string) (string, error) {
+	roots, err := tenantRoots(tenant)
+	if err != nil {
+		return "", err
+	}
+	if prefix == "" {
+		return roots[0] + "/", nil
+	}
+	for _, root := range roots {
+		if prefix == root {
+			return root + "/", nil
+		}
+		if strings.HasPrefix(prefix, root+"/") {
+			return prefix, nil
+		}
+	}
+	return "", &PolicyError{fmt.Sprintf("prefix %s is outside the prefix %s of tenant %s", prefix, roots[0], tenant)}
+}
+
+// Check a bucket key belongs to the tenant. Requests without a tenant may
+// reach any key, so routes taking keys go through requireTenant first.
+func checkTenantKey(tenant string, key string) error {
+	if tenant == "" {
+		return nil
+	}
+	roots, err := tenantRoots(tenant)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if strings.HasPrefix(key, root+"/") {
+			return nil
+		}
+	}
+	return &PolicyError{fmt.Sprintf("%s is outside the prefix %s of tenant %s", key, roots[0], tenant)}
+}
+
+// Response refusing a key outside the tenant's prefix, or nil when allowed
+func authorizeTenantKey(tenant string, key string) *events.LambdaFunctionURLResponse {
+	err := checkTenantKey(tenant, key)
+	if err == nil {
+		return nil
+	}
+	response := tenantErrorResponse(err)
+	return &response
+}
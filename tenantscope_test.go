@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Tenant folders under FOLDER_NAME, plus a staging copy of each
+func setTenantScopeEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("BUCKET_NAME", "test-bucket")
+	t.Setenv("FOLDER_NAME", "images")
+	t.Setenv("BUCKET_REGION", "us-east-1")
+	t.Setenv("TENANT_DEFAULTS_TABLE", "")
+	t.Setenv("ENVIRONMENTS", `{"staging":{"folder_prefix":"staging"}}`)
+}
+
+func TestConfineListPrefix(t *testing.T) {
+	setTenantScopeEnv(t)
+
+	tests := []struct {
+		name    string
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty lists the tenant folder", prefix: "", want: "images/tenantA/"},
+		{name: "tenant folder", prefix: "images/tenantA", want: "images/tenantA/"},
+		{name: "tenant folder with slash", prefix: "images/tenantA/", want: "images/tenantA/"},
+		{name: "inside tenant folder", prefix: "images/tenantA/2024/cat", want: "images/tenantA/2024/cat"},
+		{name: "environment copy", prefix: "staging/images/tenantA", want: "staging/images/tenantA/"},
+		{name: "inside environment copy", prefix: "staging/images/tenantA/cat", want: "staging/images/tenantA/cat"},
+		{name: "tenant with longer name", prefix: "images/tenantAB/", wantErr: true},
+		{name: "tenant name prefix", prefix: "images/tenantAB", wantErr: true},
+		{name: "partial tenant name", prefix: "images/tenant", wantErr: true},
+		{name: "leading slash", prefix: "/images/tenantA/", wantErr: true},
+		{name: "parent folder", prefix: "images/", wantErr: true},
+		{name: "other tenant", prefix: "images/tenantB/", wantErr: true},
+		{name: "internal keys", prefix: "jobs/", wantErr: true},
+		{name: "environment copy of other tenant", prefix: "staging/images/tenantAB/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := confineListPrefix("tenantA", tt.prefix)
+			if tt.wantErr {
+				var policyErr *PolicyError
+				if !errors.As(err, &policyErr) {
+					t.Errorf("confineListPrefix(%q) = %q, %v, want a PolicyError", tt.prefix, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("confineListPrefix(%q) = %q, %v, want %q", tt.prefix, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTenantKey(t *testing.T) {
+	setTenantScopeEnv(t)
+
+	tests := []struct {
+		name    string
+		tenant  string
+		key     string
+		wantErr bool
+	}{
+		{name: "inside tenant folder", tenant: "tenantA", key: "images/tenantA/cat.png"},
+		{name: "nested inside tenant folder", tenant: "tenantA", key: "images/tenantA/2024/cat.png"},
+		{name: "environment copy", tenant: "tenantA", key: "staging/images/tenantA/cat.png"},
+		{name: "no tenant reaches any key", tenant: "", key: "images/tenantB/cat.png"},
+		{name: "tenant with longer name", tenant: "tenantA", key: "images/tenantAB/cat.png", wantErr: true},
+		{name: "sibling file sharing the name", tenant: "tenantA", key: "images/tenantA.png", wantErr: true},
+		{name: "tenant folder itself", tenant: "tenantA", key: "images/tenantA", wantErr: true},
+		{name: "leading slash", tenant: "tenantA", key: "/images/tenantA/cat.png", wantErr: true},
+		{name: "empty key", tenant: "tenantA", key: "", wantErr: true},
+		{name: "other tenant", tenant: "tenantA", key: "images/tenantB/cat.png", wantErr: true},
+		{name: "internal key", tenant: "tenantA", key: "jobs/abc.json", wantErr: true},
+		{name: "environment copy of other tenant", tenant: "tenantA", key: "staging/images/tenantAB/cat.png", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTenantKey(tt.tenant, tt.key)
+			if tt.wantErr {
+				var policyErr *PolicyError
+				if !errors.As(err, &policyErr) {
+					t.Errorf("checkTenantKey(%q, %q) = %v, want a PolicyError", tt.tenant, tt.key, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("checkTenantKey(%q, %q) = %v, want none", tt.tenant, tt.key, err)
+			}
+		})
+	}
+}
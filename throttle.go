@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Values of throttle_scope, telling clients what they are waiting on
+const (
+	throttleScopeIdeogram  = "provider:ideogram"
+	throttleScopeFreepik   = "provider:freepik"
+	throttleScopeRemoveBG  = "provider:removebg"
+	throttleScopePhotoroom = "provider:photoroom"
+	throttleScopeService   = "service"
+)
+
+// Error returned when we, or a provider behind us, are rate limiting
+type ThrottleError struct {
+	Scope      string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *ThrottleError) Error() string {
+	return fmt.Sprintf("throttled (%s): %v", e.Scope, e.Err)
+}
+
+func (e *ThrottleError) Unwrap() error {
+	return e.Err
+}
+
+// Body of a 429 response
+type ThrottleResponse struct {
+	Error             string `json:"error"`
+	Message           string `json:"message"`
+	ThrottleScope     string `json:"throttle_scope"`
+	RetryAfterSeconds int    `json:"retry_after_seconds"`
+}
+
+// Wait suggested when the throttling side doesn't say how long to back off
+func defaultRetryAfter() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("THROTTLE_RETRY_AFTER_SECONDS"))
+	if err != nil || seconds <= 0 {
+		seconds = 30
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Parse a Retry-After header, given either in seconds or as an HTTP date.
+// Returns 0 when it is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && time.Until(date) > 0 {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// Report whether the error is throttling, either ours or a provider's 429
+func throttleFromError(err error) (*ThrottleError, bool) {
+	var throttleErr *ThrottleError
+	if errors.As(err, &throttleErr) {
+		return throttleErr, true
+	}
+	var providerErr *ProviderError
+	if errors.As(err, &providerErr) && providerErr.StatusCode == http.StatusTooManyRequests {
+		scope := throttleScopeIdeogram
+		switch providerErr.Provider {
+		case "freepik":
+			scope = throttleScopeFreepik
+		case "removebg":
+			scope = throttleScopeRemoveBG
+		case "photoroom":
+			scope = throttleScopePhotoroom
+		}
+		return &ThrottleError{Scope: scope, RetryAfter: providerErr.RetryAfter, Err: err}, true
+	}
+	return nil, false
+}
+
+// 429 with a Retry-After header in whole seconds, which clients and proxies
+// understand, and the same wait and scope in the body
+func throttledResponse(throttleErr *ThrottleError) events.LambdaFunctionURLResponse {
+	retryAfter := throttleErr.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultRetryAfter()
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+
+	responseBody, _ := json.Marshal(ThrottleResponse{
+		Error:             "throttled",
+		Message:           fmt.Sprintf("Rate limited, retry after %d seconds", seconds),
+		ThrottleScope:     throttleErr.Scope,
+		RetryAfterSeconds: seconds,
+	})
+	return events.LambdaFunctionURLResponse{
+		StatusCode: http.StatusTooManyRequests,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"Retry-After":  strconv.Itoa(seconds),
+		},
+		Body: string(responseBody),
+	}
+}
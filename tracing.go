@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Caller-provided tracing headers echoed back and forwarded to our own async
+// invocations and the providers' APIs
+var traceHeaderNames = []string{"X-Request-Id", "traceparent", "tracestate"}
+
+// Context key of the invocation's outbound trace headers
+type outboundTraceKey struct{}
+
+// Collect the tracing headers the caller sent
+func extractTraceHeaders(request events.LambdaFunctionURLRequest) map[string]string {
+	headers := map[string]string{}
+	for _, name := range traceHeaderNames {
+		if value := headerValue(request.Headers, name); value != "" {
+			headers[name] = value
+		}
+	}
+	return headers
+}
+
+// Add the invocation's trace headers to those of an outbound call that opts
+// in to carrying them: our own async invocations, and provider API calls
+// through newProviderRequest
+func (summary *InvocationSummary) addTraceHeaders(headers map[string]string) {
+	for name, value := range summary.outboundTrace {
+		headers[strings.ToLower(name)] = value
+	}
+}
+
+// Carry the invocation's outbound trace headers in the context its provider
+// calls are made with
+func withOutboundTrace(ctx context.Context, headers map[string]string) context.Context {
+	if len(headers) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, outboundTraceKey{}, headers)
+}
+
+// Request to a provider's API, e.g. Ideogram, Freepik or Stability, carrying
+// the trace headers of the context. Downloads from image links and caller
+// URLs, and calls to external processors, use plain requests and never see
+// the caller's trace.
+func newProviderRequest(ctx context.Context, method string, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	headers, _ := ctx.Value(outboundTraceKey{}).(map[string]string)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// Copy the tracing headers onto the response
+func withTraceHeaders(response events.LambdaFunctionURLResponse, headers map[string]string) events.LambdaFunctionURLResponse {
+	if len(headers) == 0 {
+		return response
+	}
+	merged := make(map[string]string, len(response.Headers)+len(headers))
+	for name, value := range response.Headers {
+		merged[name] = value
+	}
+	for name, value := range headers {
+		merged[strings.ToLower(name)] = value
+	}
+	response.Headers = merged
+	return response
+}
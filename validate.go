@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Placeholder for provider keys echoed back by /validate
+const redactedKey = "[redacted]"
+
+// Response of POST /validate
+type ValidateResponseBody struct {
+	Valid bool `json:"valid"`
+	// The request as it would be generated: tenant defaults and environment
+	// applied, enums normalized and prompt variables rendered
+	Request IdeogramRequestBody `json:"request"`
+	// Post-processing steps that would run on each image, in order
+	Steps        []string             `json:"steps"`
+	Sanitization []SanitizationReport `json:"sanitization,omitempty"`
+	Downgraded   bool                 `json:"downgraded,omitempty"`
+	// Prompts that would be cut to fit the token limit
+	PromptTruncations []PromptTruncation `json:"prompt_truncations,omitempty"`
+}
+
+// Run everything a generation request goes through before generating, and
+// echo back the normalized request. Zap builders use it to check their
+// mappings without spending credits.
+func handleValidateRequest(request events.LambdaFunctionURLRequest, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	ideogramRequestBody, _, _, rejection := prepareGenerationRequest(request, summary)
+	if rejection != nil {
+		return *rejection, nil
+	}
+
+	echoed := ideogramRequestBody
+	if echoed.IdeogramAPIKey != "" {
+		echoed.IdeogramAPIKey = redactedKey
+	}
+	if echoed.FreepikAPIKey != "" {
+		echoed.FreepikAPIKey = redactedKey
+	}
+	responseBody, err := json.Marshal(ValidateResponseBody{
+		Valid:             true,
+		Request:           echoed,
+		Steps:             ideogramRequestBody.postProcessingSteps(),
+		Sanitization:      ideogramRequestBody.sanitization,
+		Downgraded:        ideogramRequestBody.downgraded,
+		PromptTruncations: ideogramRequestBody.truncations,
+	})
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "Error marshaling response",
+		}, nil
+	}
+	return events.LambdaFunctionURLResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultVariationCount = 4
+	maxVariationCount     = 8
+	// Low enough for the variations to differ noticeably from the master while
+	// keeping its subject and composition
+	defaultVariationImageWeight = 25
+	// Time kept to report the variations before the function times out
+	variationsReserve = 15 * time.Second
+)
+
+// "More like this one": remix one of our stored assets several times. The rest
+// of the body is a regular generation request; without a prompt, the master's
+// description is used.
+type VariationsRequestBody struct {
+	// Object key in the image bucket or its S3 URL
+	Source string `json:"source"`
+	// Number of variations, each stored under its own key
+	Count int `json:"count,omitempty"`
+}
+
+func handleVariationsRequest(ctx context.Context, request events.LambdaFunctionURLRequest, summary *InvocationSummary) (events.LambdaFunctionURLResponse, error) {
+	body, rejection := decodeRequestBody(request)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	var variationsRequest VariationsRequestBody
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &variationsRequest); err != nil || variationsRequest.Source == "" {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: source is required",
+		}, nil
+	}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 400, Body: "Bad Request"}, nil
+	}
+	count := variationsRequest.Count
+	if count == 0 {
+		count = defaultVariationCount
+	}
+	if count < 1 || count > maxVariationCount {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf("Bad Request: count must be between 1 and %d", maxVariationCount),
+		}, nil
+	}
+
+	// The master may live in a private bucket, so Ideogram gets it presigned
+	key, err := archiveKey(variationsRequest.Source)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 400,
+			Body:       "Bad Request: " + err.Error(),
+		}, nil
+	}
+	if rejection := authorizeTenantKey(summary.Tenant, key); rejection != nil {
+		return *rejection, nil
+	}
+	settings, err := loadS3Settings()
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	s3Svc, err := newS3Client(settings)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	sourceURL, _, err := resolveBatchSource(s3Svc, settings, key)
+	if err != nil {
+		log.Println("Error resolving variation source:", err)
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+
+	// Turn the request into a remix of the master, one image per run
+	delete(fields, "source")
+	delete(fields, "count")
+	fields["source_image_url"], _ = json.Marshal(sourceURL)
+	fields["num_images"], _ = json.Marshal(1)
+	if _, ok := fields["image_weight"]; !ok {
+		fields["image_weight"], _ = json.Marshal(defaultVariationImageWeight)
+	}
+	if _, ok := fields["filename"]; !ok {
+		fields["filename"], _ = json.Marshal(strings.TrimSuffix(path.Base(key), path.Ext(key)) + "-variation")
+	}
+	generationRequest := request
+	generationRequest.IsBase64Encoded = false
+	generationBody, err := json.Marshal(fields)
+	if err != nil {
+		return events.LambdaFunctionURLResponse{StatusCode: 500, Body: "Internal Server Error"}, nil
+	}
+	generationRequest.Body = string(generationBody)
+
+	ideogramRequestBody, _, _, rejection := prepareGenerationRequest(generationRequest, summary)
+	if rejection != nil {
+		return *rejection, nil
+	}
+	// Describe the master once rather than once per variation
+	if strings.TrimSpace(ideogramRequestBody.Prompt) == "" {
+		if err := deriveRegenerationPrompt(ctx, &ideogramRequestBody, summary); err != nil {
+			log.Println("Error deriving prompt from master:", err)
+			return pipelineErrorResponse(err, ideogramRequestBody.Folder, ideogramRequestBody.FileName), nil
+		}
+	}
+	if ideogramRequestBody.downgraded {
+		count = 1
+	}
+	return runVariations(ctx, ideogramRequestBody, count, summary), nil
+}
+
+// Remix the master count times concurrently, each variation under its own key.
+// Variations still running near the function timeout are stopped and
+// reported as failed, rather than losing every result to the timeout.
+func runVariations(ctx context.Context, body IdeogramRequestBody, count int, summary *InvocationSummary) events.LambdaFunctionURLResponse {
+	if !summary.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, summary.deadline.Add(-variationsReserve))
+		defer cancel()
+	}
+	variants := make([]VariantResult, count)
+	results := make([]GenerationResult, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := range variants {
+		variantBody := body
+		variantBody.FileName = fmt.Sprintf("%s-%d", body.FileName, i+1)
+		variants[i] = VariantResult{FileName: variantBody.FileName, ImageURLs: make([]string, 0)}
+
+		wg.Add(1)
+		go func(i int, variantBody IdeogramRequestBody) {
+			defer wg.Done()
+			// A panic in a goroutine is out of reach of the handler's recovery
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					log.Printf("Recovered from panic in variation %s: %v\n%s", variantBody.FileName, recovered, debug.Stack())
+					emitMetric("Panics", 1, "Count")
+					errs[i] = fmt.Errorf("variation panicked: %v", recovered)
+				}
+			}()
+			start := time.Now()
+			results[i], errs[i] = runGenerationPipeline(ctx, variantBody, summary)
+			if errs[i] != nil && ctx.Err() == context.DeadlineExceeded {
+				errs[i] = fmt.Errorf("variation ran out of time: %v", errs[i])
+			}
+			variants[i].DurationMs = time.Since(start).Milliseconds()
+		}(i, variantBody)
+	}
+	wg.Wait()
+
+	responseBody := LambdaResponseBody{
+		ImageURLs:         make([]string, 0),
+		Regeneration:      body.regeneration,
+		Sanitization:      body.sanitization,
+		Downgraded:        body.downgraded,
+		PromptTruncations: body.truncations,
+	}
+	var gallery []GalleryImage
+	failed := 0
+	for i := range variants {
+		if errs[i] != nil {
+			log.Printf("Variation %s failed: %v", variants[i].FileName, errs[i])
+			if isQuotaExceeded(errs[i]) {
+				return handleQuotaExceeded(errs[i], body.Folder, variants[i].FileName)
+			}
+			if throttleErr, ok := throttleFromError(errs[i]); ok {
+				return throttledResponse(throttleErr)
+			}
+			variants[i].Error = errs[i].Error()
+			failed++
+			continue
+		}
+		variants[i].ImageURLs = results[i].ImageURLs
+		variants[i].WebImageURLs = results[i].WebImageURLs
+		variants[i].OriginalImageURLs = results[i].OriginalImageURLs
+		variants[i].SafetyRetry = results[i].SafetyRetry
+		variants[i].Paraphrase = results[i].Paraphrase
+		variants[i].FailedImages = results[i].FailedImages
+		variants[i].Reused = results[i].Reused
+		responseBody.ImageURLs = append(responseBody.ImageURLs, results[i].ImageURLs...)
+		responseBody.Seeds = append(responseBody.Seeds, results[i].Seeds...)
+		responseBody.ImageMetadata = append(responseBody.ImageMetadata, results[i].ImageMetadata...)
+		responseBody.WebImageURLs = append(responseBody.WebImageURLs, results[i].WebImageURLs...)
+		responseBody.OriginalImageURLs = append(responseBody.OriginalImageURLs, results[i].OriginalImageURLs...)
+		responseBody.ReviewRequired = append(responseBody.ReviewRequired, results[i].ReviewRequired...)
+		responseBody.Images = append(responseBody.Images, results[i].Images...)
+		gallery = append(gallery, results[i].Gallery...)
+	}
+	responseBody.Variants = variants
+
+	if failed == len(variants) {
+		return events.LambdaFunctionURLResponse{
+			StatusCode: 500,
+			Body:       "All variations failed",
+		}
+	}
+	if failed > 0 {
+		responseBody.Warnings = append(responseBody.Warnings, fmt.Sprintf("%d of %d variations failed", failed, len(variants)))
+	}
+	attachGallery(body, &responseBody, gallery, summary)
+	summary.reportRetries(&responseBody)
+	return buildSuccessResponse(responseBody)
+}
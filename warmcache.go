@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Named configuration is kept this long per container unless
+// WARM_CACHE_TTL_SECONDS is set
+const defaultWarmCacheTTL = 5 * time.Minute
+
+// Lookups that found nothing are kept at most this long, so a tenant or brand
+// kit created meanwhile is picked up quickly
+const warmCacheNotFoundTTL = 30 * time.Second
+
+// Entries kept per cache unless WARM_CACHE_MAX_ENTRIES is set
+const defaultWarmCacheMaxEntries = 500
+
+// Named configuration (tenant defaults, frame templates) read through a
+// per-container cache, so warm invocations skip the DynamoDB and S3 lookups.
+// Concurrent misses for the same key share a single load.
+type warmCache struct {
+	// Prefix of the <name>CacheHits and <name>CacheMisses metrics
+	name string
+
+	mu       sync.Mutex
+	entries  map[string]warmCacheEntry
+	inflight map[string]*warmCacheLoad
+}
+
+type warmCacheEntry struct {
+	value     interface{}
+	expiresAt time.Time
+	// Until when the value is served after it expired while refreshes fail
+	staleUntil time.Time
+}
+
+// A load in progress; done is closed once value and err are set
+type warmCacheLoad struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func newWarmCache(name string) *warmCache {
+	return &warmCache{
+		name:     name,
+		entries:  map[string]warmCacheEntry{},
+		inflight: map[string]*warmCacheLoad{},
+	}
+}
+
+// A TTL of 0 turns the caches off, e.g. while editing templates
+func warmCacheTTL() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("WARM_CACHE_TTL_SECONDS"))
+	if err != nil || seconds < 0 {
+		return defaultWarmCacheTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func warmCacheMaxEntries() int {
+	entries, err := strconv.Atoi(os.Getenv("WARM_CACHE_MAX_ENTRIES"))
+	if err != nil || entries <= 0 {
+		return defaultWarmCacheMaxEntries
+	}
+	return entries
+}
+
+// Loaders report a missing entry as a nil pointer, e.g. (*BrandKit)(nil)
+func warmCacheNotFound(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	reflected := reflect.ValueOf(value)
+	return reflected.Kind() == reflect.Ptr && reflected.IsNil()
+}
+
+// Return the cached value for key, calling load on a miss or once it expired.
+// Nil values are cached too, for warmCacheNotFoundTTL at most, so missing
+// entries are not looked up every time. When a refresh fails, an expired value
+// is served for up to one more TTL rather than failing the request; a missing
+// entry and errors themselves are never served stale.
+func (cache *warmCache) get(key string, load func() (interface{}, error)) (interface{}, error) {
+	ttl := warmCacheTTL()
+	if ttl == 0 {
+		return load()
+	}
+
+	cache.mu.Lock()
+	entry, cached := cache.entries[key]
+	if cached && time.Now().Before(entry.expiresAt) {
+		cache.mu.Unlock()
+		emitMetric(cache.name+"CacheHits", 1, "Count")
+		return entry.value, nil
+	}
+	if inflight, ok := cache.inflight[key]; ok {
+		cache.mu.Unlock()
+		<-inflight.done
+		emitMetric(cache.name+"CacheHits", 1, "Count")
+		return inflight.value, inflight.err
+	}
+	inflight := &warmCacheLoad{done: make(chan struct{})}
+	cache.inflight[key] = inflight
+	cache.mu.Unlock()
+
+	emitMetric(cache.name+"CacheMisses", 1, "Count")
+	inflight.value, inflight.err = load()
+	if inflight.err != nil && cached && time.Now().Before(entry.staleUntil) {
+		log.Printf("Error refreshing %s %s, serving the cached value: %v", cache.name, key, inflight.err)
+		inflight.value, inflight.err = entry.value, nil
+	}
+
+	cache.mu.Lock()
+	if inflight.err == nil {
+		cache.store(key, inflight.value, ttl)
+	}
+	delete(cache.inflight, key)
+	cache.mu.Unlock()
+	close(inflight.done)
+	return inflight.value, inflight.err
+}
+
+// Keep the value, making room first when the cache is full: entries past
+// serving go first, then those expiring soonest. Callers hold cache.mu.
+func (cache *warmCache) store(key string, value interface{}, ttl time.Duration) {
+	now := time.Now()
+	entry := warmCacheEntry{value: value, expiresAt: now.Add(ttl), staleUntil: now.Add(2 * ttl)}
+	if warmCacheNotFound(value) {
+		entry.expiresAt = now.Add(min(ttl, warmCacheNotFoundTTL))
+		entry.staleUntil = entry.expiresAt
+	}
+
+	if _, replacing := cache.entries[key]; !replacing && len(cache.entries) >= warmCacheMaxEntries() {
+		for cachedKey, cached := range cache.entries {
+			if now.After(cached.staleUntil) {
+				delete(cache.entries, cachedKey)
+			}
+		}
+		for len(cache.entries) >= warmCacheMaxEntries() {
+			soonest := ""
+			for cachedKey, cached := range cache.entries {
+				if soonest == "" || cached.expiresAt.Before(cache.entries[soonest].expiresAt) {
+					soonest = cachedKey
+				}
+			}
+			delete(cache.entries, soonest)
+		}
+	}
+	cache.entries[key] = entry
+}
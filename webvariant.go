@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Web variants are scaled down to this width unless WEB_VARIANT_MAX_WIDTH is set
+const defaultWebVariantMaxWidth = 1024
+
+// Key suffix of the web variant, stored next to the master
+const webVariantSuffix = "-web"
+
+func webVariantMaxWidth() int {
+	width, err := strconv.Atoi(os.Getenv("WEB_VARIANT_MAX_WIDTH"))
+	if err != nil || width <= 0 {
+		return defaultWebVariantMaxWidth
+	}
+	return width
+}
+
+// Derive the web variant from the master and store it as <filename>-web.png
+func storeWebVariant(ideogramRequestBody IdeogramRequestBody, master []byte, generator string, summary *InvocationSummary) (string, error) {
+	stageStart := time.Now()
+	webImage, err := makeWebVariant(master, webVariantMaxWidth())
+	summary.recordStage("web_variant", stageStart)
+	if err != nil {
+		log.Println("Error creating web variant:", err)
+		summary.recordError("web_variant", err)
+		return "", &PipelineError{StatusCode: 500, Message: "Error creating web variant", Err: err}
+	}
+
+	provenance, err := buildProvenanceMetadata(webImage, ideogramRequestBody.Prompt, generator+"+web-variant")
+	if err != nil {
+		log.Println("Error building provenance manifest:", err)
+		return "", &PipelineError{StatusCode: 500, Message: "Internal Server Error", Err: err}
+	}
+
+	stageStart = time.Now()
+	options := ideogramRequestBody.uploadOptions(provenance)
+	webURL, err := uploadImageToS3(webImage, ideogramRequestBody.FileName+webVariantSuffix, options, summary)
+	summary.recordStage("s3_upload", stageStart)
+	if err != nil {
+		log.Println("Error uploading web variant to S3:", err)
+		summary.recordError("s3_upload", err)
+		return "", &PipelineError{StatusCode: 500, Message: "Error uploading image to S3", Err: err}
+	}
+	summary.addUploadedBytes(uploadDestination(options), len(webImage))
+	summary.addAssets(webURL)
+	return webURL, nil
+}
+
+// Scale the image down to maxWidth, keeping transparency, and re-encode it
+// with the strongest PNG compression
+func makeWebVariant(imageData []byte, maxWidth int) ([]byte, error) {
+	src, err := png.Decode(bytes.NewReader(imageData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	bounds := src.Bounds()
+	var scaled image.Image = src
+	if bounds.Dx() > maxWidth {
+		height := bounds.Dy() * maxWidth / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+		scaled = downscale(src, maxWidth, height)
+	}
+
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, scaled); err != nil {
+		return nil, fmt.Errorf("failed to encode web variant: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Box-filter downscale. Averaging premultiplied RGBA keeps the edges of
+// cutouts free of dark fringes.
+func downscale(src image.Image, width int, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, (y+1)*srcHeight/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, (x+1)*srcWidth/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, count uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					offset := rgba.PixOffset(sx, sy)
+					r += uint32(rgba.Pix[offset])
+					g += uint32(rgba.Pix[offset+1])
+					b += uint32(rgba.Pix[offset+2])
+					a += uint32(rgba.Pix[offset+3])
+					count++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / count), uint8(g / count), uint8(b / count), uint8(a / count)})
+		}
+	}
+	return dst
+}